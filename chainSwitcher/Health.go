@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/segmentio/kafka-go"
+
+	"github.com/btccom/btcpool-go-modules/health"
+)
+
+// 就绪检查中访问Kafka及MySQL的超时时间
+const healthCheckTimeout = 3 * time.Second
+
+// 最后一次成功从 ChainDispatchAPI 获取币种的时间（Unix时间戳），原子访问
+var dispatchTime int64
+
+// runHealthServer 提供供编排系统（如Kubernetes）使用的存活检查 /healthz 及就绪检查 /readyz
+func runHealthServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		health.WriteStatus(w, health.Status{Status: health.StatusOK})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		health.WriteStatus(w, checkReadiness())
+	})
+
+	glog.Info("Health check enabled: ", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		glog.Fatal("health check listen failed: ", err)
+	}
+}
+
+// checkReadiness 检查Kafka、MySQL及币种调度API是否可用
+func checkReadiness() health.Status {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	return health.NewStatus(map[string]error{
+		"kafka":    checkKafka(ctx),
+		"mysql":    mysqlConn.PingContext(ctx),
+		"dispatch": checkDispatch(time.Now()),
+	})
+}
+
+// checkKafka 任意一个broker可以连接即为通过
+func checkKafka(ctx context.Context) error {
+	var errs []string
+	for _, broker := range configData.Kafka.Brokers {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		errs = append(errs, broker+": "+err.Error())
+	}
+	return errors.New("no kafka broker available: " + strings.Join(errs, "; "))
+}
+
+// checkDispatch 在 FailSafeSeconds 内成功从 ChainDispatchAPI 获取过币种即为通过
+// 否则程序已经或即将切换到 FailSafeChain
+func checkDispatch(now time.Time) error {
+	lastTime := atomic.LoadInt64(&dispatchTime)
+	if lastTime == 0 {
+		return errors.New("chain dispatch api not fetched yet")
+	}
+	age := now.Sub(time.Unix(lastTime, 0))
+	if age > configData.FailSafeSeconds*time.Second {
+		return errors.New("chain dispatch api not fetched for " + age.Truncate(time.Second).String())
+	}
+	return nil
+}
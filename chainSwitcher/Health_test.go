@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckDispatch(t *testing.T) {
+	oldConfig := configData
+	configData = &ChainSwitcherConfig{FailSafeSeconds: 60}
+	defer func() {
+		configData = oldConfig
+		atomic.StoreInt64(&dispatchTime, 0)
+	}()
+
+	now := time.Unix(1800000000, 0)
+	atomic.StoreInt64(&dispatchTime, 0)
+	if err := checkDispatch(now); err == nil || err.Error() != "chain dispatch api not fetched yet" {
+		t.Errorf("expected not fetched yet, got: %v", err)
+	}
+
+	// 在 now 成功获取过币种
+	atomic.StoreInt64(&dispatchTime, now.Unix())
+	for _, test := range []struct {
+		age time.Duration
+		err string
+	}{
+		{0, ""},
+		{30 * time.Second, ""},
+		// 恰好 FailSafeSeconds 时仍然就绪
+		{60 * time.Second, ""},
+		{61 * time.Second, "chain dispatch api not fetched for 1m1s"},
+		{90*time.Second + 700*time.Millisecond, "chain dispatch api not fetched for 1m30s"},
+	} {
+		err := checkDispatch(now.Add(test.age))
+		if (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("age %v: got %v, expected %q", test.age, err, test.err)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -50,6 +51,7 @@ type ChainSwitcherConfig struct {
 	MySQL                 MySQLInfo
 	ChainLimits           map[string]ChainLimit
 	RecordLifetime        uint64
+	HealthListenAddr      string
 }
 
 // ChainRecord HTTP API中的币种记录
@@ -171,6 +173,9 @@ func main() {
 	})
 
 	initMySQL()
+	if configData.HealthListenAddr != "" {
+		go runHealthServer(configData.HealthListenAddr)
+	}
 	go failSafe()
 	go readResponse()
 	updateChain()
@@ -326,6 +331,7 @@ func updateCurrentChain() {
 		glog.Error("Cannot find algorithm ", configData.Algorithm, ", json: ", string(body))
 		return
 	}
+	atomic.StoreInt64(&dispatchTime, time.Now().Unix())
 
 	bestChain := configData.FailSafeChain
 	for _, coin := range algorithms.Coins {
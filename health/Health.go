@@ -0,0 +1,49 @@
+// Package health 提供各模块共用的存活检查 /healthz 及就绪检查 /readyz 的响应格式
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// 检查的状态
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Status /healthz 及 /readyz 的响应
+type Status struct {
+	Status string `json:"status"`
+	// 各项检查的结果，通过为 ok，否则为失败原因
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// NewStatus 汇总各项检查的结果（nil为通过），任意一项未通过时状态为 unavailable
+func NewStatus(checks map[string]error) (status Status) {
+	status.Status = StatusOK
+	status.Checks = make(map[string]string, len(checks))
+	for name, err := range checks {
+		if err != nil {
+			status.Status = StatusUnavailable
+			status.Checks[name] = err.Error()
+		} else {
+			status.Checks[name] = StatusOK
+		}
+	}
+	return
+}
+
+// WriteStatus 输出检查结果，未通过时状态码为503
+func WriteStatus(w http.ResponseWriter, status Status) {
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		glog.Warning("Health check: write response failed: ", err)
+	}
+}
@@ -0,0 +1,47 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewStatus(t *testing.T) {
+	status := NewStatus(map[string]error{"zookeeper": nil, "kafka": nil})
+	if status.Status != StatusOK || status.Checks["zookeeper"] != StatusOK || status.Checks["kafka"] != StatusOK {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	status = NewStatus(map[string]error{"zookeeper": nil, "kafka": errors.New("no kafka broker available")})
+	if status.Status != StatusUnavailable || status.Checks["zookeeper"] != StatusOK ||
+		status.Checks["kafka"] != "no kafka broker available" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	for _, expected := range []struct {
+		status Status
+		code   int
+	}{
+		{Status{Status: StatusOK}, http.StatusOK},
+		{NewStatus(map[string]error{"mysql": errors.New("connection refused")}), http.StatusServiceUnavailable},
+	} {
+		recorder := httptest.NewRecorder()
+		WriteStatus(recorder, expected.status)
+
+		var status Status
+		if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Code != expected.code || status.Status != expected.status.Status ||
+			len(status.Checks) != len(expected.status.Checks) {
+			t.Errorf("got %d %+v, expected %d %+v", recorder.Code, status, expected.code, expected.status)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Content-Type = %s", contentType)
+		}
+	}
+}
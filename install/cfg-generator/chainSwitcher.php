@@ -50,6 +50,7 @@ foreach ($c['ChainNameMap'] as $chain) {
 }
 
 $c['RecordLifetime'] = (int)optionalTrim('RecordLifetime', '60');
+$c['HealthListenAddr'] = optionalTrim('HealthListenAddr', '');
 
 echo toJSON($c);
 
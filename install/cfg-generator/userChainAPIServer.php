@@ -53,6 +53,7 @@ if ($c['EnableAPIServer']) {
     $c['ListenAddr'] = notNullTrim("ListenAddr");
     $c['APIUser'] = optionalTrim('APIUser');
     $c['APIPassword'] = optionalTrim('APIPassword');
+    $c['ZKSessionDirectoryDir'] = optionalTrim('ZKSessionDirectoryDir');
 }
 
 $c['EnableCronJob'] = isTrue('EnableCronJob');
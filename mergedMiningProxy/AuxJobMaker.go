@@ -15,6 +15,9 @@ import (
 	zmq "github.com/pebbe/zmq4"
 )
 
+// 辅助区块的默认最长未更新时间（秒），至少为更新间隔的3倍
+const defaultMaxAuxBlockAgeSeconds = 60
+
 // AuxPowInfo 辅助工作量证明的信息
 // @see <https://en.bitcoin.it/wiki/Merged_mining_specification#Aux_proof-of-work_block>
 type AuxPowInfo struct {
@@ -57,6 +60,9 @@ type AuxJobMaker struct {
 	minJobBits   string
 	maxJobTarget hash.Byte32
 	blockHashChnel     chan string
+
+	// 各链最后一次成功获取辅助区块的时间，用于就绪检查
+	auxBlockUpdateTimes map[int]time.Time
 }
 
 // NewAuxJobMaker 创建辅助挖矿任务构造器
@@ -65,6 +71,7 @@ func NewAuxJobMaker(config AuxJobMakerInfo, chains []ChainRPCInfo) (maker *AuxJo
 	maker.chains = chains
 	maker.currentAuxBlocks = make(map[int]AuxBlockInfo)
 	maker.auxPowJobs = make(map[hash.Byte32]AuxPowJob)
+	maker.auxBlockUpdateTimes = make(map[int]time.Time)
 	maker.config = config
 
 	// set max job target and min job bits
@@ -78,6 +85,14 @@ func NewAuxJobMaker(config AuxJobMakerInfo, chains []ChainRPCInfo) (maker *AuxJo
 	glog.Info("Max Job Target: ", maker.maxJobTarget.Hex(), ", Bits: ", maker.minJobBits)
 	maker.blockHashChnel = make(chan string)
 
+	// 辅助区块超过该时间未更新则不再就绪
+	if maker.config.MaxAuxBlockAgeSeconds == 0 {
+		maker.config.MaxAuxBlockAgeSeconds = defaultMaxAuxBlockAgeSeconds
+		if maker.config.MaxAuxBlockAgeSeconds < 3*config.CreateAuxBlockIntervalSeconds {
+			maker.config.MaxAuxBlockAgeSeconds = 3 * config.CreateAuxBlockIntervalSeconds
+		}
+	}
+
 	return
 }
 
@@ -144,6 +159,7 @@ func (maker *AuxJobMaker) updateAuxBlock(index int) {
 	oldAuxBlockInfo := maker.currentAuxBlocks[index];
 
 	maker.currentAuxBlocks[index] = auxBlockInfo
+	maker.auxBlockUpdateTimes[index] = time.Now()
 
 	if auxBlockInfo.Height >  oldAuxBlockInfo.Height {
 		glog.Info("send blockhash : ", auxBlockInfo.Hash.Hex())
@@ -284,6 +300,31 @@ func (maker *AuxJobMaker) updateAuxBlockAllChains() {
 	}
 }
 
+// CheckAuxBlocks 检查各链的辅助区块是否新鲜，返回各链的检查结果（nil为通过）
+// 某条链的节点长时间无法访问时，生成的任务中该链的辅助区块已经过时，挖到的区块将被该链拒绝
+func (maker *AuxJobMaker) CheckAuxBlocks(now time.Time) map[string]error {
+	maker.lock.Lock()
+	defer maker.lock.Unlock()
+
+	maxAge := time.Duration(maker.config.MaxAuxBlockAgeSeconds) * time.Second
+	checks := make(map[string]error)
+	for index, chain := range maker.chains {
+		name := "chain/" + chain.Name
+		updateTime, ok := maker.auxBlockUpdateTimes[index]
+		if !ok {
+			checks[name] = errors.New("aux block not fetched yet")
+			continue
+		}
+		age := now.Sub(updateTime)
+		if age > maxAge {
+			checks[name] = errors.New("aux block not updated for " + age.Truncate(time.Second).String())
+			continue
+		}
+		checks[name] = nil
+	}
+	return checks
+}
+
 // makeAuxJob 构造辅助挖矿任务
 func (maker *AuxJobMaker) makeAuxJob() (job AuxPowJob, err error) {
 	maker.lock.Lock()
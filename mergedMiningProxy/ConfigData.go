@@ -81,6 +81,7 @@ type AuxJobMakerInfo struct {
 	AuxPowJobListSize             uint
 	MaxJobTarget                  string
 	BlockHashPublishPort          string
+	MaxAuxBlockAgeSeconds         uint // 辅助区块超过该时间未能更新时，就绪检查（/readyz）失败
 }
 
 // ConfigData 配置文件的数据结构
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/btccom/btcpool-go-modules/health"
+)
+
+// registerHealthHTTPAPI 注册存活检查 /healthz 及就绪检查 /readyz
+// 所有链的辅助区块都在 MaxAuxBlockAgeSeconds 内更新过才算就绪
+func registerHealthHTTPAPI(mux *http.ServeMux, auxJobMaker *AuxJobMaker) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		health.WriteStatus(w, health.Status{Status: health.StatusOK})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		health.WriteStatus(w, health.NewStatus(auxJobMaker.CheckAuxBlocks(time.Now())))
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 测试 AuxJobMaker.CheckAuxBlocks()
+func TestCheckAuxBlocks(t *testing.T) {
+	maker := &AuxJobMaker{
+		chains:              []ChainRPCInfo{{Name: "Namecoin"}, {Name: "Elastos"}, {Name: "Syscoin"}},
+		auxBlockUpdateTimes: make(map[int]time.Time),
+	}
+	maker.config.MaxAuxBlockAgeSeconds = 60
+
+	now := time.Now()
+	maker.auxBlockUpdateTimes[0] = now.Add(-10 * time.Second)
+	maker.auxBlockUpdateTimes[1] = now.Add(-90 * time.Second)
+
+	checks := maker.CheckAuxBlocks(now)
+	if len(checks) != 3 {
+		t.Fatalf("expected 3 checks, got: %v", checks)
+	}
+	if err := checks["chain/Namecoin"]; err != nil {
+		t.Errorf("chain/Namecoin expected ok, got: %v", err)
+	}
+	if err := checks["chain/Elastos"]; err == nil || err.Error() != "aux block not updated for 1m30s" {
+		t.Errorf("chain/Elastos expected stale, got: %v", err)
+	}
+	if err := checks["chain/Syscoin"]; err == nil || err.Error() != "aux block not fetched yet" {
+		t.Errorf("chain/Syscoin expected not fetched, got: %v", err)
+	}
+}
@@ -305,9 +305,13 @@ func (handle *ProxyRPCHandle) submitAuxBlock(params []interface{}, response *RPC
 func runHTTPServer(config ProxyRPCServer, auxJobMaker *AuxJobMaker) {
 
 	handle := NewProxyRPCHandle(config, auxJobMaker)
+	// 健康检查接口不需要认证，其他请求均由RPC处理器处理
+	mux := http.NewServeMux()
+	registerHealthHTTPAPI(mux, auxJobMaker)
+	mux.Handle("/", handle)
 	// HTTP监听
 	glog.Info("Listen HTTP ", config.ListenAddr)
-	err := http.ListenAndServe(config.ListenAddr, handle)
+	err := http.ListenAndServe(config.ListenAddr, mux)
 
 	if err != nil {
 		glog.Fatal("HTTP Listen Failed: ", err)
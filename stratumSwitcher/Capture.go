@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 抓包文件中的数据方向
+const (
+	// 矿机 -> stratumSwitcher
+	captureDirClientIn = "client_in"
+	// stratumSwitcher -> 矿机
+	captureDirClientOut = "client_out"
+	// sserver -> stratumSwitcher
+	captureDirServerIn = "server_in"
+	// stratumSwitcher -> sserver
+	captureDirServerOut = "server_out"
+	// 建立了新的服务器连接（切换币种或重连），Data 为币种
+	captureDirServerConnect = "server_connect"
+)
+
+// 默认的抓包文件目录
+const defaultCaptureDir = "./captures"
+
+// 默认的单个抓包文件大小上限
+const defaultCaptureMaxBytes = 10 * 1024 * 1024
+
+// 子账户名未知时（认证之前）在内存中缓存的最大数据量
+const captureMaxPendingBytes = 64 * 1024
+
+// 一条抓包规则默认最多抓取的会话数
+const defaultCaptureRuleLimit = 10
+
+// CaptureHeader 抓包文件的第一行
+type CaptureHeader struct {
+	SessionID string
+	ClientIP  string
+	ChainType string
+	// 监听器名称（只有一个监听器时为空）
+	Listener  string `json:",omitempty"`
+	ServerID  uint32
+	StartTime string
+}
+
+// CaptureRecord 抓包文件中的一条记录（第二行开始每行一条）
+type CaptureRecord struct {
+	// UnixNano
+	Time int64
+	Dir  string
+	Data []byte
+}
+
+// CaptureRule 抓包规则，SubAccount、IP、SessionID 中非空的条件全部满足时抓取会话
+type CaptureRule struct {
+	ID         uint32
+	SubAccount string `json:",omitempty"`
+	IP         string `json:",omitempty"`
+	SessionID  string `json:",omitempty"`
+	// 还可以抓取的会话数，为0时规则被删除
+	Remaining int
+}
+
+// matchConn 检查连接建立时可知的条件（IP及会话ID）是否满足
+func (rule *CaptureRule) matchConn(ip string, sessionID string) bool {
+	return (rule.IP == "" || rule.IP == ip) && (rule.SessionID == "" || rule.SessionID == sessionID)
+}
+
+// CaptureManager 管理抓包规则并创建抓包文件
+type CaptureManager struct {
+	lock   sync.Mutex
+	rules  []*CaptureRule
+	nextID uint32
+
+	// 抓包文件目录
+	dir string
+	// 单个抓包文件大小上限
+	maxBytes int64
+}
+
+// NewCaptureManager 创建抓包管理器
+func NewCaptureManager(dir string, maxBytes int64) *CaptureManager {
+	manager := new(CaptureManager)
+	manager.dir = dir
+	manager.maxBytes = maxBytes
+	manager.nextID = 1
+	return manager
+}
+
+// AddRule 添加抓包规则
+func (manager *CaptureManager) AddRule(rule CaptureRule) (CaptureRule, error) {
+	if rule.SubAccount == "" && rule.IP == "" && rule.SessionID == "" {
+		return rule, errors.New("at least one of subaccount, ip and session is required")
+	}
+	if rule.IP != "" {
+		ip := net.ParseIP(rule.IP)
+		if ip == nil {
+			return rule, errors.New("invalid ip: " + rule.IP)
+		}
+		rule.IP = ip.String()
+	}
+	if rule.Remaining <= 0 {
+		rule.Remaining = defaultCaptureRuleLimit
+	}
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	rule.ID = manager.nextID
+	manager.nextID++
+	manager.rules = append(manager.rules, &rule)
+	glog.Info("Capture rule added: ", rule)
+	return rule, nil
+}
+
+// RemoveRule 删除抓包规则
+func (manager *CaptureManager) RemoveRule(id uint32) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for i, rule := range manager.rules {
+		if rule.ID == id {
+			manager.rules = append(manager.rules[:i], manager.rules[i+1:]...)
+			glog.Info("Capture rule removed: ", *rule)
+			return true
+		}
+	}
+	return false
+}
+
+// Rules 获取所有抓包规则
+func (manager *CaptureManager) Rules() []CaptureRule {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	rules := make([]CaptureRule, 0, len(manager.rules))
+	for _, rule := range manager.rules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// takeRuleNonLock 消耗一次规则的抓取次数，次数用完后删除规则（无锁）
+func (manager *CaptureManager) takeRuleNonLock(i int) {
+	rule := manager.rules[i]
+	rule.Remaining--
+	if rule.Remaining <= 0 {
+		manager.rules = append(manager.rules[:i], manager.rules[i+1:]...)
+		glog.Info("Capture rule finished: ", *rule)
+	}
+}
+
+// NewRecorder 为新连接创建抓包记录器，没有可能匹配的规则时返回nil
+// 不含子账户条件的规则在此时即可确定是否匹配，含子账户条件的规则需在认证时确定
+func (manager *CaptureManager) NewRecorder(header CaptureHeader) *CaptureRecorder {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	maybe := false
+	for i, rule := range manager.rules {
+		if !rule.matchConn(header.ClientIP, header.SessionID) {
+			continue
+		}
+		if rule.SubAccount == "" {
+			manager.takeRuleNonLock(i)
+			recorder := &CaptureRecorder{manager: manager, header: header}
+			recorder.start("")
+			return recorder
+		}
+		maybe = true
+	}
+
+	if !maybe {
+		return nil
+	}
+	return &CaptureRecorder{manager: manager, header: header, pending: true}
+}
+
+// matchSubAccount 检查认证时得到的子账户名是否匹配某条规则，匹配则消耗该规则的一次抓取次数
+func (manager *CaptureManager) matchSubAccount(header CaptureHeader, subAccount string) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	for i, rule := range manager.rules {
+		if rule.SubAccount == subAccount && rule.matchConn(header.ClientIP, header.SessionID) {
+			manager.takeRuleNonLock(i)
+			return true
+		}
+	}
+	return false
+}
+
+// CaptureRecorder 单个会话的抓包记录器
+type CaptureRecorder struct {
+	lock    sync.Mutex
+	manager *CaptureManager
+	header  CaptureHeader
+
+	// 等待认证时确定是否抓包，此时数据缓存在内存中
+	pending      bool
+	pendingData  []CaptureRecord
+	pendingBytes int
+
+	file    *os.File
+	writer  *bufio.Writer
+	written int64
+}
+
+// OnAuthorize 认证时根据子账户名确定是否抓包
+func (recorder *CaptureRecorder) OnAuthorize(subAccount string) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	if !recorder.pending {
+		return
+	}
+	recorder.pending = false
+
+	if recorder.manager.matchSubAccount(recorder.header, subAccount) {
+		recorder.startNonLock(subAccount)
+	}
+	recorder.pendingData = nil
+}
+
+// start 创建抓包文件
+func (recorder *CaptureRecorder) start(subAccount string) {
+	recorder.lock.Lock()
+	recorder.startNonLock(subAccount)
+	recorder.lock.Unlock()
+}
+
+// startNonLock 创建抓包文件，并写入内存中缓存的数据（无锁）
+func (recorder *CaptureRecorder) startNonLock(subAccount string) {
+	err := os.MkdirAll(recorder.manager.dir, 0755)
+	if err != nil {
+		glog.Error("Create capture dir failed: ", err)
+		return
+	}
+
+	name := time.Now().Format("20060102-150405") + "_" + recorder.header.SessionID
+	if subAccount != "" {
+		name += "_" + subAccount
+	}
+	path := filepath.Join(recorder.manager.dir, name+".jsonl")
+	recorder.file, err = os.Create(path)
+	if err != nil {
+		glog.Error("Create capture file failed: ", err)
+		return
+	}
+	recorder.writer = bufio.NewWriter(recorder.file)
+	glog.Info("Capture session ", recorder.header.SessionID, " (", recorder.header.ClientIP, ") to ", path)
+
+	recorder.writeLineNonLock(recorder.header)
+	for _, record := range recorder.pendingData {
+		recorder.writeLineNonLock(record)
+	}
+	recorder.writer.Flush()
+}
+
+// Record 记录一段数据
+func (recorder *CaptureRecorder) Record(dir string, data []byte) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	record := CaptureRecord{time.Now().UnixNano(), dir, append([]byte(nil), data...)}
+
+	if recorder.pending {
+		if recorder.pendingBytes+len(data) > captureMaxPendingBytes {
+			// 认证前的数据过多，放弃抓包
+			recorder.pending = false
+			recorder.pendingData = nil
+			return
+		}
+		recorder.pendingData = append(recorder.pendingData, record)
+		recorder.pendingBytes += len(data)
+		return
+	}
+
+	if recorder.writer == nil {
+		return
+	}
+	recorder.writeLineNonLock(record)
+	recorder.writer.Flush()
+
+	if recorder.written >= recorder.manager.maxBytes {
+		glog.Info("Capture file of session ", recorder.header.SessionID, " reached size limit")
+		recorder.closeNonLock()
+	}
+}
+
+// IsCapturing 是否正在抓包（或等待认证时确定）
+func (recorder *CaptureRecorder) IsCapturing() bool {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+
+	return recorder.pending || recorder.writer != nil
+}
+
+// Close 结束抓包
+func (recorder *CaptureRecorder) Close() {
+	recorder.lock.Lock()
+	recorder.pending = false
+	recorder.pendingData = nil
+	recorder.closeNonLock()
+	recorder.lock.Unlock()
+}
+
+// closeNonLock 关闭抓包文件（无锁）
+func (recorder *CaptureRecorder) closeNonLock() {
+	if recorder.writer == nil {
+		return
+	}
+	recorder.writer.Flush()
+	recorder.file.Close()
+	recorder.writer = nil
+	recorder.file = nil
+}
+
+// writeLineNonLock 以JSON格式写入一行（无锁）
+func (recorder *CaptureRecorder) writeLineNonLock(data interface{}) {
+	line, err := json.Marshal(data)
+	if err != nil {
+		glog.Error("Marshal capture record failed: ", err)
+		return
+	}
+	n, _ := fmt.Fprintf(recorder.writer, "%s\n", line)
+	recorder.written += int64(n)
+}
+
+// captureConn 记录读写数据的连接
+type captureConn struct {
+	net.Conn
+	recorder *CaptureRecorder
+	inDir    string
+	outDir   string
+}
+
+// newCaptureConn 创建记录读写数据的连接，读到的数据记为 inDir，写出的数据记为 outDir
+func newCaptureConn(conn net.Conn, recorder *CaptureRecorder, inDir string, outDir string) *captureConn {
+	return &captureConn{conn, recorder, inDir, outDir}
+}
+
+// Read 读取并记录数据
+func (conn *captureConn) Read(p []byte) (n int, err error) {
+	n, err = conn.Conn.Read(p)
+	if n > 0 {
+		conn.recorder.Record(conn.inDir, p[:n])
+	}
+	return
+}
+
+// Write 写出并记录数据
+func (conn *captureConn) Write(p []byte) (n int, err error) {
+	n, err = conn.Conn.Write(p)
+	if n > 0 {
+		conn.recorder.Record(conn.outDir, p[:n])
+	}
+	return
+}
+
+// unwrapConn 获取被包装的原始连接
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*captureConn); ok {
+		return c.Conn
+	}
+	return conn
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	manager := NewCaptureManager(dir, defaultCaptureMaxBytes)
+	if _, err := manager.AddRule(CaptureRule{}); err == nil {
+		t.Errorf("empty rule should be rejected")
+	}
+	rule, err := manager.AddRule(CaptureRule{SubAccount: "test", Remaining: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他子账户的会话不被抓取
+	other := manager.NewRecorder(CaptureHeader{SessionID: "00000001", ClientIP: "1.2.3.4"})
+	if other == nil {
+		t.Fatal("recorder should wait for authorize")
+	}
+	other.Record(captureDirClientIn, []byte("{}\n"))
+	other.OnAuthorize("other")
+	if other.IsCapturing() {
+		t.Errorf("session of other subaccount should not be captured")
+	}
+
+	// 认证前的数据在认证后写入文件
+	recorder := manager.NewRecorder(CaptureHeader{SessionID: "00000002", ClientIP: "1.2.3.4"})
+	recorder.Record(captureDirClientIn, []byte(`{"id":1,"method":"mining.subscribe","params":[]}`+"\n"))
+	recorder.OnAuthorize("test")
+	recorder.Record(captureDirServerConnect, []byte("btc"))
+	recorder.Close()
+
+	// 规则的抓取次数已用完
+	if len(manager.Rules()) != 0 || manager.RemoveRule(rule.ID) {
+		t.Errorf("rule should be removed after use: %v", manager.Rules())
+	}
+	if manager.NewRecorder(CaptureHeader{SessionID: "00000003", ClientIP: "1.2.3.4"}) != nil {
+		t.Errorf("no recorder should be created without rules")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*_00000002_test.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("capture file not found in %s", dir)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 {
+		t.Fatalf("capture file should have 3 lines, but has %d", len(lines))
+	}
+	var header CaptureHeader
+	var record CaptureRecord
+	if json.Unmarshal([]byte(lines[0]), &header) != nil || header.SessionID != "00000002" {
+		t.Errorf("unexpected header: %s", lines[0])
+	}
+	if json.Unmarshal([]byte(lines[1]), &record) != nil || record.Dir != captureDirClientIn {
+		t.Errorf("unexpected record: %s", lines[1])
+	}
+}
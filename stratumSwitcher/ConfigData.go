@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/golang/glog"
 )
@@ -39,20 +42,78 @@ func (chainType ChainType) ToString() string {
 
 // ConfigData 配置数据
 type ConfigData struct {
-	ServerID                     uint8
+	Name                         string // 监听器名称，配置了多个监听器（Listeners）时必须设置且不能重复
+	ServerID                     uint32
 	ChainType                    string
-	ListenAddr                   string
+	ListenNetwork                string // tcp（默认，同时监听IPv4和IPv6）、tcp4或tcp6
+	ListenAddr                   string // IPv6地址需要用方括号括起，如 [::]:3333
 	StratumServerMap             StratumServerInfoMap
 	ZKBroker                     []string
 	ZKServerIDAssignDir          string // 以斜杠结尾
+	SessionIDServerBits          int    // 会话ID中服务器ID的位数，默认为8
+	SessionIDIndexBits           int    // 会话ID中会话序号的位数，默认为会话ID的总位数（比特币32，以太坊24）减去服务器ID的位数
+	SessionIDMaxBlocks           int    // 会话ID即将用尽时可从Zookeeper租用更多的ID块，该值为最多持有的ID块数（包括服务器ID），默认为1即不租用
 	ZKSwitcherWatchDir           string // 以斜杠结尾
 	EnableUserAutoReg            bool
 	ZKAutoRegWatchDir            string // 以斜杠结尾
 	AutoRegMaxWaitUsers          int64
 	StratumServerCaseInsensitive bool
-	ZKUserCaseInsensitiveIndex   string // 以斜杠结尾
+	ZKUserCaseInsensitiveIndex   string           // 以斜杠结尾
+	ZKUserNameMapDir             string           // 以斜杠结尾，为空则不使用子账户名映射表
+	ZKDifficultyHintDir          string           // 以斜杠结尾，该目录下子账户节点的值为该子账户的默认难度提示，为空则不读取
+	ZKSessionDirectoryDir        string           // 以斜杠结尾，定期在该目录下发布本机各子账户的连接数，为空则不发布
+	SessionDirIntervalSeconds    int              // 会话目录的发布间隔
+	ZKNiceHashDir                string           // initNiceHash写入的NiceHash配置目录（如 /nicehash/），以斜杠结尾，为空则不检查NiceHash的最低难度
+	WorkerNameRules              []WorkerNameRule // 矿工名改写规则，按顺序执行
+	WorkerNameCharset            string           // 矿工名中允许的字符（正则表达式字符组的内容），为空则使用默认字符集
+	WorkerNameSeparators         string           // 除“.”外可分隔子账户名与矿机名的字符，如“+_”
+	WorkerNameMaxLength          int              // 矿工名的最大长度，超出部分从矿机名中截断，为0则不限制
 	EnableHTTPDebug              bool
 	HTTPDebugListenAddr          string
+	HealthListenAddr             string   // 健康检查接口 /healthz 及 /readyz 的监听地址，为空则只在HTTP Debug服务上提供
+	LogFormat                    string   // 会话日志的格式：text（默认，glog文本）或json（JSON Lines，输出到标准错误）
+	CaptureDir                   string   // 抓包文件目录
+	CaptureMaxBytes              int64    // 单个抓包文件的大小上限
+	EnableShareAccounting        bool     // 逐行解析代理的数据流，统计各矿工及币种的share
+	KafkaBrokers                 []string // 发送会话事件的Kafka服务器
+	SessionEventTopic            string   // 会话事件的Kafka Topic，为空则不发送会话事件
+	SessionEventQueueSize        int      // 会话事件的内存队列长度，Kafka不可用时超出部分将被丢弃
+	SwitchSource                 string   // 币种切换指令的来源：zookeeper（默认，每个会话监控子账户的节点）或 kafka
+	SwitchEventTopic             string   // 币种切换事件的Kafka Topic（SwitchSource 为 kafka 时使用，Kafka服务器见 KafkaBrokers）
+	SwitchDebounceSeconds        int      // 切换币种的防抖时间，期间币种再次改变则重新计时，只切换到最后设置的币种
+	SwitchMinDwellSeconds        int      // 会话在一个币种上停留的最短时间，未到时推迟切换
+	ZKSwitchForceNode            string   // 该节点存在时忽略防抖及最短停留时间，立即切换币种（为空则不检查）
+	PreconnectCount              int      // 每个币种预先建立的服务器连接数，用于加快切换币种，为0则不预先建立连接
+	PreconnectMaxIdleSeconds     int      // 预先建立的服务器连接的最长空闲时间
+	FailoverMaxFailures          int      // 币种的服务器连续失败该次数后视为不可用，会话连续失败该次数后改挖备用币种（FallbackCoin）
+	FailoverAuthRejectWorkers    int      // 币种的服务器在两次认证成功之间拒绝了该数量的不同矿工后视为不可用
+	FailoverProbeSeconds         int      // 探测不可用币种的服务器是否恢复的间隔
+	FailoverReturnSeconds        int      // 改挖备用币种的会话检查原币种是否恢复的间隔
+	MinerIdleTimeoutSeconds      int      // 矿机超过该时间未发送任何数据则断开，为0则不检查
+	MinerShareTimeoutSeconds     int      // 矿机超过该时间未提交share则断开（需逐行解析数据流，不适用于BTCAgent），为0则不检查
+	UpgradeSocketPath            string   // 不停机升级时与新进程通信的Unix Socket路径
+	UpgradeResumeTimeoutSeconds  int      // 不停机升级时等待新进程报告会话恢复结果的超时时间
+	UpgradeMinResumeRatio        float64  // 不停机升级时新进程的会话恢复成功率低于该值则放弃升级
+
+	// 在同一进程中运行的多个监听器，每个监听器的配置可以包含上述除 Listeners 外的任意字段，
+	// 未设置的字段继承顶层配置。为空则只运行顶层配置描述的一个监听器
+	Listeners []json.RawMessage
+
+	// 解析后的各监听器的完整配置
+	listeners []ConfigData
+}
+
+// inheritProcessConfig 使用顶层配置中由所有监听器共用的字段（这些字段只能在顶层设置）
+func (conf *ConfigData) inheritProcessConfig(top *ConfigData) {
+	conf.EnableHTTPDebug = top.EnableHTTPDebug
+	conf.HTTPDebugListenAddr = top.HTTPDebugListenAddr
+	conf.HealthListenAddr = top.HealthListenAddr
+	conf.LogFormat = top.LogFormat
+	conf.UpgradeSocketPath = top.UpgradeSocketPath
+	conf.UpgradeResumeTimeoutSeconds = top.UpgradeResumeTimeoutSeconds
+	conf.UpgradeMinResumeRatio = top.UpgradeMinResumeRatio
+	conf.Listeners = nil
+	conf.listeners = nil
 }
 
 // LoadFromFile 从文件载入配置
@@ -65,7 +126,53 @@ func (conf *ConfigData) LoadFromFile(file string) (err error) {
 	}
 
 	err = json.Unmarshal(configJSON, conf)
+	if err != nil {
+		return
+	}
+
+	if len(conf.Listeners) == 0 {
+		conf.normalize()
+		return
+	}
+
+	names := make(map[string]bool)
+	for i, listenerJSON := range conf.Listeners {
+		// 以顶层配置为基础，监听器中设置的字段覆盖顶层配置
+		listener := *conf
+		listener.StratumServerMap = nil
+		err = json.Unmarshal(listenerJSON, &listener)
+		if err != nil {
+			return fmt.Errorf("parse listener %d failed: %s", i, err.Error())
+		}
+		if listener.StratumServerMap == nil {
+			listener.StratumServerMap = conf.StratumServerMap.clone()
+		}
+		listener.inheritProcessConfig(conf)
+
+		if listener.Name == "" || strings.Contains(listener.Name, "/") {
+			return fmt.Errorf("listener %d: invalid name %q", i, listener.Name)
+		}
+		if names[listener.Name] {
+			return fmt.Errorf("duplicate listener name %q", listener.Name)
+		}
+		names[listener.Name] = true
 
+		listener.normalize()
+		conf.listeners = append(conf.listeners, listener)
+	}
+	return
+}
+
+// ListenerConfigs 各监听器的完整配置，没有配置 Listeners 时只有顶层配置
+func (conf *ConfigData) ListenerConfigs() []ConfigData {
+	if len(conf.listeners) == 0 {
+		return []ConfigData{*conf}
+	}
+	return conf.listeners
+}
+
+// normalize 规范化配置并填充默认值
+func (conf *ConfigData) normalize() {
 	// 若zookeeper路径不以“/”结尾，则添加
 	if conf.ZKServerIDAssignDir[len(conf.ZKServerIDAssignDir)-1] != '/' {
 		conf.ZKServerIDAssignDir += "/"
@@ -81,6 +188,78 @@ func (conf *ConfigData) LoadFromFile(file string) (err error) {
 		conf.ZKUserCaseInsensitiveIndex[len(conf.ZKUserCaseInsensitiveIndex)-1] != '/' {
 		conf.ZKUserCaseInsensitiveIndex += "/"
 	}
+	if len(conf.ZKUserNameMapDir) > 0 &&
+		conf.ZKUserNameMapDir[len(conf.ZKUserNameMapDir)-1] != '/' {
+		conf.ZKUserNameMapDir += "/"
+	}
+
+	if len(conf.ZKDifficultyHintDir) > 0 &&
+		conf.ZKDifficultyHintDir[len(conf.ZKDifficultyHintDir)-1] != '/' {
+		conf.ZKDifficultyHintDir += "/"
+	}
+
+	if len(conf.ZKSessionDirectoryDir) > 0 &&
+		conf.ZKSessionDirectoryDir[len(conf.ZKSessionDirectoryDir)-1] != '/' {
+		conf.ZKSessionDirectoryDir += "/"
+	}
+	if len(conf.ZKNiceHashDir) > 0 &&
+		conf.ZKNiceHashDir[len(conf.ZKNiceHashDir)-1] != '/' {
+		conf.ZKNiceHashDir += "/"
+	}
+	// initNiceHash以小写的算法名创建节点
+	for coin, info := range conf.StratumServerMap {
+		info.NiceHashAlgorithm = strings.ToLower(info.NiceHashAlgorithm)
+		if info.MirrorURL != "" {
+			if info.MirrorSamplePercent <= 0 {
+				info.MirrorSamplePercent = defaultMirrorSamplePercent
+			} else if info.MirrorSamplePercent > 100 {
+				info.MirrorSamplePercent = 100
+			}
+		}
+		conf.StratumServerMap[coin] = info
+	}
+
+	if conf.ListenNetwork == "" {
+		conf.ListenNetwork = "tcp"
+	}
+	if conf.SwitchSource == "" {
+		conf.SwitchSource = switchSourceZookeeper
+	}
+	conf.SwitchSource = strings.ToLower(conf.SwitchSource)
+
+	if conf.UpgradeSocketPath == "" {
+		conf.UpgradeSocketPath = defaultUpgradeSocketPath
+	}
+	if conf.SessionDirIntervalSeconds <= 0 {
+		conf.SessionDirIntervalSeconds = defaultSessionDirIntervalSeconds
+	}
+	if conf.PreconnectMaxIdleSeconds <= 0 {
+		conf.PreconnectMaxIdleSeconds = defaultUpstreamPreconnectMaxIdleSeconds
+	}
+	if conf.FailoverMaxFailures <= 0 {
+		conf.FailoverMaxFailures = defaultFailoverMaxFailures
+	}
+	if conf.FailoverAuthRejectWorkers <= 0 {
+		conf.FailoverAuthRejectWorkers = defaultFailoverAuthRejectWorkers
+	}
+	if conf.FailoverProbeSeconds <= 0 {
+		conf.FailoverProbeSeconds = defaultFailoverProbeSeconds
+	}
+	if conf.FailoverReturnSeconds <= 0 {
+		conf.FailoverReturnSeconds = defaultFailoverReturnSeconds
+	}
+	if conf.CaptureDir == "" {
+		conf.CaptureDir = defaultCaptureDir
+	}
+	if conf.CaptureMaxBytes <= 0 {
+		conf.CaptureMaxBytes = defaultCaptureMaxBytes
+	}
+	if conf.SessionEventQueueSize <= 0 {
+		conf.SessionEventQueueSize = defaultSessionEventQueueSize
+	}
+	if conf.UpgradeResumeTimeoutSeconds <= 0 {
+		conf.UpgradeResumeTimeoutSeconds = defaultUpgradeResumeTimeoutSeconds
+	}
 
 	// 若UserSuffix为空，设为与币种相同
 	for k, v := range conf.StratumServerMap {
@@ -90,8 +269,6 @@ func (conf *ConfigData) LoadFromFile(file string) (err error) {
 		}
 		glog.Info("Chain: ", k, ", UserSuffix: ", conf.StratumServerMap[k].UserSuffix)
 	}
-
-	return
 }
 
 // SaveToFile 保存配置到文件
@@ -107,12 +284,19 @@ func (conf *ConfigData) SaveToFile(file string) (err error) {
 	return
 }
 
+// 运行时数据的格式版本
+// 0: 无版本号的旧格式，会话的协议信息需要通过重放请求推断
+// 1: 增加链类型，以及会话的协议类型、JSON-RPC版本、BTCAgent/NiceHash标记
+const runtimeDataVersion = 1
+
 // StratumSessionData Stratum会话数据
 type StratumSessionData struct {
 	// 会话ID
 	SessionID uint32
 	// 用户所挖的币种
 	MiningCoin string
+	// 因服务器故障改挖备用币种（MiningCoin）时，用户设置的币种
+	FailoverFrom string `json:",omitempty"`
 
 	ClientConnFD uintptr
 	ServerConnFD uintptr
@@ -122,13 +306,55 @@ type StratumSessionData struct {
 
 	// 比特币AsicBoost挖矿版本掩码
 	VersionMask uint32 `json:",omitempty"`
+	// 矿机或子账户的难度提示，每次连接服务器时通过 mining.suggest_difficulty 发送
+	DifficultyHint uint64 `json:",omitempty"`
+
+	// 握手阶段已从客户端读取但尚未处理的数据
+	PendingClientData []byte `json:",omitempty"`
+
+	// 协议信息（版本1开始提供），ProtocolType 为 ProtocolUnknown 表示未记录
+	ProtocolType     ProtocolType
+	JSONRPCVersion   int
+	IsBTCAgent       bool `json:",omitempty"`
+	IsNiceHashClient bool `json:",omitempty"`
+
+	// 矿机连接的时间（Unix时间戳），为0表示未记录
+	ConnectedAt int64 `json:",omitempty"`
+
+	// 服务器连接无法移交（如TLS连接），没有 ServerConnFD，新进程需要重新连接服务器
+	ReconnectServer bool `json:",omitempty"`
+}
+
+// migrate 将指定版本的会话数据转换为当前版本
+func (sessionData *StratumSessionData) migrate(version int) {
+	if version < 1 {
+		// 旧格式没有记录协议信息，恢复时通过重放请求推断
+		sessionData.ProtocolType = ProtocolUnknown
+		sessionData.JSONRPCVersion = 0
+		sessionData.IsBTCAgent = false
+		sessionData.IsNiceHashClient = false
+	}
 }
 
 // RuntimeData 运行时数据
 type RuntimeData struct {
+	// 格式版本，见 runtimeDataVersion
+	Version      int
 	Action       string
-	ServerID     uint8
+	ServerID     uint32
 	SessionDatas []StratumSessionData
+
+	// 链类型（版本1开始提供），与配置文件不同时拒绝恢复
+	ChainType string `json:",omitempty"`
+	// 监听器名称，只有一个监听器且未配置 Listeners 时为空
+	Listener string `json:",omitempty"`
+	// 除服务器ID外租用的其他会话ID块，新进程需要重新占用
+	SessionIDBlocks []uint32 `json:",omitempty"`
+
+	// 从旧进程继承的监听socket（为0表示需要重新监听）
+	ListenerFD uintptr `json:",omitempty"`
+	// 处于握手阶段（尚未开始代理）的会话，只有客户端连接
+	HandshakeSessionDatas []StratumSessionData `json:",omitempty"`
 }
 
 // LoadFromFile 从文件载入配置
@@ -144,6 +370,74 @@ func (conf *RuntimeData) LoadFromFile(file string) (err error) {
 	return
 }
 
+// loadRuntimeFile 载入旧版本进程保存的运行时数据文件并转换为当前版本
+// 旧进程已不存在，无法回滚，数据不兼容时只能放弃恢复会话（关闭继承的文件描述符并返回空的运行时数据）
+func loadRuntimeFile(file string, chainType string) (runtimeData RuntimeData) {
+	err := runtimeData.LoadFromFile(file)
+	if err == nil {
+		err = runtimeData.Migrate(chainType)
+	}
+	if err != nil {
+		glog.Error("load runtime data failed, sessions will not be resumed: ", err)
+		runtimeData.closeFds()
+		runtimeData = RuntimeData{}
+	}
+	return
+}
+
+// checkVersion 检查运行时数据的版本及链类型是否与当前进程兼容
+func (conf *RuntimeData) checkVersion(chainType string) error {
+	if conf.Version > runtimeDataVersion {
+		return fmt.Errorf("runtime data version %d is newer than the supported version %d", conf.Version, runtimeDataVersion)
+	}
+	if conf.Version < 0 {
+		return fmt.Errorf("invalid runtime data version %d", conf.Version)
+	}
+	if conf.Version >= 1 && !strings.EqualFold(conf.ChainType, chainType) {
+		return fmt.Errorf("chain type mismatch, runtime data: %s, config: %s", conf.ChainType, chainType)
+	}
+	return nil
+}
+
+// Migrate 检查运行时数据是否兼容，并将其转换为当前版本
+func (conf *RuntimeData) Migrate(chainType string) error {
+	err := conf.checkVersion(chainType)
+	if err != nil {
+		return err
+	}
+
+	for i := range conf.SessionDatas {
+		conf.SessionDatas[i].migrate(conf.Version)
+	}
+	for i := range conf.HandshakeSessionDatas {
+		conf.HandshakeSessionDatas[i].migrate(conf.Version)
+	}
+
+	if conf.Version < 1 {
+		conf.ChainType = chainType
+	}
+	conf.Version = runtimeDataVersion
+	return nil
+}
+
+// closeFds 关闭运行时数据中继承的文件描述符（拒绝恢复时调用）
+func (conf *RuntimeData) closeFds() {
+	closeFd := func(fd uintptr) {
+		if fd != 0 {
+			os.NewFile(fd, "").Close()
+		}
+	}
+
+	closeFd(conf.ListenerFD)
+	for _, sessionData := range conf.SessionDatas {
+		closeFd(sessionData.ClientConnFD)
+		closeFd(sessionData.ServerConnFD)
+	}
+	for _, sessionData := range conf.HandshakeSessionDatas {
+		closeFd(sessionData.ClientConnFD)
+	}
+}
+
 // SaveToFile 保存配置到文件
 func (conf *RuntimeData) SaveToFile(file string) (err error) {
 
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestLoadRuntimeFileClosesFds(t *testing.T) {
+	// 旧进程传入的文件描述符（监听socket、矿机及服务器连接），用管道写端模拟
+	pipes := make([]*os.File, 3)
+	fds := make([]int, 3)
+	for i := range pipes {
+		r, w := newTestPipe(t)
+		defer r.Close()
+		fd, err := syscall.Dup(int(w.Fd()))
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipes[i], fds[i] = r, fd
+	}
+
+	// 链类型不符，放弃恢复会话时关闭继承的文件描述符
+	file := writeRuntimeFile(t, fmt.Sprintf(`{
+		"Version": %d,
+		"ChainType": "bitcoin",
+		"Action": "upgrade",
+		"ListenerFD": %d,
+		"SessionDatas": [ { "SessionID": 1, "ClientConnFD": %d, "ServerConnFD": %d } ]
+	}`, runtimeDataVersion, fds[0], fds[1], fds[2]))
+	defer os.Remove(file)
+
+	data := loadRuntimeFile(file, "ethereum")
+	if data.Action != "" || len(data.SessionDatas) != 0 {
+		t.Errorf("sessions should be dropped, got %+v", data)
+	}
+	for _, r := range pipes {
+		expectPipeEOF(t, r)
+	}
+}
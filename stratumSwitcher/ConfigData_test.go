@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadListenerConfigs(t *testing.T) {
+	file, err := ioutil.TempFile("", "switcher-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{
+		"ChainType": "bitcoin",
+		"ListenAddr": "0.0.0.0:3333",
+		"StratumServerMap": { "btc": { "URL": "127.0.0.1:3333" } },
+		"ZKBroker": [ "127.0.0.1:2181" ],
+		"ZKServerIDAssignDir": "/switcher/bitcoin_swid",
+		"ZKSwitcherWatchDir": "/switcher/btcbcc",
+		"ZKAutoRegWatchDir": "/switcher/bitcoin_autoreg",
+		"UpgradeSocketPath": "/tmp/upgrade.sock",
+		"Listeners": [
+			{ "Name": "btc" },
+			{
+				"Name": "eth",
+				"ChainType": "ethereum",
+				"ListenAddr": "0.0.0.0:8008",
+				"StratumServerMap": { "eth": { "URL": "127.0.0.1:8009" } },
+				"ZKServerIDAssignDir": "/switcher/eth_swid",
+				"UpgradeSocketPath": "/tmp/ignored.sock"
+			}
+		]
+	}`)
+	file.Close()
+
+	var conf ConfigData
+	err = conf.LoadFromFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := conf.ListenerConfigs()
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+
+	btc, eth := listeners[0], listeners[1]
+	if btc.ChainType != "bitcoin" || btc.ListenAddr != "0.0.0.0:3333" || btc.StratumServerMap["btc"].UserSuffix != "btc" {
+		t.Errorf("listener btc should inherit top-level config: %+v", btc)
+	}
+	if eth.ChainType != "ethereum" || eth.ListenAddr != "0.0.0.0:8008" || eth.ZKServerIDAssignDir != "/switcher/eth_swid/" {
+		t.Errorf("listener eth should override top-level config: %+v", eth)
+	}
+	if _, ok := eth.StratumServerMap["btc"]; ok {
+		t.Errorf("StratumServerMap of listener eth should not be merged with top-level config")
+	}
+	if eth.ZKSwitcherWatchDir != "/switcher/btcbcc/" || eth.UpgradeSocketPath != "/tmp/upgrade.sock" {
+		t.Errorf("listener eth should inherit process config: %+v", eth)
+	}
+
+	if findListenerConfig(listeners, "eth") != 1 || findListenerConfig(listeners, "") != 0 || findListenerConfig(listeners, "ltc") != -1 {
+		t.Errorf("findListenerConfig returned unexpected index")
+	}
+}
+
+func TestRuntimeDataMigrate(t *testing.T) {
+	// 版本0没有记录协议信息，其中的值不可信
+	sessionData := StratumSessionData{SessionID: 1, MiningCoin: "btc", ProtocolType: ProtocolEthereumStratum, JSONRPCVersion: 2, IsNiceHashClient: true}
+
+	for _, test := range []struct {
+		name      string
+		data      RuntimeData
+		chainType string
+		ok        bool
+		// 转换后的链类型及会话的协议信息
+		expectedChainType string
+		expectedProtocol  ProtocolType
+	}{
+		{"v0 to v1", RuntimeData{Version: 0}, "bitcoin", true, "bitcoin", ProtocolUnknown},
+		{"v1", RuntimeData{Version: 1, ChainType: "ethereum"}, "ethereum", true, "ethereum", ProtocolEthereumStratum},
+		{"v1 chain type case insensitive", RuntimeData{Version: 1, ChainType: "Ethereum"}, "ethereum", true, "Ethereum", ProtocolEthereumStratum},
+		{"chain type mismatch", RuntimeData{Version: 1, ChainType: "bitcoin"}, "ethereum", false, "", 0},
+		{"chain type missing in v1", RuntimeData{Version: 1}, "bitcoin", false, "", 0},
+		{"newer version", RuntimeData{Version: runtimeDataVersion + 1, ChainType: "bitcoin"}, "bitcoin", false, "", 0},
+		{"invalid version", RuntimeData{Version: -1}, "bitcoin", false, "", 0},
+	} {
+		data := test.data
+		data.SessionDatas = []StratumSessionData{sessionData}
+		data.HandshakeSessionDatas = []StratumSessionData{sessionData}
+
+		err := data.Migrate(test.chainType)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: Migrate() returned %v", test.name, err)
+			continue
+		}
+		if !test.ok {
+			if data.Version != test.data.Version || data.SessionDatas[0].ProtocolType != sessionData.ProtocolType {
+				t.Errorf("%s: refused data should not be changed: %+v", test.name, data)
+			}
+			continue
+		}
+
+		if data.Version != runtimeDataVersion || data.ChainType != test.expectedChainType {
+			t.Errorf("%s: version %d, chain type %s", test.name, data.Version, data.ChainType)
+		}
+		for _, migrated := range []StratumSessionData{data.SessionDatas[0], data.HandshakeSessionDatas[0]} {
+			if migrated.ProtocolType != test.expectedProtocol || migrated.MiningCoin != "btc" ||
+				migrated.IsNiceHashClient != (test.expectedProtocol != ProtocolUnknown) {
+				t.Errorf("%s: migrated session %+v", test.name, migrated)
+			}
+		}
+	}
+}
+
+// writeRuntimeFile 写入临时的运行时数据文件
+func writeRuntimeFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "switcher-runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString(content)
+	return file.Name()
+}
+
+func TestLoadRuntimeFile(t *testing.T) {
+	// 旧版本进程保存的版本0数据
+	v0File := writeRuntimeFile(t, `{
+		"Action": "upgrade",
+		"ServerID": 3,
+		"SessionDatas": [ { "SessionID": 50331650, "MiningCoin": "btc", "ProtocolType": 2, "IsNiceHashClient": true } ]
+	}`)
+	defer os.Remove(v0File)
+
+	data := loadRuntimeFile(v0File, "bitcoin")
+	if data.Version != runtimeDataVersion || data.ChainType != "bitcoin" || data.Action != "upgrade" || data.ServerID != 3 {
+		t.Errorf("unexpected runtime data: %+v", data)
+	}
+	if len(data.SessionDatas) != 1 || data.SessionDatas[0].SessionID != 0x03000002 ||
+		data.SessionDatas[0].ProtocolType != ProtocolUnknown || data.SessionDatas[0].IsNiceHashClient {
+		t.Errorf("unexpected session data: %+v", data.SessionDatas)
+	}
+
+	// 不兼容或无法读取的数据，放弃恢复会话
+	mismatchFile := writeRuntimeFile(t, `{"Version": 1, "ChainType": "ethereum", "Action": "upgrade", "SessionDatas": [ { "SessionID": 1 } ]}`)
+	defer os.Remove(mismatchFile)
+	invalidFile := writeRuntimeFile(t, `{"Version": 1,`)
+	defer os.Remove(invalidFile)
+
+	for _, file := range []string{mismatchFile, invalidFile, v0File + ".missing"} {
+		data := loadRuntimeFile(file, "bitcoin")
+		if data.Action != "" || data.Version != 0 || len(data.SessionDatas) != 0 {
+			t.Errorf("%s: sessions should be dropped, got %+v", file, data)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 转入代理模式后，在服务器发来的前若干行中寻找 mining.suggest_difficulty 的响应
+const suggestDifficultyResponseMaxLines = 32
+
+// 矿机密码中表示难度的参数名，如 “d=1024”、“x,diff=65536”
+var passwordDifficultyKeys = map[string]bool{"d": true, "diff": true, "difficulty": true, "sd": true}
+
+// parseDifficultyValue 将数字或数字字符串形式的难度转换为整数，无效或小于1时返回0
+func parseDifficultyValue(value interface{}) uint64 {
+	var difficulty float64
+	switch v := value.(type) {
+	case float64:
+		difficulty = v
+	case string:
+		var err error
+		difficulty, err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0
+		}
+	default:
+		return 0
+	}
+
+	if math.IsNaN(difficulty) || difficulty < 1 || difficulty >= math.MaxUint64 {
+		return 0
+	}
+	return uint64(difficulty)
+}
+
+// parseSuggestDifficulty 解析矿机的 mining.suggest_difficulty 请求中的难度，无效时返回0
+// request example: {"id":2,"method":"mining.suggest_difficulty","params":[1024]}
+func parseSuggestDifficulty(request *JSONRPCRequest) uint64 {
+	if len(request.Params) < 1 {
+		return 0
+	}
+	return parseDifficultyValue(request.Params[0])
+}
+
+// parsePasswordDifficulty 解析矿机密码中的难度提示，没有时返回0
+// 密码由逗号、分号、空格或“&”分隔为多个部分，其中的 d=、diff=、difficulty= 或 sd= 为难度
+func parsePasswordDifficulty(password string) uint64 {
+	fields := strings.FieldsFunc(password, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '&'
+	})
+	for _, field := range fields {
+		pos := strings.IndexByte(field, '=')
+		if pos < 0 || !passwordDifficultyKeys[strings.ToLower(field[:pos])] {
+			continue
+		}
+		if difficulty := parseDifficultyValue(field[pos+1:]); difficulty > 0 {
+			return difficulty
+		}
+	}
+	return 0
+}
+
+// supportsDifficultyHint 当前协议是否支持向服务器发送难度提示
+// 只有比特币Stratum协议有 mining.suggest_difficulty。以太坊的各种协议没有对应的请求，
+// 会话忽略矿机的 mining.suggest_difficulty 及子账户的默认难度，矿机密码中的难度提示随认证请求原样发给服务器
+func (session *StratumSession) supportsDifficultyHint() bool {
+	return session.protocolType == ProtocolBitcoinStratum
+}
+
+// newSuggestDifficultyResponseFilter 返回去掉服务器对 mining.suggest_difficulty 的响应的行处理函数
+// 难度提示在认证成功后发送，其响应在转入代理模式后才到达，不应转发给矿机
+func newSuggestDifficultyResponseFilter() func(line []byte) ([]byte, bool) {
+	lines := 0
+	return func(line []byte) ([]byte, bool) {
+		lines++
+		if bytes.Contains(line, []byte(`"suggest_difficulty"`)) {
+			response, err := NewJSONRPCResponse(line)
+			if err == nil && response.ID == "suggest_difficulty" {
+				return nil, true
+			}
+		}
+		return line, lines >= suggestDifficultyResponseMaxLines
+	}
+}
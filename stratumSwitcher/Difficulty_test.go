@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePasswordDifficulty(t *testing.T) {
+	cases := map[string]uint64{
+		"":                 0,
+		"x":                0,
+		"d=1024":           1024,
+		"x,d=1024":         1024,
+		"x;DIFF=65536":     65536,
+		"difficulty=2e4 x": 20000,
+		"sd=8192&p=1":      8192,
+		"d=0,diff=512":     512,
+		"d=abc":            0,
+		"d=0.5":            0,
+		"pd=1024":          0,
+	}
+	for password, expected := range cases {
+		if difficulty := parsePasswordDifficulty(password); difficulty != expected {
+			t.Errorf("parsePasswordDifficulty(%q) = %d, expected %d", password, difficulty, expected)
+		}
+	}
+}
+
+func TestParseSuggestDifficulty(t *testing.T) {
+	cases := []struct {
+		json     string
+		expected uint64
+	}{
+		{`{"id":2,"method":"mining.suggest_difficulty","params":[1024]}`, 1024},
+		{`{"id":2,"method":"mining.suggest_difficulty","params":["4096"]}`, 4096},
+		{`{"id":2,"method":"mining.suggest_difficulty","params":[16.9]}`, 16},
+		{`{"id":2,"method":"mining.suggest_difficulty","params":[-1]}`, 0},
+		{`{"id":2,"method":"mining.suggest_difficulty","params":[]}`, 0},
+		{`{"id":2,"method":"mining.suggest_difficulty","params":[null]}`, 0},
+	}
+	for _, c := range cases {
+		request, err := NewJSONRPCRequest([]byte(c.json))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if difficulty := parseSuggestDifficulty(request); difficulty != c.expected {
+			t.Errorf("parseSuggestDifficulty(%s) = %d, expected %d", c.json, difficulty, c.expected)
+		}
+	}
+}
+
+func TestSuggestDifficultyResponseFilter(t *testing.T) {
+	input := `{"id":null,"method":"mining.set_difficulty","params":[8]}` + "\n" +
+		`{"id":"suggest_difficulty","result":true,"error":null}` + "\n" +
+		`{"id":null,"method":"mining.set_difficulty","params":[65536]}` + "\n" +
+		`{"id":"suggest_difficulty","result":true,"error":null}` + "\n"
+	expected := `{"id":null,"method":"mining.set_difficulty","params":[8]}` + "\n" +
+		`{"id":null,"method":"mining.set_difficulty","params":[65536]}` + "\n" +
+		// 只去掉第一个响应，之后的数据原样输出
+		`{"id":"suggest_difficulty","result":true,"error":null}` + "\n"
+
+	rewriter := newLineRewriter(strings.NewReader(input[20:]), newSuggestDifficultyResponseFilter())
+	// 模拟proxyStratum中bufio剩余的数据
+	rewriter.feed([]byte(input[:20]))
+	output, err := ioutil.ReadAll(rewriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", output, expected)
+	}
+
+	// 服务器没有响应时，超过 suggestDifficultyResponseMaxLines 行后不再处理
+	notify := `{"id":null,"method":"mining.notify","params":[]}` + "\n"
+	input = strings.Repeat(notify, suggestDifficultyResponseMaxLines) + `{"id":"suggest_difficulty","result":true,"error":null}` + "\n"
+	rewriter = newLineRewriter(strings.NewReader(input), newSuggestDifficultyResponseFilter())
+	output, err = ioutil.ReadAll(rewriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != input {
+		t.Errorf("filter should stop after %d lines", suggestDifficultyResponseMaxLines)
+	}
+}
+
+func TestSuggestDifficultyAfterAuthorize(t *testing.T) {
+	manager, watcher := newUpgradeTestManager(t)
+	setTestSubaccountCoin(watcher, "alice", "btc")
+
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+	go io.Copy(ioutil.Discard, clientPeer)
+	session := NewStratumSession(manager, clientConn, 0x01000006)
+
+	url, requests := startFakeStratumServer(t, session.sessionIDString, true)
+	manager.stratumServerInfoMap = StratumServerInfoMap{"btc": StratumServerInfo{URL: url}}
+	var err error
+	manager.upstreamDialers, err = NewUpstreamDialers(manager.stratumServerInfoMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshakeTestSession(t, session,
+		`{"id":1,"method":"mining.subscribe","params":["cgminer/4.10"]}`,
+		`{"id":2,"method":"mining.suggest_difficulty","params":[65536]}`,
+		`{"id":3,"method":"mining.authorize","params":["alice.rig1","x"]}`)
+	if err := session.getMiningCoin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.connectStratumServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer session.closeServerConn()
+	if !session.suggestDifficultySent {
+		t.Error("suggestDifficultySent should be set")
+	}
+
+	// 服务器按顺序收到订阅、认证及难度提示
+	expected := []string{"mining.subscribe", "mining.authorize alice.rig1", "mining.suggest_difficulty"}
+	for _, method := range expected {
+		select {
+		case request := <-requests:
+			if request != method {
+				t.Errorf("server received %s, want %s", request, method)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server did not receive %s", method)
+		}
+	}
+}
+
+func TestDifficultyHintNotSupported(t *testing.T) {
+	manager, _ := newUpgradeTestManager(t)
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+	session := NewStratumSession(manager, clientConn, 0x01000007)
+
+	// 以太坊协议没有 mining.suggest_difficulty，难度提示被忽略，也不发送给服务器
+	session.protocolType = ProtocolEthereumStratumNiceHash
+	stat := StatSubScribed
+	for _, line := range []string{
+		`{"id":1,"method":"mining.suggest_difficulty","params":[65536]}`,
+		`{"id":2,"method":"mining.authorize","params":["alice.rig1","d=1024"]}`,
+	} {
+		request, err := NewJSONRPCRequest([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, stratumErr := session.stratumHandleRequest(request, &stat); stratumErr != nil {
+			t.Fatalf("%s: %v", line, stratumErr)
+		}
+	}
+	if stat != StatAuthorized {
+		t.Fatalf("stat = %d", stat)
+	}
+	if session.difficultyHint != 0 {
+		t.Errorf("difficultyHint = %d, want 0", session.difficultyHint)
+	}
+	session.difficultyHint = 65536
+	if err := session.sendMiningSuggestDifficultyToServer(); err != nil || session.suggestDifficultySent {
+		t.Errorf("difficulty hint should not be sent: %v", err)
+	}
+}
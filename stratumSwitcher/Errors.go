@@ -40,14 +40,24 @@ var (
 	ErrSessionIDFull = errors.New("Session ID is Full")
 	// ErrSessionIDOccupied SessionID已被占用（恢复SessionID时）
 	ErrSessionIDOccupied = errors.New("Session ID has been occupied")
+	// ErrSessionIDBlockNotHeld SessionID所在的ID块不属于本机（恢复SessionID时）
+	ErrSessionIDBlockNotHeld = errors.New("Session ID block is not held")
 	// ErrParseSubscribeResponseFailed 解析订阅响应失败
 	ErrParseSubscribeResponseFailed = errors.New("Parse Subscribe Response Failed")
 	// ErrSessionIDInconformity 返回的会话ID和当前保存的不匹配
 	ErrSessionIDInconformity = errors.New("Session ID Inconformity")
 	// ErrAuthorizeFailed 认证失败
 	ErrAuthorizeFailed = errors.New("Authorize Failed")
+	// ErrServerAuthorizeFailed 服务器拒绝了认证请求
+	ErrServerAuthorizeFailed = errors.New("Authorize Failed for Server")
 	// ErrTooMuchPendingAutoRegReq 太多等待中的自动注册请求
 	ErrTooMuchPendingAutoRegReq = errors.New("Too much pending auto reg request")
+	// ErrSessionUpgrading 会话已被冻结，等待移交给新进程
+	ErrSessionUpgrading = errors.New("Session is Upgrading")
+	// ErrSessionIsRunning 会话已在运行，无法再次恢复
+	ErrSessionIsRunning = errors.New("Session is Running")
+	// ErrUpstreamUnhealthy 币种的服务器不可用（故障转移时使用）
+	ErrUpstreamUnhealthy = errors.New("Stratum Server is Unhealthy")
 )
 
 var (
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 默认值：币种的服务器连续失败多少次后视为不可用，会话在一个币种上连续失败多少次后转移到备用币种
+const defaultFailoverMaxFailures = 3
+
+// 默认值：币种的服务器在两次认证成功之间拒绝了多少个不同矿工的认证后视为不可用
+const defaultFailoverAuthRejectWorkers = 10
+
+// 默认值：探测不可用币种的服务器是否恢复的间隔
+const defaultFailoverProbeSeconds = 10
+
+// 默认值：转移到备用币种的会话检查原币种是否恢复的间隔
+const defaultFailoverReturnSeconds = 60
+
+// FailoverManager 管理各币种服务器的可用状态及备用币种
+// 会话连接某币种的服务器连续失败时（或该币种已不可用时）临时改挖备用币种，
+// 原币种恢复后再切换回来
+type FailoverManager struct {
+	lock sync.Mutex
+	// 币种 -> 备用币种
+	fallbacks map[string]string
+	// 币种 -> 服务器连续失败的次数（不包括认证被拒绝）
+	failures map[string]int
+	// 币种 -> 上次认证成功后被拒绝认证的矿工
+	authRejects map[string]map[string]bool
+	// 不可用的币种
+	unhealthy map[string]bool
+	// 各币种的服务器连接器，用于探测不可用的币种是否恢复
+	dialers UpstreamDialerMap
+
+	maxFailures       int
+	authRejectWorkers int
+	probeInterval     time.Duration
+	returnInterval    time.Duration
+}
+
+// NewFailoverManager 根据各币种的 FallbackCoin 创建故障转移管理器，没有币种配置备用币种时返回nil
+func NewFailoverManager(serverMap StratumServerInfoMap, dialers UpstreamDialerMap,
+	maxFailures int, authRejectWorkers int, probeSeconds int, returnSeconds int) (failover *FailoverManager, err error) {
+	fallbacks := make(map[string]string)
+	for coin, info := range serverMap {
+		if info.FallbackCoin == "" {
+			continue
+		}
+		if info.FallbackCoin == coin {
+			err = errors.New("FallbackCoin of " + coin + " cannot be itself")
+			return
+		}
+		if _, ok := serverMap[info.FallbackCoin]; !ok {
+			err = errors.New("FallbackCoin " + info.FallbackCoin + " of " + coin + " not found in StratumServerMap")
+			return
+		}
+		fallbacks[coin] = info.FallbackCoin
+	}
+	if len(fallbacks) == 0 {
+		return
+	}
+
+	failover = new(FailoverManager)
+	failover.fallbacks = fallbacks
+	failover.failures = make(map[string]int)
+	failover.authRejects = make(map[string]map[string]bool)
+	failover.unhealthy = make(map[string]bool)
+	failover.dialers = dialers
+	failover.maxFailures = maxFailures
+	failover.authRejectWorkers = authRejectWorkers
+	failover.probeInterval = time.Duration(probeSeconds) * time.Second
+	failover.returnInterval = time.Duration(returnSeconds) * time.Second
+	return
+}
+
+// IsHealthy 币种的服务器是否可用
+func (failover *FailoverManager) IsHealthy(coin string) bool {
+	failover.lock.Lock()
+	defer failover.lock.Unlock()
+
+	return !failover.unhealthy[coin]
+}
+
+// Fallback 沿备用币种链寻找第一个可用的备用币种，找不到时返回空字符串
+func (failover *FailoverManager) Fallback(coin string) string {
+	failover.lock.Lock()
+	defer failover.lock.Unlock()
+
+	visited := map[string]bool{coin: true}
+	for {
+		coin = failover.fallbacks[coin]
+		if coin == "" || visited[coin] {
+			return ""
+		}
+		if !failover.unhealthy[coin] {
+			return coin
+		}
+		visited[coin] = true
+	}
+}
+
+// RecordResult 记录矿工一次连接币种服务器的结果
+// 连续失败达到 maxFailures 次后将币种标记为不可用，并在后台探测其是否恢复。
+// 认证被拒绝可能只与该矿工有关，不计入连续失败的次数，而是单独记录被拒绝的矿工，
+// 两次认证成功之间有 authRejectWorkers 个不同的矿工被拒绝时才将币种标记为不可用
+func (failover *FailoverManager) RecordResult(coin string, worker string, err error) {
+	if err == StratumErrStratumServerNotFound {
+		return
+	}
+
+	failover.lock.Lock()
+	defer failover.lock.Unlock()
+
+	if err == nil {
+		failover.failures[coin] = 0
+		delete(failover.authRejects, coin)
+		if failover.unhealthy[coin] {
+			delete(failover.unhealthy, coin)
+			glog.Info("Failover: stratum server of ", coin, " recovered")
+		}
+		return
+	}
+
+	if err == ErrServerAuthorizeFailed {
+		rejects := failover.authRejects[coin]
+		if rejects == nil {
+			rejects = make(map[string]bool)
+			failover.authRejects[coin] = rejects
+		}
+		rejects[worker] = true
+		if len(rejects) >= failover.authRejectWorkers {
+			failover.markUnhealthy(coin, len(rejects), " workers rejected: ", err)
+		}
+		return
+	}
+
+	failover.failures[coin]++
+	if failover.failures[coin] >= failover.maxFailures {
+		failover.markUnhealthy(coin, failover.failures[coin], " failures: ", err)
+	}
+}
+
+// markUnhealthy 将币种标记为不可用并在后台探测其是否恢复，调用者需持有锁
+func (failover *FailoverManager) markUnhealthy(coin string, count int, what string, err error) {
+	if failover.unhealthy[coin] {
+		return
+	}
+	failover.unhealthy[coin] = true
+	glog.Warning("Failover: stratum server of ", coin, " is unhealthy after ", count, what, err)
+	go failover.probe(coin)
+}
+
+// probe 定期探测不可用币种的服务器，能够建立连接时将其标记为可用
+func (failover *FailoverManager) probe(coin string) {
+	dialer, ok := failover.dialers[coin]
+	if !ok {
+		return
+	}
+
+	for {
+		time.Sleep(failover.probeInterval)
+
+		if failover.IsHealthy(coin) {
+			// 已有会话成功连接
+			return
+		}
+
+		conn, err := dialer.Dial(upstreamDialTimeoutSeconds * time.Second)
+		if err != nil {
+			if glog.V(2) {
+				glog.Info("Failover: probe stratum server of ", coin, " failed: ", err)
+			}
+			continue
+		}
+		conn.Close()
+
+		failover.RecordResult(coin, "", nil)
+		return
+	}
+}
+
+// recordUpstreamResult 记录会话连接当前币种服务器的结果
+func (session *StratumSession) recordUpstreamResult(err error) {
+	if session.manager.failover != nil {
+		session.manager.failover.RecordResult(session.miningCoin, session.fullWorkerName, err)
+	}
+}
+
+// userCoin 用户设置的币种（故障转移期间与正在挖的币种不同）
+func (session *StratumSession) userCoin() string {
+	if len(session.failoverFrom) > 0 {
+		return session.failoverFrom
+	}
+	return session.miningCoin
+}
+
+// tryFailover 当前币种的服务器已不可用，或会话在当前币种上已连续失败 failures 次时，改挖备用币种
+// 返回是否改挖了备用币种。只在会话重连服务器（持有会话锁）或握手阶段调用
+func (session *StratumSession) tryFailover(failures int, reason error) bool {
+	failover := session.manager.failover
+	if failover == nil {
+		return false
+	}
+	if failures < failover.maxFailures && failover.IsHealthy(session.miningCoin) {
+		return false
+	}
+	fallback := failover.Fallback(session.miningCoin)
+	if fallback == "" {
+		return false
+	}
+
+	oldMiningCoin := session.miningCoin
+	if len(session.failoverFrom) == 0 {
+		session.failoverFrom = oldMiningCoin
+	} else if fallback == session.failoverFrom {
+		// 备用币种链绕回了用户设置的币种
+		session.failoverFrom = ""
+	}
+	session.miningCoin = fallback
+	session.miningCoinSince = time.Now()
+	session.updateLogContext()
+
+	if session.shareCounter != nil {
+		session.shareCounter.RecordSwitch(oldMiningCoin, fallback)
+	}
+	session.publishEvent(sessionEventFailover, func(event *SessionEvent) {
+		event.OldCoin = oldMiningCoin
+		event.NewCoin = fallback
+		event.Reason = reason.Error()
+	})
+	session.logWarning("Failover", "old_coin", oldMiningCoin, "reason", reason)
+	return true
+}
+
+// connectStratumServerWithFailover 握手阶段连接服务器，失败后重试，
+// 在当前币种上连续失败 maxFailures 次（包括认证被拒绝）后改挖备用币种。
+// 重试期间失败的响应暂不发给矿机，全部失败后只发送最后一次的响应
+func (session *StratumSession) connectStratumServerWithFailover() (err error) {
+	failover := session.manager.failover
+	if failover == nil {
+		err = session.connectStratumServer()
+		session.recordUpstreamResult(err)
+		return
+	}
+
+	session.holdConnectError = true
+	defer func() {
+		session.holdConnectError = false
+		if err != nil && session.heldConnectError != nil {
+			session.writeJSONResponseToClient(session.heldConnectError)
+		}
+		session.heldConnectError = nil
+	}()
+
+	// 已尝试过的币种，备用币种链绕回时不再重试
+	tried := map[string]bool{session.miningCoin: true}
+	// 在当前币种上连续失败的次数
+	failures := 0
+	for {
+		err = session.connectStratumServer()
+		session.recordUpstreamResult(err)
+		if err == nil {
+			return
+		}
+		session.closeServerConn()
+
+		failures++
+		if session.tryFailover(failures, err) {
+			if tried[session.miningCoin] {
+				return
+			}
+			tried[session.miningCoin] = true
+			failures = 0
+			continue
+		}
+		if failures >= failover.maxFailures {
+			return
+		}
+		time.Sleep(reconnectRetryMinDelay)
+	}
+}
+
+// writeConnectErrorToClient 发送连接服务器失败的响应给矿机，还会重试时暂存该响应
+func (session *StratumSession) writeConnectErrorToClient(response *JSONRPCResponse) {
+	if session.holdConnectError {
+		session.heldConnectError = response
+		return
+	}
+	session.writeJSONResponseToClient(response)
+}
+
+// closeServerConn 关闭连接失败的服务器连接，以便重试
+func (session *StratumSession) closeServerConn() {
+	if session.serverConn != nil {
+		session.serverConn.Close()
+		session.serverConn = nil
+	}
+	session.serverReader = nil
+}
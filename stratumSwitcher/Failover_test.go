@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewFailoverManager(t *testing.T) {
+	serverMap := StratumServerInfoMap{
+		"btc": StratumServerInfo{FallbackCoin: "bch"},
+		"bch": StratumServerInfo{},
+	}
+	failover, err := NewFailoverManager(serverMap, nil, 3, 10, 10, 60)
+	if err != nil || failover == nil {
+		t.Fatalf("NewFailoverManager returned %v, %v", failover, err)
+	}
+
+	failover, err = NewFailoverManager(StratumServerInfoMap{"btc": StratumServerInfo{}}, nil, 3, 10, 10, 60)
+	if err != nil || failover != nil {
+		t.Errorf("expected nil manager without FallbackCoin, got %v, %v", failover, err)
+	}
+
+	_, err = NewFailoverManager(StratumServerInfoMap{"btc": StratumServerInfo{FallbackCoin: "ltc"}}, nil, 3, 10, 10, 60)
+	if err == nil {
+		t.Error("expected error for unknown FallbackCoin")
+	}
+
+	_, err = NewFailoverManager(StratumServerInfoMap{"btc": StratumServerInfo{FallbackCoin: "btc"}}, nil, 3, 10, 10, 60)
+	if err == nil {
+		t.Error("expected error for FallbackCoin pointing to itself")
+	}
+}
+
+func TestFailoverManager(t *testing.T) {
+	serverMap := StratumServerInfoMap{
+		"btc": StratumServerInfo{FallbackCoin: "bch"},
+		"bch": StratumServerInfo{FallbackCoin: "bsv"},
+		"bsv": StratumServerInfo{FallbackCoin: "btc"},
+	}
+	// 没有连接器，不会在后台探测
+	failover, err := NewFailoverManager(serverMap, nil, 2, 2, 10, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fallback := failover.Fallback("btc"); fallback != "bch" {
+		t.Errorf("Fallback(btc) = %q, want bch", fallback)
+	}
+
+	// 同一矿工被多次拒绝认证不计入失败次数
+	failover.RecordResult("bch", "alice.rig1", ErrServerAuthorizeFailed)
+	failover.RecordResult("bch", "alice.rig1", ErrServerAuthorizeFailed)
+	if !failover.IsHealthy("bch") {
+		t.Error("authorize failures should not mark coin unhealthy")
+	}
+
+	// 成功连接会清零失败次数
+	failover.RecordResult("bch", "alice.rig1", errors.New("connection refused"))
+	failover.RecordResult("bch", "alice.rig1", nil)
+	failover.RecordResult("bch", "alice.rig1", errors.New("connection refused"))
+	if !failover.IsHealthy("bch") {
+		t.Error("failures are not consecutive, coin should be healthy")
+	}
+
+	failover.RecordResult("bch", "alice.rig1", errors.New("connection refused"))
+	if failover.IsHealthy("bch") {
+		t.Error("coin should be unhealthy after 2 consecutive failures")
+	}
+	if fallback := failover.Fallback("btc"); fallback != "bsv" {
+		t.Errorf("Fallback(btc) = %q, want bsv when bch is unhealthy", fallback)
+	}
+
+	failover.RecordResult("bsv", "alice.rig1", errors.New("timeout"))
+	failover.RecordResult("bsv", "alice.rig1", errors.New("timeout"))
+	if fallback := failover.Fallback("btc"); fallback != "" {
+		t.Errorf("Fallback(btc) = %q, want empty when all fallbacks are unhealthy", fallback)
+	}
+
+	failover.RecordResult("bch", "alice.rig1", nil)
+	if !failover.IsHealthy("bch") {
+		t.Error("coin should recover after a successful connection")
+	}
+	if fallback := failover.Fallback("btc"); fallback != "bch" {
+		t.Errorf("Fallback(btc) = %q, want bch after recovery", fallback)
+	}
+}
+
+func TestFailoverManagerAuthRejects(t *testing.T) {
+	serverMap := StratumServerInfoMap{"btc": StratumServerInfo{FallbackCoin: "bch"}, "bch": StratumServerInfo{}}
+	failover, err := NewFailoverManager(serverMap, nil, 3, 3, 10, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 被拒绝的矿工数按不同矿工计算
+	for i := 0; i < 5; i++ {
+		failover.RecordResult("btc", "alice.rig1", ErrServerAuthorizeFailed)
+	}
+	failover.RecordResult("btc", "alice.rig2", ErrServerAuthorizeFailed)
+	if !failover.IsHealthy("btc") {
+		t.Error("coin should be healthy with 2 rejected workers")
+	}
+
+	// 认证成功后重新计算
+	failover.RecordResult("btc", "bob.rig1", nil)
+	failover.RecordResult("btc", "carol.rig1", ErrServerAuthorizeFailed)
+	failover.RecordResult("btc", "dave.rig1", ErrServerAuthorizeFailed)
+	if !failover.IsHealthy("btc") {
+		t.Error("rejected workers should be reset after a successful authorization")
+	}
+
+	// 被拒绝的矿工不影响连续失败的次数
+	failover.RecordResult("btc", "erin.rig1", errors.New("connection refused"))
+	failover.RecordResult("btc", "erin.rig1", errors.New("connection refused"))
+	if !failover.IsHealthy("btc") {
+		t.Error("coin should be healthy with 2 failures and 2 rejected workers")
+	}
+
+	failover.RecordResult("btc", "frank.rig1", ErrServerAuthorizeFailed)
+	if failover.IsHealthy("btc") {
+		t.Error("coin should be unhealthy after 3 workers rejected")
+	}
+	if fallback := failover.Fallback("btc"); fallback != "bch" {
+		t.Errorf("Fallback(btc) = %q, want bch", fallback)
+	}
+}
+
+// startFakeStratumServer 启动模拟的sserver，订阅时返回 sessionID，authorized 决定是否接受认证
+// 返回服务器地址及按顺序收到的请求，认证请求记录为 “mining.authorize 矿工名”
+func startFakeStratumServer(t *testing.T, sessionID string, authorized bool) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					var request struct {
+						ID     string        `json:"id"`
+						Method string        `json:"method"`
+						Params []interface{} `json:"params"`
+					}
+					json.Unmarshal(line, &request)
+
+					var response string
+					switch request.ID {
+					case "subscribe":
+						requests <- request.Method
+						response = `{"id":"subscribe","result":[[],"` + sessionID + `",8],"error":null}`
+					case "auth":
+						worker, _ := request.Params[0].(string)
+						requests <- request.Method + " " + worker
+						if authorized {
+							response = `{"id":"auth","result":true,"error":null}`
+						} else {
+							response = `{"id":"auth","result":null,"error":[29,"Invalid username",null]}`
+						}
+					case "suggest_difficulty":
+						requests <- request.Method
+						response = `{"id":"suggest_difficulty","result":true,"error":null}`
+					default:
+						requests <- request.Method
+						continue
+					}
+					conn.Write([]byte(response + "\n"))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+// countRequests 统计收到的以 prefix 开头的请求数
+func countRequests(requests <-chan string, prefix string) int {
+	count := 0
+	for {
+		select {
+		case request := <-requests:
+			if strings.HasPrefix(request, prefix) {
+				count++
+			}
+		default:
+			return count
+		}
+	}
+}
+
+func TestConnectStratumServerWithFailover(t *testing.T) {
+	manager, watcher := newUpgradeTestManager(t)
+	setTestSubaccountCoin(watcher, "alice", "btc")
+
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+	session := NewStratumSession(manager, clientConn, 0x01000004)
+
+	// btc 的sserver拒绝认证，bcc 的接受
+	btcURL, btcRequests := startFakeStratumServer(t, session.sessionIDString, false)
+	bccURL, bccRequests := startFakeStratumServer(t, session.sessionIDString, true)
+	manager.stratumServerInfoMap = StratumServerInfoMap{
+		"btc": StratumServerInfo{URL: btcURL, FallbackCoin: "bcc"},
+		"bcc": StratumServerInfo{URL: bccURL},
+	}
+	var err error
+	manager.upstreamDialers, err = NewUpstreamDialers(manager.stratumServerInfoMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 需要5个不同的矿工被拒绝认证，币种才会不可用
+	manager.failover, err = NewFailoverManager(manager.stratumServerInfoMap, nil, 2, 5, 10, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshakeTestSession(t, session,
+		`{"id":1,"method":"mining.subscribe","params":["cgminer/4.10"]}`,
+		`{"id":2,"method":"mining.authorize","params":["alice.rig1","x"]}`)
+	if err := session.getMiningCoin(); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan string, 10)
+	go func() {
+		reader := bufio.NewReader(clientPeer)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				close(responses)
+				return
+			}
+			responses <- string(line)
+		}
+	}()
+
+	if err := session.connectStratumServerWithFailover(); err != nil {
+		t.Fatal(err)
+	}
+	if session.miningCoin != "bcc" || session.failoverFrom != "btc" {
+		t.Errorf("session should fail over to bcc, mining %s, failover from %s", session.miningCoin, session.failoverFrom)
+	}
+	// 每次连接尝试带与不带币种后缀的两个矿工名
+	if n := countRequests(btcRequests, "mining.authorize"); n != 4 {
+		t.Errorf("btc server received %d authorize requests, want 4", n)
+	}
+	if n := countRequests(bccRequests, "mining.authorize"); n != 1 {
+		t.Errorf("bcc server received %d authorize requests, want 1", n)
+	}
+	if !manager.failover.IsHealthy("btc") {
+		t.Error("rejecting one worker should not mark btc unhealthy")
+	}
+
+	// 矿机只收到最终成功的认证响应
+	select {
+	case line := <-responses:
+		if response, err := NewJSONRPCResponse([]byte(line)); err != nil || response.Result != true {
+			t.Errorf("unexpected authorize response: %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no authorize response")
+	}
+	select {
+	case line := <-responses:
+		t.Errorf("unexpected response: %s", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+	session.closeServerConn()
+}
+
+func TestConnectStratumServerWithFailoverRejected(t *testing.T) {
+	manager, watcher := newUpgradeTestManager(t)
+	setTestSubaccountCoin(watcher, "alice", "btc")
+
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+	session := NewStratumSession(manager, clientConn, 0x01000005)
+
+	// 两个币种都拒绝认证
+	btcURL, _ := startFakeStratumServer(t, session.sessionIDString, false)
+	bccURL, _ := startFakeStratumServer(t, session.sessionIDString, false)
+	manager.stratumServerInfoMap = StratumServerInfoMap{
+		"btc": StratumServerInfo{URL: btcURL, FallbackCoin: "bcc"},
+		"bcc": StratumServerInfo{URL: bccURL, FallbackCoin: "btc"},
+	}
+	var err error
+	manager.upstreamDialers, err = NewUpstreamDialers(manager.stratumServerInfoMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.failover, err = NewFailoverManager(manager.stratumServerInfoMap, nil, 2, 5, 10, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshakeTestSession(t, session,
+		`{"id":1,"method":"mining.subscribe","params":["cgminer/4.10"]}`,
+		`{"id":2,"method":"mining.authorize","params":["alice.rig1","x"]}`)
+	if err := session.getMiningCoin(); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan string, 10)
+	go func() {
+		reader := bufio.NewReader(clientPeer)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				close(responses)
+				return
+			}
+			responses <- string(line)
+		}
+	}()
+
+	// 备用币种链绕回原币种后不再重试
+	if err := session.connectStratumServerWithFailover(); err != ErrServerAuthorizeFailed {
+		t.Fatalf("expected authorize failure, got %v", err)
+	}
+
+	// 矿机只收到一次认证失败的响应
+	select {
+	case line := <-responses:
+		if response, err := NewJSONRPCResponse([]byte(line)); err != nil || response.Error == nil {
+			t.Errorf("unexpected authorize response: %s", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no authorize response")
+	}
+	select {
+	case line := <-responses:
+		t.Errorf("unexpected response: %s", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// RegisterHTTPAPI 在默认的HTTP服务上注册管理接口
+// 管理接口与HTTP Debug共用 HTTPDebugListenAddr，仅在 EnableHTTPDebug 开启时可用。
+// 配置了多个监听器（Listeners）时，各监听器的接口路径以 /listeners/<监听器名称> 开头
+func (manager *StratumSessionManager) RegisterHTTPAPI() {
+	prefix := manager.httpPathPrefix()
+	http.HandleFunc(prefix+"/debug/workername", manager.httpParseWorkerName)
+	http.HandleFunc(prefix+"/capture/add", manager.httpAddCaptureRule)
+	http.HandleFunc(prefix+"/capture/remove", manager.httpRemoveCaptureRule)
+	http.HandleFunc(prefix+"/capture/list", manager.httpListCaptureRules)
+	if manager.shareStats != nil {
+		http.HandleFunc(prefix+"/stats/shares", manager.httpShareStats)
+		http.HandleFunc(prefix+"/stats/workers", manager.httpWorkerShareStats)
+	}
+	if manager.mirror != nil {
+		http.HandleFunc(prefix+"/stats/mirror", manager.httpMirrorStats)
+	}
+}
+
+// httpPathPrefix 管理接口的路径前缀
+func (manager *StratumSessionManager) httpPathPrefix() string {
+	if len(manager.name) == 0 {
+		return ""
+	}
+	return "/listeners/" + manager.name
+}
+
+// ListenerInfo 监听器的信息
+type ListenerInfo struct {
+	Name       string
+	ChainType  string
+	ListenAddr string
+	ServerID   uint32
+	// 正在代理及处于握手阶段的会话数
+	Sessions          int
+	HandshakeSessions int
+}
+
+// RegisterListenersHTTPAPI 注册列出所有监听器的接口 /listeners
+func RegisterListenersHTTPAPI(managers []*StratumSessionManager) {
+	http.HandleFunc("/listeners", func(w http.ResponseWriter, req *http.Request) {
+		listeners := make([]ListenerInfo, 0, len(managers))
+		for _, manager := range managers {
+			manager.lock.Lock()
+			listeners = append(listeners, ListenerInfo{
+				Name:              manager.name,
+				ChainType:         manager.chainType.ToString(),
+				ListenAddr:        manager.tcpListenAddr,
+				ServerID:          manager.serverID,
+				Sessions:          len(manager.sessions),
+				HandshakeSessions: len(manager.handshakeSessions),
+			})
+			manager.lock.Unlock()
+		}
+		writeJSON(w, listeners)
+	})
+}
+
+// writeJSON 以JSON格式输出数据
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		glog.Warning("HTTP API: write response failed: ", err)
+	}
+}
+
+// httpShareStats 各币种的share统计（进程启动以来）
+func (manager *StratumSessionManager) httpShareStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, manager.shareStats.Snapshot())
+}
+
+// httpMirrorStats 各币种镜像服务器与主服务器的对比结果（进程启动以来）
+func (manager *StratumSessionManager) httpMirrorStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, manager.mirror.Snapshot())
+}
+
+// httpWorkerShareStats 各在线矿工在各币种的share统计
+// 可用参数 worker 按矿工名前缀过滤，如 /stats/workers?worker=subaccount.
+func (manager *StratumSessionManager) httpWorkerShareStats(w http.ResponseWriter, req *http.Request) {
+	prefix := req.FormValue("worker")
+
+	manager.lock.Lock()
+	var sessions []*StratumSession
+	for _, session := range manager.sessions {
+		if session.shareCounter != nil && strings.HasPrefix(session.fullWorkerName, prefix) {
+			sessions = append(sessions, session)
+		}
+	}
+	manager.lock.Unlock()
+
+	// 同一矿工的多个连接合并统计
+	workers := make(map[string]CoinShareStatsMap)
+	for _, session := range sessions {
+		stats, ok := workers[session.fullWorkerName]
+		if !ok {
+			stats = make(CoinShareStatsMap)
+			workers[session.fullWorkerName] = stats
+		}
+		stats.merge(session.shareCounter.Snapshot())
+	}
+
+	writeJSON(w, workers)
+}
+
+// httpParseWorkerName 展示矿工名的解析过程
+// 参数 name 为矿机认证时发送的矿工名，worker 为以太坊矿机在 worker 字段中单独发送的矿机名（可选），
+// 如 /debug/workername?name=subaccount%2Bworker1
+func (manager *StratumSessionManager) httpParseWorkerName(w http.ResponseWriter, req *http.Request) {
+	stripEthAddr := manager.chainType == ChainTypeEthereum
+	result := manager.workerNameParser.Parse(req.FormValue("name"), req.FormValue("worker"), stripEthAddr, true)
+
+	regularSubAccount := manager.GetRegularSubaccountName(result.SubAccount)
+	writeJSON(w, struct {
+		WorkerNameParseResult
+		RegularSubAccount string
+		FullWorkerName    string
+	}{result, regularSubAccount, regularSubAccount + result.MinerNameWithDot})
+}
+
+// httpAddCaptureRule 添加抓包规则
+// 参数 subaccount、ip、session（8位十六进制的会话ID）至少提供一个，全部满足时抓取会话；
+// limit 为最多抓取的会话数，默认为10。如 /capture/add?subaccount=test&limit=1
+func (manager *StratumSessionManager) httpAddCaptureRule(w http.ResponseWriter, req *http.Request) {
+	limit, _ := strconv.Atoi(req.FormValue("limit"))
+	rule, err := manager.captureManager.AddRule(CaptureRule{
+		SubAccount: req.FormValue("subaccount"),
+		IP:         req.FormValue("ip"),
+		SessionID:  strings.ToLower(req.FormValue("session")),
+		Remaining:  limit,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, rule)
+}
+
+// httpRemoveCaptureRule 删除抓包规则，参数 id 为添加规则时返回的ID
+func (manager *StratumSessionManager) httpRemoveCaptureRule(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 32)
+	if err != nil || !manager.captureManager.RemoveRule(uint32(id)) {
+		http.Error(w, "capture rule not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, true)
+}
+
+// httpListCaptureRules 列出所有抓包规则
+func (manager *StratumSessionManager) httpListCaptureRules(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, manager.captureManager.Rules())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+
+	"github.com/btccom/btcpool-go-modules/health"
+)
+
+// 健康检查服务监听失败（如平滑重启时旧进程尚未退出）后的重试间隔
+const healthListenRetrySeconds = 1
+
+// HealthChecker 提供供编排系统（如Kubernetes）使用的存活检查 /healthz 及就绪检查 /readyz
+// 所有监听器创建完成并开始监听之前，进程不会就绪
+type HealthChecker struct {
+	lock     sync.Mutex
+	managers []*StratumSessionManager
+}
+
+// NewHealthChecker 创建健康检查器
+func NewHealthChecker() *HealthChecker {
+	return new(HealthChecker)
+}
+
+// SetManagers 设置要检查的监听器，在所有监听器创建完成后调用
+func (checker *HealthChecker) SetManagers(managers []*StratumSessionManager) {
+	checker.lock.Lock()
+	checker.managers = managers
+	checker.lock.Unlock()
+}
+
+// RegisterHTTPAPI 在 mux 上注册 /healthz 及 /readyz
+func (checker *HealthChecker) RegisterHTTPAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		// 能够响应HTTP请求即为存活
+		health.WriteStatus(w, health.Status{Status: health.StatusOK})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		health.WriteStatus(w, checker.Check())
+	})
+}
+
+// ListenAndServe 在单独的地址上提供健康检查，不暴露HTTP Debug的其他接口
+// 地址被占用时持续重试，以便平滑重启时在旧进程退出后接管该地址
+func (checker *HealthChecker) ListenAndServe(addr string) {
+	mux := http.NewServeMux()
+	checker.RegisterHTTPAPI(mux)
+
+	glog.Info("Health check enabled: ", addr)
+	for {
+		err := http.ListenAndServe(addr, mux)
+		glog.Warning("Health check listen failed, retry in ", healthListenRetrySeconds, "s: ", err)
+		time.Sleep(healthListenRetrySeconds * time.Second)
+	}
+}
+
+// Check 检查所有监听器是否就绪
+func (checker *HealthChecker) Check() health.Status {
+	checker.lock.Lock()
+	managers := checker.managers
+	checker.lock.Unlock()
+
+	if managers == nil {
+		return health.NewStatus(map[string]error{"listeners": errors.New("starting")})
+	}
+
+	checks := make(map[string]error)
+	for _, manager := range managers {
+		prefix := ""
+		if len(manager.name) > 0 {
+			prefix = manager.name + "/"
+		}
+		for name, err := range manager.checkReadiness() {
+			checks[prefix+name] = err
+		}
+	}
+	return health.NewStatus(checks)
+}
+
+// checkReadiness 检查监听器的依赖，返回各项检查的结果（nil为通过）
+func (manager *StratumSessionManager) checkReadiness() map[string]error {
+	checks := make(map[string]error)
+
+	zkConn := manager.zookeeperManager.zookeeperConn
+	zkConnected := zkConn.State() == zk.StateHasSession
+	if !zkConnected {
+		checks["zookeeper"] = errors.New("zookeeper state: " + zkConn.State().String())
+	} else {
+		checks["zookeeper"] = nil
+	}
+
+	checks["server_id"] = manager.checkServerIDNode(zkConnected)
+
+	manager.lock.Lock()
+	listening, upgrading := manager.listening, manager.upgrading
+	manager.lock.Unlock()
+	if !listening {
+		checks["listener"] = errors.New("not listening")
+	} else if upgrading {
+		checks["listener"] = errors.New("upgrading")
+	} else {
+		checks["listener"] = nil
+	}
+	return checks
+}
+
+// checkServerIDNode 检查服务器ID是否仍被本进程持有
+// 从Zookeeper分配的服务器ID是一个临时节点，Zookeeper会话过期后可能被其他stratumSwitcher占用，导致会话ID重复
+func (manager *StratumSessionManager) checkServerIDNode(zkConnected bool) error {
+	if manager.serverID == 0 {
+		return errors.New("server id not assigned")
+	}
+
+	nodes := manager.getServerIDNodes()
+	if len(nodes) == 0 {
+		// 服务器ID来自配置文件
+		return nil
+	}
+	if !zkConnected {
+		return errors.New("cannot check server id node without zookeeper")
+	}
+
+	zkConn := manager.zookeeperManager.zookeeperConn
+	exists, stat, err := zkConn.Exists(nodes[0])
+	if err != nil {
+		return errors.New("check server id node " + nodes[0] + " failed: " + err.Error())
+	}
+	if !exists {
+		return errors.New("server id node " + nodes[0] + " lost")
+	}
+	if stat.EphemeralOwner != zkConn.SessionID() {
+		return errors.New("server id node " + nodes[0] + " is owned by another zookeeper session")
+	}
+	return nil
+}
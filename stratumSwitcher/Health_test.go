@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btccom/btcpool-go-modules/health"
+)
+
+func TestHealthCheckerNotReadyBeforeListeners(t *testing.T) {
+	mux := http.NewServeMux()
+	NewHealthChecker().RegisterHTTPAPI(mux)
+
+	cases := map[string]struct {
+		code   int
+		status string
+	}{
+		"/healthz": {http.StatusOK, health.StatusOK},
+		"/readyz":  {http.StatusServiceUnavailable, health.StatusUnavailable},
+	}
+	for path, expected := range cases {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+
+		var status health.Status
+		err := json.Unmarshal(recorder.Body.Bytes(), &status)
+		if err != nil {
+			t.Fatal(path, ": ", err)
+		}
+		if recorder.Code != expected.code || status.Status != expected.status {
+			t.Errorf("%s: got %d %s, expected %d %s", path, recorder.Code, status.Status, expected.code, expected.status)
+		}
+	}
+}
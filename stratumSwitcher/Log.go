@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 日志格式
+const (
+	// glog的文本格式（默认）
+	logFormatText = "text"
+	// 每行一个JSON对象，日志带有监听器、会话等上下文字段
+	logFormatJSON = "json"
+)
+
+// 日志级别
+const (
+	logSeverityInfo    = "info"
+	logSeverityWarning = "warning"
+	logSeverityError   = "error"
+	logSeverityFatal   = "fatal"
+)
+
+// JSONLogger 以JSON Lines格式输出日志
+type JSONLogger struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// jsonLogger 开启JSON格式日志时的输出器，为nil时使用glog的文本格式
+var jsonLogger *JSONLogger
+
+// setLogFormat 设置日志格式，启动时调用
+// JSON格式的日志输出到标准错误，不写入glog的日志文件
+func setLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", logFormatText:
+		jsonLogger = nil
+	case logFormatJSON:
+		jsonLogger = &JSONLogger{writer: os.Stderr}
+	default:
+		return fmt.Errorf("unknown log format %q, should be %q or %q", format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// Write 输出一条日志，record 中的 time 字段由该函数填写
+func (logger *JSONLogger) Write(record map[string]interface{}) {
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":  record["time"],
+			"level": logSeverityError,
+			"msg":   "marshal log record failed: " + err.Error(),
+		})
+	}
+	line = append(line, '\n')
+
+	logger.lock.Lock()
+	logger.writer.Write(line)
+	logger.lock.Unlock()
+}
+
+// logFieldValue 转换JSON日志中的字段值，error、time.Duration等类型转为字符串
+func logFieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+// logContext 日志的上下文字段，创建后不再修改，可以在多个goroutine中同时读取
+type logContext struct {
+	// JSON格式时附加的字段
+	fields map[string]interface{}
+	// 文本格式时的消息前缀（如监听器名称）
+	prefix string
+	// 文本格式时依次附加在消息后的字段
+	text []string
+}
+
+// 不属于任何监听器的日志的上下文
+var emptyLogContext = &logContext{}
+
+// listenerLogContext 返回监听器的日志上下文，监听器名称为空时没有上下文字段
+func listenerLogContext(name string) *logContext {
+	if len(name) == 0 {
+		return emptyLogContext
+	}
+	return &logContext{fields: map[string]interface{}{"listener": name}, prefix: listenerLogPrefix(name)}
+}
+
+// writeLog 按日志格式输出一条日志，depth 为从 writeLog 的调用者到输出日志的代码之间的栈帧数
+// keyvals 为附加字段的键值对，如 "new_coin", "bch"
+func writeLog(depth int, context *logContext, severity string, level glog.Level, msg string, keyvals []interface{}) {
+	if jsonLogger != nil {
+		record := make(map[string]interface{}, len(context.fields)+len(keyvals)/2+4)
+		for key, value := range context.fields {
+			record[key] = value
+		}
+		record["level"] = severity
+		record["msg"] = msg
+		if level > 0 {
+			record["v"] = level
+		}
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			record[fmt.Sprint(keyvals[i])] = logFieldValue(keyvals[i+1])
+		}
+		jsonLogger.Write(record)
+		if severity == logSeverityFatal {
+			os.Exit(255)
+		}
+		return
+	}
+
+	// 文本格式：[监听器] 消息: 上下文; 上下文; 键=值; ...
+	var text strings.Builder
+	text.WriteString(context.prefix)
+	text.WriteString(msg)
+	separator := ": "
+	for _, field := range context.text {
+		text.WriteString(separator)
+		text.WriteString(field)
+		separator = "; "
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprint(&text, separator, keyvals[i], "=", keyvals[i+1])
+		separator = "; "
+	}
+
+	switch severity {
+	case logSeverityFatal:
+		glog.FatalDepth(depth+1, text.String())
+	case logSeverityError:
+		glog.ErrorDepth(depth+1, text.String())
+	case logSeverityWarning:
+		glog.WarningDepth(depth+1, text.String())
+	default:
+		glog.InfoDepth(depth+1, text.String())
+	}
+}
+
+// logInfo 输出不属于任何监听器的日志，level 与 glog.V(level) 的含义相同（0为总是输出）
+func logInfo(level glog.Level, msg string, keyvals ...interface{}) {
+	if level > 0 && !glog.V(level) {
+		return
+	}
+	writeLog(1, emptyLogContext, logSeverityInfo, level, msg, keyvals)
+}
+
+// logWarning 输出不属于任何监听器的警告日志
+func logWarning(msg string, keyvals ...interface{}) {
+	writeLog(1, emptyLogContext, logSeverityWarning, 0, msg, keyvals)
+}
+
+// logError 输出不属于任何监听器的错误日志
+func logError(msg string, keyvals ...interface{}) {
+	writeLog(1, emptyLogContext, logSeverityError, 0, msg, keyvals)
+}
+
+// logInfo 输出监听器的日志，带有监听器名称
+func (manager *StratumSessionManager) logInfo(level glog.Level, msg string, keyvals ...interface{}) {
+	if level > 0 && !glog.V(level) {
+		return
+	}
+	writeLog(1, listenerLogContext(manager.name), logSeverityInfo, level, msg, keyvals)
+}
+
+// logWarning 输出监听器的警告日志
+func (manager *StratumSessionManager) logWarning(msg string, keyvals ...interface{}) {
+	writeLog(1, listenerLogContext(manager.name), logSeverityWarning, 0, msg, keyvals)
+}
+
+// logError 输出监听器的错误日志
+func (manager *StratumSessionManager) logError(msg string, keyvals ...interface{}) {
+	writeLog(1, listenerLogContext(manager.name), logSeverityError, 0, msg, keyvals)
+}
+
+// logFatal 输出监听器的错误日志并退出
+func (manager *StratumSessionManager) logFatal(msg string, keyvals ...interface{}) {
+	writeLog(1, listenerLogContext(manager.name), logSeverityFatal, 0, msg, keyvals)
+}
+
+// updateLogContext 根据会话当前的字段生成新的日志上下文
+// 在修改会话ID、协议、子账户、矿工名、币种或重连计数后由修改者调用（修改者持有会话锁或处于握手阶段），
+// 输出日志时只读取该上下文，不需要持有会话锁
+func (session *StratumSession) updateLogContext() {
+	context := &logContext{
+		fields: map[string]interface{}{
+			"session_id": Uint32ToHex(session.sessionID),
+			"ip":         session.clientIPPort,
+			"protocol":   session.protocolType.String(),
+			"reconnect":  session.reconnectCounter,
+		},
+		text: []string{session.clientIPPort},
+	}
+	// 监听器在会话创建时确定，会话停止后 manager 被置为nil，沿用之前的值
+	if old := session.getLogContext(); old != emptyLogContext {
+		context.prefix = old.prefix
+		if listener, ok := old.fields["listener"]; ok {
+			context.fields["listener"] = listener
+		}
+	} else if manager := session.manager; manager != nil {
+		context.prefix = manager.logPrefix()
+		if len(manager.name) > 0 {
+			context.fields["listener"] = manager.name
+		}
+	}
+	if len(session.subaccountName) > 0 {
+		context.fields["subaccount"] = session.subaccountName
+	}
+	if len(session.fullWorkerName) > 0 {
+		context.fields["worker"] = session.fullWorkerName
+		context.text = append(context.text, session.fullWorkerName)
+	}
+	if len(session.miningCoin) > 0 {
+		context.fields["coin"] = session.miningCoin
+		context.text = append(context.text, session.miningCoin)
+	}
+	if session.isBTCAgent {
+		context.fields["btcagent"] = true
+	}
+	session.logContext.Store(context)
+}
+
+// getLogContext 获取会话的日志上下文
+func (session *StratumSession) getLogContext() *logContext {
+	if context, ok := session.logContext.Load().(*logContext); ok {
+		return context
+	}
+	return emptyLogContext
+}
+
+// logInfo 输出会话日志，level 与 glog.V(level) 的含义相同（0为总是输出），因此 -v 参数同样有效
+// keyvals 为附加字段的键值对，如 "new_coin", "bch"
+func (session *StratumSession) logInfo(level glog.Level, msg string, keyvals ...interface{}) {
+	if level > 0 && !glog.V(level) {
+		return
+	}
+	writeLog(1, session.getLogContext(), logSeverityInfo, level, msg, keyvals)
+}
+
+// logWarning 输出会话的警告日志
+func (session *StratumSession) logWarning(msg string, keyvals ...interface{}) {
+	writeLog(1, session.getLogContext(), logSeverityWarning, 0, msg, keyvals)
+}
+
+// logError 输出会话的错误日志
+func (session *StratumSession) logError(msg string, keyvals ...interface{}) {
+	writeLog(1, session.getLogContext(), logSeverityError, 0, msg, keyvals)
+}
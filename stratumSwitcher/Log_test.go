@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestSessionJSONLog(t *testing.T) {
+	defer setLogFormat(logFormatText)
+	if err := setLogFormat("JSON"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	jsonLogger.writer = &buf
+
+	session := &StratumSession{
+		manager:          &StratumSessionManager{name: "btc"},
+		protocolType:     ProtocolEthereumProxy,
+		reconnectCounter: 2,
+		clientIPPort:     "1.2.3.4:5678",
+		sessionID:        0x0a0b0c0d,
+		fullWorkerName:   "alice.rig1",
+		subaccountName:   "alice",
+		miningCoin:       "eth",
+	}
+	session.updateLogContext()
+	session.logWarning("Connect Stratum Server Failed", "error", errors.New("refused"))
+	// 未开启 -v 时不输出
+	session.logInfo(3, "Subscribe Success")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected one JSON line, got %q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"level":      "warning",
+		"msg":        "Connect Stratum Server Failed",
+		"listener":   "btc",
+		"session_id": "0a0b0c0d",
+		"ip":         "1.2.3.4:5678",
+		"subaccount": "alice",
+		"worker":     "alice.rig1",
+		"coin":       "eth",
+		"protocol":   "ethproxy",
+		"reconnect":  float64(2),
+		"error":      "refused",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("%s = %v, expected %v", key, record[key], value)
+		}
+	}
+	if _, ok := record["time"]; !ok {
+		t.Error("time is missing")
+	}
+
+	if err := setLogFormat("xml"); err == nil {
+		t.Error("expected error for unknown log format")
+	}
+}
+
+// readJSONLogs 解析缓冲区中的JSON日志并清空缓冲区
+func readJSONLogs(t *testing.T, buf *bytes.Buffer) (records []map[string]interface{}) {
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var record map[string]interface{}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("invalid JSON log: %v", err)
+		}
+		records = append(records, record)
+	}
+	buf.Reset()
+	return
+}
+
+func TestManagerJSONLog(t *testing.T) {
+	defer setLogFormat(logFormatText)
+	setLogFormat(logFormatJSON)
+	var buf bytes.Buffer
+	jsonLogger.writer = &buf
+
+	manager := &StratumSessionManager{name: "btc"}
+	manager.logWarning("Upgrade Failed, Rolling Back", "error", errors.New("timeout"))
+	logInfo(0, "Switch events: kafka topic loaded", "topic", "switch", "subaccounts", 3)
+
+	records := readJSONLogs(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 JSON lines, got %d", len(records))
+	}
+	if records[0]["listener"] != "btc" || records[0]["level"] != "warning" || records[0]["error"] != "timeout" {
+		t.Errorf("unexpected manager log: %v", records[0])
+	}
+	if _, ok := records[1]["listener"]; ok || records[1]["topic"] != "switch" || records[1]["subaccounts"] != float64(3) {
+		t.Errorf("unexpected log without listener: %v", records[1])
+	}
+}
+
+// 日志只读取上下文快照，与修改会话字段的goroutine并发时没有数据竞争（配合 -race 运行）
+func TestSessionLogContextSnapshot(t *testing.T) {
+	defer setLogFormat(logFormatText)
+	setLogFormat(logFormatJSON)
+	var buf bytes.Buffer
+	jsonLogger.writer = &buf
+
+	session := &StratumSession{
+		manager:    &StratumSessionManager{name: "btc"},
+		miningCoin: "btc",
+	}
+	session.updateLogContext()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			session.logWarning("Switch Coin")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		session.lock.Lock()
+		session.miningCoin = "bcc"
+		session.reconnectCounter++
+		session.updateLogContext()
+		session.lock.Unlock()
+	}
+	<-done
+
+	// 会话停止后 manager 被置为nil，仍保留监听器名称
+	session.manager = nil
+	session.updateLogContext()
+	buf.Reset()
+	session.logWarning("Session Stopped")
+	records := readJSONLogs(t, &buf)
+	if len(records) != 1 || records[0]["listener"] != "btc" || records[0]["coin"] != "bcc" || records[0]["reconnect"] != float64(100) {
+		t.Errorf("unexpected log after updates: %v", records)
+	}
+}
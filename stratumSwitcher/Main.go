@@ -2,19 +2,45 @@ package main
 
 import (
 	"flag"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
 
+// HTTP Debug服务监听失败后重试的间隔
+// 平滑重启时新进程先于旧进程退出启动，需要等待旧进程释放该地址
+const httpDebugListenRetrySeconds = 1
+
 func main() {
 	// 解析命令行参数
 	configFilePath := flag.String("config", "./config.json", "Path of config file")
 	// 不停机升级时保存的运行状态文件
 	runtimeFilePath := flag.String("runtime", "", "Path of runtime file, use for zero downtime upgrade.")
+	// 不停机升级时由旧进程传入，用于接收监听socket及会话
+	upgradeSocketPath := flag.String("upgrade-socket", "", "Unix socket of the old process, use for zero downtime upgrade.")
+	// 以主进程方式运行，不停机升级后pid不变，便于supervisor管理
+	master := flag.Bool("master", false, "Run as a master process whose pid is kept across zero downtime upgrades.")
 	flag.Parse()
 
+	if *master {
+		// 工作进程使用除 -master 以外的相同参数
+		var args []string
+		for _, arg := range os.Args[1:] {
+			name := strings.TrimLeft(arg, "-")
+			if name != "master" && !strings.HasPrefix(name, "master=") {
+				args = append(args, arg)
+			}
+		}
+		exitCode := runMaster(os.Args[0], args)
+		glog.Flush()
+		os.Exit(exitCode)
+	}
+
 	// 读取配置文件
 	var configData ConfigData
 	err := configData.LoadFromFile(*configFilePath)
@@ -24,25 +50,62 @@ func main() {
 		return
 	}
 
-	// 读取运行时状态
-	var runtimeData RuntimeData
+	err = setLogFormat(configData.LogFormat)
+	if err != nil {
+		glog.Fatal("load config failed: ", err)
+		return
+	}
+
+	listeners := configData.ListenerConfigs()
 
-	if len(*runtimeFilePath) > 0 {
-		runtimeData.LoadFromFile(*runtimeFilePath)
+	// 读取运行时状态，与各监听器一一对应
+	runtimeDatas := make([]RuntimeData, len(listeners))
+	var upgradeConn *net.UnixConn
+
+	if len(*upgradeSocketPath) > 0 {
+		runtimeDatas, upgradeConn, err = receiveRuntimeData(*upgradeSocketPath, listeners)
+		if err != nil {
+			glog.Fatal("receive runtime data from old process failed: ", err)
+			return
+		}
+	} else if len(*runtimeFilePath) > 0 {
+		// 兼容由旧版本进程通过exec启动的升级方式，旧版本只有一个监听器
+		runtimeDatas[0] = loadRuntimeFile(*runtimeFilePath, listeners[0].ChainType)
+	}
+
+	// 健康检查，监听器创建完成前 /readyz 返回未就绪
+	healthChecker := NewHealthChecker()
+	healthChecker.RegisterHTTPAPI(http.DefaultServeMux)
+	if len(configData.HealthListenAddr) > 0 {
+		go healthChecker.ListenAndServe(configData.HealthListenAddr)
 	}
 
 	// 开启HTTP Debug
 	if configData.EnableHTTPDebug {
 		go func() {
 			glog.Info("HTTP debug enabled: ", configData.HTTPDebugListenAddr)
-			http.ListenAndServe(configData.HTTPDebugListenAddr, nil)
+			for {
+				err := http.ListenAndServe(configData.HTTPDebugListenAddr, nil)
+				glog.Warning("HTTP debug listen failed, retry in ", httpDebugListenRetrySeconds, "s: ", err)
+				time.Sleep(httpDebugListenRetrySeconds * time.Second)
+			}
 		}()
 	}
 
-	sessionManager, err := NewStratumSessionManager(configData, runtimeData)
-	if err != nil {
-		glog.Fatal("create session manager failed: ", err)
-		return
+	var sessionManagers []*StratumSessionManager
+	for i, listener := range listeners {
+		sessionManager, err := NewStratumSessionManager(listener, runtimeDatas[i])
+		if err != nil {
+			glog.Fatal(listenerLogPrefix(listener.Name), "create session manager failed: ", err)
+			return
+		}
+
+		// 管理接口与HTTP Debug共用同一个HTTP服务
+		sessionManager.RegisterHTTPAPI()
+		sessionManagers = append(sessionManagers, sessionManager)
 	}
-	sessionManager.Run(runtimeData)
+	RegisterListenersHTTPAPI(sessionManagers)
+	healthChecker.SetManagers(sessionManagers)
+
+	RunStratumSwitcher(sessionManagers, runtimeDatas, upgradeConn)
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// 主进程通过该环境变量告知工作进程通知管道的文件描述符
+const masterNotifyFdEnv = "STRATUM_SWITCHER_MASTER_FD"
+
+// 通知管道在工作进程中的文件描述符（exec.Cmd.ExtraFiles 中的第一个）
+const masterNotifyFd = 3
+
+// syscall 包中没有定义 PR_SET_CHILD_SUBREAPER
+const prSetChildSubreaper = 36
+
+// 主进程转发给工作进程的信号
+var masterForwardSignals = []os.Signal{syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP}
+
+var masterNotifyOnce sync.Once
+var masterNotify *os.File
+
+// runMaster 以主进程方式运行：启动工作进程并向其转发信号，返回工作进程的退出码
+// 不停机升级成功后，旧工作进程在退出前将新工作进程的pid写入通知管道，主进程随后转为等待新工作进程。
+// 因此主进程的pid始终不变，可以由supervisor等工具管理
+func runMaster(binPath string, args []string) (exitCode int) {
+	// 旧工作进程退出后由主进程收养新工作进程，主进程才能等待它退出
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0)
+	if errno != 0 {
+		logError("Master: Set Child Subreaper Failed", "error", errno)
+		return 1
+	}
+
+	notifyReader, notifyWriter, err := os.Pipe()
+	if err != nil {
+		logError("Master: Create Notify Pipe Failed", "error", err)
+		return 1
+	}
+	defer notifyReader.Close()
+
+	// 在启动工作进程前开始接收信号，之后收到的信号都会被转发
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, masterForwardSignals...)
+	defer signal.Stop(signals)
+
+	cmd := exec.Command(binPath, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), masterNotifyFdEnv+"="+strconv.Itoa(masterNotifyFd))
+	cmd.ExtraFiles = []*os.File{notifyWriter}
+
+	glog.Info("Master: Start: ", append([]string{binPath}, args...))
+	err = cmd.Start()
+	// 写端只由工作进程持有
+	notifyWriter.Close()
+	if err != nil {
+		logError("Master: Start Worker Failed", "error", err)
+		return 1
+	}
+
+	var lock sync.Mutex
+	workerPid := cmd.Process.Pid
+	// 收到的停止信号，升级期间只发给了旧工作进程，需要补发给新工作进程
+	var stopSignal os.Signal
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				lock.Lock()
+				if sig != syscall.SIGUSR2 {
+					stopSignal = sig
+				}
+				pid := workerPid
+				lock.Unlock()
+
+				logInfo(0, "Master: Forward Signal", "signal", sig, "pid", pid)
+				syscall.Kill(pid, sig.(syscall.Signal))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		lock.Lock()
+		pid := workerPid
+		lock.Unlock()
+
+		var status syscall.WaitStatus
+		_, err = syscall.Wait4(pid, &status, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logError("Master: Wait Worker Failed", "pid", pid, "error", err)
+			return 1
+		}
+
+		// 旧工作进程在退出前写入通知，此时已可读取
+		newPid := readMasterNotify(notifyReader)
+		if newPid == 0 || newPid == pid {
+			exitCode = status.ExitStatus()
+			if status.Signaled() {
+				exitCode = 128 + int(status.Signal())
+			}
+			logInfo(0, "Master: Worker Exited", "pid", pid, "exit_code", exitCode)
+			return
+		}
+
+		lock.Lock()
+		workerPid = newPid
+		sig := stopSignal
+		lock.Unlock()
+
+		logInfo(0, "Master: Worker Upgraded", "old_pid", pid, "new_pid", newPid)
+		if sig != nil {
+			syscall.Kill(newPid, sig.(syscall.Signal))
+		}
+	}
+}
+
+// readMasterNotify 读取通知管道中已有的内容，返回最后通知的新工作进程pid，没有通知时返回0
+func readMasterNotify(reader *os.File) (pid int) {
+	rawReader, err := reader.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	// 管道为非阻塞模式，只读取已写入的内容，不等待
+	var data []byte
+	buf := make([]byte, 256)
+	rawReader.Read(func(fd uintptr) bool {
+		for {
+			n, err := syscall.Read(int(fd), buf)
+			if n <= 0 || err != nil {
+				return true
+			}
+			data = append(data, buf[:n]...)
+		}
+	})
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if newPid, err := strconv.Atoi(strings.TrimSpace(line)); err == nil && newPid > 0 {
+			pid = newPid
+		}
+	}
+	return
+}
+
+// masterNotifyFile 返回主进程传入的通知管道，进程不是由主进程启动时返回nil
+func masterNotifyFile() *os.File {
+	masterNotifyOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(masterNotifyFdEnv))
+		if err != nil || fd < 0 {
+			return
+		}
+		masterNotify = os.NewFile(uintptr(fd), "master notify")
+	})
+	return masterNotify
+}
+
+// notifyMasterUpgraded 旧工作进程在升级成功、退出之前通知主进程改为等待新工作进程
+func notifyMasterUpgraded(pid int) {
+	file := masterNotifyFile()
+	if file == nil {
+		return
+	}
+
+	_, err := file.WriteString(strconv.Itoa(pid) + "\n")
+	if err != nil {
+		logError("Notify Master Failed", "new_pid", pid, "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunMasterExitCode(t *testing.T) {
+	// 工作进程能拿到通知管道，退出码原样返回
+	script := `[ "$` + masterNotifyFdEnv + `" = 3 ] && [ -e /proc/self/fd/3 ] || exit 9; exit 3`
+	if exitCode := runMaster("/bin/sh", []string{"-c", script}); exitCode != 3 {
+		t.Errorf("exit code = %d, want 3", exitCode)
+	}
+}
+
+func TestRunMasterFollowsUpgradedWorker(t *testing.T) {
+	// 旧工作进程启动新工作进程，通知主进程后退出
+	script := `sh -c 'sleep 0.2; exit 5' & echo $! >&3; exit 0`
+	start := time.Now()
+	if exitCode := runMaster("/bin/sh", []string{"-c", script}); exitCode != 5 {
+		t.Errorf("exit code = %d, want 5 from the new worker", exitCode)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("master exited after %v, before the new worker", elapsed)
+	}
+}
+
+func TestRunMasterForwardsSignals(t *testing.T) {
+	ready := filepath.Join(t.TempDir(), "ready")
+	script := `trap 'exit 7' TERM; touch ` + ready + `; sleep 5 & wait`
+
+	result := make(chan int, 1)
+	go func() {
+		result <- runMaster("/bin/sh", []string{"-c", script})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 发给主进程的信号被转发给工作进程
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case exitCode := <-result:
+		if exitCode != 7 {
+			t.Errorf("exit code = %d, want 7", exitCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker not stopped by the forwarded signal")
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// 默认值：配置了 MirrorURL 的币种中进行镜像的会话比例（百分比）
+const defaultMirrorSamplePercent = 10
+
+// 等待主服务器或镜像服务器响应share的最长时间，超时后计为未响应
+var mirrorResponseTimeout = 30 * time.Second
+
+// 检查等待超时的share的间隔
+var mirrorExpireInterval = 5 * time.Second
+
+// 写入镜像服务器的超时时间
+const mirrorWriteTimeout = 10 * time.Second
+
+// 单个会话等待写入镜像服务器的数据行数上限，超出后丢弃新的share（不阻塞主服务器的代理）
+const mirrorQueueSize = 256
+
+// MirrorStats 镜像服务器与主服务器处理share的对比
+type MirrorStats struct {
+	// 进行镜像的会话数（每次切换币种或重连后重新计数）
+	Sessions uint64
+	// 连接镜像服务器失败或镜像连接中途断开的次数
+	ConnectFailures uint64
+	// 复制到镜像服务器的share数
+	Submitted uint64
+	// 镜像服务器写入过慢或已断开，未能复制的share数
+	Dropped uint64
+	// 两者都接受
+	BothAccepted uint64
+	// 两者都拒绝
+	BothRejected uint64
+	// 主服务器接受而镜像服务器拒绝
+	MirrorRejected uint64
+	// 主服务器拒绝而镜像服务器接受
+	MirrorAccepted uint64
+	// 主服务器已响应而镜像服务器未响应（超时或连接断开）
+	MirrorNoResponse uint64
+	// 镜像服务器已响应而主服务器未响应（如在等待期间切换了币种）
+	PrimaryNoResponse uint64
+	// 结果或拒绝原因不一致时的原因对比，键为“主服务器结果 -> 镜像服务器结果”
+	Differences map[string]uint64 `json:",omitempty"`
+	// 平均响应时间（毫秒），从矿机提交share到收到响应
+	PrimaryLatencyMs float64
+	MirrorLatencyMs  float64
+
+	primaryLatencySum   time.Duration
+	primaryLatencyCount uint64
+	mirrorLatencySum    time.Duration
+	mirrorLatencyCount  uint64
+}
+
+// addDifference 记录一次结果不一致
+func (stats *MirrorStats) addDifference(difference string) {
+	if stats.Differences == nil {
+		stats.Differences = make(map[string]uint64)
+	}
+	if _, exists := stats.Differences[difference]; !exists && len(stats.Differences) >= maxRejectReasons {
+		difference = otherRejectReason
+	}
+	stats.Differences[difference]++
+}
+
+// snapshot 获取统计数据的副本并计算平均响应时间
+func (stats *MirrorStats) snapshot() *MirrorStats {
+	snapshot := *stats
+	snapshot.Differences = nil
+	for difference, count := range stats.Differences {
+		if snapshot.Differences == nil {
+			snapshot.Differences = make(map[string]uint64)
+		}
+		snapshot.Differences[difference] = count
+	}
+	if stats.primaryLatencyCount > 0 {
+		snapshot.PrimaryLatencyMs = float64(stats.primaryLatencySum) / float64(stats.primaryLatencyCount) / float64(time.Millisecond)
+	}
+	if stats.mirrorLatencyCount > 0 {
+		snapshot.MirrorLatencyMs = float64(stats.mirrorLatencySum) / float64(stats.mirrorLatencyCount) / float64(time.Millisecond)
+	}
+	return &snapshot
+}
+
+// MirrorManager 将部分会话的流量复制到各币种的镜像服务器（如待上线的新版sserver），
+// 丢弃镜像服务器的响应，只对比其与主服务器对每个share的处理结果及响应时间
+type MirrorManager struct {
+	lock sync.Mutex
+	// 各币种镜像服务器的连接器
+	dialers UpstreamDialerMap
+	// 各币种进行镜像的会话比例（百分比）
+	samplePercents map[string]int
+	// 各币种的对比结果
+	stats map[string]*MirrorStats
+}
+
+// NewMirrorManager 根据各币种的 MirrorURL 创建镜像管理器，没有币种配置镜像服务器时返回nil
+func NewMirrorManager(serverMap StratumServerInfoMap) (mirror *MirrorManager, err error) {
+	dialers := make(UpstreamDialerMap)
+	samplePercents := make(map[string]int)
+	for coin, info := range serverMap {
+		if info.MirrorURL == "" {
+			continue
+		}
+		// 镜像服务器使用与主服务器相同的TLS选项
+		mirrorInfo := info
+		mirrorInfo.URL = info.MirrorURL
+		dialers[coin], err = NewUpstreamDialer(mirrorInfo)
+		if err != nil {
+			return nil, errors.New("mirror server of " + coin + ": " + err.Error())
+		}
+		samplePercents[coin] = info.MirrorSamplePercent
+	}
+	if len(dialers) == 0 {
+		return
+	}
+
+	mirror = new(MirrorManager)
+	mirror.dialers = dialers
+	mirror.samplePercents = samplePercents
+	mirror.stats = make(map[string]*MirrorStats)
+	return
+}
+
+// isSampled 会话是否需要镜像
+// 同一服务器的会话ID是顺序分配的，按其取模即可得到均匀的抽样
+func (mirror *MirrorManager) isSampled(coin string, sessionID uint32) bool {
+	percent, ok := mirror.samplePercents[coin]
+	return ok && int(sessionID%100) < percent
+}
+
+// update 修改币种的对比结果
+func (mirror *MirrorManager) update(coin string, fn func(stats *MirrorStats)) {
+	mirror.lock.Lock()
+	stats, ok := mirror.stats[coin]
+	if !ok {
+		stats = new(MirrorStats)
+		mirror.stats[coin] = stats
+	}
+	fn(stats)
+	mirror.lock.Unlock()
+}
+
+// Snapshot 获取各币种对比结果的副本
+func (mirror *MirrorManager) Snapshot() map[string]*MirrorStats {
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+
+	snapshot := make(map[string]*MirrorStats, len(mirror.stats))
+	for coin, stats := range mirror.stats {
+		snapshot[coin] = stats.snapshot()
+	}
+	return snapshot
+}
+
+// mirrorShareResult 一个share在一台服务器上的处理结果
+type mirrorShareResult struct {
+	done     bool
+	accepted bool
+	reason   string
+	latency  time.Duration
+}
+
+// String 用于记录结果不一致的原因
+func (result *mirrorShareResult) String() string {
+	switch {
+	case !result.done:
+		return "no response"
+	case result.accepted:
+		return "accepted"
+	}
+	return result.reason
+}
+
+// mirrorShare 等待对比的share
+type mirrorShare struct {
+	submitTime time.Time
+	primary    mirrorShareResult
+	mirror     mirrorShareResult
+}
+
+// SessionMirror 一个会话在当前币种上的镜像连接
+// 连接镜像服务器后重放会话向主服务器发送的握手请求（订阅、认证等），此后只复制矿机提交的share
+type SessionMirror struct {
+	session *StratumSession
+	manager *MirrorManager
+	coin    string
+	dialer  *UpstreamDialer
+
+	// 会话向主服务器发送的握手请求
+	handshake [][]byte
+	// 已重放、尚未收到镜像服务器响应的握手请求，ID -> 请求数
+	// 握手请求的ID可能与之后的share相同，其响应需要丢弃
+	handshakeIDs map[string]int
+	// 等待写入镜像服务器的share
+	queue chan []byte
+	// 关闭镜像时关闭
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock sync.Mutex
+	conn net.Conn
+	// 镜像连接已断开，不再复制share
+	broken bool
+	// 等待对比的share，ID -> share
+	pending map[string]*mirrorShare
+}
+
+// Start 若会话需要镜像，则创建镜像连接并在后台连接镜像服务器，否则返回nil
+// handshake 为会话向主服务器发送的握手请求，将原样重放给镜像服务器
+func (mirror *MirrorManager) Start(session *StratumSession, coin string, handshake [][]byte) *SessionMirror {
+	if len(handshake) == 0 || !mirror.isSampled(coin, session.sessionID) {
+		return nil
+	}
+
+	sessionMirror := &SessionMirror{
+		session:      session,
+		manager:      mirror,
+		coin:         coin,
+		dialer:       mirror.dialers[coin],
+		handshake:    handshake,
+		handshakeIDs: make(map[string]int),
+		queue:        make(chan []byte, mirrorQueueSize),
+		closed:       make(chan struct{}),
+		pending:      make(map[string]*mirrorShare),
+	}
+	mirror.update(coin, func(stats *MirrorStats) {
+		stats.Sessions++
+	})
+	go sessionMirror.run()
+	return sessionMirror
+}
+
+// run 连接镜像服务器，重放握手请求，然后持续写入share，并定期对比等待超时的share
+// 镜像连接失败或断开后不再写入，但仍继续检查超时，直到镜像被关闭
+func (sessionMirror *SessionMirror) run() {
+	expireTicker := time.NewTicker(mirrorExpireInterval)
+	defer expireTicker.Stop()
+
+	var queue <-chan []byte
+	conn := sessionMirror.connect()
+	if conn != nil {
+		queue = sessionMirror.queue
+	}
+
+	for {
+		select {
+		case line := <-queue:
+			if !sessionMirror.write(conn, line) {
+				queue = nil
+			}
+		case now := <-expireTicker.C:
+			sessionMirror.lock.Lock()
+			sessionMirror.expireNonLock(now.Add(-mirrorResponseTimeout))
+			sessionMirror.lock.Unlock()
+		case <-sessionMirror.closed:
+			return
+		}
+	}
+}
+
+// connect 连接镜像服务器并重放握手请求，失败或镜像已关闭时返回nil
+func (sessionMirror *SessionMirror) connect() net.Conn {
+	conn, err := sessionMirror.dialer.Dial(upstreamDialTimeoutSeconds * time.Second)
+	if err != nil {
+		sessionMirror.session.logInfo(2, "Connect Mirror Server Failed", "server", sessionMirror.dialer.URL, "error", err)
+		sessionMirror.fail()
+		return nil
+	}
+
+	sessionMirror.lock.Lock()
+	select {
+	case <-sessionMirror.closed:
+		sessionMirror.lock.Unlock()
+		conn.Close()
+		return nil
+	default:
+	}
+	sessionMirror.conn = conn
+	// 在读取响应之前记录握手请求的ID
+	for _, line := range sessionMirror.handshake {
+		request, err := NewJSONRPCRequest(line)
+		if err == nil && request.ID != nil {
+			sessionMirror.handshakeIDs[shareIDKey(request.ID)]++
+		}
+	}
+	sessionMirror.lock.Unlock()
+
+	go sessionMirror.readResponses(conn)
+
+	for _, line := range sessionMirror.handshake {
+		if !sessionMirror.write(conn, line) {
+			return nil
+		}
+	}
+	sessionMirror.session.logInfo(3, "Mirror Started", "server", sessionMirror.dialer.URL)
+	return conn
+}
+
+// write 向镜像服务器写入一行数据，失败时中止镜像
+func (sessionMirror *SessionMirror) write(conn net.Conn, line []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(mirrorWriteTimeout))
+	_, err := conn.Write(line)
+	if err != nil {
+		select {
+		case <-sessionMirror.closed:
+		default:
+			sessionMirror.session.logInfo(2, "Write Mirror Server Failed", "error", err)
+		}
+		sessionMirror.fail()
+		return false
+	}
+	return true
+}
+
+// readResponses 读取镜像服务器的响应，只记录share的处理结果，其他内容（任务、握手响应等）全部丢弃
+func (sessionMirror *SessionMirror) readResponses(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, bufioReaderBufSize)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			select {
+			case <-sessionMirror.closed:
+			default:
+				sessionMirror.session.logInfo(2, "Mirror Server Disconnected", "error", err)
+				sessionMirror.fail()
+			}
+			return
+		}
+		sessionMirror.onResponse(line, false)
+	}
+}
+
+// fail 镜像连接失败或断开，此后不再复制share
+func (sessionMirror *SessionMirror) fail() {
+	sessionMirror.lock.Lock()
+	alreadyBroken := sessionMirror.broken
+	sessionMirror.broken = true
+	sessionMirror.lock.Unlock()
+
+	select {
+	case <-sessionMirror.closed:
+		// 关闭镜像导致的连接断开不计为失败
+		return
+	default:
+	}
+	if !alreadyBroken {
+		sessionMirror.manager.update(sessionMirror.coin, func(stats *MirrorStats) {
+			stats.ConnectFailures++
+		})
+	}
+}
+
+// onClientLine 处理矿机发给主服务器的一行数据，若为share提交则复制到镜像服务器
+func (sessionMirror *SessionMirror) onClientLine(line []byte) {
+	request := parseShareSubmit(line)
+	if request == nil {
+		return
+	}
+	now := time.Now()
+
+	sessionMirror.lock.Lock()
+	select {
+	case <-sessionMirror.closed:
+		// 已切换币种或会话已停止
+		sessionMirror.lock.Unlock()
+		return
+	default:
+	}
+	if sessionMirror.broken {
+		sessionMirror.lock.Unlock()
+		sessionMirror.manager.update(sessionMirror.coin, func(stats *MirrorStats) {
+			stats.Dropped++
+		})
+		return
+	}
+
+	// 复制一份，sniffer会重用其缓冲区
+	data := make([]byte, len(line)+1)
+	copy(data, line)
+	data[len(line)] = '\n'
+
+	select {
+	case sessionMirror.queue <- data:
+		sessionMirror.pending[shareIDKey(request.ID)] = &mirrorShare{submitTime: now}
+		sessionMirror.lock.Unlock()
+		sessionMirror.manager.update(sessionMirror.coin, func(stats *MirrorStats) {
+			stats.Submitted++
+		})
+	default:
+		sessionMirror.lock.Unlock()
+		sessionMirror.manager.update(sessionMirror.coin, func(stats *MirrorStats) {
+			stats.Dropped++
+		})
+	}
+}
+
+// onPrimaryLine 处理主服务器发给矿机的一行数据
+func (sessionMirror *SessionMirror) onPrimaryLine(line []byte) {
+	sessionMirror.onResponse(line, true)
+}
+
+// onResponse 记录主服务器或镜像服务器对share的响应，两者都响应后进行对比
+func (sessionMirror *SessionMirror) onResponse(line []byte, fromPrimary bool) {
+	// 服务器推送的通知不是share的响应
+	if bytes.Contains(line, []byte(`"method"`)) {
+		return
+	}
+	response, err := NewJSONRPCResponse(line)
+	if err != nil || response.ID == nil {
+		return
+	}
+	now := time.Now()
+
+	sessionMirror.lock.Lock()
+	key := shareIDKey(response.ID)
+	// 镜像服务器对重放的握手请求的响应，与主服务器无关
+	if count := sessionMirror.handshakeIDs[key]; !fromPrimary && count > 0 {
+		if count > 1 {
+			sessionMirror.handshakeIDs[key] = count - 1
+		} else {
+			delete(sessionMirror.handshakeIDs, key)
+		}
+		sessionMirror.lock.Unlock()
+		return
+	}
+	share, ok := sessionMirror.pending[key]
+	if !ok {
+		sessionMirror.lock.Unlock()
+		return
+	}
+
+	result := &share.mirror
+	if fromPrimary {
+		result = &share.primary
+	}
+	if result.done {
+		sessionMirror.lock.Unlock()
+		return
+	}
+	result.done = true
+	result.latency = now.Sub(share.submitTime)
+	if accepted, ok := response.Result.(bool); ok && accepted && response.Error == nil {
+		result.accepted = true
+	} else {
+		_, result.reason = parseShareError(response.Error)
+	}
+
+	if share.primary.done && share.mirror.done {
+		delete(sessionMirror.pending, key)
+		sessionMirror.lock.Unlock()
+		sessionMirror.compare(share)
+		return
+	}
+	sessionMirror.lock.Unlock()
+}
+
+// expireNonLock 对比在 deadline 之前提交、仍有一方未响应的share（无锁）
+func (sessionMirror *SessionMirror) expireNonLock(deadline time.Time) {
+	for key, share := range sessionMirror.pending {
+		if share.submitTime.Before(deadline) {
+			delete(sessionMirror.pending, key)
+			sessionMirror.compare(share)
+		}
+	}
+}
+
+// compare 对比一个share在主服务器及镜像服务器上的处理结果
+func (sessionMirror *SessionMirror) compare(share *mirrorShare) {
+	primary, mirror := &share.primary, &share.mirror
+	same := primary.done && mirror.done && primary.accepted == mirror.accepted &&
+		(primary.accepted || primary.reason == mirror.reason)
+
+	sessionMirror.manager.update(sessionMirror.coin, func(stats *MirrorStats) {
+		switch {
+		case !primary.done && !mirror.done:
+			stats.PrimaryNoResponse++
+			stats.MirrorNoResponse++
+		case !primary.done:
+			stats.PrimaryNoResponse++
+		case !mirror.done:
+			stats.MirrorNoResponse++
+		case primary.accepted && mirror.accepted:
+			stats.BothAccepted++
+		case primary.accepted:
+			stats.MirrorRejected++
+		case mirror.accepted:
+			stats.MirrorAccepted++
+		default:
+			stats.BothRejected++
+		}
+		if primary.done {
+			stats.primaryLatencySum += primary.latency
+			stats.primaryLatencyCount++
+		}
+		if mirror.done {
+			stats.mirrorLatencySum += mirror.latency
+			stats.mirrorLatencyCount++
+		}
+		if !same {
+			stats.addDifference(primary.String() + " -> " + mirror.String())
+		}
+	})
+
+	if !same {
+		sessionMirror.session.logInfo(2, "Mirror Share Mismatch", "mirror_coin", sessionMirror.coin,
+			"primary_result", primary.String(), "mirror_result", mirror.String(),
+			"primary_latency", primary.latency, "mirror_latency", mirror.latency)
+	}
+}
+
+// Close 关闭镜像连接，对比所有仍在等待的share（切换币种、重连或会话停止时调用）
+func (sessionMirror *SessionMirror) Close() {
+	sessionMirror.closeOnce.Do(func() {
+		sessionMirror.lock.Lock()
+		close(sessionMirror.closed)
+		if sessionMirror.conn != nil {
+			sessionMirror.conn.Close()
+		}
+		pending := sessionMirror.pending
+		sessionMirror.pending = make(map[string]*mirrorShare)
+		sessionMirror.lock.Unlock()
+
+		for _, share := range pending {
+			sessionMirror.compare(share)
+		}
+	})
+}
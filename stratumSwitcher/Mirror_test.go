@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewMirrorManager(t *testing.T) {
+	mirror, err := NewMirrorManager(StratumServerInfoMap{"btc": StratumServerInfo{URL: "127.0.0.1:3333"}})
+	if err != nil || mirror != nil {
+		t.Errorf("expected nil manager without MirrorURL, got %v, %v", mirror, err)
+	}
+
+	serverMap := StratumServerInfoMap{
+		"btc": StratumServerInfo{URL: "127.0.0.1:3333", MirrorURL: "127.0.0.1:4333", MirrorSamplePercent: 10},
+		"bch": StratumServerInfo{URL: "127.0.0.1:3334"},
+	}
+	mirror, err = NewMirrorManager(serverMap)
+	if err != nil || mirror == nil {
+		t.Fatalf("NewMirrorManager returned %v, %v", mirror, err)
+	}
+
+	for _, test := range []struct {
+		coin      string
+		sessionID uint32
+		sampled   bool
+	}{
+		// 0x01000054 % 100 == 0
+		{"btc", 0x01000054, true},
+		{"btc", 0x0100005d, true},
+		{"btc", 0x0100005e, false},
+		{"btc", 0x01000053, false},
+		{"bch", 0x01000054, false},
+	} {
+		if sampled := mirror.isSampled(test.coin, test.sessionID); sampled != test.sampled {
+			t.Errorf("isSampled(%s, %08x) = %v, want %v", test.coin, test.sessionID, sampled, test.sampled)
+		}
+	}
+}
+
+func TestSessionMirrorCompare(t *testing.T) {
+	mirror := &MirrorManager{stats: make(map[string]*MirrorStats)}
+	// 不启动 run()，只测试响应的对比
+	sessionMirror := &SessionMirror{
+		session: &StratumSession{clientIPPort: "1.2.3.4:5678"},
+		manager: mirror,
+		coin:    "btc",
+		queue:   make(chan []byte, mirrorQueueSize),
+		closed:  make(chan struct{}),
+		pending: make(map[string]*mirrorShare),
+	}
+
+	sessionMirror.onClientLine([]byte(`{"id":1,"method":"mining.submit","params":["a.b","1","0","5e000000","00000001"]}`))
+	sessionMirror.onClientLine([]byte(`{"id":2,"method":"mining.submit","params":["a.b","1","0","5e000000","00000002"]}`))
+	sessionMirror.onClientLine([]byte(`{"id":3,"method":"mining.submit","params":["a.b","1","0","5e000000","00000003"]}`))
+	sessionMirror.onClientLine([]byte(`{"id":4,"method":"mining.submit","params":["a.b","1","0","5e000000","00000004"]}`))
+	// 不是share
+	sessionMirror.onClientLine([]byte(`{"id":5,"method":"mining.suggest_difficulty","params":[1024]}`))
+	if len(sessionMirror.queue) != 4 {
+		t.Fatalf("expected 4 shares queued, got %d", len(sessionMirror.queue))
+	}
+	if line := <-sessionMirror.queue; line[len(line)-1] != '\n' {
+		t.Errorf("queued line should end with newline: %q", line)
+	}
+
+	// 1: 两者都接受
+	sessionMirror.onPrimaryLine([]byte(`{"id":1,"result":true,"error":null}`))
+	sessionMirror.onResponse([]byte(`{"id":1,"result":true,"error":null}`), false)
+	// 2: 主服务器接受，镜像服务器拒绝
+	sessionMirror.onPrimaryLine([]byte(`{"id":2,"result":true,"error":null}`))
+	sessionMirror.onResponse([]byte(`{"id":2,"result":null,"error":[23,"Low difficulty share",null]}`), false)
+	// 3: 两者以相同原因拒绝
+	sessionMirror.onPrimaryLine([]byte(`{"id":3,"result":null,"error":[21,"Job not found",null]}`))
+	sessionMirror.onResponse([]byte(`{"id":3,"result":null,"error":[21,"Job not found",null]}`), false)
+	// 4: 镜像服务器未响应，任务通知被忽略
+	sessionMirror.onPrimaryLine([]byte(`{"id":null,"method":"mining.notify","params":[]}`))
+	sessionMirror.onPrimaryLine([]byte(`{"id":4,"result":true,"error":null}`))
+	sessionMirror.Close()
+
+	// 关闭后不再复制
+	sessionMirror.onClientLine([]byte(`{"id":6,"method":"mining.submit","params":["a.b","1","0","5e000000","00000006"]}`))
+
+	stats := mirror.Snapshot()["btc"]
+	if stats == nil {
+		t.Fatal("no stats for btc")
+	}
+	if stats.Submitted != 4 || stats.BothAccepted != 1 || stats.MirrorRejected != 1 ||
+		stats.BothRejected != 1 || stats.MirrorNoResponse != 1 || stats.PrimaryNoResponse != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	expected := map[string]uint64{
+		"accepted -> Low difficulty share": 1,
+		"accepted -> no response":          1,
+	}
+	if len(stats.Differences) != len(expected) {
+		t.Errorf("Differences = %v, want %v", stats.Differences, expected)
+	}
+	for difference, count := range expected {
+		if stats.Differences[difference] != count {
+			t.Errorf("Differences[%q] = %d, want %d", difference, stats.Differences[difference], count)
+		}
+	}
+}
+
+// waitMirrorStats 等待币种的对比结果满足条件
+func waitMirrorStats(t *testing.T, mirror *MirrorManager, coin string, condition func(stats *MirrorStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := mirror.Snapshot()[coin]
+		if stats != nil && condition(stats) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats of %s: %+v", coin, stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionMirrorRun(t *testing.T) {
+	oldTimeout, oldInterval := mirrorResponseTimeout, mirrorExpireInterval
+	mirrorResponseTimeout, mirrorExpireInterval = 100*time.Millisecond, 10*time.Millisecond
+	defer func() { mirrorResponseTimeout, mirrorExpireInterval = oldTimeout, oldInterval }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	mirror, err := NewMirrorManager(StratumServerInfoMap{
+		"btc": StratumServerInfo{URL: "127.0.0.1:3333", MirrorURL: listener.Addr().String(), MirrorSamplePercent: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := [][]byte{
+		[]byte("{\"id\":1,\"method\":\"mining.subscribe\",\"params\":[]}\n"),
+		[]byte("{\"id\":2,\"method\":\"mining.authorize\",\"params\":[\"a.b\",\"x\"]}\n"),
+	}
+	sessionMirror := mirror.Start(&StratumSession{sessionID: 0x01000001}, "btc", handshake)
+	if sessionMirror == nil {
+		t.Fatal("session should be mirrored")
+	}
+	defer sessionMirror.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	readLines := func(count int) {
+		for i := 0; i < count; i++ {
+			if _, err := reader.ReadBytes('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	readLines(len(handshake))
+
+	// share的ID与重放的认证请求相同
+	sessionMirror.onClientLine([]byte(`{"id":2,"method":"mining.submit","params":["a.b","1","0","5e000000","00000002"]}`))
+	sessionMirror.onClientLine([]byte(`{"id":3,"method":"mining.submit","params":["a.b","1","0","5e000000","00000003"]}`))
+	readLines(2)
+
+	// 镜像服务器对认证请求的响应被丢弃，不作为share的响应
+	sessionMirror.onPrimaryLine([]byte(`{"id":2,"result":true,"error":null}`))
+	conn.Write([]byte("{\"id\":1,\"result\":[[],\"01000001\",4],\"error\":null}\n"))
+	conn.Write([]byte("{\"id\":2,\"result\":true,\"error\":null}\n"))
+	conn.Write([]byte("{\"id\":2,\"result\":null,\"error\":[23,\"Low difficulty share\",null]}\n"))
+	waitMirrorStats(t, mirror, "btc", func(stats *MirrorStats) bool {
+		return stats.MirrorRejected == 1
+	})
+
+	// 两者都未响应的share由定时器对比，不需要等待下一个share或关闭镜像
+	waitMirrorStats(t, mirror, "btc", func(stats *MirrorStats) bool {
+		return stats.PrimaryNoResponse == 1 && stats.MirrorNoResponse == 1
+	})
+
+	stats := mirror.Snapshot()["btc"]
+	if stats.Sessions != 1 || stats.Submitted != 2 || stats.BothAccepted != 0 || stats.ConnectFailures != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// 读取最低难度失败（如节点尚不存在）后重试的间隔
+var niceHashWatchRetryInterval = zookeeperConnAliveTimeout * time.Second
+
+// NiceHashDifficultyWatcher 监控 initNiceHash 写入Zookeeper的各算法的最低难度
+// 节点路径为 <ZKNiceHashDir><算法名>/min_difficulty
+type NiceHashDifficultyWatcher struct {
+	lock sync.RWMutex
+	// 算法名 -> 最低难度
+	minDifficulty map[string]uint64
+
+	zookeeperConn ZookeeperConn
+	dir           string
+}
+
+// NewNiceHashDifficultyWatcher 创建最低难度监控器并开始监控指定的算法
+func NewNiceHashDifficultyWatcher(zookeeperConn ZookeeperConn, dir string, algorithms []string) *NiceHashDifficultyWatcher {
+	watcher := new(NiceHashDifficultyWatcher)
+	watcher.minDifficulty = make(map[string]uint64)
+	watcher.zookeeperConn = zookeeperConn
+	watcher.dir = dir
+
+	for _, algorithm := range algorithms {
+		go watcher.watch(algorithm)
+	}
+	return watcher
+}
+
+// Get 获取算法的最低难度，未知时返回0
+func (watcher *NiceHashDifficultyWatcher) Get(algorithm string) uint64 {
+	watcher.lock.RLock()
+	defer watcher.lock.RUnlock()
+
+	return watcher.minDifficulty[algorithm]
+}
+
+// watch 监控一个算法的最低难度
+func (watcher *NiceHashDifficultyWatcher) watch(algorithm string) {
+	path := watcher.dir + algorithm + "/min_difficulty"
+
+	for {
+		data, _, event, err := watcher.zookeeperConn.GetW(path)
+		if err != nil {
+			// 节点被删除后最低难度未知，不再使用旧值
+			if err == zk.ErrNoNode {
+				watcher.set(algorithm, 0)
+			}
+			glog.Error("Read NiceHash min difficulty failed, sleep ", niceHashWatchRetryInterval, ": ", path, "; ", err)
+			time.Sleep(niceHashWatchRetryInterval)
+			continue
+		}
+
+		minDifficulty, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			glog.Error("Invalid NiceHash min difficulty: ", path, "; ", string(data))
+		} else {
+			watcher.set(algorithm, minDifficulty)
+			glog.Info("NiceHash min difficulty of ", algorithm, ": ", minDifficulty)
+		}
+
+		<-event
+	}
+}
+
+// set 设置算法的最低难度，为0表示未知
+func (watcher *NiceHashDifficultyWatcher) set(algorithm string, minDifficulty uint64) {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	if minDifficulty == 0 {
+		delete(watcher.minDifficulty, algorithm)
+		return
+	}
+	watcher.minDifficulty[algorithm] = minDifficulty
+}
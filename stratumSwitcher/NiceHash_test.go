@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitNiceHashMinDifficulty 等待算法的最低难度变为期望值
+func waitNiceHashMinDifficulty(t *testing.T, watcher *NiceHashDifficultyWatcher, algorithm string, expected uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for watcher.Get(algorithm) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("min difficulty of %s = %d, want %d", algorithm, watcher.Get(algorithm), expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNiceHashDifficultyWatcher(t *testing.T) {
+	oldInterval := niceHashWatchRetryInterval
+	niceHashWatchRetryInterval = 10 * time.Millisecond
+	defer func() { niceHashWatchRetryInterval = oldInterval }()
+
+	const path = "/nicehash/sha256/min_difficulty"
+	conn := newFakeZookeeperConn(1)
+	conn.setNode("/nicehash/scrypt/min_difficulty", "65536", 0)
+
+	// 节点尚不存在时最低难度未知，之后重试读取
+	watcher := NewNiceHashDifficultyWatcher(conn, "/nicehash/", []string{"sha256", "scrypt"})
+	waitNiceHashMinDifficulty(t, watcher, "scrypt", 65536)
+	if difficulty := watcher.Get("sha256"); difficulty != 0 {
+		t.Errorf("min difficulty of sha256 = %d before the node is created", difficulty)
+	}
+
+	conn.setNode(path, "500000\n", 0)
+	waitNiceHashMinDifficulty(t, watcher, "sha256", 500000)
+
+	// 节点修改后通过监控立即更新
+	conn.setNode(path, "1000000", 0)
+	waitNiceHashMinDifficulty(t, watcher, "sha256", 1000000)
+
+	// 无效的值被忽略，保留原来的最低难度
+	conn.setNode(path, "abc", 0)
+	for conn.watchCount(path) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if difficulty := watcher.Get("sha256"); difficulty != 1000000 {
+		t.Errorf("invalid min difficulty should be ignored, got %d", difficulty)
+	}
+
+	// 节点被删除后最低难度未知，重新创建后恢复
+	conn.deleteNode(path)
+	waitNiceHashMinDifficulty(t, watcher, "sha256", 0)
+	conn.setNode(path, "2000000", 0)
+	waitNiceHashMinDifficulty(t, watcher, "sha256", 2000000)
+
+	if difficulty := watcher.Get("scrypt"); difficulty != 65536 {
+		t.Errorf("other algorithms should not be affected, got %d", difficulty)
+	}
+	// 等待重新设置监控，之后不再读取重试间隔
+	for conn.watchCount(path) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// 默认的会话目录发布间隔
+const defaultSessionDirIntervalSeconds = 30
+
+// 会话目录节点的大小上限（Zookeeper默认的 jute.maxbuffer 为1MB）
+const sessionDirectoryMaxBytes = 1000 * 1000
+
+// SessionDirectoryData 会话目录，即本机各子账户在各币种上的连接数
+// 发布在 <ZKSessionDirectoryDir><serverID> 临时节点中，配置了多个监听器时为 <ZKSessionDirectoryDir><serverID>-<监听器名称>
+type SessionDirectoryData struct {
+	ServerID  uint32
+	HostName  string
+	UpdatedAt int64
+	// 监听器名称（只有一个监听器时为空）
+	Listener string `json:",omitempty"`
+	// 本机的会话总数
+	Sessions int
+	// 节点大小超出上限，连接数较少的子账户被省略
+	Truncated bool `json:",omitempty"`
+	// 子账户名 -> 币种 -> 连接数
+	SubAccounts map[string]map[string]int
+}
+
+// runSessionDirectory 定期发布会话目录
+func (manager *StratumSessionManager) runSessionDirectory() {
+	manager.logInfo(0, "Publish session directory", "path", manager.sessionDirectoryPath, "interval", manager.sessionDirectoryInterval)
+
+	for {
+		// 升级时会话已移交给新进程，由新进程发布
+		if !manager.isUpgrading() {
+			err := manager.publishSessionDirectory()
+			if err != nil {
+				manager.logError("Publish session directory failed", "error", err)
+			}
+		}
+		time.Sleep(manager.sessionDirectoryInterval)
+	}
+}
+
+// publishSessionDirectory 统计并写入会话目录
+func (manager *StratumSessionManager) publishSessionDirectory() error {
+	data := manager.collectSessionDirectory()
+	dataJSON := marshalSessionDirectory(&data)
+
+	zkConn := manager.zookeeperManager.zookeeperConn
+	_, err := zkConn.Set(manager.sessionDirectoryPath, dataJSON, -1)
+	if err == zk.ErrNoNode {
+		// 首次发布，或Zookeeper会话过期导致临时节点被删除
+		_, err = zkConn.Create(manager.sessionDirectoryPath, dataJSON, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	}
+	return err
+}
+
+// collectSessionDirectory 统计各子账户在各币种上的连接数
+func (manager *StratumSessionManager) collectSessionDirectory() (data SessionDirectoryData) {
+	manager.lock.Lock()
+	sessions := make([]*StratumSession, 0, len(manager.sessions))
+	for _, session := range manager.sessions {
+		sessions = append(sessions, session)
+	}
+	manager.lock.Unlock()
+
+	data.ServerID = manager.serverID
+	data.Listener = manager.name
+	data.HostName, _ = os.Hostname()
+	data.UpdatedAt = time.Now().Unix()
+	data.SubAccounts = make(map[string]map[string]int)
+
+	for _, session := range sessions {
+		subAccount, coin := session.getSubaccountAndCoin()
+		coins, ok := data.SubAccounts[subAccount]
+		if !ok {
+			coins = make(map[string]int)
+			data.SubAccounts[subAccount] = coins
+		}
+		coins[coin]++
+		data.Sessions++
+	}
+	return
+}
+
+// marshalSessionDirectory 序列化会话目录，超出大小上限时省略连接数较少的子账户
+func marshalSessionDirectory(data *SessionDirectoryData) []byte {
+	dataJSON, _ := json.Marshal(data)
+	if len(dataJSON) <= sessionDirectoryMaxBytes {
+		return dataJSON
+	}
+
+	type subAccountSessions struct {
+		name     string
+		sessions int
+	}
+	list := make([]subAccountSessions, 0, len(data.SubAccounts))
+	for name, coins := range data.SubAccounts {
+		total := 0
+		for _, num := range coins {
+			total += num
+		}
+		list = append(list, subAccountSessions{name, total})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].sessions != list[j].sessions {
+			return list[i].sessions > list[j].sessions
+		}
+		return list[i].name < list[j].name
+	})
+
+	// 预留给其他字段的空间
+	size := len(dataJSON) - len(mustMarshal(data.SubAccounts)) + 64
+	subAccounts := make(map[string]map[string]int)
+	for _, item := range list {
+		coins := data.SubAccounts[item.name]
+		// "name":{...},
+		itemSize := len(mustMarshal(item.name)) + len(mustMarshal(coins)) + 2
+		if size+itemSize > sessionDirectoryMaxBytes {
+			break
+		}
+		size += itemSize
+		subAccounts[item.name] = coins
+	}
+
+	logWarning("Session directory too large", "published", len(subAccounts), "subaccounts", len(data.SubAccounts))
+	data.SubAccounts = subAccounts
+	data.Truncated = true
+	dataJSON, _ = json.Marshal(data)
+	return dataJSON
+}
+
+// mustMarshal 序列化不会失败的数据
+func mustMarshal(v interface{}) []byte {
+	dataJSON, _ := json.Marshal(v)
+	return dataJSON
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestMarshalSessionDirectory(t *testing.T) {
+	data := SessionDirectoryData{ServerID: 1, SubAccounts: make(map[string]map[string]int)}
+	for i := 0; i < 100000; i++ {
+		data.SubAccounts[fmt.Sprintf("subaccount%06d", i)] = map[string]int{"btc": 1}
+	}
+	data.SubAccounts["large"] = map[string]int{"btc": 100, "bcc": 5}
+
+	dataJSON := marshalSessionDirectory(&data)
+	if len(dataJSON) > sessionDirectoryMaxBytes {
+		t.Fatalf("size %d exceeds limit", len(dataJSON))
+	}
+
+	var result SessionDirectoryData
+	err := json.Unmarshal(dataJSON, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Truncated || len(result.SubAccounts) >= 100001 {
+		t.Errorf("session directory should be truncated")
+	}
+	if result.SubAccounts["large"]["btc"] != 100 {
+		t.Errorf("subaccount with most sessions should be kept")
+	}
+}
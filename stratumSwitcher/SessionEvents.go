@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/snappy"
+)
+
+// 会话事件的类型
+const (
+	// 矿机连接
+	sessionEventConnect = "connect"
+	// 认证（成功或失败）
+	sessionEventAuthorize = "authorize"
+	// 切换币种
+	sessionEventSwitch = "switch"
+	// 币种的服务器故障，临时改挖备用币种
+	sessionEventFailover = "failover"
+	// 原币种恢复，从备用币种切换回来
+	sessionEventFailback = "failback"
+	// 重连服务器（成功或失败）
+	sessionEventReconnect = "reconnect"
+	// 矿机断开
+	sessionEventDisconnect = "disconnect"
+)
+
+// 默认的会话事件队列长度
+const defaultSessionEventQueueSize = 100000
+
+// 每批发送的最大事件数
+const sessionEventBatchSize = 1000
+
+// 凑齐一批事件的最长等待时间
+var sessionEventBatchTimeout = 1 * time.Second
+
+// 单次发送的超时时间
+const sessionEventWriteTimeout = 10 * time.Second
+
+// Kafka不可用时重试的间隔，连续失败时加倍，最长为 sessionEventMaxRetryInterval
+var sessionEventMinRetryInterval = 1 * time.Second
+var sessionEventMaxRetryInterval = 30 * time.Second
+
+// 每丢弃多少个事件输出一次日志
+const sessionEventDropLogInterval = 10000
+
+// SessionEvent 发送到Kafka的会话事件
+type SessionEvent struct {
+	Type        string `json:"type"`
+	CreatedAt   string `json:"created_at"`
+	Timestamp   int64  `json:"timestamp"` // 毫秒
+	ServerID    uint32 `json:"server_id"`
+	Listener    string `json:"listener,omitempty"`
+	SessionID   string `json:"session_id"`
+	IP          string `json:"ip"`
+	SubAccount  string `json:"sub_account,omitempty"`
+	Worker      string `json:"worker,omitempty"`
+	Coin        string `json:"coin,omitempty"`
+	OldCoin     string `json:"old_coin,omitempty"`
+	NewCoin     string `json:"new_coin,omitempty"`
+	Result      *bool  `json:"result,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	ConnectedAt int64  `json:"connected_at"` // 秒
+	// 在线时长（秒），仅 disconnect 事件有
+	OnlineSeconds int64 `json:"online_seconds,omitempty"`
+}
+
+// SessionEventWriter 批量写入会话事件（*kafka.Writer）
+type SessionEventWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// SessionEventPublisher 会话事件发布器
+// 事件先放入内存队列，由后台goroutine批量发送到Kafka。
+// Kafka不可用时会不断重试当前批次，队列满后新的事件将被丢弃，不会阻塞会话
+type SessionEventPublisher struct {
+	writer  SessionEventWriter
+	queue   chan []byte
+	dropped uint64
+}
+
+// NewSessionEventPublisher 创建会话事件发布器
+func NewSessionEventPublisher(brokers []string, topic string, queueSize int) *SessionEventPublisher {
+	writer := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:          brokers,
+		Topic:            topic,
+		Balancer:         &kafka.LeastBytes{},
+		CompressionCodec: snappy.NewCompressionCodec(),
+		BatchSize:        sessionEventBatchSize,
+		BatchTimeout:     sessionEventBatchTimeout,
+		WriteTimeout:     sessionEventWriteTimeout,
+	})
+
+	logInfo(0, "Session events will be published to kafka topic", "topic", topic, "brokers", brokers)
+	return newSessionEventPublisher(writer, queueSize)
+}
+
+// newSessionEventPublisher 创建使用指定写入器的会话事件发布器并开始发送
+func newSessionEventPublisher(writer SessionEventWriter, queueSize int) *SessionEventPublisher {
+	if queueSize <= 0 {
+		queueSize = defaultSessionEventQueueSize
+	}
+
+	publisher := new(SessionEventPublisher)
+	publisher.queue = make(chan []byte, queueSize)
+	publisher.writer = writer
+
+	go publisher.run()
+	return publisher
+}
+
+// Publish 发布一个事件，不会阻塞
+func (publisher *SessionEventPublisher) Publish(event *SessionEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logError("Marshal session event failed", "error", err)
+		return
+	}
+
+	select {
+	case publisher.queue <- data:
+	default:
+		dropped := atomic.AddUint64(&publisher.dropped, 1)
+		if dropped%sessionEventDropLogInterval == 1 {
+			logWarning("Session event queue is full", "dropped", dropped)
+		}
+	}
+}
+
+// run 从队列中取出事件并批量发送
+func (publisher *SessionEventPublisher) run() {
+	messages := make([]kafka.Message, 0, sessionEventBatchSize)
+	batchTimeout := sessionEventBatchTimeout
+	minRetryInterval, maxRetryInterval := sessionEventMinRetryInterval, sessionEventMaxRetryInterval
+	retryInterval := minRetryInterval
+
+	for {
+		// 等待第一个事件，然后在超时前尽量凑满一批
+		messages = append(messages[:0], kafka.Message{Value: <-publisher.queue})
+		timeout := time.After(batchTimeout)
+	collect:
+		for len(messages) < sessionEventBatchSize {
+			select {
+			case data := <-publisher.queue:
+				messages = append(messages, kafka.Message{Value: data})
+			case <-timeout:
+				break collect
+			}
+		}
+
+		// 发送失败时重试同一批事件，期间新事件继续进入队列
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), sessionEventWriteTimeout)
+			err := publisher.writer.WriteMessages(ctx, messages...)
+			cancel()
+			if err == nil {
+				retryInterval = minRetryInterval
+				break
+			}
+
+			logWarning("Publish session events failed", "retry_in", retryInterval, "error", err)
+			time.Sleep(retryInterval)
+			retryInterval *= 2
+			if retryInterval > maxRetryInterval {
+				retryInterval = maxRetryInterval
+			}
+		}
+	}
+}
+
+// publishEvent 发布一个会话事件，未开启会话事件时不做任何操作
+// fill 用于填写各类型事件特有的字段
+func (session *StratumSession) publishEvent(eventType string, fill func(event *SessionEvent)) {
+	publisher := session.manager.eventPublisher
+	if publisher == nil {
+		return
+	}
+
+	now := time.Now()
+	event := &SessionEvent{
+		Type:        eventType,
+		CreatedAt:   now.UTC().Format("2006-01-02 15:04:05"),
+		Timestamp:   now.UnixNano() / int64(time.Millisecond),
+		ServerID:    session.manager.serverID,
+		Listener:    session.manager.name,
+		SessionID:   Uint32ToHex(session.sessionID),
+		IP:          session.clientIPPort,
+		SubAccount:  session.subaccountName,
+		Worker:      session.fullWorkerName,
+		Coin:        session.miningCoin,
+		ConnectedAt: session.connectedAt.Unix(),
+	}
+	if session.clientIP != nil {
+		event.IP = session.clientIP.String()
+	}
+	if fill != nil {
+		fill(event)
+	}
+	publisher.Publish(event)
+}
+
+// publishResultEvent 发布带有结果的会话事件（认证、重连）
+func (session *StratumSession) publishResultEvent(eventType string, err error) {
+	session.publishEvent(eventType, func(event *SessionEvent) {
+		success := err == nil
+		event.Result = &success
+		if err != nil {
+			event.Reason = err.Error()
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeSessionEventWriter 记录写入的批次，前 failures 次写入返回错误
+type fakeSessionEventWriter struct {
+	lock     sync.Mutex
+	failures int
+	// 每次写入（包括失败的）的时间及事件
+	calls   []time.Time
+	batches chan []kafka.Message
+}
+
+func newFakeSessionEventWriter(failures int) *fakeSessionEventWriter {
+	return &fakeSessionEventWriter{failures: failures, batches: make(chan []kafka.Message, 100)}
+}
+
+func (writer *fakeSessionEventWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	writer.calls = append(writer.calls, time.Now())
+	if writer.failures > 0 {
+		writer.failures--
+		return errors.New("kafka unavailable")
+	}
+	writer.batches <- append([]kafka.Message(nil), msgs...)
+	return nil
+}
+
+// getCalls 返回每次写入的时间
+func (writer *fakeSessionEventWriter) getCalls() []time.Time {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	return append([]time.Time(nil), writer.calls...)
+}
+
+// nextBatch 等待下一个成功写入的批次
+func (writer *fakeSessionEventWriter) nextBatch(t *testing.T) []kafka.Message {
+	select {
+	case batch := <-writer.batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch written")
+	}
+	return nil
+}
+
+func TestSessionEventPublisherBatch(t *testing.T) {
+	oldTimeout := sessionEventBatchTimeout
+	sessionEventBatchTimeout = 100 * time.Millisecond
+	defer func() { sessionEventBatchTimeout = oldTimeout }()
+
+	writer := newFakeSessionEventWriter(0)
+	publisher := newSessionEventPublisher(writer, 0)
+
+	// 超过一批的事件分两批发送，凑满的一批不等待超时
+	for i := 0; i < sessionEventBatchSize+2; i++ {
+		publisher.Publish(&SessionEvent{Type: sessionEventConnect, SessionID: "0a0b0c0d", ConnectedAt: int64(i)})
+	}
+	batch := writer.nextBatch(t)
+	if len(batch) != sessionEventBatchSize {
+		t.Fatalf("first batch has %d events, want %d", len(batch), sessionEventBatchSize)
+	}
+	var event SessionEvent
+	if err := json.Unmarshal(batch[0].Value, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != sessionEventConnect || event.SessionID != "0a0b0c0d" || event.ConnectedAt != 0 {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	// 不足一批的事件在超时后发送
+	start := time.Now()
+	if batch := writer.nextBatch(t); len(batch) != 2 {
+		t.Errorf("second batch has %d events, want 2", len(batch))
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("partial batch flushed after %v, before the batch timeout", elapsed)
+	}
+}
+
+func TestSessionEventPublisherQueueFull(t *testing.T) {
+	// 不启动 run()，队列不会被取出
+	publisher := &SessionEventPublisher{queue: make(chan []byte, 2)}
+	for i := 0; i < 5; i++ {
+		publisher.Publish(&SessionEvent{Type: sessionEventDisconnect})
+	}
+	if len(publisher.queue) != 2 {
+		t.Errorf("queue has %d events, want 2", len(publisher.queue))
+	}
+	if dropped := atomic.LoadUint64(&publisher.dropped); dropped != 3 {
+		t.Errorf("dropped = %d, want 3", dropped)
+	}
+}
+
+func TestSessionEventPublisherRetry(t *testing.T) {
+	oldTimeout, oldMin, oldMax := sessionEventBatchTimeout, sessionEventMinRetryInterval, sessionEventMaxRetryInterval
+	sessionEventBatchTimeout = 10 * time.Millisecond
+	sessionEventMinRetryInterval, sessionEventMaxRetryInterval = 20*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		sessionEventBatchTimeout, sessionEventMinRetryInterval, sessionEventMaxRetryInterval = oldTimeout, oldMin, oldMax
+	}()
+
+	// 前4次写入失败
+	writer := newFakeSessionEventWriter(4)
+	publisher := newSessionEventPublisher(writer, 0)
+	publisher.Publish(&SessionEvent{Type: sessionEventSwitch, NewCoin: "bcc"})
+
+	// 失败期间发布的事件进入队列，不与正在重试的批次合并
+	time.Sleep(30 * time.Millisecond)
+	publisher.Publish(&SessionEvent{Type: sessionEventSwitch, NewCoin: "bsv"})
+
+	batch := writer.nextBatch(t)
+	if len(batch) != 1 {
+		t.Fatalf("retried batch has %d events, want 1", len(batch))
+	}
+	var event SessionEvent
+	json.Unmarshal(batch[0].Value, &event)
+	if event.NewCoin != "bcc" {
+		t.Errorf("retried batch should contain the first event, got %+v", event)
+	}
+	if batch := writer.nextBatch(t); len(batch) != 1 {
+		t.Errorf("queued batch has %d events, want 1", len(batch))
+	}
+
+	// 重试间隔加倍，最长为 sessionEventMaxRetryInterval
+	calls := writer.getCalls()
+	if len(calls) != 6 {
+		t.Fatalf("%d writes, want 6", len(calls))
+	}
+	for i, interval := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond} {
+		if gap := calls[i+1].Sub(calls[i]); gap < interval {
+			t.Errorf("retry %d after %v, want at least %v", i+1, gap, interval)
+		}
+	}
+	if dropped := atomic.LoadUint64(&publisher.dropped); dropped != 0 {
+		t.Errorf("dropped = %d, want 0", dropped)
+	}
+}
@@ -2,12 +2,24 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/willf/bitset"
 )
 
+// 已分配的会话ID达到总数的该百分比时，提前租用新的ID块
+const sessionIDLeaseThresholdPercent = 90
+
+// 租用ID块失败后的重试间隔
+const sessionIDLeaseRetrySeconds = 10
+
+// 所有ID块可容纳的会话ID总数上限（决定了位图的最大内存占用）
+const sessionIDMaxCapacity = 1 << 28
+
 //////////////////////////////// SessionIDManager //////////////////////////////
 
 // SessionIDManager 线程安全的会话ID管理器
@@ -20,7 +32,11 @@ type SessionIDManager struct {
 	//  server ID         session index id
 	//   [1, 255]        range: [0, MaxValidSessionID]
 	//
-	serverID   uint32
+	// 以上为默认的位数划分，两部分的位数均可配置（见 SessionIDLayout）。
+	// server ID 部分也称为ID块，服务器ID是第一个ID块，会话ID不足时可从Zookeeper租用更多的ID块。
+	// 各ID块的会话序号依次排列在 sessionIDs 中，即位图中的位置为 块序号<<indexBits | 会话序号
+	blockIDs   []uint32
+	blockIndex map[uint32]uint32
 	sessionIDs *bitset.BitSet
 
 	count         uint32 // how many ids are used now
@@ -32,10 +48,21 @@ type SessionIDManager struct {
 	// SessionIDMask 会话ID掩码，用于分离serverID和sessionID
 	// 也是sessionID部分可以达到的最大数值
 	sessionIDMask uint32
+	// 所有ID块可容纳的会话ID总数
+	capacity uint32
+
+	// 租用新ID块的函数，为nil则不租用
+	leaseBlock func() (uint32, error)
+	// 最多持有的ID块数（包括服务器ID）
+	maxBlocks int
+	// 是否正在租用ID块
+	leasing bool
+	// 租用失败后，在此时间之前不再重试
+	leaseRetryAt time.Time
 }
 
 // NewSessionIDManager 创建一个会话ID管理器实例
-func NewSessionIDManager(serverID uint8, indexBits uint8) (manager *SessionIDManager, err error) {
+func NewSessionIDManager(serverID uint32, indexBits uint8) (manager *SessionIDManager, err error) {
 	if indexBits > 24 {
 		err = errors.New("indexBits should not > 24, but it = " + strconv.Itoa(int(indexBits)))
 		return
@@ -44,17 +71,23 @@ func NewSessionIDManager(serverID uint8, indexBits uint8) (manager *SessionIDMan
 		err = errors.New("serverID not set (serverID = 0)")
 		return
 	}
+	if uint64(serverID)<<indexBits > 0xffffffff {
+		err = errors.New("serverID " + strconv.Itoa(int(serverID)) + " is too large for indexBits " + strconv.Itoa(int(indexBits)))
+		return
+	}
 
 	manager = new(SessionIDManager)
 
+	manager.indexBits = indexBits
 	manager.sessionIDMask = (1 << indexBits) - 1
 
-	manager.serverID = uint32(serverID) << indexBits
+	manager.blockIndex = make(map[uint32]uint32)
 	manager.sessionIDs = bitset.New(uint(manager.sessionIDMask + 1))
+	manager.addBlockNonLock(serverID)
 	manager.count = 0
 	// 设置一个与sserver不同的初始值，以便尽早发现 session ID 不一致
 	// (sserver忘记启用WORK_WITH_STRATUM_SWITCHER编译选项)的问题
-	manager.allocIDx = 128
+	manager.allocIDx = 128 % manager.capacity
 	manager.allocInterval = 0
 
 	manager.sessionIDs.ClearAll()
@@ -68,9 +101,68 @@ func (manager *SessionIDManager) setAllocInterval(interval uint32) {
 	manager.allocInterval = interval
 }
 
+// setBlockLeaser 设置租用新ID块的函数及最多持有的ID块数
+// 已分配的会话ID接近总数时，在后台调用 leaseBlock 租用新的ID块
+func (manager *SessionIDManager) setBlockLeaser(leaseBlock func() (uint32, error), maxBlocks int) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	manager.leaseBlock = leaseBlock
+	manager.maxBlocks = maxBlocks
+}
+
+// AddBlock 增加一个ID块（如不停机升级时从旧进程继承的ID块）
+func (manager *SessionIDManager) AddBlock(blockID uint32) error {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	return manager.addBlockNonLock(blockID)
+}
+
+// addBlockNonLock 增加一个ID块（内部使用，不加锁）
+func (manager *SessionIDManager) addBlockNonLock(blockID uint32) error {
+	if _, ok := manager.blockIndex[blockID]; ok {
+		return errors.New("session ID block " + strconv.Itoa(int(blockID)) + " already exists")
+	}
+	if blockID == 0 || uint64(blockID)<<manager.indexBits > 0xffffffff {
+		return errors.New("invalid session ID block " + strconv.Itoa(int(blockID)))
+	}
+	if uint64(manager.capacity)+uint64(manager.sessionIDMask)+1 > sessionIDMaxCapacity {
+		return errors.New("too many session ID blocks")
+	}
+
+	manager.blockIndex[blockID] = uint32(len(manager.blockIDs))
+	manager.blockIDs = append(manager.blockIDs, blockID)
+	manager.capacity += manager.sessionIDMask + 1
+	return nil
+}
+
+// Blocks 当前持有的所有ID块，第一个为服务器ID
+func (manager *SessionIDManager) Blocks() []uint32 {
+	defer manager.lock.Unlock()
+	manager.lock.Lock()
+
+	return append([]uint32(nil), manager.blockIDs...)
+}
+
+// toSessionID 将位图中的位置转换为会话ID（内部使用，不加锁）
+func (manager *SessionIDManager) toSessionID(idx uint32) uint32 {
+	return manager.blockIDs[idx>>manager.indexBits]<<manager.indexBits | idx&manager.sessionIDMask
+}
+
+// toIndex 将会话ID转换为位图中的位置，会话ID不属于任何ID块时返回false（内部使用，不加锁）
+func (manager *SessionIDManager) toIndex(sessionID uint32) (idx uint32, ok bool) {
+	block, ok := manager.blockIndex[sessionID>>manager.indexBits]
+	if !ok {
+		return
+	}
+	idx = block<<manager.indexBits | sessionID&manager.sessionIDMask
+	return
+}
+
 // isFull 判断会话ID是否已满（内部使用，不加锁）
 func (manager *SessionIDManager) isFullWithoutLock() bool {
-	return (manager.count > manager.sessionIDMask)
+	return (manager.count >= manager.capacity)
 }
 
 // IsFull 判断会话ID是否已满
@@ -86,6 +178,10 @@ func (manager *SessionIDManager) AllocSessionID() (sessionID uint32, err error)
 	defer manager.lock.Unlock()
 	manager.lock.Lock()
 
+	if uint64(manager.count+1)*100 >= uint64(manager.capacity)*sessionIDLeaseThresholdPercent {
+		manager.leaseBlockNonLock()
+	}
+
 	if manager.isFullWithoutLock() {
 		sessionID = manager.sessionIDMask
 		err = ErrSessionIDFull
@@ -94,25 +190,57 @@ func (manager *SessionIDManager) AllocSessionID() (sessionID uint32, err error)
 
 	// find an empty bit
 	for manager.sessionIDs.Test(uint(manager.allocIDx)) {
-		manager.allocIDx = (manager.allocIDx + 1) & manager.sessionIDMask
+		manager.allocIDx = (manager.allocIDx + 1) % manager.capacity
 	}
 
 	// set to true
 	manager.sessionIDs.Set(uint(manager.allocIDx))
 	manager.count++
 
-	sessionID = manager.serverID | manager.allocIDx
+	sessionID = manager.toSessionID(manager.allocIDx)
 	err = nil
-	manager.allocIDx = (manager.allocIDx + manager.allocInterval) & manager.sessionIDMask
+	manager.allocIDx = (manager.allocIDx + manager.allocInterval) % manager.capacity
 	return
 }
 
+// leaseBlockNonLock 在后台租用一个新的ID块（内部使用，不加锁）
+func (manager *SessionIDManager) leaseBlockNonLock() {
+	if manager.leaseBlock == nil || manager.leasing || len(manager.blockIDs) >= manager.maxBlocks ||
+		time.Now().Before(manager.leaseRetryAt) {
+		return
+	}
+	manager.leasing = true
+
+	go func() {
+		// 租用时需要访问Zookeeper，不能持有锁
+		blockID, err := manager.leaseBlock()
+
+		manager.lock.Lock()
+		defer manager.lock.Unlock()
+
+		manager.leasing = false
+		if err == nil {
+			err = manager.addBlockNonLock(blockID)
+		}
+		if err != nil {
+			manager.leaseRetryAt = time.Now().Add(sessionIDLeaseRetrySeconds * time.Second)
+			glog.Error("Lease session ID block failed: ", err)
+			return
+		}
+		glog.Info("Session ID block leased: ", blockID, ", blocks: ", len(manager.blockIDs), ", capacity: ", manager.capacity)
+	}()
+}
+
 // ResumeSessionID 恢复之前的会话ID
 func (manager *SessionIDManager) ResumeSessionID(sessionID uint32) (err error) {
 	defer manager.lock.Unlock()
 	manager.lock.Lock()
 
-	idx := sessionID & manager.sessionIDMask
+	idx, ok := manager.toIndex(sessionID)
+	if !ok {
+		err = ErrSessionIDBlockNotHeld
+		return
+	}
 
 	// test if the bit be empty
 	if manager.sessionIDs.Test(uint(idx)) {
@@ -125,7 +253,7 @@ func (manager *SessionIDManager) ResumeSessionID(sessionID uint32) (err error) {
 	manager.count++
 
 	if manager.allocIDx <= idx {
-		manager.allocIDx = idx + manager.allocInterval
+		manager.allocIDx = (idx + manager.allocInterval) % manager.capacity
 	}
 
 	err = nil
@@ -137,9 +265,8 @@ func (manager *SessionIDManager) FreeSessionID(sessionID uint32) {
 	defer manager.lock.Unlock()
 	manager.lock.Lock()
 
-	idx := sessionID & manager.sessionIDMask
-
-	if !manager.sessionIDs.Test(uint(idx)) {
+	idx, ok := manager.toIndex(sessionID)
+	if !ok || !manager.sessionIDs.Test(uint(idx)) {
 		// ID未分配，无需释放
 		return
 	}
@@ -147,3 +274,41 @@ func (manager *SessionIDManager) FreeSessionID(sessionID uint32) {
 	manager.sessionIDs.Clear(uint(idx))
 	manager.count--
 }
+
+// SessionIDLayout 会话ID的位数划分，需要与sserver的配置一致
+type SessionIDLayout struct {
+	// 服务器ID（ID块）的位数
+	ServerIDBits uint8
+	// 会话序号的位数
+	IndexBits uint8
+}
+
+// NewSessionIDLayout 根据链类型及配置确定会话ID的位数划分
+// 比特币及DCR的会话ID为32位，以太坊为24位。未配置时服务器ID为8位，其余为会话序号
+func NewSessionIDLayout(chainType ChainType, serverIDBits int, indexBits int) (layout SessionIDLayout, err error) {
+	totalBits := 32
+	if chainType == ChainTypeEthereum {
+		totalBits = 24
+	}
+	if serverIDBits == 0 {
+		serverIDBits = 8
+	}
+	if indexBits == 0 {
+		indexBits = totalBits - serverIDBits
+	}
+
+	if serverIDBits < 1 || indexBits < 1 || indexBits > 24 || serverIDBits+indexBits > totalBits {
+		err = fmt.Errorf("invalid session ID layout: %d server ID bits, %d index bits, %d bits in total for %s",
+			serverIDBits, indexBits, totalBits, chainType.ToString())
+		return
+	}
+
+	layout.ServerIDBits = uint8(serverIDBits)
+	layout.IndexBits = uint8(indexBits)
+	return
+}
+
+// MaxServerID 可分配的最大服务器ID
+func (layout SessionIDLayout) MaxServerID() uint32 {
+	return 1<<layout.ServerIDBits - 1
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/willf/bitset"
 )
@@ -260,3 +261,79 @@ func TestSessionIDManager16BitsWithInterval(t *testing.T) {
 		}
 	}
 }
+
+func TestSessionIDManagerBlocks(t *testing.T) {
+	m, err := NewSessionIDManager(1, 4)
+	if err != nil {
+		t.Fatalf("NewSessionIDManager return an error: %s", err.Error())
+	}
+	m.setBlockLeaser(func() (uint32, error) { return 5, nil }, 2)
+
+	allocated := make(map[uint32]bool)
+	for i := 0; i < 16; i++ {
+		id, err := m.AllocSessionID()
+		if err != nil {
+			t.Fatalf("AllocSessionID return an error: %s", err.Error())
+		}
+		allocated[id] = true
+	}
+
+	// 接近用尽时在后台租用新的ID块
+	deadline := time.Now().Add(time.Second)
+	for len(m.Blocks()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if blocks := m.Blocks(); len(blocks) != 2 || blocks[1] != 5 {
+		t.Fatalf("session ID block not leased, blocks: %v", blocks)
+	}
+
+	for i := 0; i < 16; i++ {
+		id, err := m.AllocSessionID()
+		if err != nil {
+			t.Fatalf("AllocSessionID return an error: %s", err.Error())
+		}
+		if id>>4 != 5 || allocated[id] {
+			t.Fatalf("AllocSessionID returned an unexpected id: %x", id)
+		}
+		allocated[id] = true
+	}
+	if id, err := m.AllocSessionID(); err == nil {
+		t.Fatalf("AllocSessionID should return an error because all blocks are full, but it returned a session ID: %x", id)
+	}
+
+	m.FreeSessionID(0x53)
+	if err := m.ResumeSessionID(0x53); err != nil {
+		t.Errorf("ResumeSessionID return an error: %s", err.Error())
+	}
+	if err := m.ResumeSessionID(0x23); err != ErrSessionIDBlockNotHeld {
+		t.Errorf("ResumeSessionID should return ErrSessionIDBlockNotHeld, but it returned %v", err)
+	}
+	m.FreeSessionID(0x23)
+	if m.count != 32 {
+		t.Errorf("m.count should be 32, but it is %d", m.count)
+	}
+}
+
+func TestNewSessionIDLayout(t *testing.T) {
+	cases := []struct {
+		chainType    ChainType
+		serverIDBits int
+		indexBits    int
+		layout       SessionIDLayout
+		ok           bool
+	}{
+		{ChainTypeBitcoin, 0, 0, SessionIDLayout{8, 24}, true},
+		{ChainTypeEthereum, 0, 0, SessionIDLayout{8, 16}, true},
+		{ChainTypeBitcoin, 12, 0, SessionIDLayout{12, 20}, true},
+		{ChainTypeEthereum, 10, 12, SessionIDLayout{10, 12}, true},
+		{ChainTypeEthereum, 10, 16, SessionIDLayout{}, false},
+		{ChainTypeBitcoin, 4, 28, SessionIDLayout{}, false},
+	}
+
+	for _, c := range cases {
+		layout, err := NewSessionIDLayout(c.chainType, c.serverIDBits, c.indexBits)
+		if (err == nil) != c.ok || (c.ok && layout != c.layout) {
+			t.Errorf("NewSessionIDLayout(%s, %d, %d) returned %v, %v", c.chainType.ToString(), c.serverIDBits, c.indexBits, layout, err)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// 每个统计对象保留的拒绝原因种类上限，超出部分计入 otherRejectReason
+const maxRejectReasons = 32
+
+// 拒绝原因的最大长度
+const maxRejectReasonLength = 64
+
+// 超出种类上限的拒绝原因
+const otherRejectReason = "other"
+
+// 单个会话等待响应的share数上限，超出后全部计为丢失
+const maxPendingShares = 256
+
+// 逐行解析时单行数据的最大长度，超出后丢弃该行
+const maxSniffLineSize = 64 * 1024
+
+// sserver 表示 stale share 的错误码（Job not found）
+const staleShareErrorCode = 21
+
+// ShareStats share统计
+type ShareStats struct {
+	// 提交的share数
+	Submitted uint64
+	// 被接受的share数
+	Accepted uint64
+	// 被拒绝的share数（包括Stale）
+	Rejected uint64
+	// 因任务过期被拒绝的share数
+	Stale uint64
+	// 切换币种、重连或断开时仍未收到响应的share数
+	Lost uint64
+	// 各拒绝原因的share数
+	RejectReasons map[string]uint64 `json:",omitempty"`
+	// 切换到该币种的次数
+	SwitchedIn uint64 `json:",omitempty"`
+	// 从该币种切走的次数
+	SwitchedOut uint64 `json:",omitempty"`
+}
+
+// addRejectReason 记录拒绝原因
+func (stats *ShareStats) addRejectReason(reason string, count uint64) {
+	if stats.RejectReasons == nil {
+		stats.RejectReasons = make(map[string]uint64)
+	}
+	if _, exists := stats.RejectReasons[reason]; !exists && len(stats.RejectReasons) >= maxRejectReasons {
+		reason = otherRejectReason
+	}
+	stats.RejectReasons[reason] += count
+}
+
+// merge 将另一个统计对象累加到当前对象
+func (stats *ShareStats) merge(other *ShareStats) {
+	stats.Submitted += other.Submitted
+	stats.Accepted += other.Accepted
+	stats.Rejected += other.Rejected
+	stats.Stale += other.Stale
+	stats.Lost += other.Lost
+	stats.SwitchedIn += other.SwitchedIn
+	stats.SwitchedOut += other.SwitchedOut
+	for reason, count := range other.RejectReasons {
+		stats.addRejectReason(reason, count)
+	}
+}
+
+// CoinShareStatsMap 各币种的share统计
+type CoinShareStatsMap map[string]*ShareStats
+
+// get 获取币种的统计对象，不存在时创建
+func (statsMap CoinShareStatsMap) get(coin string) *ShareStats {
+	stats, ok := statsMap[coin]
+	if !ok {
+		stats = new(ShareStats)
+		statsMap[coin] = stats
+	}
+	return stats
+}
+
+// merge 将另一个统计表累加到当前统计表
+func (statsMap CoinShareStatsMap) merge(other CoinShareStatsMap) {
+	for coin, stats := range other {
+		statsMap.get(coin).merge(stats)
+	}
+}
+
+// ShareStatsCollector 线程安全的share统计
+type ShareStatsCollector struct {
+	lock  sync.Mutex
+	stats CoinShareStatsMap
+}
+
+// NewShareStatsCollector 创建share统计
+func NewShareStatsCollector() *ShareStatsCollector {
+	collector := new(ShareStatsCollector)
+	collector.stats = make(CoinShareStatsMap)
+	return collector
+}
+
+// update 修改币种的统计数据
+func (collector *ShareStatsCollector) update(coin string, fn func(stats *ShareStats)) {
+	collector.lock.Lock()
+	fn(collector.stats.get(coin))
+	collector.lock.Unlock()
+}
+
+// Snapshot 获取统计数据的副本
+func (collector *ShareStatsCollector) Snapshot() CoinShareStatsMap {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	snapshot := make(CoinShareStatsMap)
+	snapshot.merge(collector.stats)
+	return snapshot
+}
+
+// ShareCounter 单个会话的share计数器
+// 记录矿机提交的share，按请求ID匹配服务器的响应，同时累加到进程级的统计中
+type ShareCounter struct {
+	lock sync.Mutex
+	// 会话的统计
+	stats CoinShareStatsMap
+	// 进程级的统计
+	collector *ShareStatsCollector
+	// 等待响应的share，ID -> 币种
+	pending map[string]string
+}
+
+// NewShareCounter 创建share计数器
+func NewShareCounter(collector *ShareStatsCollector) *ShareCounter {
+	counter := new(ShareCounter)
+	counter.stats = make(CoinShareStatsMap)
+	counter.collector = collector
+	counter.pending = make(map[string]string)
+	return counter
+}
+
+// update 同时修改会话及进程级的统计
+func (counter *ShareCounter) update(coin string, fn func(stats *ShareStats)) {
+	fn(counter.stats.get(coin))
+	counter.collector.update(coin, fn)
+}
+
+// parseShareSubmit 若矿机发给服务器的一行数据是share提交请求，则返回该请求，否则返回nil
+func parseShareSubmit(line []byte) *JSONRPCRequest {
+	// 先做简单的字符串匹配，避免解析每一行
+	if !bytes.Contains(line, []byte("submit")) {
+		return nil
+	}
+
+	request, err := NewJSONRPCRequest(line)
+	if err != nil || request.ID == nil {
+		return nil
+	}
+	if request.Method != "mining.submit" && request.Method != "eth_submitWork" {
+		return nil
+	}
+	return request
+}
+
+// onClientLine 处理矿机发给服务器的一行数据，返回该行是否为share提交请求
+func (counter *ShareCounter) onClientLine(coin string, line []byte) bool {
+	request := parseShareSubmit(line)
+	if request == nil {
+		return false
+	}
+
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if len(counter.pending) >= maxPendingShares {
+		// 服务器长时间未响应，放弃等待
+		counter.flushPendingNonLock()
+	}
+
+	counter.pending[shareIDKey(request.ID)] = coin
+	counter.update(coin, func(stats *ShareStats) {
+		stats.Submitted++
+	})
+	return true
+}
+
+// onServerLine 处理服务器发给矿机的一行数据
+func (counter *ShareCounter) onServerLine(line []byte) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if len(counter.pending) == 0 {
+		return
+	}
+	// 服务器推送的通知不是share的响应
+	if bytes.Contains(line, []byte(`"method"`)) {
+		return
+	}
+
+	response, err := NewJSONRPCResponse(line)
+	if err != nil || response.ID == nil {
+		return
+	}
+
+	key := shareIDKey(response.ID)
+	coin, ok := counter.pending[key]
+	if !ok {
+		return
+	}
+	delete(counter.pending, key)
+
+	if accepted, ok := response.Result.(bool); ok && accepted && response.Error == nil {
+		counter.update(coin, func(stats *ShareStats) {
+			stats.Accepted++
+		})
+		return
+	}
+
+	code, reason := parseShareError(response.Error)
+	stale := code == staleShareErrorCode || strings.Contains(strings.ToLower(reason), "stale")
+	counter.update(coin, func(stats *ShareStats) {
+		stats.Rejected++
+		if stale {
+			stats.Stale++
+		}
+		stats.addRejectReason(reason, 1)
+	})
+}
+
+// RecordSwitch 记录一次币种切换
+func (counter *ShareCounter) RecordSwitch(oldCoin string, newCoin string) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	counter.update(oldCoin, func(stats *ShareStats) {
+		stats.SwitchedOut++
+	})
+	counter.update(newCoin, func(stats *ShareStats) {
+		stats.SwitchedIn++
+	})
+}
+
+// FlushPending 将所有等待响应的share计为丢失（切换币种、重连或断开时调用）
+func (counter *ShareCounter) FlushPending() {
+	counter.lock.Lock()
+	counter.flushPendingNonLock()
+	counter.lock.Unlock()
+}
+
+// flushPendingNonLock 将所有等待响应的share计为丢失（无锁）
+func (counter *ShareCounter) flushPendingNonLock() {
+	for _, coin := range counter.pending {
+		counter.update(coin, func(stats *ShareStats) {
+			stats.Lost++
+		})
+	}
+	counter.pending = make(map[string]string)
+}
+
+// Snapshot 获取会话统计数据的副本
+func (counter *ShareCounter) Snapshot() CoinShareStatsMap {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	snapshot := make(CoinShareStatsMap)
+	snapshot.merge(counter.stats)
+	return snapshot
+}
+
+// shareIDKey 将JSON-RPC的ID转换为用于匹配的字符串
+// 数字ID在解析后为float64，与字符串ID区分开
+func shareIDKey(id interface{}) string {
+	return fmt.Sprintf("%T:%v", id, id)
+}
+
+// parseShareError 解析share被拒绝时的错误码及原因
+// 支持 JSON-RPC 1.0 的 [code, "message", data] 及 2.0 的 {"code": code, "message": "message"}
+func parseShareError(shareErr interface{}) (code int, reason string) {
+	switch e := shareErr.(type) {
+	case nil:
+		reason = "rejected"
+	case []interface{}:
+		if len(e) >= 1 {
+			if c, ok := e[0].(float64); ok {
+				code = int(c)
+			}
+		}
+		if len(e) >= 2 {
+			reason, _ = e[1].(string)
+		}
+	case map[string]interface{}:
+		if c, ok := e["code"].(float64); ok {
+			code = int(c)
+		}
+		reason, _ = e["message"].(string)
+	case string:
+		reason = e
+	}
+
+	if len(reason) == 0 {
+		reason = fmt.Sprintf("error %d", code)
+	}
+	if len(reason) > maxRejectReasonLength {
+		reason = reason[:maxRejectReasonLength]
+	}
+	return
+}
+
+// lineSniffer 在不改变数据流的前提下逐行观察读取到的数据
+type lineSniffer struct {
+	reader io.Reader
+	buffer []byte
+	onLine func(line []byte)
+}
+
+// newLineSniffer 创建逐行观察数据的Reader
+func newLineSniffer(reader io.Reader, onLine func(line []byte)) *lineSniffer {
+	return &lineSniffer{reader: reader, onLine: onLine}
+}
+
+// Read 读取数据并观察其中的完整行
+func (sniffer *lineSniffer) Read(p []byte) (n int, err error) {
+	n, err = sniffer.reader.Read(p)
+	if n > 0 {
+		sniffer.feed(p[:n])
+	}
+	return
+}
+
+// feed 观察一段数据，对其中的每一个完整行调用 onLine
+func (sniffer *lineSniffer) feed(data []byte) {
+	for len(data) > 0 {
+		pos := bytes.IndexByte(data, '\n')
+		if pos < 0 {
+			if len(sniffer.buffer)+len(data) > maxSniffLineSize {
+				// 行太长，丢弃
+				sniffer.buffer = sniffer.buffer[:0]
+				return
+			}
+			sniffer.buffer = append(sniffer.buffer, data...)
+			return
+		}
+
+		if len(sniffer.buffer) > 0 {
+			sniffer.buffer = append(sniffer.buffer, data[:pos]...)
+			sniffer.onLine(sniffer.buffer)
+			sniffer.buffer = sniffer.buffer[:0]
+		} else {
+			sniffer.onLine(data[:pos])
+		}
+		data = data[pos+1:]
+	}
+}
+
+// lineRewriter 逐行处理读取到的数据，rewrite 返回处理后的行（为空则去掉该行），
+// 返回 done 为true后不再处理之后的数据，原样输出
+type lineRewriter struct {
+	reader  io.Reader
+	rewrite func(line []byte) (output []byte, done bool)
+	done    bool
+	// 尚未读到换行符的数据
+	pending []byte
+	// 已处理、等待输出的数据
+	output []byte
+	// 读取时发生的错误，输出所有数据后返回
+	err error
+}
+
+// newLineRewriter 创建逐行处理数据的Reader
+func newLineRewriter(reader io.Reader, rewrite func(line []byte) ([]byte, bool)) *lineRewriter {
+	return &lineRewriter{reader: reader, rewrite: rewrite}
+}
+
+// Read 读取并处理数据
+func (rewriter *lineRewriter) Read(p []byte) (n int, err error) {
+	for len(rewriter.output) == 0 {
+		if rewriter.err != nil {
+			return 0, rewriter.err
+		}
+		if rewriter.done {
+			return rewriter.reader.Read(p)
+		}
+
+		buf := make([]byte, len(p))
+		nr, er := rewriter.reader.Read(buf)
+		rewriter.err = er
+		rewriter.feed(buf[:nr])
+	}
+
+	n = copy(p, rewriter.output)
+	rewriter.output = rewriter.output[n:]
+	return
+}
+
+// feed 处理一段数据，处理后的完整行在下次 Read 时输出
+func (rewriter *lineRewriter) feed(data []byte) {
+	if rewriter.done {
+		rewriter.output = append(rewriter.output, data...)
+		return
+	}
+	rewriter.pending = append(rewriter.pending, data...)
+
+	for !rewriter.done {
+		pos := bytes.IndexByte(rewriter.pending, '\n')
+		if pos < 0 {
+			break
+		}
+		var line []byte
+		line, rewriter.done = rewriter.rewrite(rewriter.pending[:pos+1])
+		rewriter.output = append(rewriter.output, line...)
+		rewriter.pending = rewriter.pending[pos+1:]
+	}
+
+	// 行太长、不再处理或连接已断开，剩余数据原样输出
+	if len(rewriter.pending) > maxSniffLineSize || rewriter.done || rewriter.err != nil {
+		rewriter.output = append(rewriter.output, rewriter.pending...)
+		rewriter.pending = nil
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShareCounter(t *testing.T) {
+	collector := NewShareStatsCollector()
+	counter := NewShareCounter(collector)
+
+	clientSniffer := newLineSniffer(nil, func(line []byte) {
+		counter.onClientLine("btc", line)
+	})
+	serverSniffer := newLineSniffer(nil, counter.onServerLine)
+
+	// 请求被拆分在多个数据块中
+	clientSniffer.feed([]byte(`{"id":1,"method":"mining.submit","params":["a.b","1","2","3","4"]}` + "\n" + `{"id":"x","meth`))
+	clientSniffer.feed([]byte(`od":"mining.submit","params":[]}` + "\n"))
+	clientSniffer.feed([]byte(`{"id":3,"method":"mining.submit","params":[]}` + "\n"))
+	clientSniffer.feed([]byte(`{"id":4,"method":"mining.submit","params":[]}` + "\n"))
+	clientSniffer.feed([]byte(`{"id":5,"method":"mining.extranonce.subscribe","params":[]}` + "\n"))
+
+	serverSniffer.feed([]byte(`{"id":null,"method":"mining.notify","params":[]}` + "\n"))
+	serverSniffer.feed([]byte(`{"id":1,"result":true,"error":null}` + "\n"))
+	serverSniffer.feed([]byte(`{"id":"x","result":null,"error":[21,"Job not found (=stale)",null]}` + "\n"))
+	serverSniffer.feed([]byte(`{"id":3,"result":null,"error":[23,"Low difficulty",null]}` + "\n"))
+
+	counter.RecordSwitch("btc", "bch")
+	counter.FlushPending()
+
+	stats := collector.Snapshot()
+	btc := stats["btc"]
+	if btc == nil {
+		t.Fatalf("stats of btc not found")
+	}
+	if btc.Submitted != 4 || btc.Accepted != 1 || btc.Rejected != 2 || btc.Stale != 1 || btc.Lost != 1 || btc.SwitchedOut != 1 {
+		t.Errorf("unexpected stats of btc: %+v", *btc)
+	}
+	if btc.RejectReasons["Low difficulty"] != 1 || btc.RejectReasons["Job not found (=stale)"] != 1 {
+		t.Errorf("unexpected reject reasons: %v", btc.RejectReasons)
+	}
+	if bch := stats["bch"]; bch == nil || bch.SwitchedIn != 1 {
+		t.Errorf("unexpected stats of bch: %v", bch)
+	}
+
+	sessionStats := counter.Snapshot()
+	if sessionStats["btc"].Submitted != 4 {
+		t.Errorf("unexpected session stats of btc: %+v", *sessionStats["btc"])
+	}
+}
+
+func TestParseShareError(t *testing.T) {
+	code, reason := parseShareError(map[string]interface{}{"code": float64(21), "message": "stale share"})
+	if code != 21 || reason != "stale share" {
+		t.Errorf("unexpected result of JSON-RPC 2.0 error: %d, %s", code, reason)
+	}
+
+	code, reason = parseShareError(nil)
+	if code != 0 || reason != "rejected" {
+		t.Errorf("unexpected result of empty error: %d, %s", code, reason)
+	}
+}
+
+func TestParseShareSubmit(t *testing.T) {
+	if parseShareSubmit([]byte(`{"id":1,"method":"mining.submit","params":[]}`)) == nil {
+		t.Errorf("mining.submit should be a share")
+	}
+	if parseShareSubmit([]byte(`{"id":2,"method":"eth_submitHashrate","params":[]}`)) != nil {
+		t.Errorf("eth_submitHashrate should not be a share")
+	}
+	if parseShareSubmit([]byte(`{"id":null,"method":"mining.submit","params":[]}`)) != nil {
+		t.Errorf("notification should not be a share")
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -43,14 +45,20 @@ const findWorkerNameTimeoutSeconds = 60
 // 服务器响应subscribe、authorize等消息的超时时间
 const readServerResponseTimeoutSeconds = 10
 
-// 纯代理模式下接收消息的超时时间
-// 若长时间接收不到消息，就无法及时处理对端已断开事件，
-// 因此设置接收超时时间，每隔一定时间就放弃接收，检查状态，并重新开始接收
-const receiveMessageTimeoutSeconds = 15
+// 纯代理模式下检查矿机是否空闲的时间间隔
+// 转发数据的goroutine会一直阻塞在读操作上，矿机不发送数据也不断开连接时，
+// 只能由定期检查发现并停止会话
+const idleCheckIntervalSeconds = 15
 
 // 服务器断开连接时的重试次数
 const retryTimeWhenServerDown = 10
 
+// 重连服务器失败后第一次重试前的等待时间，之后每次加倍，最长为 reconnectRetryMaxDelay
+const reconnectRetryMinDelay = 100 * time.Millisecond
+
+// 重连服务器失败后重试前的最长等待时间
+const reconnectRetryMaxDelay = 2 * time.Second
+
 // 创建的 bufio Reader 的 buffer 大小
 const bufioReaderBufSize = 128
 
@@ -70,6 +78,21 @@ const (
 	ProtocolUnknown
 )
 
+// String 协议名称，用于日志
+func (protocolType ProtocolType) String() string {
+	switch protocolType {
+	case ProtocolBitcoinStratum:
+		return "bitcoin"
+	case ProtocolEthereumStratum:
+		return "ethereum"
+	case ProtocolEthereumStratumNiceHash:
+		return "ethereum-nicehash"
+	case ProtocolEthereumProxy:
+		return "ethproxy"
+	}
+	return "unknown"
+}
+
 // RunningStat 运行状态
 type RunningStat uint8
 
@@ -80,6 +103,8 @@ const (
 	StatStoped RunningStat = iota
 	// StatReconnecting 正在重连服务器
 	StatReconnecting RunningStat = iota
+	// StatUpgrading 已冻结，等待移交给新进程（不停机升级）
+	StatUpgrading RunningStat = iota
 )
 
 // AuthorizeStat 认证状态
@@ -96,6 +121,11 @@ const (
 
 // StratumSession 是一个 Stratum 会话，包含了到客户端和到服务端的连接及状态信息
 type StratumSession struct {
+	// 最后一次从矿机收到数据的时间（UnixNano，原子操作，须放在结构体开头以保证64位对齐）
+	lastClientDataTime int64
+	// 最后一次收到矿机提交share的时间（UnixNano，原子操作），为0表示未解析数据流，不检查
+	lastShareTime int64
+
 	// 会话管理器
 	manager *StratumSessionManager
 
@@ -109,6 +139,10 @@ type StratumSession struct {
 	jsonRPCVersion int
 	// 比特币版本掩码(用于AsicBoost)
 	versionMask uint32
+	// 难度提示（来自矿机的 mining.suggest_difficulty、密码或子账户的默认值），为0表示没有
+	difficultyHint uint64
+	// 认证成功后向服务器发送了难度提示，转入代理模式后需去掉服务器对它的响应
+	suggestDifficultySent bool
 
 	// 是否在运行
 	runningStat RunningStat
@@ -122,6 +156,8 @@ type StratumSession struct {
 
 	// 客户端IP地址及端口
 	clientIPPort string
+	// 客户端IP地址（解析失败时为nil）
+	clientIP net.IP
 
 	serverConn   net.Conn
 	serverReader *bufio.Reader
@@ -139,10 +175,41 @@ type StratumSession struct {
 
 	// 用户所挖的币种
 	miningCoin string
+	// 因服务器故障临时改挖备用币种时，用户设置的币种（未发生故障转移时为空）
+	failoverFrom string
+	// 握手阶段连接服务器失败后还会重试时为true，此时失败的响应暂不发给矿机
+	holdConnectError bool
+	// 暂不发给矿机的失败响应，重试全部失败后再发送
+	heldConnectError *JSONRPCResponse
 	// 监控的Zookeeper路径
 	zkWatchPath string
 	// 监控的Zookeeper事件
 	zkWatchEvent <-chan zk.Event
+
+	// 会话被冻结（不停机升级）时关闭的channel
+	upgradeNotify chan bool
+	// 会话中读写连接的goroutine，冻结会话后需等待其退出
+	ioWaitGroup sync.WaitGroup
+	// 冻结会话时已从客户端读取但尚未处理的数据
+	pendingClientData []byte
+
+	// share计数器（未开启share统计或为BTCAgent时为nil）
+	shareCounter *ShareCounter
+	// 与服务器握手时发送的请求，用于在镜像服务器上重放
+	serverHandshake [][]byte
+	// 当前币种的镜像连接（未被抽样时为nil）
+	mirror *SessionMirror
+
+	// 矿机连接的时间
+	connectedAt time.Time
+	// 会话停止的原因，用于会话事件
+	stopReason string
+	// 最后一次切换币种的时间（未切换过时为零值）
+	miningCoinSince time.Time
+	// 抓包记录器（不匹配抓包规则时为nil）
+	recorder *CaptureRecorder
+	// 日志上下文（*logContext），相关字段改变时整体替换，见 updateLogContext
+	logContext atomic.Value
 }
 
 // NewStratumSession 创建一个新的 Stratum 会话
@@ -154,11 +221,14 @@ func NewStratumSession(manager *StratumSessionManager, clientConn net.Conn, sess
 	session.runningStat = StatStoped
 	session.manager = manager
 	session.sessionID = sessionID
+	session.upgradeNotify = make(chan bool)
 
 	session.clientConn = clientConn
 	session.clientReader = bufio.NewReaderSize(clientConn, bufioReaderBufSize)
 
 	session.clientIPPort = clientConn.RemoteAddr().String()
+	session.clientIP = parseClientIP(session.clientIPPort)
+	session.connectedAt = time.Now()
 
 	switch manager.chainType {
 	case ChainTypeBitcoin:
@@ -174,9 +244,8 @@ func NewStratumSession(manager *StratumSessionManager, clientConn net.Conn, sess
 		session.sessionIDString = Uint32ToHex(session.sessionID)[2:8]
 	}
 
-	if glog.V(3) {
-		glog.Info("IP: ", session.clientIPPort, ", Session ID: ", session.sessionIDString)
-	}
+	session.updateLogContext()
+	session.logInfo(3, "New Session")
 	return
 }
 
@@ -221,6 +290,25 @@ func (session *StratumSession) getReconnectCounter() uint32 {
 	return session.reconnectCounter
 }
 
+// getRunningServerConn 获取运行中会话的服务器连接（线程安全），会话未在运行时返回nil
+func (session *StratumSession) getRunningServerConn() net.Conn {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if session.runningStat != StatRunning {
+		return nil
+	}
+	return session.serverConn
+}
+
+// getSubaccountAndCoin 获取子账户名及正在挖的币种（线程安全）
+func (session *StratumSession) getSubaccountAndCoin() (subaccountName string, miningCoin string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	return session.subaccountName, session.miningCoin
+}
+
 // Run 启动一个 Stratum 会话
 func (session *StratumSession) Run() {
 	session.lock.Lock()
@@ -233,25 +321,30 @@ func (session *StratumSession) Run() {
 	session.runningStat = StatRunning
 	session.lock.Unlock()
 
+	session.publishEvent(sessionEventConnect, nil)
+
 	session.protocolType = session.protocolDetect()
+	session.updateLogContext()
 
 	// 其实目前只有一种协议，即Stratum协议
 	// BTCAgent在认证完成之前走的也是Stratum协议
 	if session.protocolType == ProtocolUnknown {
+		session.setStopReason("unknown protocol")
 		session.Stop()
 		return
 	}
 
-	session.runProxyStratum()
+	session.runProxyStratum(StatConnected)
 }
 
-// Resume 恢复一个Stratum会话
-func (session *StratumSession) Resume(sessionData StratumSessionData, serverConn net.Conn) {
+// prepareResume 根据会话数据恢复一个正在代理的Stratum会话的状态
+// 不读写任何连接，调用 proxyStratum() 后会话才真正开始运行
+func (session *StratumSession) prepareResume(sessionData StratumSessionData, serverConn net.Conn) error {
 	session.lock.Lock()
 
 	if session.runningStat != StatStoped {
 		session.lock.Unlock()
-		return
+		return ErrSessionIsRunning
 	}
 
 	session.runningStat = StatRunning
@@ -259,71 +352,264 @@ func (session *StratumSession) Resume(sessionData StratumSessionData, serverConn
 
 	// 设置默认协议
 	session.protocolType = session.getDefaultStratumProtocol()
+	session.updateLogContext()
 
-	// 恢复服务器连接
-	session.serverConn = serverConn
-	session.serverReader = bufio.NewReaderSize(serverConn, bufioReaderBufSize)
+	// 恢复服务器连接（为nil表示稍后重新连接）
+	if serverConn != nil {
+		session.serverConn = serverConn
+		session.serverReader = bufio.NewReaderSize(serverConn, bufioReaderBufSize)
+	}
 	stat := StatConnected
 
 	// 恢复版本位
 	session.versionMask = sessionData.VersionMask
 
+	err := session.restoreProtocolInfo(sessionData)
+	if err != nil {
+		return err
+	}
+
 	if sessionData.StratumSubscribeRequest != nil {
 		_, stratumErr := session.stratumHandleRequest(sessionData.StratumSubscribeRequest, &stat)
 		if stratumErr != nil {
-			glog.Error("Resume session ", session.clientIPPort, " failed: ", stratumErr)
-			session.Stop()
-			return
+			return stratumErr
 		}
 	}
 
 	if sessionData.StratumAuthorizeRequest != nil {
 		_, stratumErr := session.stratumHandleRequest(sessionData.StratumAuthorizeRequest, &stat)
 		if stratumErr != nil {
-			glog.Error("Resume session ", session.clientIPPort, " failed: ", stratumErr)
-			session.Stop()
-			return
+			return stratumErr
 		}
 	}
 
+	// 重放请求时推断的协议信息可能与记录的不同（如ETHProxy），以记录的为准
+	session.restoreProtocolInfo(sessionData)
+	if sessionData.DifficultyHint != 0 {
+		session.difficultyHint = sessionData.DifficultyHint
+	}
+
 	if stat != StatAuthorized {
-		glog.Error("Resume session ", session.clientIPPort, " failed: stat should be StatAuthorized, but is ", stat)
-		session.Stop()
-		return
+		return errors.New("stat should be StatAuthorized, but is " + strconv.Itoa(int(stat)))
 	}
 
-	err := session.findMiningCoin(false)
+	err = session.getMiningCoin()
 	if err != nil {
-		glog.Error("Resume session ", session.clientIPPort, " failed: ", err)
-		session.Stop()
+		return err
+	}
+
+	if len(sessionData.FailoverFrom) > 0 {
+		// 会话正在挖备用币种，用户设置的币种未变时继续挖备用币种
+		if session.miningCoin != sessionData.FailoverFrom {
+			return errors.New("mining coin changed: " + sessionData.FailoverFrom + " -> " + session.miningCoin)
+		}
+		session.failoverFrom = sessionData.FailoverFrom
+		session.miningCoin = sessionData.MiningCoin
+		session.updateLogContext()
+	} else if session.miningCoin != sessionData.MiningCoin {
+		return errors.New("mining coin changed: " + sessionData.MiningCoin + " -> " + session.miningCoin)
+	}
+
+	return nil
+}
+
+// prepareResumeHandshake 根据会话数据恢复一个处于握手阶段的Stratum会话的状态
+// 不读写任何连接，返回握手中断时的认证状态
+func (session *StratumSession) prepareResumeHandshake(sessionData StratumSessionData) (stat AuthorizeStat, err error) {
+	session.lock.Lock()
+
+	if session.runningStat != StatStoped {
+		session.lock.Unlock()
+		err = ErrSessionIsRunning
 		return
 	}
 
-	if session.miningCoin != sessionData.MiningCoin {
-		glog.Error("Resume session ", session.clientIPPort, " failed: mining coin changed: ",
-			sessionData.MiningCoin, " -> ", session.miningCoin)
-		session.Stop()
+	session.runningStat = StatRunning
+	session.lock.Unlock()
+
+	// 设置默认协议
+	session.protocolType = session.getDefaultStratumProtocol()
+	session.updateLogContext()
+
+	// 恢复版本位
+	session.versionMask = sessionData.VersionMask
+
+	// 旧进程已读取但尚未处理的数据放在clientReader的最前面
+	if len(sessionData.PendingClientData) > 0 {
+		pendingLen := len(sessionData.PendingClientData)
+		bufSize := bufioReaderBufSize
+		if pendingLen > bufSize {
+			bufSize = pendingLen
+		}
+		reader := io.MultiReader(bytes.NewReader(sessionData.PendingClientData), session.clientConn)
+		session.clientReader = bufio.NewReaderSize(reader, bufSize)
+		// 立即将这些数据读入缓冲区，以免在转入纯代理模式时丢失
+		session.clientReader.Peek(pendingLen)
+	}
+
+	err = session.restoreProtocolInfo(sessionData)
+	if err != nil {
 		return
 	}
 
-	glog.Info("Resume Session Success: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+	stat = StatConnected
 
-	// 此后转入纯代理模式
-	session.proxyStratum()
+	if sessionData.StratumSubscribeRequest != nil {
+		_, stratumErr := session.stratumHandleRequest(sessionData.StratumSubscribeRequest, &stat)
+		if stratumErr != nil {
+			err = stratumErr
+			return
+		}
+	}
+
+	if sessionData.StratumAuthorizeRequest != nil {
+		_, stratumErr := session.stratumHandleRequest(sessionData.StratumAuthorizeRequest, &stat)
+		if stratumErr != nil {
+			err = stratumErr
+			return
+		}
+	}
+
+	// 重放请求时推断的协议信息可能与记录的不同（如ETHProxy），以记录的为准
+	session.restoreProtocolInfo(sessionData)
+	if sessionData.DifficultyHint != 0 {
+		session.difficultyHint = sessionData.DifficultyHint
+	}
+	return
+}
+
+// restoreProtocolInfo 恢复会话数据中记录的协议信息
+// 旧版本的会话数据没有记录协议信息，此时保留默认值
+func (session *StratumSession) restoreProtocolInfo(sessionData StratumSessionData) error {
+	if sessionData.ProtocolType == ProtocolUnknown {
+		return nil
+	}
+
+	if !session.isProtocolSupported(sessionData.ProtocolType) {
+		return fmt.Errorf("protocol type %d is not supported by chain %s", sessionData.ProtocolType, session.manager.chainType.ToString())
+	}
+
+	if sessionData.JSONRPCVersion != 1 && sessionData.JSONRPCVersion != 2 {
+		return fmt.Errorf("invalid JSON-RPC version %d", sessionData.JSONRPCVersion)
+	}
+
+	session.protocolType = sessionData.ProtocolType
+	session.jsonRPCVersion = sessionData.JSONRPCVersion
+	session.isBTCAgent = sessionData.IsBTCAgent
+	session.isNiceHashClient = sessionData.IsNiceHashClient
+	session.updateLogContext()
+	return nil
+}
+
+// isProtocolSupported 当前链类型是否支持该协议
+func (session *StratumSession) isProtocolSupported(protocolType ProtocolType) bool {
+	switch session.manager.chainType {
+	case ChainTypeBitcoin:
+		fallthrough
+	case ChainTypeDecredNormal:
+		fallthrough
+	case ChainTypeDecredGoMiner:
+		return protocolType == ProtocolBitcoinStratum
+	case ChainTypeEthereum:
+		return protocolType == ProtocolEthereumStratum ||
+			protocolType == ProtocolEthereumStratumNiceHash ||
+			protocolType == ProtocolEthereumProxy
+	default:
+		return false
+	}
+}
+
+// freeze 冻结会话以便将其移交给新进程，不关闭连接
+// 只有处于正常运行状态的会话可以被冻结
+func (session *StratumSession) freeze() bool {
+	session.lock.Lock()
+	if session.runningStat != StatRunning {
+		session.lock.Unlock()
+		return false
+	}
+	session.runningStat = StatUpgrading
+	session.lock.Unlock()
+
+	close(session.upgradeNotify)
+
+	// 使阻塞中的读操作立即返回，读写连接的goroutine将随之退出
+	now := time.Now()
+	session.clientConn.SetReadDeadline(now)
+	if session.manager.isProxySession(session) {
+		session.serverConn.SetReadDeadline(now)
+	}
+	return true
+}
+
+// waitIOExit 等待会话中读写连接的goroutine退出
+func (session *StratumSession) waitIOExit(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		session.ioWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// getSessionData 获取用于移交给新进程的会话数据（不含文件描述符）
+// 仅可在会话冻结且读写goroutine退出后调用
+func (session *StratumSession) getSessionData() (sessionData StratumSessionData) {
+	sessionData.SessionID = session.sessionID
+	sessionData.MiningCoin = session.miningCoin
+	sessionData.FailoverFrom = session.failoverFrom
+	sessionData.StratumSubscribeRequest = session.stratumSubscribeRequest
+	sessionData.StratumAuthorizeRequest = session.stratumAuthorizeRequest
+	sessionData.VersionMask = session.versionMask
+	sessionData.DifficultyHint = session.difficultyHint
+	sessionData.ProtocolType = session.protocolType
+	sessionData.JSONRPCVersion = session.jsonRPCVersion
+	sessionData.IsBTCAgent = session.isBTCAgent
+	sessionData.IsNiceHashClient = session.isNiceHashClient
+	sessionData.ConnectedAt = session.connectedAt.Unix()
+
+	sessionData.PendingClientData = session.pendingClientData
+	if session.clientReader != nil {
+		if bufLen := session.clientReader.Buffered(); bufLen > 0 {
+			buf, _ := session.clientReader.Peek(bufLen)
+			sessionData.PendingClientData = append(sessionData.PendingClientData, buf...)
+		}
+	}
+	return
 }
 
 // Stop 停止一个 Stratum 会话
 func (session *StratumSession) Stop() {
 	session.lock.Lock()
 
-	if session.runningStat == StatStoped {
+	// 已冻结的会话将被移交给新进程，不能关闭其连接
+	if session.runningStat == StatStoped || session.runningStat == StatUpgrading {
 		session.lock.Unlock()
 		return
 	}
 
 	session.runningStat = StatStoped
+	reason := session.stopReason
 	session.lock.Unlock()
 
+	if session.shareCounter != nil {
+		session.shareCounter.FlushPending()
+	}
+	session.closeMirror()
+
+	if len(reason) == 0 {
+		reason = "stopped"
+	}
+	session.publishEvent(sessionEventDisconnect, func(event *SessionEvent) {
+		event.Reason = reason
+		event.OnlineSeconds = int64(time.Since(session.connectedAt) / time.Second)
+	})
+
 	if session.serverConn != nil {
 		session.serverConn.Close()
 	}
@@ -332,11 +618,27 @@ func (session *StratumSession) Stop() {
 		session.clientConn.Close()
 	}
 
+	if session.recorder != nil {
+		session.recorder.Close()
+	}
+
+	session.logInfo(2, "Session Stoped", "reason", reason)
+
 	session.manager.ReleaseStratumSession(session)
 	session.manager = nil
+}
+
+// setStopReason 记录会话停止的原因（线程安全），只保留最先记录的原因
+func (session *StratumSession) setStopReason(reason string) {
+	session.lock.Lock()
+	session.setStopReasonNonLock(reason)
+	session.lock.Unlock()
+}
 
-	if glog.V(2) {
-		glog.Info("Session Stoped: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+// setStopReasonNonLock 记录会话停止的原因（无锁，用于在已加锁函数内部调用）
+func (session *StratumSession) setStopReasonNonLock(reason string) {
+	if len(session.stopReason) == 0 {
+		session.stopReason = reason
 	}
 }
 
@@ -344,7 +646,7 @@ func (session *StratumSession) protocolDetect() ProtocolType {
 	magicNumber, err := session.peekFromClientWithTimeout(1, protocolDetectTimeoutSeconds*time.Second)
 
 	if err != nil {
-		glog.Warning("read failed: ", err)
+		session.logWarning("read failed", "error", err)
 		return ProtocolUnknown
 	}
 
@@ -355,13 +657,11 @@ func (session *StratumSession) protocolDetect() ProtocolType {
 	// 这也就是说，一方面，BTC Agent可以和普通矿机共享连接和认证流程，
 	// 另一方面，我们无法在最开始就检测出客户端是BTC Agent，我们要随时做好收到ex-message的准备。
 	if magicNumber[0] != '{' {
-		glog.Warning("Unknown Protocol")
+		session.logWarning("Unknown Protocol")
 		return ProtocolUnknown
 	}
 
-	if glog.V(3) {
-		glog.Info("Found Stratum Protocol")
-	}
+	session.logInfo(3, "Found Stratum Protocol")
 
 	return session.getDefaultStratumProtocol()
 }
@@ -385,26 +685,40 @@ func (session *StratumSession) getDefaultStratumProtocol() ProtocolType {
 	}
 }
 
-func (session *StratumSession) runProxyStratum() {
+func (session *StratumSession) runProxyStratum(stat AuthorizeStat) {
 	var err error
 
-	err = session.stratumFindWorkerName()
+	if stat != StatAuthorized {
+		err = session.stratumFindWorkerName(stat)
 
-	if err != nil {
-		session.Stop()
-		return
+		if err != nil {
+			session.setStopReason("handshake failed: " + err.Error())
+			session.Stop()
+			return
+		}
 	}
 
 	err = session.findMiningCoin(session.manager.enableUserAutoReg)
 
 	if err != nil {
+		session.setStopReason("find mining coin failed: " + err.Error())
 		session.Stop()
 		return
 	}
 
-	err = session.connectStratumServer()
+	// 矿机没有给出难度提示时使用子账户的默认值
+	if session.difficultyHint == 0 && session.supportsDifficultyHint() {
+		session.difficultyHint = session.manager.GetSubaccountDifficultyHint(session.subaccountName)
+	}
+
+	// 币种的服务器已不可用时直接改挖备用币种
+	session.tryFailover(0, ErrUpstreamUnhealthy)
+
+	err = session.connectStratumServerWithFailover()
+	session.publishResultEvent(sessionEventAuthorize, err)
 
 	if err != nil {
+		session.setStopReason("connect server failed: " + err.Error())
 		session.Stop()
 		return
 	}
@@ -430,6 +744,10 @@ func (session *StratumSession) parseSubscribeRequest(request *JSONRPCRequest) (r
 			if ok && strings.HasPrefix(strings.ToLower(userAgent), btcAgentClientTypePrefix) {
 				session.isBTCAgent = true
 			}
+			// 判断是否为NiceHash客户端
+			if ok && strings.HasPrefix(strings.ToLower(userAgent), niceHashClientTypePrefix) {
+				session.isNiceHashClient = true
+			}
 		}
 
 		result = JSONRPCArray{JSONRPCArray{JSONRPCArray{"mining.set_difficulty", session.sessionIDString}, JSONRPCArray{"mining.notify", session.sessionIDString}}, session.sessionIDString, 8}
@@ -513,27 +831,20 @@ func (session *StratumSession) parseAuthorizeRequest(request *JSONRPCRequest) (r
 		return
 	}
 
-	// 矿工名
-	session.fullWorkerName = FilterWorkerName(fullWorkerName)
-
 	// 以太坊矿工名中可能包含钱包地址，且矿工名本身可能位于附加的worker字段
-	if session.protocolType != ProtocolBitcoinStratum {
-		if request.Worker != "" {
-			session.fullWorkerName += "." + FilterWorkerName(request.Worker)
-		}
-		session.fullWorkerName = StripEthAddrFromFullName(session.fullWorkerName)
+	var worker string
+	stripEthAddr := session.protocolType != ProtocolBitcoinStratum
+	if stripEthAddr {
+		worker = request.Worker
 	}
+	parsed := session.manager.workerNameParser.Parse(fullWorkerName, worker, stripEthAddr, false)
 
-	if strings.Contains(session.fullWorkerName, ".") {
-		// 截取“.”之前的做为子账户名，“.”及之后的做矿机名
-		pos := strings.Index(session.fullWorkerName, ".")
-		session.subaccountName = session.manager.GetRegularSubaccountName(session.fullWorkerName[:pos])
-		session.minerNameWithDot = session.fullWorkerName[pos:]
-		session.fullWorkerName = session.subaccountName + session.minerNameWithDot
-	} else {
-		session.subaccountName = session.manager.GetRegularSubaccountName(session.fullWorkerName)
-		session.minerNameWithDot = ""
-		session.fullWorkerName = session.subaccountName
+	session.subaccountName = session.manager.GetRegularSubaccountName(parsed.SubAccount)
+	session.minerNameWithDot = parsed.MinerNameWithDot
+	session.fullWorkerName = session.subaccountName + session.minerNameWithDot
+
+	if session.recorder != nil {
+		session.recorder.OnAuthorize(session.subaccountName)
 	}
 
 	if len(session.subaccountName) < 1 {
@@ -541,6 +852,13 @@ func (session *StratumSession) parseAuthorizeRequest(request *JSONRPCRequest) (r
 		return
 	}
 
+	// 密码中的难度提示（如 “x,d=1024”），优先使用 mining.suggest_difficulty 给出的难度
+	if session.difficultyHint == 0 && session.supportsDifficultyHint() && len(request.Params) >= 2 {
+		if password, ok := request.Params[1].(string); ok {
+			session.difficultyHint = parsePasswordDifficulty(password)
+		}
+	}
+
 	// 获取矿机名成功，但此处不需要返回内容给矿机
 	// 连接服务器后会将服务器发送的响应返回给矿机
 	result = nil
@@ -585,6 +903,9 @@ func (session *StratumSession) parseConfigureRequest(request *JSONRPCRequest) (r
 }
 
 func (session *StratumSession) stratumHandleRequest(request *JSONRPCRequest, stat *AuthorizeStat) (result interface{}, err *StratumError) {
+	// 订阅及认证请求会改变协议、矿工名等日志上下文
+	defer session.updateLogContext()
+
 	switch request.Method {
 	case "mining.subscribe":
 		if *stat != StatConnected {
@@ -622,26 +943,41 @@ func (session *StratumSession) stratumHandleRequest(request *JSONRPCRequest, sta
 		}
 		return
 
+	case "mining.suggest_difficulty":
+		// 记录难度提示，连接服务器后发送。与 mining.configure 不同，该请求不需要响应
+		if !session.supportsDifficultyHint() {
+			session.logInfo(3, "Difficulty Hint Not Supported by Protocol", "protocol", session.protocolType)
+			return
+		}
+		if difficulty := parseSuggestDifficulty(request); difficulty > 0 {
+			session.difficultyHint = difficulty
+		}
+		return
+
 	default:
 		// ignore unimplemented methods
 		return
 	}
 }
 
-func (session *StratumSession) stratumFindWorkerName() error {
+func (session *StratumSession) stratumFindWorkerName(stat AuthorizeStat) error {
 	e := make(chan error, 1)
 
 	go func() {
 		defer close(e)
 		response := new(JSONRPCResponse)
 
-		stat := StatConnected
-
 		// 循环结束说明认证成功
 		for stat != StatAuthorized {
 			requestJSON, err := session.clientReader.ReadBytes('\n')
 
 			if err != nil {
+				if session.getStat() == StatUpgrading {
+					// 会话已冻结，保存读到的不完整数据以便移交给新进程
+					session.pendingClientData = requestJSON
+					e <- ErrSessionUpgrading
+					return
+				}
 				e <- errors.New("read line failed: " + err.Error())
 				return
 			}
@@ -650,9 +986,7 @@ func (session *StratumSession) stratumFindWorkerName() error {
 
 			// ignore the json decode error
 			if err != nil {
-				if glog.V(3) {
-					glog.Info("JSON decode failed: ", err.Error(), string(requestJSON))
-				}
+				session.logInfo(3, "JSON decode failed", "error", err, "data", string(requestJSON))
 				continue
 			}
 
@@ -682,34 +1016,28 @@ func (session *StratumSession) stratumFindWorkerName() error {
 	select {
 	case err := <-e:
 		if err != nil {
-			glog.Warning(err)
+			session.logWarning("FindWorkerName Failed", "error", err)
 			return err
 		}
 
-		if glog.V(2) {
-			glog.Info("FindWorkerName Success: ", session.fullWorkerName)
-		}
+		session.logInfo(2, "FindWorkerName Success")
 		return nil
 
 	case <-time.After(findWorkerNameTimeoutSeconds * time.Second):
-		glog.Warning("FindWorkerName Timeout")
+		session.logWarning("FindWorkerName Timeout")
 		return errors.New("FindWorkerName Timeout")
 	}
 }
 
 func (session *StratumSession) findMiningCoin(autoReg bool) error {
-	// 从zookeeper读取用户想挖的币种
-	session.zkWatchPath = session.manager.zookeeperSwitcherWatchDir + session.subaccountName
-	data, event, err := session.manager.zookeeperManager.GetW(session.zkWatchPath, session.sessionID)
+	err := session.getMiningCoin()
 
 	if err != nil {
 		if autoReg {
 			return session.tryAutoReg()
 		}
 
-		if glog.V(3) {
-			glog.Info("FindMiningCoin Failed: " + session.zkWatchPath + "; " + err.Error())
-		}
+		session.logInfo(3, "FindMiningCoin Failed", "path", session.zkWatchPath, "error", err)
 
 		var response JSONRPCResponse
 		response.Error = NewStratumError(201, "Invalid Sub-account Name").ToJSONRPCArray(session.manager.serverID)
@@ -721,21 +1049,34 @@ func (session *StratumSession) findMiningCoin(autoReg bool) error {
 		return err
 	}
 
+	return nil
+}
+
+// getMiningCoin 读取用户想挖的币种（来自zookeeper或kafka，见 SwitchSource）并设置监控，不向客户端发送任何数据
+func (session *StratumSession) getMiningCoin() error {
+	session.zkWatchPath = session.manager.zookeeperSwitcherWatchDir + session.subaccountName
+	data, event, err := session.manager.switchWatcher.GetW(session.zkWatchPath, session.sessionID)
+
+	if err != nil {
+		return err
+	}
+
 	session.miningCoin = string(data)
 	session.zkWatchEvent = event
+	session.updateLogContext()
 
 	return nil
 }
 
 func (session *StratumSession) tryAutoReg() error {
-	glog.Info("Try to auto register sub-account, worker: ", session.fullWorkerName)
+	session.logInfo(0, "Try to auto register sub-account")
 
 	autoRegWatchPath := session.manager.zookeeperAutoRegWatchDir + session.subaccountName
 	_, event, err := session.manager.zookeeperManager.GetW(autoRegWatchPath, session.sessionID)
 	if err != nil {
 		// 检查自动注册等待人数是否超限
 		if atomic.LoadInt64(&session.manager.autoRegAllowUsers) < 1 {
-			glog.Warning("Too much pending auto reg request. worker: ", session.fullWorkerName)
+			session.logWarning("Too much pending auto reg request")
 			return ErrTooMuchPendingAutoRegReq
 		}
 		// 没有加锁，大并发时允许短暂的超过上限。减小到负值是安全的
@@ -756,16 +1097,20 @@ func (session *StratumSession) tryAutoReg() error {
 
 		if err != nil {
 			if createErr != nil {
-				glog.Error("Create auto register key failed, worker: ", session.fullWorkerName, ", errmsg: ", createErr)
+				session.logError("Create auto register key failed", "error", createErr)
 			} else {
-				glog.Info("Sub-account auto register failed, worker: ", session.fullWorkerName, ", errmsg: ", err)
+				session.logInfo(0, "Sub-account auto register failed", "error", err)
 			}
 			return err
 		}
 	}
 
 	// waiting for register finished for remote process
-	<-event
+	select {
+	case <-event:
+	case <-session.upgradeNotify:
+		return ErrSessionUpgrading
+	}
 
 	return session.findMiningCoin(false)
 }
@@ -774,7 +1119,7 @@ func (session *StratumSession) connectStratumServer() error {
 	// 获取当前运行状态
 	runningStat := session.getStatNonLock()
 	// 寻找币种对应的服务器
-	serverInfo, ok := session.manager.stratumServerInfoMap[session.miningCoin]
+	dialer, ok := session.manager.upstreamDialers[session.miningCoin]
 
 	var rpcID interface{}
 	if session.stratumAuthorizeRequest != nil {
@@ -783,32 +1128,47 @@ func (session *StratumSession) connectStratumServer() error {
 
 	// 对应的服务器不存在
 	if !ok {
-		glog.Error("Stratum Server Not Found: ", session.miningCoin)
+		session.logError("Stratum Server Not Found")
 		if runningStat != StatReconnecting {
 			response := JSONRPCResponse{rpcID, nil, StratumErrStratumServerNotFound.ToJSONRPCArray(session.manager.serverID)}
-			session.writeJSONResponseToClient(&response)
+			session.writeConnectErrorToClient(&response)
 		}
 		return StratumErrStratumServerNotFound
 	}
 
 	// 连接服务器
-	serverConn, err := net.Dial("tcp", serverInfo.URL)
+	// 切换币种或重连时优先取用预先建立的连接
+	var serverConn net.Conn
+	var err error
+	if runningStat == StatReconnecting && session.manager.upstreamPreconnector != nil {
+		serverConn = session.manager.upstreamPreconnector.Get(session.miningCoin)
+		if serverConn != nil {
+			session.logInfo(3, "Use Preconnected Stratum Server Connection", "server", dialer.URL)
+		}
+	}
+	if serverConn == nil {
+		serverConn, err = dialer.Dial(upstreamDialTimeoutSeconds * time.Second)
+	}
 
 	if err != nil {
-		glog.Error("Connect Stratum Server Failed: ", session.miningCoin, "; ", serverInfo.URL, "; ", err)
+		session.logError("Connect Stratum Server Failed", "server", dialer.URL, "error", err)
 		if runningStat != StatReconnecting {
 			response := JSONRPCResponse{rpcID, nil, StratumErrConnectStratumServerFailed.ToJSONRPCArray(session.manager.serverID)}
-			session.writeJSONResponseToClient(&response)
+			session.writeConnectErrorToClient(&response)
 		}
 		return StratumErrConnectStratumServerFailed
 	}
 
-	if glog.V(3) {
-		glog.Info("Connect Stratum Server Success: ", session.miningCoin, "; ", serverInfo.URL)
+	session.logInfo(3, "Connect Stratum Server Success", "server", dialer.URL)
+
+	if session.recorder != nil && session.recorder.IsCapturing() {
+		session.recorder.Record(captureDirServerConnect, []byte(session.miningCoin))
+		serverConn = newCaptureConn(serverConn, session.recorder, captureDirServerIn, captureDirServerOut)
 	}
 
 	session.serverConn = serverConn
 	session.serverReader = bufio.NewReaderSize(serverConn, bufioReaderBufSize)
+	session.serverHandshake = nil
 
 	return session.serverSubscribeAndAuthorize()
 }
@@ -831,6 +1191,13 @@ func (session *StratumSession) sendMiningConfigureToServer() (err error) {
 	return
 }
 
+// getClientIPParam 获取发送给当前币种的sserver的矿机IP参数
+// IPv4为整数，IPv6仅在sserver声明支持时为字符串
+func (session *StratumSession) getClientIPParam() interface{} {
+	serverInfo := session.manager.stratumServerInfoMap[session.miningCoin]
+	return clientIPParam(session.clientIP, serverInfo.SupportIPv6)
+}
+
 // 发送 mining.subscribe
 func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string, protocol string, err error) {
 	userAgent = "stratumSwitcher"
@@ -851,16 +1218,13 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 		if len(session.stratumSubscribeRequest.Params) >= 1 {
 			userAgent, _ = session.stratumSubscribeRequest.Params[0].(string)
 		}
-		if glog.V(3) {
-			glog.Info("UserAgent: ", userAgent)
-		}
+		session.logInfo(3, "Subscribe", "user_agent", userAgent)
 
 		// 为了保证Web侧“最近提交IP”显示正确，将矿机的IP做为第三个参数传递给Stratum Server
-		clientIP := session.clientIPPort[:strings.LastIndex(session.clientIPPort, ":")]
-		clientIPLong := IP2Long(clientIP)
+		clientIP := session.getClientIPParam()
 		// 不直接使用 session.sessionIDString，因为在DCR币种里，它已经进行了填充和字节序颠倒。
 		sessionIDString := Uint32ToHex(session.sessionID)
-		session.stratumSubscribeRequest.SetParam(userAgent, sessionIDString, clientIPLong)
+		session.stratumSubscribeRequest.SetParam(userAgent, sessionIDString, clientIP)
 
 	case ProtocolEthereumStratum:
 		fallthrough
@@ -874,16 +1238,13 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 		if len(session.stratumSubscribeRequest.Params) >= 2 {
 			protocol, _ = session.stratumSubscribeRequest.Params[1].(string)
 		}
-		if glog.V(3) {
-			glog.Info("UserAgent: ", userAgent, "; Protocol: ", protocol)
-		}
+		session.logInfo(3, "Subscribe", "user_agent", userAgent, "stratum_protocol", protocol)
 
-		clientIP := session.clientIPPort[:strings.LastIndex(session.clientIPPort, ":")]
-		clientIPLong := IP2Long(clientIP)
+		clientIP := session.getClientIPParam()
 
 		// Session ID 做为第三个参数传递
 		// 矿机IP做为第四个参数传递
-		session.stratumSubscribeRequest.SetParam(userAgent, protocol, session.sessionIDString, clientIPLong)
+		session.stratumSubscribeRequest.SetParam(userAgent, protocol, session.sessionIDString, clientIP)
 
 	default:
 		glog.Fatal("Unimplemented Stratum Protocol: ", session.protocolType)
@@ -895,7 +1256,7 @@ func (session *StratumSession) sendMiningSubscribeToServer() (userAgent string,
 	// sessionID已包含在其中，一并发送给服务器
 	_, err = session.writeJSONRequestToServer(session.stratumSubscribeRequest)
 	if err != nil {
-		glog.Warning("Write Subscribe Request Failed: ", err)
+		session.logWarning("Write Subscribe Request Failed", "error", err)
 	}
 	return
 }
@@ -910,16 +1271,64 @@ func (session *StratumSession) getUserSuffix() string {
 	return serverInfo.UserSuffix
 }
 
-// 发送 mining.subscribe
-func (session *StratumSession) sendMiningAuthorizeToServer(withSuffix bool) (authWorkerName string, authWorkerPasswd string, err error) {
+// 获取向服务器认证时使用的矿工名
+// mappedName 不为空时使用映射后的子账户名，否则根据 withSuffix 决定是否添加币种后缀
+func (session *StratumSession) getAuthWorkerName(mappedName string, withSuffix bool) string {
+	if len(mappedName) > 0 {
+		// 映射表中指定的子账户名
+		return mappedName + session.minerNameWithDot
+	}
 	if withSuffix {
 		// 带币种后缀的矿机名
-		authWorkerName = session.subaccountName + "_" + session.getUserSuffix() + session.minerNameWithDot
-	} else {
-		// 无币种后缀的矿工名
-		authWorkerName = session.fullWorkerName
+		return session.subaccountName + "_" + session.getUserSuffix() + session.minerNameWithDot
+	}
+	// 无币种后缀的矿工名
+	return session.fullWorkerName
+}
+
+// 发送 mining.suggest_difficulty
+// 认证成功后发送矿机或子账户的难度提示，以便切换币种或重连服务器后保持矿机要求的难度；
+// 对NiceHash矿机发送的难度不低于NiceHash要求的最低难度。仅用于比特币Stratum协议（见 supportsDifficultyHint）
+func (session *StratumSession) sendMiningSuggestDifficultyToServer() (err error) {
+	if !session.supportsDifficultyHint() {
+		return
+	}
+	difficulty := session.getNiceHashMinDifficulty()
+	if session.difficultyHint > difficulty {
+		difficulty = session.difficultyHint
+	}
+	if difficulty == 0 {
+		return
 	}
 
+	request := JSONRPCRequest{
+		"suggest_difficulty",
+		"mining.suggest_difficulty",
+		JSONRPCArray{difficulty},
+		""}
+	_, err = session.writeJSONRequestToServer(&request)
+	if err == nil {
+		session.suggestDifficultySent = true
+	}
+	return
+}
+
+// getNiceHashMinDifficulty 获取NiceHash对当前币种要求的最低难度
+// 不是NiceHash矿机、协议不支持、未配置算法或未知时返回0
+func (session *StratumSession) getNiceHashMinDifficulty() uint64 {
+	watcher := session.manager.niceHashWatcher
+	if watcher == nil || !session.isNiceHashClient || session.protocolType != ProtocolBitcoinStratum {
+		return 0
+	}
+	algorithm := session.manager.stratumServerInfoMap[session.miningCoin].NiceHashAlgorithm
+	if algorithm == "" {
+		return 0
+	}
+	return watcher.Get(algorithm)
+}
+
+// 发送 mining.authorize
+func (session *StratumSession) sendMiningAuthorizeToServer(authWorkerName string) (authWorkerPasswd string, err error) {
 	var request JSONRPCRequest
 	request.Method = session.stratumAuthorizeRequest.Method
 	request.Params = make([]interface{}, len(session.stratumAuthorizeRequest.Params))
@@ -931,7 +1340,7 @@ func (session *StratumSession) sendMiningAuthorizeToServer(withSuffix bool) (aut
 		authWorkerPasswd, _ = request.Params[1].(string)
 	}
 
-	// 设置为无币种后缀的矿工名
+	// 设置为发送给服务器的矿工名
 	request.Params[0] = authWorkerName
 	request.ID = "auth"
 	// 发送mining.authorize请求给服务器
@@ -940,6 +1349,17 @@ func (session *StratumSession) sendMiningAuthorizeToServer(withSuffix bool) (aut
 }
 
 func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
+	// 映射表中有该子账户时只认证一次，否则先尝试无币种后缀的矿工名，再尝试带币种后缀的；
+	// 子账户上次在该币种需要带后缀才能认证时，先尝试带后缀的
+	mappedName, _ := session.manager.GetMappedSubaccountName(session.miningCoin, session.subaccountName)
+	maxAuthMsgs := 2
+	withSuffix := false
+	if len(mappedName) > 0 {
+		maxAuthMsgs = 1
+	} else {
+		withSuffix = session.manager.isAuthSuffixNeeded(session.miningCoin, session.subaccountName)
+	}
+
 	// 发送请求
 	err = session.sendMiningConfigureToServer()
 	if err != nil {
@@ -949,13 +1369,16 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 	if err != nil {
 		return
 	}
-	authWorkerName, authWorkerPasswd, err := session.sendMiningAuthorizeToServer(false)
+	authWorkerName := session.getAuthWorkerName(mappedName, withSuffix)
+	authWorkerPasswd, err := session.sendMiningAuthorizeToServer(authWorkerName)
 	if err != nil {
 		return
 	}
 
 	// 接收响应
 	e := make(chan error, 1)
+	// 暂不发给矿机的认证失败响应，收到 e 中的结果后才可读取
+	var heldResponse *JSONRPCResponse
 	go func() {
 		defer close(e)
 
@@ -966,7 +1389,7 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 		authSuccess := false
 
 		// 循环结束说明认证完成
-		for authMsgCounter < 2 {
+		for authMsgCounter < maxAuthMsgs {
 			json, err := session.serverReader.ReadBytes('\n')
 
 			if err != nil {
@@ -984,9 +1407,11 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 					return
 				}
 
-				// 首次认证(无币种后缀)不成功，发送第二次认证请求(带币种后缀)
-				if !authSuccess && authMsgCounter == 1 {
-					authWorkerName, authWorkerPasswd, err = session.sendMiningAuthorizeToServer(true)
+				// 首次认证不成功，换用另一种矿工名（有无币种后缀）发送第二次认证请求
+				if !authSuccess && authMsgCounter == 1 && authMsgCounter < maxAuthMsgs {
+					withSuffix = !withSuffix
+					authWorkerName = session.getAuthWorkerName("", withSuffix)
+					authWorkerPasswd, err = session.sendMiningAuthorizeToServer(authWorkerName)
 					if err != nil {
 						e <- err
 						return
@@ -994,8 +1419,8 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 				}
 				continue
 			}
-			if err != nil && glog.V(3) {
-				glog.Info("JSON RPC Response decode failed: ", err.Error(), string(json))
+			if err != nil {
+				session.logInfo(3, "JSON RPC Response decode failed", "error", err, "data", string(json))
 			}
 
 			// 服务器推送的JSON RPC通知
@@ -1008,17 +1433,21 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 				}
 				continue
 			}
-			if err != nil && glog.V(3) {
-				glog.Info("JSON RPC Request decode failed: ", err.Error(), string(json))
+			if err != nil {
+				session.logInfo(3, "JSON RPC Request decode failed", "error", err, "data", string(json))
 			}
 		} // for
 
-		// 发送认证响应给矿机
+		// 发送认证响应给矿机，还会重试时暂存失败的响应
 		authResponse.ID = session.stratumAuthorizeRequest.ID
-		_, err = session.writeJSONResponseToClient(&authResponse)
-		if err != nil {
-			e <- err
-			return
+		if !authSuccess && session.holdConnectError {
+			heldResponse = &authResponse
+		} else {
+			_, err = session.writeJSONResponseToClient(&authResponse)
+			if err != nil {
+				e <- err
+				return
+			}
 		}
 
 		// 发送 version mask 更新
@@ -1037,7 +1466,9 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 		}
 
 		if !authSuccess {
-			err = errors.New("Authorize Failed for Server")
+			err = ErrServerAuthorizeFailed
+		} else if len(mappedName) == 0 {
+			session.manager.setAuthSuffixNeeded(session.miningCoin, session.subaccountName, withSuffix)
 		}
 		// 发送认证结果，nil表示成功
 		e <- err
@@ -1046,23 +1477,26 @@ func (session *StratumSession) serverSubscribeAndAuthorize() (err error) {
 
 	select {
 	case err = <-e:
+		if heldResponse != nil {
+			session.heldConnectError = heldResponse
+		}
+		// 服务器在认证时为矿工设置初始难度，难度提示在认证成功后发送才不会被覆盖
+		if err == nil {
+			err = session.sendMiningSuggestDifficultyToServer()
+		}
 		if err != nil {
 			if glog.V(2) {
-				glog.Warning("Authorize Failed: ", session.clientIPPort, "; ", session.miningCoin, "; ",
-					authWorkerName, "; ", authWorkerPasswd, "; ", userAgent, ";",
-					session.getVersionMaskStr(), "; ", protocol, "; ", err)
+				session.logWarning("Authorize Failed", "auth_worker", authWorkerName, "auth_password", authWorkerPasswd,
+					"user_agent", userAgent, "version_mask", session.getVersionMaskStr(), "stratum_protocol", protocol, "error", err)
 			}
 		} else {
-			if glog.V(2) {
-				glog.Info("Authorize Success: ", session.clientIPPort, "; ", session.miningCoin, "; ",
-					authWorkerName, "; ", authWorkerPasswd, "; ", userAgent, "; ",
-					session.getVersionMaskStr(), "; ", protocol)
-			}
+			session.logInfo(2, "Authorize Success", "auth_worker", authWorkerName, "auth_password", authWorkerPasswd,
+				"user_agent", userAgent, "version_mask", session.getVersionMaskStr(), "stratum_protocol", protocol)
 		}
 
 	case <-time.After(readServerResponseTimeoutSeconds * time.Second):
 		err = errors.New("Authorize Timeout")
-		glog.Warning(err)
+		session.logWarning("Authorize Timeout")
 	}
 
 	return
@@ -1088,7 +1522,7 @@ func (session *StratumSession) stratumHandleServerNotify(notify *JSONRPCRequest,
 func (session *StratumSession) stratumHandleServerResponse(response *JSONRPCResponse, authMsgCounter *int, authSuccess *bool, authResponse *JSONRPCResponse) (err error) {
 	id, ok := response.ID.(string)
 	if !ok {
-		glog.Warning("Server Response ID is Not a String: ", response)
+		session.logWarning("Server Response ID is Not a String", "response", response)
 		return
 	}
 
@@ -1096,6 +1530,9 @@ func (session *StratumSession) stratumHandleServerResponse(response *JSONRPCResp
 	case "configure":
 		// ignore
 
+	case "suggest_difficulty":
+		// ignore
+
 	case "subscribe":
 		err = session.stratumHandleServerSubscribeResponse(response)
 
@@ -1126,46 +1563,46 @@ func (session *StratumSession) stratumHandleServerSubscribeResponse(response *JS
 	case ProtocolBitcoinStratum:
 		result, ok := response.Result.([]interface{})
 		if !ok {
-			glog.Warning("Parse Subscribe Response Failed: result is not an array")
+			session.logWarning("Parse Subscribe Response Failed: result is not an array")
 			return ErrParseSubscribeResponseFailed
 		}
 		if len(result) < 2 {
-			glog.Warning("Field too Few of Subscribe Response Result: ", result)
+			session.logWarning("Field too Few of Subscribe Response Result", "result", result)
 			return ErrParseSubscribeResponseFailed
 		}
 
 		sessionID, ok := result[1].(string)
 		if !ok {
-			glog.Warning("Parse Subscribe Response Failed: result[1] is not a string")
+			session.logWarning("Parse Subscribe Response Failed: result[1] is not a string")
 			return ErrParseSubscribeResponseFailed
 		}
 
 		// 服务器返回的 sessionID 与当前保存的不一致，此时挖到的所有share都会是无效的，断开连接
 		if sessionID != session.sessionIDString {
-			glog.Warning("Session ID Mismatched:  ", sessionID, " != ", session.sessionIDString)
+			session.logWarning("Session ID Mismatched", "server_session_id", sessionID)
 			return ErrSessionIDInconformity
 		}
 
 	case ProtocolEthereumStratumNiceHash:
 		result, ok := response.Result.([]interface{})
 		if !ok {
-			glog.Warning("Parse Subscribe Response Failed: result is not an array")
+			session.logWarning("Parse Subscribe Response Failed: result is not an array")
 			return ErrParseSubscribeResponseFailed
 		}
 		if len(result) < 2 {
-			glog.Warning("Field too Few of Subscribe Response Result: ", result)
+			session.logWarning("Field too Few of Subscribe Response Result", "result", result)
 			return ErrParseSubscribeResponseFailed
 		}
 
 		notify, ok := result[0].([]interface{})
 		if !ok {
-			glog.Warning("Parse Subscribe Response Failed: result[0] is not a array")
+			session.logWarning("Parse Subscribe Response Failed: result[0] is not a array")
 			return ErrParseSubscribeResponseFailed
 		}
 
 		sessionID, ok := notify[1].(string)
 		if !ok {
-			glog.Warning("Parse Subscribe Response Failed: result[0][1] is not a string")
+			session.logWarning("Parse Subscribe Response Failed: result[0][1] is not a string")
 			return ErrParseSubscribeResponseFailed
 		}
 
@@ -1175,17 +1612,17 @@ func (session *StratumSession) stratumHandleServerSubscribeResponse(response *JS
 		}
 		extraNonce, ok := result[1].(string)
 		if !ok {
-			glog.Warning("Parse Subscribe Response Failed: result[1] is not a string")
+			session.logWarning("Parse Subscribe Response Failed: result[1] is not a string")
 			return ErrParseSubscribeResponseFailed
 		}
 
 		// 服务器返回的 sessionID 与当前保存的不一致，此时挖到的所有share都会是无效的，断开连接
 		if sessionID != session.sessionIDString {
-			glog.Warning("Session ID Mismatched:  ", sessionID, " != ", session.sessionIDString)
+			session.logWarning("Session ID Mismatched", "server_session_id", sessionID)
 			return ErrSessionIDInconformity
 		}
 		if extraNonce != sessionExtraNonce {
-			glog.Warning("ExtraNonce Mismatched:  ", extraNonce, " != ", sessionExtraNonce)
+			session.logWarning("ExtraNonce Mismatched", "server_extranonce", extraNonce, "extranonce", sessionExtraNonce)
 			return ErrSessionIDInconformity
 		}
 
@@ -1194,7 +1631,7 @@ func (session *StratumSession) stratumHandleServerSubscribeResponse(response *JS
 	case ProtocolEthereumProxy:
 		result, ok := response.Result.(bool)
 		if !ok || !result {
-			glog.Warning("Parse Subscribe Response Failed: response is ", response)
+			session.logWarning("Parse Subscribe Response Failed", "response", response)
 			return ErrParseSubscribeResponseFailed
 		}
 
@@ -1203,40 +1640,122 @@ func (session *StratumSession) stratumHandleServerSubscribeResponse(response *JS
 		return ErrParseSubscribeResponseFailed
 	}
 
-	if glog.V(3) {
-		glog.Info("Subscribe Success: ", response)
-	}
+	session.logInfo(3, "Subscribe Success", "response", response)
 	return nil
 }
 
 func (session *StratumSession) proxyStratum() {
-	if session.getStat() != StatRunning {
-		glog.Info("proxyStratum: session stopped by another goroutine")
+	session.lock.Lock()
+	if session.runningStat != StatRunning {
+		session.lock.Unlock()
+		session.logInfo(0, "proxyStratum: session stopped by another goroutine")
 		return
 	}
+	// 在锁内计数，保证冻结会话后等待的goroutine不会遗漏
+	session.ioWaitGroup.Add(2)
+	// 会话停止后 session.manager 被置为nil，此后只使用这里取得的值
+	manager := session.manager
+	// 重连会在锁内替换连接及bufio，两个goroutine只使用这里取得的值
+	serverConn := session.serverConn
+	serverReader := session.serverReader
+	clientReader := session.clientReader
+	session.serverReader = nil
+	session.clientReader = nil
+	// 记录当前的币种切换计数
+	currentReconnectCounter := session.reconnectCounter
+	session.lock.Unlock()
+
+	// 切换币种后旧币种的镜像连接不再有效
+	session.closeMirror()
+
+	// 记录矿机的活动时间，用于检查空闲的矿机
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&session.lastClientDataTime, now)
+	atomic.StoreInt64(&session.lastShareTime, 0)
+	var serverSrc io.Reader = serverConn
+	var clientSrc io.Reader = newActivityReader(session.clientConn, &session.lastClientDataTime)
+	var serverSniffer, clientSniffer *lineSniffer
+	var rewriter *lineRewriter
+
+	// 去掉服务器对认证后发送的难度提示的响应
+	if session.suggestDifficultySent {
+		session.suggestDifficultySent = false
+		rewriter = newLineRewriter(serverSrc, newSuggestDifficultyResponseFilter())
+		serverSrc = rewriter
+	}
+
+	// 开启share统计或share超时检查时，在转发数据的同时逐行解析数据流
+	// BTCAgent的数据流中包含二进制的ex-message，不进行解析
+	if !session.isBTCAgent {
+		var counter *ShareCounter
+		if manager.shareStats != nil {
+			if session.shareCounter == nil {
+				session.shareCounter = NewShareCounter(manager.shareStats)
+			}
+			counter = session.shareCounter
+		}
+		mirror := session.startMirror(session.miningCoin)
+
+		if counter != nil || mirror != nil {
+			serverSniffer = newLineSniffer(serverSrc, func(line []byte) {
+				if counter != nil {
+					counter.onServerLine(line)
+				}
+				if mirror != nil {
+					mirror.onPrimaryLine(line)
+				}
+			})
+			serverSrc = serverSniffer
+		}
+
+		if counter != nil || mirror != nil || manager.minerShareTimeout > 0 {
+			atomic.StoreInt64(&session.lastShareTime, now)
+			coin := session.miningCoin
+			clientSniffer = newLineSniffer(clientSrc, func(line []byte) {
+				var isShare bool
+				if counter != nil {
+					isShare = counter.onClientLine(coin, line)
+				} else {
+					isShare = parseShareSubmit(line) != nil
+				}
+				if isShare {
+					atomic.StoreInt64(&session.lastShareTime, time.Now().UnixNano())
+				}
+				if mirror != nil {
+					mirror.onClientLine(line)
+				}
+			})
+			clientSrc = clientSniffer
+		}
+	}
 
 	// 注册会话
-	session.manager.RegisterStratumSession(session)
+	manager.RegisterStratumSession(session)
 
 	// 从服务器到客户端
 	go func() {
-		// 记录当前的币种切换计数
-		currentReconnectCounter := session.getReconnectCounter()
+		defer session.ioWaitGroup.Done()
 
-		if session.serverReader != nil {
-			bufLen := session.serverReader.Buffered()
+		if serverReader != nil {
+			bufLen := serverReader.Buffered()
 			// 将bufio中的剩余内容写入对端
 			if bufLen > 0 {
 				buf := make([]byte, bufLen)
-				session.serverReader.Read(buf)
-				session.clientConn.Write(buf)
+				serverReader.Read(buf)
+				if rewriter != nil {
+					// 交给逐行处理的Reader，随后续数据一并写入对端
+					rewriter.feed(buf)
+				} else {
+					session.clientConn.Write(buf)
+					if serverSniffer != nil {
+						serverSniffer.feed(buf)
+					}
+				}
 			}
-			// 释放bufio
-			session.serverReader = nil
 		}
 		// 简单的流复制
 		buffer := make([]byte, bufioReaderBufSize)
-		_, err := IOCopyBuffer(session.clientConn, session.serverConn, buffer)
+		_, err := IOCopyBuffer(session.clientConn, serverSrc, buffer)
 		// 流复制结束，说明其中一方关闭了连接
 		// 不对BTCAgent应用重连
 		if err == ErrReadFailed && !session.isBTCAgent {
@@ -1244,71 +1763,104 @@ func (session *StratumSession) proxyStratum() {
 			session.tryReconnect(currentReconnectCounter)
 		} else {
 			// 客户端关闭了连接，结束会话
-			session.tryStop(currentReconnectCounter)
-		}
-		if glog.V(3) {
-			glog.Info("DownStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+			session.tryStop(currentReconnectCounter, "client disconnected")
 		}
+		session.logInfo(3, "DownStream: exited")
 	}()
 
 	// 从客户端到服务器
 	go func() {
-		// 记录当前的币种切换计数
-		currentReconnectCounter := session.getReconnectCounter()
+		defer session.ioWaitGroup.Done()
 
-		if session.clientReader != nil {
-			bufLen := session.clientReader.Buffered()
+		if clientReader != nil {
+			bufLen := clientReader.Buffered()
 			// 将bufio中的剩余内容写入对端
 			if bufLen > 0 {
 				buf := make([]byte, bufLen)
-				session.clientReader.Read(buf)
-				session.serverConn.Write(buf)
+				clientReader.Read(buf)
+				serverConn.Write(buf)
+				if clientSniffer != nil {
+					clientSniffer.feed(buf)
+				}
 			}
-			// 释放bufio
-			session.clientReader = nil
 		}
 		// 简单的流复制
 		buffer := make([]byte, bufioReaderBufSize)
-		bufferLen, err := IOCopyBuffer(session.serverConn, session.clientConn, buffer)
+		bufferLen, err := IOCopyBuffer(serverConn, clientSrc, buffer)
 		// 流复制结束，说明其中一方关闭了连接
 		// 不对BTCAgent应用重连
 		if err == ErrWriteFailed && !session.isBTCAgent {
 			// 服务器关闭了连接，尝试重连
 			session.tryReconnect(currentReconnectCounter)
 			// 若重连成功，尝试将缓存中的内容转发到新服务器
-			// getStat() 会锁定到重连成功或放弃重连为止
-			if bufferLen > 0 && session.getStat() == StatRunning {
-				session.serverConn.Write(buffer[0:bufferLen])
+			// getRunningServerConn() 会锁定到重连成功或放弃重连为止
+			if bufferLen > 0 {
+				if newServerConn := session.getRunningServerConn(); newServerConn != nil {
+					newServerConn.Write(buffer[0:bufferLen])
+				}
 			}
 		} else {
 			// 客户端关闭了连接，结束会话
-			session.tryStop(currentReconnectCounter)
-		}
-		if glog.V(3) {
-			glog.Info("UpStream: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+			session.tryStop(currentReconnectCounter, "client disconnected")
 		}
+		session.logInfo(3, "UpStream: exited")
 	}()
 
-	// 监控来自zookeeper的切换指令并进行Stratum切换
-	go func() {
-		// 记录当前的币种切换计数
-		currentReconnectCounter := session.getReconnectCounter()
-
-		for {
-			<-session.zkWatchEvent
+	// 监控来自zookeeper或kafka的切换指令并进行Stratum切换
+	go session.watchMiningCoin(manager)
+}
 
-			if !session.IsRunning() {
-				break
+// watchMiningCoin 监控来自zookeeper或kafka的切换指令，按防抖、最短停留时间及故障转移的规则切换币种
+// 切换或会话停止、重连后退出。manager 由调用者在会话运行时取得，会话停止后 session.manager 为nil
+func (session *StratumSession) watchMiningCoin(manager *StratumSessionManager) {
+	// 记录当前的币种切换计数
+	currentReconnectCounter := session.getReconnectCounter()
+	// 等待切换的币种（防抖或最短停留时间未到时）
+	var pendingMiningCoin string
+	// 等待结束后进行切换，为nil表示没有等待中的切换
+	var switchTimer <-chan time.Time
+	// 等待期间强制切换节点被创建时立即切换
+	var switchForced <-chan struct{}
+	// 正在挖备用币种时，定期检查用户设置的币种是否恢复
+	failover := manager.failover
+	var failbackTimer <-chan time.Time
+	if failover != nil && len(session.failoverFrom) > 0 {
+		failbackTimer = time.After(failover.returnInterval)
+	}
+
+	for {
+		delayed := false
+		select {
+		case <-session.zkWatchEvent:
+		case <-switchTimer:
+			delayed = true
+		case <-switchForced:
+			session.logInfo(2, "Mining Coin Switch Forced", "new_coin", pendingMiningCoin)
+			delayed = true
+		case <-failbackTimer:
+			failbackTimer = time.After(failover.returnInterval)
+			// 有等待中的切换时由其决定币种
+			if switchTimer != nil || !failover.IsHealthy(session.failoverFrom) {
+				continue
 			}
+			// 切换回用户设置的币种，不受防抖及最短停留时间的限制
+			pendingMiningCoin = session.failoverFrom
+			delayed = true
+		}
 
-			if currentReconnectCounter != session.getReconnectCounter() {
-				break
-			}
+		if stat := session.getStat(); stat == StatStoped || stat == StatUpgrading {
+			break
+		}
+
+		if currentReconnectCounter != session.getReconnectCounter() {
+			break
+		}
 
-			data, event, err := session.manager.zookeeperManager.GetW(session.zkWatchPath, session.sessionID)
+		if !delayed {
+			data, event, err := manager.switchWatcher.GetW(session.zkWatchPath, session.sessionID)
 
 			if err != nil {
-				glog.Error("Read From Zookeeper Failed, sleep ", zookeeperConnAliveTimeout, "s: ", session.zkWatchPath, "; ", err)
+				session.logError("Read From Zookeeper Failed", "path", session.zkWatchPath, "error", err, "retry_seconds", zookeeperConnAliveTimeout)
 				time.Sleep(zookeeperConnAliveTimeout * time.Second)
 				continue
 			}
@@ -1317,46 +1869,76 @@ func (session *StratumSession) proxyStratum() {
 			newMiningCoin := string(data)
 
 			// 若币种未改变，则继续监控
-			if newMiningCoin == session.miningCoin {
-				if glog.V(3) {
-					glog.Info("Mining Coin Not Changed: ", session.fullWorkerName, ": ", session.miningCoin, " -> ", newMiningCoin)
-				}
+			if newMiningCoin == session.userCoin() {
+				session.logInfo(3, "Mining Coin Not Changed", "user_coin", session.userCoin(), "new_coin", newMiningCoin)
+				// 币种在等待期间又变回了原值，取消切换
+				switchTimer = nil
+				switchForced = nil
 				continue
 			}
 
 			// 若币种对应的Stratum服务器不存在，则忽略事件并继续监控
-			_, exists := session.manager.stratumServerInfoMap[newMiningCoin]
+			_, exists := manager.stratumServerInfoMap[newMiningCoin]
 			if !exists {
-				glog.Error("Stratum Server Not Found for New Mining Coin: ", newMiningCoin)
+				session.logError("Stratum Server Not Found for New Mining Coin", "new_coin", newMiningCoin)
 				continue
 			}
 
-			// 币种已改变
-			if glog.V(2) {
-				glog.Info("Mining Coin Changed: ", session.fullWorkerName, "; ", session.miningCoin, " -> ", newMiningCoin, "; ", currentReconnectCounter)
-			}
-
-			// 进行币种切换
-			if session.isBTCAgent {
-				// 因为BTCAgent会话是有状态的（一个连接里包含多个AgentSession，
-				// 对应多台矿机），所以没有办法安全的无缝切换BTCAgent会话，
-				// 只能采用断开连接的方法。
-				session.tryStop(currentReconnectCounter)
-			} else {
-				// 普通连接，直接切换币种
-				session.switchCoinType(newMiningCoin, currentReconnectCounter)
+			// 防抖时间或最短停留时间未到，等待后再切换到最后一次设置的币种
+			pendingMiningCoin = newMiningCoin
+			if delay := session.getSwitchDelay(manager); delay > 0 {
+				session.logInfo(2, "Mining Coin Switch Delayed", "new_coin", newMiningCoin, "delay", delay)
+				switchTimer = time.After(delay)
+				switchForced = manager.switchForced()
+				continue
 			}
-			break
 		}
 
-		if glog.V(3) {
-			glog.Info("CoinWatcher: exited; ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
+		newMiningCoin := pendingMiningCoin
+
+		// 币种已改变
+		session.logInfo(2, "Mining Coin Changed", "new_coin", newMiningCoin)
+
+		// 进行币种切换
+		if session.isBTCAgent {
+			// 因为BTCAgent会话是有状态的（一个连接里包含多个AgentSession，
+			// 对应多台矿机），所以没有办法安全的无缝切换BTCAgent会话，
+			// 只能采用断开连接的方法。
+			session.tryStop(currentReconnectCounter, "mining coin changed")
+		} else {
+			// 普通连接，直接切换币种
+			session.switchCoinType(newMiningCoin, currentReconnectCounter)
 		}
-	}()
+		break
+	}
+
+	session.logInfo(3, "CoinWatcher: exited")
+}
+
+// getSwitchDelay 获取切换币种前需要等待的时间，即防抖时间与最短停留时间剩余部分中的较大者
+// 强制切换节点存在时不等待
+func (session *StratumSession) getSwitchDelay(manager *StratumSessionManager) time.Duration {
+	if manager.switchDebounce <= 0 && manager.switchMinDwell <= 0 {
+		return 0
+	}
+	if manager.isSwitchForced() {
+		return 0
+	}
+
+	since := session.miningCoinSince
+	if since.IsZero() {
+		since = session.connectedAt
+	}
+
+	delay := manager.switchDebounce
+	if dwell := manager.switchMinDwell - time.Since(since); dwell > delay {
+		delay = dwell
+	}
+	return delay
 }
 
 // 检查是否发生了重连，若未发生重连，则停止会话
-func (session *StratumSession) tryStop(currentReconnectCounter uint32) bool {
+func (session *StratumSession) tryStop(currentReconnectCounter uint32, reason string) bool {
 	session.lock.Lock()
 	defer session.lock.Unlock()
 
@@ -1368,6 +1950,7 @@ func (session *StratumSession) tryStop(currentReconnectCounter uint32) bool {
 	// 判断是否已经重连过
 	if currentReconnectCounter == session.reconnectCounter {
 		//未发生重连，尝试停止
+		session.setStopReasonNonLock(reason)
 		go session.Stop()
 		return true
 	}
@@ -1376,6 +1959,29 @@ func (session *StratumSession) tryStop(currentReconnectCounter uint32) bool {
 	return false
 }
 
+// checkIdle 检查矿机是否长时间未发送数据或未提交share，若是则停止会话
+// 会话可能已被其他goroutine停止（此时 session.manager 为nil），因此超时时间由调用者传入
+func (session *StratumSession) checkIdle(now time.Time, idleTimeout time.Duration, shareTimeout time.Duration) bool {
+	var reason string
+
+	lastClientDataTime := atomic.LoadInt64(&session.lastClientDataTime)
+	lastShareTime := atomic.LoadInt64(&session.lastShareTime)
+
+	if idleTimeout > 0 && now.Sub(time.Unix(0, lastClientDataTime)) > idleTimeout {
+		reason = "miner idle timeout"
+	} else if shareTimeout > 0 && lastShareTime != 0 && now.Sub(time.Unix(0, lastShareTime)) > shareTimeout {
+		reason = "miner share timeout"
+	} else {
+		return false
+	}
+
+	if !session.tryStop(session.getReconnectCounter(), reason) {
+		return false
+	}
+	session.logInfo(2, "Stop Idle Session", "reason", reason)
+	return true
+}
+
 // 检查是否发生了重连，若未发生重连，则尝试重连
 func (session *StratumSession) tryReconnect(currentReconnectCounter uint32) bool {
 	session.lock.Lock()
@@ -1392,10 +1998,9 @@ func (session *StratumSession) tryReconnect(currentReconnectCounter uint32) bool
 		// 状态设为“正在重连服务器”，重连计数器加一
 		session.setStatNonLock(StatReconnecting)
 		session.reconnectCounter++
+		session.updateLogContext()
 
-		if glog.V(3) {
-			glog.Info("Reconnect Server: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
-		}
+		session.logInfo(3, "Reconnect Server")
 
 		session.reconnectStratumServer(retryTimeWhenServerDown)
 		return true
@@ -1405,28 +2010,61 @@ func (session *StratumSession) tryReconnect(currentReconnectCounter uint32) bool
 	return false
 }
 
-func (session *StratumSession) switchCoinType(newMiningCoin string, currentReconnectCounter uint32) {
-	// 设置新币种
-	session.miningCoin = newMiningCoin
+// reconnectAfterResume 为服务器连接未被移交的恢复会话重新连接服务器，成功后转入纯代理模式
+func (session *StratumSession) reconnectAfterResume() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if session.runningStat != StatRunning {
+		return
+	}
+	session.setStatNonLock(StatReconnecting)
+	session.reconnectCounter++
+	session.updateLogContext()
+
+	session.reconnectStratumServer(retryTimeWhenServerDown)
+}
 
+func (session *StratumSession) switchCoinType(newMiningCoin string, currentReconnectCounter uint32) {
 	// 锁定会话，防止会话被其他线程停止
 	session.lock.Lock()
 	defer session.lock.Unlock()
 
+	oldMiningCoin := session.miningCoin
+	// 设置新币种
+	session.miningCoin = newMiningCoin
+	session.updateLogContext()
+
 	// 会话未在运行，放弃操作
 	if session.runningStat != StatRunning {
-		glog.Warning("SwitchCoinType: session not running")
+		session.logWarning("SwitchCoinType: session not running")
 		return
 	}
 	// 会话已被其他线程重连，放弃操作
 	if currentReconnectCounter != session.reconnectCounter {
-		glog.Warning("SwitchCoinType: session reconnected by other goroutine")
+		session.logWarning("SwitchCoinType: session reconnected by other goroutine")
 		return
 	}
 	// 会话未被重连，可操作
 	// 状态设为“正在重连服务器”，重连计数器加一
 	session.setStatNonLock(StatReconnecting)
 	session.reconnectCounter++
+	session.updateLogContext()
+
+	session.miningCoinSince = time.Now()
+	if session.shareCounter != nil {
+		session.shareCounter.RecordSwitch(oldMiningCoin, newMiningCoin)
+	}
+	eventType := sessionEventSwitch
+	if len(session.failoverFrom) > 0 && newMiningCoin == session.failoverFrom {
+		eventType = sessionEventFailback
+	}
+	// 切换到用户设置的币种后，故障转移结束
+	session.failoverFrom = ""
+	session.publishEvent(eventType, func(event *SessionEvent) {
+		event.OldCoin = oldMiningCoin
+		event.NewCoin = newMiningCoin
+	})
 
 	// 重连服务器
 	session.reconnectStratumServer(retryTimeWhenServerDown)
@@ -1437,6 +2075,11 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 	// 移除会话注册
 	session.manager.UnRegisterStratumSession(session)
 
+	// 发给原服务器的share不会再收到响应
+	if session.shareCounter != nil {
+		session.shareCounter.FlushPending()
+	}
+
 	// 销毁serverReader
 	if session.serverReader != nil {
 		bufLen := session.serverReader.Buffered()
@@ -1450,8 +2093,10 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 	}
 
 	// 断开原服务器
-	session.serverConn.Close()
-	session.serverConn = nil
+	if session.serverConn != nil {
+		session.serverConn.Close()
+		session.serverConn = nil
+	}
 
 	// 重新创建clientReader
 	if session.clientReader == nil {
@@ -1460,19 +2105,34 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 
 	// 连接服务器
 	var err error
+	// 在当前币种上连续失败的次数
+	failures := 0
+	retryDelay := reconnectRetryMinDelay
 	// 至少要尝试一次，所以从-1开始
 	for i := -1; i < retryTime; i++ {
 		err = session.connectStratumServer()
+		session.recordUpstreamResult(err)
 		if err == nil {
 			break
-		} else {
-			time.Sleep(1 * time.Second)
+		}
+		session.closeServerConn()
+
+		failures++
+		if session.tryFailover(failures, err) {
+			failures = 0
+			retryDelay = reconnectRetryMinDelay
+			continue
+		}
+		time.Sleep(retryDelay)
+		retryDelay *= 2
+		if retryDelay > reconnectRetryMaxDelay {
+			retryDelay = reconnectRetryMaxDelay
 		}
 	}
+	session.publishResultEvent(sessionEventReconnect, err)
 	if err != nil {
-		if glog.V(2) {
-			glog.Info("Reconnect Server Failed: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin, "; ", err)
-		}
+		session.logInfo(2, "Reconnect Server Failed", "error", err)
+		session.setStopReasonNonLock("reconnect server failed: " + err.Error())
 		go session.Stop()
 		return
 	}
@@ -1483,9 +2143,7 @@ func (session *StratumSession) reconnectStratumServer(retryTime int) {
 	// 转入纯代理模式
 	go session.proxyStratum()
 
-	if glog.V(2) {
-		glog.Info("Reconnect Server Success: ", session.clientIPPort, "; ", session.fullWorkerName, "; ", session.miningCoin)
-	}
+	session.logInfo(2, "Reconnect Server Success")
 }
 
 func peekWithTimeout(reader *bufio.Reader, len int, timeout time.Duration) ([]byte, error) {
@@ -1598,10 +2256,48 @@ func (session *StratumSession) writeJSONRequestToServer(jsonData *JSONRPCRequest
 		return 0, err
 	}
 
+	// 握手请求会在镜像服务器上重放
+	if session.manager.mirror != nil {
+		session.serverHandshake = append(session.serverHandshake, append(bytes, '\n'))
+	}
+
 	defer session.serverConn.Write([]byte{'\n'})
 	return session.serverConn.Write(bytes)
 }
 
+// startMirror 若会话被抽样，则为当前币种建立镜像连接
+func (session *StratumSession) startMirror(coin string) *SessionMirror {
+	if session.manager.mirror == nil {
+		return nil
+	}
+	mirror := session.manager.mirror.Start(session, coin, session.serverHandshake)
+	if mirror == nil {
+		return nil
+	}
+
+	session.lock.Lock()
+	if session.runningStat != StatRunning {
+		session.lock.Unlock()
+		mirror.Close()
+		return nil
+	}
+	session.mirror = mirror
+	session.lock.Unlock()
+	return mirror
+}
+
+// closeMirror 关闭会话的镜像连接（若有）
+func (session *StratumSession) closeMirror() {
+	session.lock.Lock()
+	mirror := session.mirror
+	session.mirror = nil
+	session.lock.Unlock()
+
+	if mirror != nil {
+		mirror.Close()
+	}
+}
+
 func (session *StratumSession) getVersionMaskStr() string {
 	return fmt.Sprintf("%08x", session.versionMask)
 }
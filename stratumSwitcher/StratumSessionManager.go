@@ -3,41 +3,82 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/samuel/go-zookeeper/zk"
 	"github.com/willf/bitset"
 )
 
 // StratumServerInfo Stratum服务器的信息
 type StratumServerInfo struct {
+	// host:port、tcp://host:port、tls://host:port 或 unix:///path/to/socket
 	URL        string
 	UserSuffix string
+	// sserver支持以字符串形式接收IPv6矿机的IP
+	SupportIPv6 bool
+	// 该币种在NiceHash上对应的算法名（如 sha256），用于获取NiceHash要求的最低难度
+	NiceHashAlgorithm string
+	// 该币种的服务器故障时临时改挖的备用币种，为空则不进行故障转移
+	FallbackCoin string
+	// 镜像服务器（如待上线的新版sserver），格式与URL相同，为空则不镜像
+	// 抽样的会话的握手请求及share会被复制到镜像服务器，其响应只用于与主服务器对比，不会发给矿机
+	MirrorURL string
+	// 进行镜像的会话比例（1~100，百分比），默认为10
+	MirrorSamplePercent int
+
+	// TLS连接的选项（仅用于 tls:// ）
+	// 验证服务器证书的CA证书文件，为空则使用系统的CA证书
+	TLSCAFile string
+	// 双向认证时使用的客户端证书及私钥文件
+	TLSCertFile string
+	TLSKeyFile  string
+	// 验证服务器证书时使用的域名，为空则使用URL中的主机名
+	TLSServerName string
+	// 不验证服务器证书（仅用于测试）
+	TLSInsecureSkipVerify bool
 }
 
 // StratumServerInfoMap Stratum服务器的信息散列表
 type StratumServerInfoMap map[string]StratumServerInfo
 
+// clone 复制服务器信息散列表
+func (infoMap StratumServerInfoMap) clone() StratumServerInfoMap {
+	newMap := make(StratumServerInfoMap, len(infoMap))
+	for coin, info := range infoMap {
+		newMap[coin] = info
+	}
+	return newMap
+}
+
 // StratumSessionMap Stratum会话散列表
 type StratumSessionMap map[uint32]*StratumSession
 
 // StratumSessionManager Stratum会话管理器
 type StratumSessionManager struct {
+	// 监听器名称（只有一个监听器且未配置 Listeners 时为空）
+	name string
 	// 修改StratumSessionMap时加的锁
 	lock sync.Mutex
 	// 所有处于正常代理状态的会话
 	sessions StratumSessionMap
+	// 所有处于握手阶段（尚未开始代理）的会话
+	handshakeSessions StratumSessionMap
 	// 会话ID管理器
 	sessionIDManager *SessionIDManager
 	// Stratum服务器列表
 	stratumServerInfoMap StratumServerInfoMap
+	// 各币种的服务器连接器
+	upstreamDialers UpstreamDialerMap
 	// Zookeeper管理器
 	zookeeperManager *ZookeeperManager
+	// 币种切换指令的监控器（Zookeeper管理器或Kafka切换事件监控器）
+	switchWatcher SwitchWatcher
 	// zookeeperSwitcherWatchDir 切换服务监控的zookeeper目录路径
 	// 具体监控的路径为 zookeeperSwitcherWatchDir/子账户名
 	zookeeperSwitcherWatchDir string
@@ -52,74 +93,243 @@ type StratumSessionManager struct {
 	stratumServerCaseInsensitive bool
 	// 大小写不敏感的用户名索引（可空，仅在 stratumServerCaseInsensitive == false 时用到）
 	zkUserCaseInsensitiveIndex string
+	// 子账户名映射表（可空），具体路径为 zkUserNameMapDir/币种/子账户名，值为该币种下使用的子账户名
+	zkUserNameMapDir string
+	// 需要使用带币种后缀的矿工名才能认证的子账户，键为“币种/子账户名”
+	// 切换到这些币种时先尝试带后缀的矿工名，避免每次都认证两次
+	authSuffixLock        sync.Mutex
+	authSuffixSubaccounts map[string]bool
+	// 子账户默认难度提示的目录（可空），具体路径为 zkDifficultyHintDir/子账户名
+	zkDifficultyHintDir string
+	// 监听的网络类型（tcp、tcp4或tcp6）
+	tcpListenNetwork string
 	// 监听的IP和TCP端口
 	tcpListenAddr string
 	// TCP监听对象
 	tcpListener net.Listener
-	// 无停机升级对象
-	upgradable *Upgradable
+	// 不停机升级时与新进程通信的Unix Socket路径
+	upgradeSocketPath string
+	// 是否正在进行不停机升级（此时暂停接受新连接）
+	upgrading bool
+	// 是否已开始监听（用于就绪检查）
+	listening bool
+	// 不停机升级时等待新进程报告会话恢复结果的超时时间
+	upgradeResumeTimeout time.Duration
+	// 不停机升级时新进程的会话恢复成功率低于该值则放弃升级
+	upgradeMinResumeRatio float64
+	// share统计（未开启时为nil）
+	shareStats *ShareStatsCollector
+	// 矿机超过该时间未发送任何数据则断开，为0则不检查
+	minerIdleTimeout time.Duration
+	// 矿机超过该时间未提交share则断开，为0则不检查
+	minerShareTimeout time.Duration
+	// 抓包规则管理
+	captureManager *CaptureManager
+	// 矿工名解析器
+	workerNameParser *WorkerNameParser
+	// 切换币种的防抖时间，等待期间币种再次改变则重新计时，只切换到最后设置的币种
+	switchDebounce time.Duration
+	// 会话切换币种后需要停留的最短时间
+	switchMinDwell time.Duration
+	// 强制切换节点的监控器，该节点存在时忽略防抖时间及最短停留时间，立即切换币种（未配置时为nil）
+	switchForceWatcher *SwitchForceWatcher
+	// 预先建立的服务器连接（未开启时为nil）
+	upstreamPreconnector *UpstreamPreconnector
+	// 会话事件发布器（未开启时为nil）
+	eventPublisher *SessionEventPublisher
+	// 故障转移管理器（没有币种配置备用币种时为nil）
+	failover *FailoverManager
+	// 镜像管理器（没有币种配置镜像服务器时为nil）
+	mirror *MirrorManager
+	// NiceHash最低难度监控器（未开启时为nil）
+	niceHashWatcher *NiceHashDifficultyWatcher
+	// 发布会话目录的Zookeeper节点路径（为空则不发布）
+	sessionDirectoryPath string
+	// 会话目录的发布间隔
+	sessionDirectoryInterval time.Duration
 	// 区块链类型
 	chainType ChainType
-	// 用于在错误信息中展示的serverID
-	serverID uint8
+	// 服务器ID（即第一个会话ID块），也用于在错误信息中展示
+	serverID uint32
+	// 会话ID的位数划分
+	sessionIDLayout SessionIDLayout
+	// 分配服务器ID的zookeeper目录（为空表示ID来自配置文件）
+	serverIDAssignDir string
+	// 在zookeeper中为服务器ID及其他会话ID块创建的节点路径，以及节点内容
+	serverIDNodePaths []string
+	serverIDNodeData  []byte
 }
 
 // NewStratumSessionManager 创建Stratum会话管理器
 func NewStratumSessionManager(conf ConfigData, runtimeData RuntimeData) (manager *StratumSessionManager, err error) {
 	var chainType ChainType
-	var indexBits uint8
 
 	switch strings.ToLower(conf.ChainType) {
 	case "bitcoin":
 		chainType = ChainTypeBitcoin
-		indexBits = 24
 	case "decred-normal":
 		chainType = ChainTypeDecredNormal
-		indexBits = 24
 	case "decred-gominer":
 		chainType = ChainTypeDecredGoMiner
-		indexBits = 24
 	case "ethereum":
 		chainType = ChainTypeEthereum
-		indexBits = 16
 	default:
 		err = errors.New("Unknown ChainType: " + conf.ChainType)
 		return
 	}
 
+	sessionIDLayout, err := NewSessionIDLayout(chainType, conf.SessionIDServerBits, conf.SessionIDIndexBits)
+	if err != nil {
+		return
+	}
+
+	workerNameParser, err := NewWorkerNameParser(conf.WorkerNameRules, conf.WorkerNameCharset,
+		conf.WorkerNameSeparators, conf.WorkerNameMaxLength)
+	if err != nil {
+		return
+	}
+
+	upstreamDialers, err := NewUpstreamDialers(conf.StratumServerMap)
+	if err != nil {
+		return
+	}
+
 	manager = new(StratumSessionManager)
 
+	manager.name = conf.Name
 	manager.serverID = conf.ServerID
 	manager.sessions = make(StratumSessionMap)
+	manager.handshakeSessions = make(StratumSessionMap)
 	manager.stratumServerInfoMap = conf.StratumServerMap
+	manager.upstreamDialers = upstreamDialers
 	manager.zookeeperSwitcherWatchDir = conf.ZKSwitcherWatchDir
 	manager.enableUserAutoReg = conf.EnableUserAutoReg
 	manager.zookeeperAutoRegWatchDir = conf.ZKAutoRegWatchDir
 	manager.autoRegAllowUsers = conf.AutoRegMaxWaitUsers
 	manager.stratumServerCaseInsensitive = conf.StratumServerCaseInsensitive
 	manager.zkUserCaseInsensitiveIndex = conf.ZKUserCaseInsensitiveIndex
+	manager.zkUserNameMapDir = conf.ZKUserNameMapDir
+	manager.authSuffixSubaccounts = make(map[string]bool)
+	manager.zkDifficultyHintDir = conf.ZKDifficultyHintDir
+	manager.workerNameParser = workerNameParser
+	manager.captureManager = NewCaptureManager(conf.CaptureDir, conf.CaptureMaxBytes)
+	manager.tcpListenNetwork = conf.ListenNetwork
 	manager.tcpListenAddr = conf.ListenAddr
+	manager.upgradeSocketPath = conf.UpgradeSocketPath
+	manager.upgradeResumeTimeout = time.Duration(conf.UpgradeResumeTimeoutSeconds) * time.Second
+	manager.upgradeMinResumeRatio = conf.UpgradeMinResumeRatio
 	manager.chainType = chainType
+	manager.sessionIDLayout = sessionIDLayout
+	manager.switchDebounce = time.Duration(conf.SwitchDebounceSeconds) * time.Second
+	manager.switchMinDwell = time.Duration(conf.SwitchMinDwellSeconds) * time.Second
+	manager.minerIdleTimeout = time.Duration(conf.MinerIdleTimeoutSeconds) * time.Second
+	manager.minerShareTimeout = time.Duration(conf.MinerShareTimeoutSeconds) * time.Second
+
+	if conf.EnableShareAccounting {
+		manager.shareStats = NewShareStatsCollector()
+	}
+	if conf.PreconnectCount > 0 {
+		manager.upstreamPreconnector = NewUpstreamPreconnector(upstreamDialers, conf.PreconnectCount,
+			time.Duration(conf.PreconnectMaxIdleSeconds)*time.Second)
+	}
+	if len(conf.SessionEventTopic) > 0 {
+		manager.eventPublisher = NewSessionEventPublisher(conf.KafkaBrokers, conf.SessionEventTopic, conf.SessionEventQueueSize)
+	}
+	manager.failover, err = NewFailoverManager(conf.StratumServerMap, upstreamDialers,
+		conf.FailoverMaxFailures, conf.FailoverAuthRejectWorkers, conf.FailoverProbeSeconds, conf.FailoverReturnSeconds)
+	if err != nil {
+		return
+	}
+	manager.mirror, err = NewMirrorManager(conf.StratumServerMap)
+	if err != nil {
+		return
+	}
 
 	manager.zookeeperManager, err = NewZookeeperManager(conf.ZKBroker)
 	if err != nil {
 		return
 	}
 
+	switch conf.SwitchSource {
+	case switchSourceZookeeper:
+		manager.switchWatcher = manager.zookeeperManager
+	case switchSourceKafka:
+		manager.switchWatcher, err = NewKafkaSwitchWatcher(conf.KafkaBrokers, conf.SwitchEventTopic,
+			conf.ZKSwitcherWatchDir, manager.zookeeperManager)
+		if err != nil {
+			return
+		}
+	default:
+		err = errors.New("Unknown SwitchSource: " + conf.SwitchSource)
+		return
+	}
+
+	if len(conf.ZKNiceHashDir) > 0 {
+		var algorithms []string
+		for _, info := range conf.StratumServerMap {
+			if info.NiceHashAlgorithm != "" {
+				algorithms = append(algorithms, info.NiceHashAlgorithm)
+			}
+		}
+		manager.niceHashWatcher = NewNiceHashDifficultyWatcher(manager.zookeeperManager.zookeeperConn, conf.ZKNiceHashDir, algorithms)
+	}
+
+	if len(conf.ZKSwitchForceNode) > 0 {
+		manager.switchForceWatcher = NewSwitchForceWatcher(manager.zookeeperManager.zookeeperConn, conf.ZKSwitchForceNode)
+	}
+
 	if manager.serverID == 0 {
 		// 尝试从zookeeper分配ID
+		manager.serverIDAssignDir = conf.ZKServerIDAssignDir
+		err = manager.checkSessionIDLayout(conf.ZKServerIDAssignDir)
+		if err != nil {
+			return
+		}
 		manager.serverID, err = manager.AssignServerIDFromZK(conf.ZKServerIDAssignDir, runtimeData.ServerID)
 		if err != nil {
 			err = errors.New("Cannot assign server id from zk: " + err.Error())
 			return
 		}
+	} else if manager.serverID > sessionIDLayout.MaxServerID() {
+		err = errors.New("ServerID " + strconv.Itoa(int(manager.serverID)) + " exceeds the maximum " +
+			strconv.Itoa(int(sessionIDLayout.MaxServerID())) + " of SessionIDServerBits")
+		return
 	}
 
-	manager.sessionIDManager, err = NewSessionIDManager(manager.serverID, indexBits)
+	manager.sessionIDManager, err = NewSessionIDManager(manager.serverID, sessionIDLayout.IndexBits)
 	if err != nil {
 		return
 	}
 
+	if len(manager.serverIDAssignDir) > 0 {
+		// 重新占用旧进程租用的其他ID块，以便恢复其中的会话
+		for _, blockID := range runtimeData.SessionIDBlocks {
+			blockErr := manager.leaseSessionIDBlock(blockID)
+			if blockErr == nil {
+				blockErr = manager.sessionIDManager.AddBlock(blockID)
+			}
+			if blockErr != nil {
+				manager.logError("Lease Session ID Block of Old Process Failed", "block_id", blockID, "error", blockErr)
+			}
+		}
+		if conf.SessionIDMaxBlocks > 1 {
+			manager.sessionIDManager.setBlockLeaser(manager.leaseNewSessionIDBlock, conf.SessionIDMaxBlocks)
+		}
+	}
+
+	if len(conf.ZKSessionDirectoryDir) > 0 {
+		err = manager.zookeeperManager.createZookeeperPath(conf.ZKSessionDirectoryDir)
+		if err != nil {
+			return
+		}
+		manager.sessionDirectoryPath = conf.ZKSessionDirectoryDir + strconv.Itoa(int(manager.serverID))
+		if len(manager.name) > 0 {
+			// 不同监听器的服务器ID可能分配自不同的目录
+			manager.sessionDirectoryPath += "-" + manager.name
+		}
+		manager.sessionDirectoryInterval = time.Duration(conf.SessionDirIntervalSeconds) * time.Second
+	}
+
 	if manager.chainType == ChainTypeEthereum {
 		// 由于SessionID是预分配的，为了与要求extraNonce不超过2字节的NiceHash以太坊客户端取得兼容，
 		// 默认采用较大的ID分配间隔，以减少挖矿空间重叠的影响。
@@ -130,7 +340,8 @@ func NewStratumSessionManager(conf ConfigData, runtimeData RuntimeData) (manager
 }
 
 // AssignServerIDFromZK 从Zookeeper分配服务器ID
-func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, oldServerID uint8) (serverID uint8, err error) {
+// 也用于租用新的会话ID块，ID块与服务器ID使用相同的编号空间
+func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, oldServerID uint32) (serverID uint32, err error) {
 	manager.zookeeperManager.createZookeeperPath(assignDir)
 
 	parent := assignDir[:len(assignDir)-1]
@@ -140,34 +351,80 @@ func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, old
 		return
 	}
 
-	childrenSet := bitset.New(256)
+	maxID := manager.sessionIDLayout.MaxServerID()
+	childrenSet := bitset.New(uint(maxID) + 1)
 	childrenSet.Set(0) // id 0 不可分配
 	// 将已分配的id记录到bitset中
 	for _, idStr := range children {
 		idInt, convErr := strconv.Atoi(idStr)
 		if convErr != nil {
-			glog.Warning("AssignServerIDFromZK: strconv.Atoi(", idStr, ") failed. errmsg: ", convErr)
+			manager.logWarning("AssignServerIDFromZK: Invalid Server ID", "id", idStr, "error", convErr)
 			continue
 		}
-		if idInt < 1 || idInt > 255 {
-			glog.Warning("AssignServerIDFromZK: found out of range id in zk: ", idStr)
+		if idInt < 1 || idInt > int(maxID) {
+			manager.logWarning("AssignServerIDFromZK: Server ID Out of Range", "id", idStr)
 			continue
 		}
 		childrenSet.Set(uint(idInt))
 	}
 
-	// 构造写入分配节点的元信息
+	dataJSON := manager.serverIDNodeDataJSON()
+
+	// 寻找并尝试可分配的id，找不到时从头开始再找一次
+	idIndex := uint(oldServerID)
+	if idIndex > uint(maxID) {
+		idIndex = 0
+	}
+	for {
+		newID, success := childrenSet.NextClear(idIndex)
+		if !success {
+			if idIndex > 0 {
+				idIndex = 0
+				continue
+			}
+			err = errors.New("server id is full")
+			return
+		}
+
+		nodePath := assignDir + strconv.Itoa(int(newID))
+		_, err = manager.zookeeperManager.zookeeperConn.Create(nodePath, dataJSON, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+		if err != nil {
+			manager.logWarning("AssignServerIDFromZK: Create Node Failed", "path", nodePath, "error", err)
+			childrenSet.Set(newID)
+			idIndex = newID
+			continue
+		}
+
+		manager.logInfo(0, "AssignServerIDFromZK: Got Server ID", "server_id", newID, "path", nodePath)
+		serverID = uint32(newID)
+		manager.addServerIDNode(nodePath)
+		return
+	}
+}
+
+// serverIDNodeDataJSON 构造写入服务器ID及会话ID块节点的元信息
+func (manager *StratumSessionManager) serverIDNodeDataJSON() []byte {
+	if manager.serverIDNodeData != nil {
+		return manager.serverIDNodeData
+	}
+
 	type SwitcherMetaData struct {
-		ChainType  string
-		Coins      []string
-		IPs        []string
-		HostName   string
-		ListenAddr string
+		ChainType    string
+		Listener     string `json:",omitempty"`
+		Coins        []string
+		IPs          []string
+		HostName     string
+		ListenAddr   string
+		ServerIDBits uint8
+		IndexBits    uint8
 	}
 	var data SwitcherMetaData
 	data.ChainType = manager.chainType.ToString()
+	data.Listener = manager.name
 	data.HostName, _ = os.Hostname()
 	data.ListenAddr = manager.tcpListenAddr
+	data.ServerIDBits = manager.sessionIDLayout.ServerIDBits
+	data.IndexBits = manager.sessionIDLayout.IndexBits
 	for coin := range manager.stratumServerInfoMap {
 		data.Coins = append(data.Coins, coin)
 	}
@@ -177,27 +434,91 @@ func (manager *StratumSessionManager) AssignServerIDFromZK(assignDir string, old
 		}
 	}
 
-	dataJSON, _ := json.Marshal(data)
+	manager.serverIDNodeData, _ = json.Marshal(data)
+	return manager.serverIDNodeData
+}
 
-	// 寻找并尝试可分配的id
-	idIndex := uint(oldServerID)
+// addServerIDNode 记录为服务器ID或会话ID块创建的节点
+func (manager *StratumSessionManager) addServerIDNode(nodePath string) {
+	manager.lock.Lock()
+	manager.serverIDNodePaths = append(manager.serverIDNodePaths, nodePath)
+	manager.lock.Unlock()
+}
+
+// getServerIDNodes 为服务器ID及会话ID块创建的所有节点
+func (manager *StratumSessionManager) getServerIDNodes() []string {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	return append([]string(nil), manager.serverIDNodePaths...)
+}
+
+// leaseSessionIDBlock 在zookeeper中占用指定的会话ID块（不停机升级时继承旧进程的ID块）
+func (manager *StratumSessionManager) leaseSessionIDBlock(blockID uint32) error {
+	if blockID < 1 || blockID > manager.sessionIDLayout.MaxServerID() {
+		return errors.New("session ID block out of range")
+	}
+
+	nodePath := manager.serverIDAssignDir + strconv.Itoa(int(blockID))
+	_, err := manager.zookeeperManager.zookeeperConn.Create(nodePath, manager.serverIDNodeDataJSON(), zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	if err != nil {
+		return err
+	}
+
+	manager.logInfo(0, "Session ID Block Leased", "block_id", blockID, "path", nodePath)
+	manager.addServerIDNode(nodePath)
+	return nil
+}
+
+// leaseNewSessionIDBlock 会话ID即将用尽时，从zookeeper租用一个新的会话ID块
+// 租用的ID块在进程退出（zookeeper会话结束）时释放
+func (manager *StratumSessionManager) leaseNewSessionIDBlock() (uint32, error) {
+	if manager.isUpgrading() {
+		return 0, ErrSessionUpgrading
+	}
+	return manager.AssignServerIDFromZK(manager.serverIDAssignDir, manager.serverID)
+}
+
+// checkSessionIDLayout 检查服务器ID目录中记录的服务器ID位数与配置是否相同，未记录时写入
+// 在同一目录中分配ID的stratumSwitcher必须使用相同的服务器ID位数
+func (manager *StratumSessionManager) checkSessionIDLayout(assignDir string) error {
+	err := manager.zookeeperManager.createZookeeperPath(assignDir)
+	if err != nil {
+		return err
+	}
+
+	type AssignDirData struct {
+		ServerIDBits uint8
+	}
+	expected := AssignDirData{manager.sessionIDLayout.ServerIDBits}
+	expectedJSON, _ := json.Marshal(expected)
+
+	path := assignDir[:len(assignDir)-1]
+	zkConn := manager.zookeeperManager.zookeeperConn
 	for {
-		newID, success := childrenSet.NextClear(idIndex)
-		if !success {
-			err = errors.New("server id is full")
-			return
+		data, stat, err := zkConn.Get(path)
+		if err != nil {
+			return err
 		}
 
-		nodePath := assignDir + strconv.Itoa(int(newID))
-		_, err = manager.zookeeperManager.zookeeperConn.Create(nodePath, dataJSON, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
-		if err != nil {
-			glog.Warning("AssignServerIDFromZK: create ", nodePath, " failed. errmsg: ", err)
-			continue
+		if len(data) == 0 {
+			// 该目录由旧版本创建或刚刚创建，记录当前的位数
+			_, err = zkConn.Set(path, expectedJSON, stat.Version)
+			if err == zk.ErrBadVersion {
+				continue
+			}
+			return err
 		}
 
-		glog.Info("AssignServerIDFromZK: got server id ", newID, " (", nodePath, ")")
-		serverID = uint8(newID)
-		return
+		var current AssignDirData
+		err = json.Unmarshal(data, &current)
+		if err != nil {
+			return errors.New("invalid data of " + path + ": " + string(data))
+		}
+		if current != expected {
+			return fmt.Errorf("SessionIDServerBits mismatch, %s: %d, config: %d", path, current.ServerIDBits, expected.ServerIDBits)
+		}
+		return nil
 	}
 }
 
@@ -208,52 +529,211 @@ func (manager *StratumSessionManager) RunStratumSession(conn net.Conn) {
 
 	if err != nil {
 		conn.Close()
-		glog.Error("NewStratumSession failed: ", err)
+		manager.logError("NewStratumSession Failed", "error", err)
 		return
 	}
 
+	// 匹配抓包规则的会话，记录其连接上的所有数据
+	var clientIP string
+	if ip := parseClientIP(conn.RemoteAddr().String()); ip != nil {
+		clientIP = ip.String()
+	}
+	recorder := manager.captureManager.NewRecorder(CaptureHeader{
+		SessionID: Uint32ToHex(sessionID),
+		ClientIP:  clientIP,
+		ChainType: manager.chainType.ToString(),
+		Listener:  manager.name,
+		ServerID:  manager.serverID,
+		StartTime: time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if recorder != nil {
+		conn = newCaptureConn(conn, recorder, captureDirClientIn, captureDirClientOut)
+	}
+
 	session := NewStratumSession(manager, conn, sessionID)
+	session.recorder = recorder
+	manager.addHandshakeSession(session)
+
+	session.ioWaitGroup.Add(1)
 	session.Run()
+	session.ioWaitGroup.Done()
 }
 
-// ResumeStratumSession 恢复一个Stratum会话
-func (manager *StratumSessionManager) ResumeStratumSession(sessionData StratumSessionData) {
-	clientConn, clientErr := newConnFromFd(sessionData.ClientConnFD)
-	serverConn, serverErr := newConnFromFd(sessionData.ServerConnFD)
+// ResumeStratumSession 从文件描述符恢复一个正在代理的Stratum会话
+// 返回使会话开始读写连接的函数
+func (manager *StratumSessionManager) ResumeStratumSession(sessionData StratumSessionData) (start func(), err error) {
+	clientConn, err := newConnFromFd(sessionData.ClientConnFD)
+	if err != nil {
+		err = errors.New("resume client conn failed: " + err.Error())
+		return
+	}
 
-	if clientErr != nil {
-		glog.Error("Resume client conn failed: ", clientErr)
+	if clientConn.RemoteAddr() == nil {
+		clientConn.Close()
+		err = errors.New("resume client conn failed: downstream exited")
 		return
 	}
 
-	if serverErr != nil {
-		glog.Error("Resume server conn failed: ", clientErr)
+	// 服务器连接未被移交（如TLS连接），恢复后重新连接服务器
+	var serverConn net.Conn
+	if !sessionData.ReconnectServer {
+		serverConn, err = newConnFromFd(sessionData.ServerConnFD)
+		if err != nil {
+			clientConn.Close()
+			err = errors.New("resume server conn failed: " + err.Error())
+			return
+		}
+
+		if serverConn.RemoteAddr() == nil {
+			clientConn.Close()
+			serverConn.Close()
+			err = errors.New("resume server conn failed: upstream exited")
+			return
+		}
+	}
+
+	//恢复sessionID
+	idErr := manager.sessionIDManager.ResumeSessionID(sessionData.SessionID)
+	if idErr != nil {
+		manager.logError("Resume Session ID Failed", "session_id", Uint32ToHex(sessionData.SessionID), "error", idErr)
+	}
+
+	return manager.resumeSession(clientConn, serverConn, sessionData)
+}
+
+// ResumeHandshakeSession 从文件描述符恢复一个处于握手阶段的Stratum会话
+// 返回使会话开始读写连接的函数
+func (manager *StratumSessionManager) ResumeHandshakeSession(sessionData StratumSessionData) (start func(), err error) {
+	clientConn, err := newConnFromFd(sessionData.ClientConnFD)
+	if err != nil {
+		err = errors.New("resume client conn failed: " + err.Error())
 		return
 	}
 
 	if clientConn.RemoteAddr() == nil {
-		glog.Error("Resume client conn failed: downstream exited.")
+		clientConn.Close()
+		err = errors.New("resume client conn failed: downstream exited")
 		return
 	}
 
-	if serverConn.RemoteAddr() == nil {
-		glog.Error("Resume client conn failed: upstream exited.")
+	idErr := manager.sessionIDManager.ResumeSessionID(sessionData.SessionID)
+	if idErr != nil {
+		manager.logError("Resume Session ID Failed", "session_id", Uint32ToHex(sessionData.SessionID), "error", idErr)
+	}
+
+	return manager.resumeSession(clientConn, nil, sessionData)
+}
+
+// resumeSession 根据会话数据重建会话状态，此时不读写任何连接
+// serverConn 为 nil 表示会话处于握手阶段，或服务器连接未被移交（sessionData.ReconnectServer）。
+// 恢复失败的会话将被停止
+func (manager *StratumSessionManager) resumeSession(clientConn net.Conn, serverConn net.Conn, sessionData StratumSessionData) (start func(), err error) {
+	session := NewStratumSession(manager, clientConn, sessionData.SessionID)
+	if sessionData.ConnectedAt > 0 {
+		session.connectedAt = time.Unix(sessionData.ConnectedAt, 0)
+	}
+
+	if serverConn != nil || sessionData.ReconnectServer {
+		err = session.prepareResume(sessionData, serverConn)
+		if err != nil {
+			session.setStopReason("resume session failed: " + err.Error())
+			session.Stop()
+			err = errors.New("resume session " + session.clientIPPort + " failed: " + err.Error())
+			return
+		}
+
+		session.logInfo(2, "Resume Session")
+
+		if serverConn == nil {
+			// 重新连接服务器后转入纯代理模式
+			start = func() {
+				go session.reconnectAfterResume()
+			}
+			return
+		}
+
+		// 此后转入纯代理模式
+		start = session.proxyStratum
 		return
 	}
 
-	//恢复sessionID
-	err := manager.sessionIDManager.ResumeSessionID(sessionData.SessionID)
+	manager.addHandshakeSession(session)
+
+	stat, err := session.prepareResumeHandshake(sessionData)
 	if err != nil {
-		glog.Error("Resume server conn failed: ", err)
+		session.setStopReason("resume session failed: " + err.Error())
+		session.Stop()
+		err = errors.New("resume handshake session " + session.clientIPPort + " failed: " + err.Error())
+		return
 	}
 
-	session := NewStratumSession(manager, clientConn, sessionData.SessionID)
-	session.Resume(sessionData, serverConn)
+	session.logInfo(2, "Resume Handshake Session", "stat", stat)
+
+	// 从中断处继续握手，会继续读取客户端数据，因此需要在新的goroutine中运行
+	start = func() {
+		session.ioWaitGroup.Add(1)
+		go func() {
+			defer session.ioWaitGroup.Done()
+			session.runProxyStratum(stat)
+		}()
+	}
+	return
+}
+
+// addHandshakeSession 记录处于握手阶段的会话（不停机升级时需要移交）
+func (manager *StratumSessionManager) addHandshakeSession(session *StratumSession) {
+	manager.lock.Lock()
+	manager.handshakeSessions[session.sessionID] = session
+	manager.lock.Unlock()
+}
+
+// isProxySession 会话是否处于正常代理状态（已注册）
+func (manager *StratumSessionManager) isProxySession(session *StratumSession) bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	return manager.sessions[session.sessionID] == session
+}
+
+// checkIdleSessions 定期检查并停止长时间未发送数据或未提交share的会话
+func (manager *StratumSessionManager) checkIdleSessions() {
+	manager.logInfo(0, "Check Idle Sessions", "idle_timeout", manager.minerIdleTimeout, "share_timeout", manager.minerShareTimeout)
+
+	for {
+		time.Sleep(idleCheckIntervalSeconds * time.Second)
+
+		manager.lock.Lock()
+		sessions := make([]*StratumSession, 0, len(manager.sessions))
+		for _, session := range manager.sessions {
+			sessions = append(sessions, session)
+		}
+		manager.lock.Unlock()
+
+		now := time.Now()
+		stopped := 0
+		for _, session := range sessions {
+			if session.checkIdle(now, manager.minerIdleTimeout, manager.minerShareTimeout) {
+				stopped++
+			}
+		}
+		if stopped > 0 {
+			manager.logInfo(0, "Idle Sessions Stopped", "count", stopped)
+		}
+	}
+}
+
+// isUpgrading 是否正在进行不停机升级
+func (manager *StratumSessionManager) isUpgrading() bool {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+
+	return manager.upgrading
 }
 
 // RegisterStratumSession 注册Stratum会话（在Stratum会话开始正常代理之后调用）
 func (manager *StratumSessionManager) RegisterStratumSession(session *StratumSession) {
 	manager.lock.Lock()
+	delete(manager.handshakeSessions, session.sessionID)
 	manager.sessions[session.sessionID] = session
 	manager.lock.Unlock()
 }
@@ -265,8 +745,8 @@ func (manager *StratumSessionManager) UnRegisterStratumSession(session *StratumS
 	delete(manager.sessions, session.sessionID)
 	manager.lock.Unlock()
 
-	// 从Zookeeper管理器中删除币种监控
-	manager.zookeeperManager.ReleaseW(session.zkWatchPath, session.sessionID)
+	// 删除币种监控
+	manager.switchWatcher.ReleaseW(session.zkWatchPath, session.sessionID)
 }
 
 // ReleaseStratumSession 释放Stratum会话（在Stratum会话停止时调用）
@@ -274,40 +754,131 @@ func (manager *StratumSessionManager) ReleaseStratumSession(session *StratumSess
 	manager.lock.Lock()
 	// 删除已注册的会话
 	delete(manager.sessions, session.sessionID)
+	delete(manager.handshakeSessions, session.sessionID)
 	manager.lock.Unlock()
 
 	// 释放会话ID
 	manager.sessionIDManager.FreeSessionID(session.sessionID)
-	// 从Zookeeper管理器中删除币种监控
-	manager.zookeeperManager.ReleaseW(session.zkWatchPath, session.sessionID)
+	// 删除币种监控
+	manager.switchWatcher.ReleaseW(session.zkWatchPath, session.sessionID)
 }
 
-// Run 开始运行StratumSwitcher服务
-func (manager *StratumSessionManager) Run(runtimeData RuntimeData) {
+// RunStratumSwitcher 恢复旧进程移交的会话，并开始运行所有监听器
+// runtimeDatas 与 managers 一一对应，upgradeConn 为 nil 表示不是通过Unix Socket升级
+func RunStratumSwitcher(managers []*StratumSessionManager, runtimeDatas []RuntimeData, upgradeConn *net.UnixConn) {
+	upgradable := NewUpgradable(managers)
+
+	var starters []func()
+	total := 0
+	for i, manager := range managers {
+		if runtimeDatas[i].Action == "upgrade" {
+			managerStarters, managerTotal := manager.resumeSessions(runtimeDatas[i])
+			starters = append(starters, managerStarters...)
+			total += managerTotal
+		}
+	}
+
+	if upgradeConn != nil {
+		// 旧进程确认之前不能读写任何连接，因为它可能放弃升级并收回这些会话
+		if !upgradable.confirmUpgrade(upgradeConn, len(starters), total) {
+			upgradable.exitAbortedUpgrade()
+		}
+	}
+
+	for _, start := range starters {
+		start()
+	}
+
+	for i, manager := range managers {
+		manager.listen(runtimeDatas[i].ListenerFD)
+	}
+
+	upgradable.listenSignal()
+
+	for _, manager := range managers[1:] {
+		go manager.Run()
+	}
+	managers[0].Run()
+}
+
+// resumeSessions 恢复旧进程移交的会话，返回使会话开始读写连接的函数及收到的会话总数
+func (manager *StratumSessionManager) resumeSessions(runtimeData RuntimeData) (starters []func(), total int) {
+	total = len(runtimeData.SessionDatas) + len(runtimeData.HandshakeSessionDatas)
+
+	// 恢复 TCP 会话
+	for _, sessionData := range runtimeData.SessionDatas {
+		start, resumeErr := manager.ResumeStratumSession(sessionData)
+		if resumeErr != nil {
+			manager.logError("Resume Session Failed", "session_id", Uint32ToHex(sessionData.SessionID), "error", resumeErr)
+			continue
+		}
+		starters = append(starters, start)
+	}
+	// 恢复处于握手阶段的会话
+	for _, sessionData := range runtimeData.HandshakeSessionDatas {
+		start, resumeErr := manager.ResumeHandshakeSession(sessionData)
+		if resumeErr != nil {
+			manager.logError("Resume Session Failed", "session_id", Uint32ToHex(sessionData.SessionID), "error", resumeErr)
+			continue
+		}
+		starters = append(starters, start)
+	}
+	manager.logInfo(0, "Sessions Resumed", "resumed", len(starters), "total", total)
+	return
+}
+
+// listen 开始监听，listenerFD 不为0时使用从旧进程继承的监听socket
+func (manager *StratumSessionManager) listen(listenerFD uintptr) {
 	var err error
 
-	if runtimeData.Action == "upgrade" {
-		// 恢复 TCP 会话
-		for _, sessionData := range runtimeData.SessionDatas {
-			manager.ResumeStratumSession(sessionData)
+	if listenerFD != 0 {
+		// 使用从旧进程继承的监听socket，升级过程中不会拒绝新连接
+		manager.tcpListener, err = newListenerFromFd(listenerFD)
+		if err != nil {
+			manager.logError("Resume Listener Failed", "error", err)
+		} else if !isSameTCPAddr(manager.tcpListener.Addr(), manager.tcpListenAddr) {
+			// 配置文件中的监听地址已改变
+			manager.logInfo(0, "Listen Address Changed", "old_address", manager.tcpListener.Addr(), "new_address", manager.tcpListenAddr)
+			manager.tcpListener.Close()
+			manager.tcpListener = nil
+		} else {
+			manager.logInfo(0, "Listener Resumed", "address", manager.tcpListener.Addr())
 		}
 	}
 
-	// TCP监听
-	glog.Info("Listen TCP ", manager.tcpListenAddr)
-	manager.tcpListener, err = net.Listen("tcp", manager.tcpListenAddr)
+	if manager.tcpListener == nil {
+		// TCP监听
+		manager.logInfo(0, "Listen", "network", manager.tcpListenNetwork, "address", manager.tcpListenAddr)
+		manager.tcpListener, err = net.Listen(manager.tcpListenNetwork, manager.tcpListenAddr)
 
-	if err != nil {
-		glog.Fatal("listen failed: ", err)
-		return
+		if err != nil {
+			manager.logFatal("Listen Failed", "error", err)
+			return
+		}
 	}
 
-	manager.Upgradable()
+	manager.lock.Lock()
+	manager.listening = true
+	manager.lock.Unlock()
+}
+
+// Run 接受并处理新连接（需先调用 listen）
+func (manager *StratumSessionManager) Run() {
+	if manager.minerIdleTimeout > 0 || manager.minerShareTimeout > 0 {
+		go manager.checkIdleSessions()
+	}
+	if len(manager.sessionDirectoryPath) > 0 {
+		go manager.runSessionDirectory()
+	}
 
 	for {
 		conn, err := manager.tcpListener.Accept()
 
 		if err != nil {
+			if manager.isUpgrading() {
+				// 监听socket已移交给新进程，不再接受连接
+				time.Sleep(upgradeAcceptPauseMilliseconds * time.Millisecond)
+			}
 			continue
 		}
 
@@ -315,18 +886,17 @@ func (manager *StratumSessionManager) Run(runtimeData RuntimeData) {
 	}
 }
 
-// Upgradable 使StratumSwitcher可无停机升级
-func (manager *StratumSessionManager) Upgradable() {
-	manager.upgradable = NewUpgradable(manager)
-
-	go signalUSR2Listener(func() {
-		err := manager.upgradable.upgradeStratumSwitcher()
-		if err != nil {
-			glog.Error("Upgrade Failed: ", err)
-		}
-	})
+// logPrefix 日志前缀，用于区分不同监听器的日志
+func (manager *StratumSessionManager) logPrefix() string {
+	return listenerLogPrefix(manager.name)
+}
 
-	glog.Info("Stratum Switcher is Now Upgradable.")
+// listenerLogPrefix 带有监听器名称的日志前缀，监听器名称为空时没有前缀
+func listenerLogPrefix(name string) string {
+	if len(name) == 0 {
+		return ""
+	}
+	return "[" + name + "] "
 }
 
 // GetRegularSubaccountName 获取规范化的(大小写敏感的)子账户名
@@ -344,14 +914,85 @@ func (manager *StratumSessionManager) GetRegularSubaccountName(subAccountName st
 	path := manager.zkUserCaseInsensitiveIndex + strings.ToLower(subAccountName)
 	regularNameBytes, _, err := manager.zookeeperManager.zookeeperConn.Get(path)
 	if err != nil {
-		if glog.V(3) {
-			glog.Info("GetRegularSubaccountName failed. user: ", subAccountName, ", errmsg: ", err)
-		}
+		manager.logInfo(3, "GetRegularSubaccountName Failed", "subaccount", subAccountName, "error", err)
 		return subAccountName
 	}
 	regularName := string(regularNameBytes)
-	if glog.V(3) {
-		glog.Info("GetRegularSubaccountName: ", subAccountName, " -> ", regularName)
-	}
+	manager.logInfo(3, "GetRegularSubaccountName", "subaccount", subAccountName, "regular_name", regularName)
 	return regularName
 }
+
+// GetMappedSubaccountName 获取子账户在指定币种的Stratum服务器上使用的名称
+// 映射表被禁用或其中没有该子账户时返回false
+func (manager *StratumSessionManager) GetMappedSubaccountName(coin string, subAccountName string) (mappedName string, ok bool) {
+	if len(manager.zkUserNameMapDir) <= 0 {
+		return
+	}
+
+	path := manager.zkUserNameMapDir + coin + "/" + subAccountName
+	mappedNameBytes, _, err := manager.zookeeperManager.zookeeperConn.Get(path)
+	if err != nil {
+		manager.logInfo(3, "GetMappedSubaccountName Failed", "subaccount", subAccountName, "coin", coin, "error", err)
+		return
+	}
+
+	mappedName = strings.TrimSpace(string(mappedNameBytes))
+	if len(mappedName) <= 0 {
+		return
+	}
+	manager.logInfo(3, "GetMappedSubaccountName", "subaccount", subAccountName, "coin", coin, "mapped_name", mappedName)
+	ok = true
+	return
+}
+
+// isAuthSuffixNeeded 子账户上次在该币种认证成功时是否使用了带币种后缀的矿工名
+func (manager *StratumSessionManager) isAuthSuffixNeeded(coin string, subAccountName string) bool {
+	manager.authSuffixLock.Lock()
+	defer manager.authSuffixLock.Unlock()
+	return manager.authSuffixSubaccounts[coin+"/"+subAccountName]
+}
+
+// setAuthSuffixNeeded 记录子账户在该币种认证成功时使用的矿工名是否带币种后缀
+func (manager *StratumSessionManager) setAuthSuffixNeeded(coin string, subAccountName string, withSuffix bool) {
+	manager.authSuffixLock.Lock()
+	defer manager.authSuffixLock.Unlock()
+	if withSuffix {
+		manager.authSuffixSubaccounts[coin+"/"+subAccountName] = true
+	} else {
+		delete(manager.authSuffixSubaccounts, coin+"/"+subAccountName)
+	}
+}
+
+// GetSubaccountDifficultyHint 获取子账户的默认难度提示
+// 未设置 ZKDifficultyHintDir、没有该子账户的节点或其值无效时返回0
+func (manager *StratumSessionManager) GetSubaccountDifficultyHint(subAccountName string) uint64 {
+	if len(manager.zkDifficultyHintDir) <= 0 {
+		return 0
+	}
+
+	path := manager.zkDifficultyHintDir + subAccountName
+	value, _, err := manager.zookeeperManager.zookeeperConn.Get(path)
+	if err != nil {
+		manager.logInfo(3, "GetSubaccountDifficultyHint Failed", "subaccount", subAccountName, "error", err)
+		return 0
+	}
+
+	difficulty := parseDifficultyValue(string(value))
+	if difficulty == 0 && len(strings.TrimSpace(string(value))) > 0 {
+		manager.logWarning("Invalid Difficulty Hint of Sub-account", "subaccount", subAccountName, "value", string(value))
+	}
+	return difficulty
+}
+
+// isSwitchForced 检查是否要求立即切换币种（强制切换节点存在）
+func (manager *StratumSessionManager) isSwitchForced() bool {
+	return manager.switchForceWatcher != nil && manager.switchForceWatcher.IsForced()
+}
+
+// switchForced 返回在强制切换节点存在时关闭的通道，未配置强制切换节点时返回nil
+func (manager *StratumSessionManager) switchForced() <-chan struct{} {
+	if manager.switchForceWatcher == nil {
+		return nil
+	}
+	return manager.switchForceWatcher.Forced()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGetMappedSubaccountName(t *testing.T) {
+	manager, _ := newUpgradeTestManager(t)
+
+	// 映射表被禁用时不访问Zookeeper
+	if name, ok := manager.GetMappedSubaccountName("bcc", "alice"); ok || name != "" {
+		t.Errorf("disabled map returned %q, %v", name, ok)
+	}
+
+	conn := newFakeZookeeperConn(1)
+	manager.zookeeperManager = newFakeZookeeperManager(conn)
+	manager.zkUserNameMapDir = "/stratumSwitcher/usermap/"
+	conn.setNode("/stratumSwitcher/usermap/bcc/alice", " alice_bch\n", 0)
+	conn.setNode("/stratumSwitcher/usermap/bcc/bob", "  ", 0)
+
+	for _, test := range []struct {
+		coin       string
+		subaccount string
+		mappedName string
+		ok         bool
+	}{
+		{"bcc", "alice", "alice_bch", true},
+		// 其他币种没有映射
+		{"btc", "alice", "", false},
+		// 节点不存在
+		{"bcc", "carol", "", false},
+		// 空值视为没有映射
+		{"bcc", "bob", "", false},
+	} {
+		mappedName, ok := manager.GetMappedSubaccountName(test.coin, test.subaccount)
+		if mappedName != test.mappedName || ok != test.ok {
+			t.Errorf("GetMappedSubaccountName(%s, %s) = %q, %v, want %q, %v",
+				test.coin, test.subaccount, mappedName, ok, test.mappedName, test.ok)
+		}
+	}
+}
+
+func TestConnectStratumServerMappedSubaccount(t *testing.T) {
+	manager, watcher := newUpgradeTestManager(t)
+	setTestSubaccountCoin(watcher, "alice", "bcc")
+	setTestSubaccountCoin(watcher, "carol", "bcc")
+
+	conn := newFakeZookeeperConn(1)
+	manager.zookeeperManager = newFakeZookeeperManager(conn)
+	manager.zkUserNameMapDir = "/stratumSwitcher/usermap/"
+	conn.setNode("/stratumSwitcher/usermap/bcc/alice", "alice_bch", 0)
+
+	for _, test := range []struct {
+		worker string
+		// sserver收到的认证请求
+		authorize string
+	}{
+		// 使用映射后的子账户名，只认证一次
+		{"alice.rig1", "mining.authorize alice_bch.rig1"},
+		// 映射表中没有该子账户时使用原名
+		{"carol.rig1", "mining.authorize carol.rig1"},
+	} {
+		clientConn, clientPeer := net.Pipe()
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				if _, err := clientPeer.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		session := NewStratumSession(manager, clientConn, 0x01000007)
+		serverURL, requests := startFakeStratumServer(t, session.sessionIDString, true)
+		manager.stratumServerInfoMap = StratumServerInfoMap{"btc": StratumServerInfo{URL: serverURL}, "bcc": StratumServerInfo{URL: serverURL}}
+		var err error
+		manager.upstreamDialers, err = NewUpstreamDialers(manager.stratumServerInfoMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handshakeTestSession(t, session,
+			`{"id":1,"method":"mining.subscribe","params":["cgminer/4.10"]}`,
+			`{"id":2,"method":"mining.authorize","params":["`+test.worker+`","x"]}`)
+		if err := session.getMiningCoin(); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.connectStratumServer(); err != nil {
+			t.Fatalf("%s: %v", test.worker, err)
+		}
+		session.closeServerConn()
+		clientPeer.Close()
+
+		if n := countRequests(requests, test.authorize); n != 1 {
+			t.Errorf("%s: server received %d %q requests, want 1", test.worker, n, test.authorize)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// coinWatchTest 运行 watchMiningCoin 的测试会话
+// 会话不处于运行状态，switchCoinType 只记录新币种而不重连服务器
+type coinWatchTest struct {
+	t       *testing.T
+	manager *StratumSessionManager
+	watcher *KafkaSwitchWatcher
+	session *StratumSession
+	start   time.Time
+	done    chan struct{}
+}
+
+// newCoinWatchTest 创建子账户 alice 在 btc 上的会话
+func newCoinWatchTest(t *testing.T, configure func(manager *StratumSessionManager)) *coinWatchTest {
+	test := &coinWatchTest{t: t, done: make(chan struct{})}
+	test.manager, test.watcher = newUpgradeTestManager(t)
+	test.manager.stratumServerInfoMap["bsv"] = StratumServerInfo{}
+	setTestSubaccountCoin(test.watcher, "alice", "btc")
+	if configure != nil {
+		configure(test.manager)
+	}
+
+	clientConn, clientPeer := net.Pipe()
+	t.Cleanup(func() { clientPeer.Close() })
+	test.session = NewStratumSession(test.manager, clientConn, 0x01000006)
+	handshakeTestSession(t, test.session,
+		`{"id":1,"method":"mining.subscribe","params":["cgminer/4.10"]}`,
+		`{"id":2,"method":"mining.authorize","params":["alice.rig1","x"]}`)
+	if err := test.session.getMiningCoin(); err != nil {
+		t.Fatal(err)
+	}
+	test.session.setStat(StatReconnecting)
+	return test
+}
+
+// run 在后台运行 watchMiningCoin
+func (test *coinWatchTest) run() {
+	test.start = time.Now()
+	go func() {
+		test.session.watchMiningCoin(test.manager)
+		close(test.done)
+	}()
+	test.t.Cleanup(func() {
+		// 让仍在监控的 watchMiningCoin 退出
+		test.session.setStat(StatStoped)
+		setTestSubaccountCoin(test.watcher, "alice", "stop")
+		<-test.done
+	})
+}
+
+// waitSwitch 等待会话切换币种，返回新币种及从 run 开始经过的时间
+func (test *coinWatchTest) waitSwitch() (string, time.Duration) {
+	select {
+	case <-test.done:
+	case <-time.After(5 * time.Second):
+		test.t.Fatal("mining coin not switched")
+	}
+	test.session.lock.Lock()
+	defer test.session.lock.Unlock()
+	return test.session.miningCoin, time.Since(test.start)
+}
+
+// expectNoSwitch 确认在 duration 内没有切换币种
+func (test *coinWatchTest) expectNoSwitch(duration time.Duration) {
+	select {
+	case <-test.done:
+		test.t.Fatalf("mining coin switched to %s after %v", test.session.miningCoin, time.Since(test.start))
+	case <-time.After(duration):
+	}
+}
+
+func TestWatchMiningCoinDebounce(t *testing.T) {
+	test := newCoinWatchTest(t, func(manager *StratumSessionManager) {
+		manager.switchDebounce = 200 * time.Millisecond
+	})
+	test.run()
+
+	// 防抖期间币种再次改变则重新计时，只切换到最后设置的币种
+	setTestSubaccountCoin(test.watcher, "alice", "bcc")
+	test.expectNoSwitch(100 * time.Millisecond)
+	setTestSubaccountCoin(test.watcher, "alice", "bsv")
+	coin, elapsed := test.waitSwitch()
+	if coin != "bsv" || elapsed < 300*time.Millisecond {
+		t.Errorf("switched to %s after %v, want bsv after 300ms", coin, elapsed)
+	}
+}
+
+func TestWatchMiningCoinDebounceCancel(t *testing.T) {
+	test := newCoinWatchTest(t, func(manager *StratumSessionManager) {
+		manager.switchDebounce = 100 * time.Millisecond
+	})
+	test.run()
+
+	// 币种在等待期间又变回原值，取消切换
+	setTestSubaccountCoin(test.watcher, "alice", "bcc")
+	time.Sleep(50 * time.Millisecond)
+	setTestSubaccountCoin(test.watcher, "alice", "btc")
+	test.expectNoSwitch(300 * time.Millisecond)
+}
+
+func TestWatchMiningCoinMinDwell(t *testing.T) {
+	test := newCoinWatchTest(t, func(manager *StratumSessionManager) {
+		manager.switchMinDwell = 400 * time.Millisecond
+	})
+	// 会话已在当前币种上停留了 200ms
+	test.session.miningCoinSince = time.Now().Add(-200 * time.Millisecond)
+	test.run()
+
+	setTestSubaccountCoin(test.watcher, "alice", "bcc")
+	coin, elapsed := test.waitSwitch()
+	if coin != "bcc" || elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("switched to %s after %v, want bcc after about 200ms", coin, elapsed)
+	}
+
+	// 停留时间已满足时立即切换
+	test = newCoinWatchTest(t, func(manager *StratumSessionManager) {
+		manager.switchMinDwell = 400 * time.Millisecond
+	})
+	test.session.miningCoinSince = time.Now().Add(-time.Second)
+	test.run()
+	setTestSubaccountCoin(test.watcher, "alice", "bcc")
+	if coin, elapsed := test.waitSwitch(); coin != "bcc" || elapsed > 300*time.Millisecond {
+		t.Errorf("switched to %s after %v, want bcc immediately", coin, elapsed)
+	}
+}
+
+func TestWatchMiningCoinForced(t *testing.T) {
+	const forceNode = "/stratumSwitcher/btcbcc_force"
+	conn := newFakeZookeeperConn(1)
+	test := newCoinWatchTest(t, func(manager *StratumSessionManager) {
+		manager.switchDebounce = 10 * time.Second
+		manager.switchForceWatcher = NewSwitchForceWatcher(conn, forceNode)
+	})
+	test.run()
+
+	setTestSubaccountCoin(test.watcher, "alice", "bcc")
+	test.expectNoSwitch(100 * time.Millisecond)
+
+	// 等待期间创建强制切换节点，立即切换
+	conn.setNode(forceNode, "", 0)
+	coin, elapsed := test.waitSwitch()
+	if coin != "bcc" || elapsed > time.Second {
+		t.Errorf("switched to %s after %v, want bcc before the debounce ends", coin, elapsed)
+	}
+
+	// 节点存在期间新的切换指令不等待
+	test = newCoinWatchTest(t, func(manager *StratumSessionManager) {
+		manager.switchDebounce = 10 * time.Second
+		manager.switchForceWatcher = test.manager.switchForceWatcher
+	})
+	test.run()
+	setTestSubaccountCoin(test.watcher, "alice", "bsv")
+	if coin, elapsed := test.waitSwitch(); coin != "bsv" || elapsed > time.Second {
+		t.Errorf("switched to %s after %v, want bsv immediately", coin, elapsed)
+	}
+}
+
+func TestWatchMiningCoinFailback(t *testing.T) {
+	test := newCoinWatchTest(t, func(manager *StratumSessionManager) {
+		manager.stratumServerInfoMap["btc"] = StratumServerInfo{FallbackCoin: "bcc"}
+		var err error
+		manager.failover, err = NewFailoverManager(manager.stratumServerInfoMap, nil, 2, 5, 10, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.failover.returnInterval = 100 * time.Millisecond
+		// 防抖不影响切换回用户设置的币种
+		manager.switchDebounce = 10 * time.Second
+	})
+	failover := test.manager.failover
+	failover.lock.Lock()
+	failover.unhealthy["btc"] = true
+	failover.lock.Unlock()
+
+	// 会话已故障转移到 bcc
+	test.session.miningCoin = "bcc"
+	test.session.failoverFrom = "btc"
+	test.run()
+
+	// btc 恢复之前不切换回去
+	test.expectNoSwitch(250 * time.Millisecond)
+	failover.RecordResult("btc", "alice.rig1", nil)
+	coin, elapsed := test.waitSwitch()
+	if coin != "btc" || elapsed > 2*time.Second {
+		t.Errorf("switched to %s after %v, want btc after the next failback check", coin, elapsed)
+	}
+}
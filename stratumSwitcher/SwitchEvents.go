@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/segmentio/kafka-go"
+)
+
+// 币种切换指令的来源
+const (
+	// 每个会话监控Zookeeper中子账户的节点（默认）
+	switchSourceZookeeper = "zookeeper"
+	// 消费Kafka中的币种切换事件，并分发给本机的会话
+	switchSourceKafka = "kafka"
+)
+
+// 启动时回放切换事件Topic的超时时间
+const switchEventBootstrapTimeoutSeconds = 300
+
+// 连接Kafka及查询Topic信息的超时时间
+const switchEventDialTimeoutSeconds = 10
+
+// 读取切换事件失败后的重试间隔
+const switchEventRetryIntervalSeconds = 5
+
+// SwitchWatcher 币种切换指令的监控器
+// GetW 返回子账户当前的币种及一个一次性的事件channel，币种改变时channel收到事件并关闭，
+// 调用者需要再次调用 GetW 读取新的币种并继续监控。ZookeeperManager 和 KafkaSwitchWatcher 均实现了该接口
+type SwitchWatcher interface {
+	GetW(path string, sessionID uint32) (value []byte, event <-chan zk.Event, err error)
+	ReleaseW(path string, sessionID uint32)
+}
+
+// SwitchEvent 币种切换事件，由userChainAPIServer写入Kafka
+// 消息的Key为子账户名，Value为空（墓碑消息）表示删除该子账户。
+// Topic应开启日志压缩（cleanup.policy=compact），压缩后的Topic即为各子账户币种的快照
+type SwitchEvent struct {
+	SubAccount string `json:"sub_account"`
+	Coin       string `json:"coin"`
+	Timestamp  int64  `json:"timestamp"` // 秒
+}
+
+// switchEventSource 从Kafka消费的各子账户的币种，由同一进程中使用相同Topic及监控路径的所有监听器共用
+// 启动时从头回放Topic得到所有子账户的币种，之后持续消费新事件，并按子账户分发给各监听器的监控器
+type switchEventSource struct {
+	// 同时保护各监听器的监控者，以保证读取币种与设置监控之间不会遗漏事件
+	lock sync.Mutex
+	// 会话监控的路径前缀，路径为 watchDir + 子账户名（与Zookeeper节点路径相同）
+	watchDir string
+	// 各路径（子账户）当前的币种
+	coins map[string][]byte
+	// 各监听器的监控器
+	watchers []*KafkaSwitchWatcher
+}
+
+// KafkaSwitchWatcher 一个监听器的币种切换监控器，从共用的 switchEventSource 获取子账户的币种
+// 按子账户将变化分发给本监听器中监控该子账户的会话，从而不再需要为每个会话设置Zookeeper监控
+type KafkaSwitchWatcher struct {
+	source *switchEventSource
+	// 各路径的监控者
+	watcherChannels map[string]NodeWatcherChannels
+	// 共用数据中不存在的子账户（如刚刚自动注册的子账户）从Zookeeper读取，为nil则不读取
+	zookeeperManager *ZookeeperManager
+}
+
+var (
+	switchEventSourcesLock sync.Mutex
+	// 已载入的切换事件，键为 switchEventSourceKey() 的返回值
+	switchEventSources = make(map[string]*switchEventSource)
+)
+
+// newSwitchEventSource 创建共用的币种数据，不连接Kafka
+func newSwitchEventSource(watchDir string) *switchEventSource {
+	source := new(switchEventSource)
+	source.watchDir = watchDir
+	source.coins = make(map[string][]byte)
+	return source
+}
+
+// newWatcher 为一个监听器创建监控器
+func (source *switchEventSource) newWatcher(zookeeperManager *ZookeeperManager) *KafkaSwitchWatcher {
+	watcher := new(KafkaSwitchWatcher)
+	watcher.source = source
+	watcher.watcherChannels = make(map[string]NodeWatcherChannels)
+	watcher.zookeeperManager = zookeeperManager
+
+	source.lock.Lock()
+	source.watchers = append(source.watchers, watcher)
+	source.lock.Unlock()
+	return watcher
+}
+
+// newKafkaSwitchWatcher 创建使用独立币种数据的监控器，不连接Kafka
+func newKafkaSwitchWatcher(watchDir string, zookeeperManager *ZookeeperManager) *KafkaSwitchWatcher {
+	return newSwitchEventSource(watchDir).newWatcher(zookeeperManager)
+}
+
+// switchEventSourceKey 共用币种数据的键
+func switchEventSourceKey(brokers []string, topic string, watchDir string) string {
+	return strings.Join(brokers, ",") + "|" + topic + "|" + watchDir
+}
+
+// NewKafkaSwitchWatcher 为一个监听器创建监控器
+// 进程中第一个使用该Topic及监控路径的监听器回放Topic，回放到各分区的最新位置后返回；其他监听器直接共用回放结果
+func NewKafkaSwitchWatcher(brokers []string, topic string, watchDir string, zookeeperManager *ZookeeperManager) (watcher *KafkaSwitchWatcher, err error) {
+	if len(brokers) < 1 || len(topic) < 1 {
+		err = errors.New("KafkaBrokers and SwitchEventTopic are required when SwitchSource is kafka")
+		return
+	}
+
+	switchEventSourcesLock.Lock()
+	defer switchEventSourcesLock.Unlock()
+
+	key := switchEventSourceKey(brokers, topic, watchDir)
+	source := switchEventSources[key]
+	if source == nil {
+		source, err = loadSwitchEventSource(brokers, topic, watchDir)
+		if err != nil {
+			return
+		}
+		switchEventSources[key] = source
+	} else {
+		logInfo(0, "Switch events: sharing loaded kafka topic", "topic", topic)
+	}
+
+	watcher = source.newWatcher(zookeeperManager)
+	return
+}
+
+// loadSwitchEventSource 回放切换事件Topic，回放到各分区的最新位置后返回，之后继续在后台消费新事件
+func loadSwitchEventSource(brokers []string, topic string, watchDir string) (source *switchEventSource, err error) {
+	partitions, err := lookupSwitchEventPartitions(brokers, topic)
+	if err != nil {
+		return
+	}
+
+	source = newSwitchEventSource(watchDir)
+	logInfo(0, "Switch events: loading kafka topic", "topic", topic, "partitions", len(partitions), "brokers", brokers)
+
+	caughtUps := make([]chan bool, 0, len(partitions))
+	for _, partition := range partitions {
+		// 分区的最新位置，回放到该位置即完成了启动
+		var first, last int64
+		first, last, err = readSwitchEventOffsets(partition)
+		if err != nil {
+			return
+		}
+
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   brokers,
+			Topic:     topic,
+			Partition: partition.ID,
+			MinBytes:  1,
+			MaxBytes:  10e6,
+		})
+		reader.SetOffset(kafka.FirstOffset)
+
+		caughtUp := make(chan bool)
+		caughtUps = append(caughtUps, caughtUp)
+		if first >= last {
+			// 空分区
+			close(caughtUp)
+			caughtUp = nil
+		}
+		go source.consume(reader, last, caughtUp)
+	}
+
+	timeout := time.After(switchEventBootstrapTimeoutSeconds * time.Second)
+	for _, caughtUp := range caughtUps {
+		select {
+		case <-caughtUp:
+		case <-timeout:
+			err = errors.New("Switch events: loading kafka topic " + topic + " timeout")
+			return
+		}
+	}
+
+	source.lock.Lock()
+	logInfo(0, "Switch events: kafka topic loaded", "topic", topic, "subaccounts", len(source.coins))
+	source.lock.Unlock()
+	return
+}
+
+// lookupSwitchEventPartitions 依次尝试各Kafka服务器，查询Topic的分区
+func lookupSwitchEventPartitions(brokers []string, topic string) (partitions []kafka.Partition, err error) {
+	for _, broker := range brokers {
+		ctx, cancel := context.WithTimeout(context.Background(), switchEventDialTimeoutSeconds*time.Second)
+		partitions, err = kafka.DefaultDialer.LookupPartitions(ctx, "tcp", broker, topic)
+		cancel()
+		if err == nil {
+			if len(partitions) < 1 {
+				err = errors.New("kafka topic " + topic + " has no partition")
+			}
+			return
+		}
+		logWarning("Switch events: lookup partitions failed", "broker", broker, "error", err)
+	}
+	return
+}
+
+// readSwitchEventOffsets 读取分区的起始位置和最新位置
+func readSwitchEventOffsets(partition kafka.Partition) (first int64, last int64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), switchEventDialTimeoutSeconds*time.Second)
+	defer cancel()
+
+	conn, err := kafka.DefaultDialer.DialPartition(ctx, "tcp", "", partition)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(switchEventDialTimeoutSeconds * time.Second))
+	return conn.ReadOffsets()
+}
+
+// consume 持续消费一个分区的事件，读到 lastOffset 之前的所有事件后关闭 caughtUp
+func (source *switchEventSource) consume(reader *kafka.Reader, lastOffset int64, caughtUp chan bool) {
+	for {
+		message, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			logWarning("Switch events: read kafka failed", "retry_in", switchEventRetryIntervalSeconds*time.Second, "error", err)
+			time.Sleep(switchEventRetryIntervalSeconds * time.Second)
+			continue
+		}
+
+		source.applyMessage(message)
+
+		// 压缩后的Topic末尾可能没有消息，因此同时检查读取进度
+		if caughtUp != nil && (message.Offset+1 >= lastOffset || reader.Lag() == 0) {
+			close(caughtUp)
+			caughtUp = nil
+		}
+	}
+}
+
+// applyMessage 应用一条Kafka消息
+func (source *switchEventSource) applyMessage(message kafka.Message) {
+	subaccount := string(message.Key)
+	var coin []byte
+
+	if len(message.Value) > 0 {
+		var event SwitchEvent
+		err := json.Unmarshal(message.Value, &event)
+		if err != nil {
+			logWarning("Switch events: invalid message", "offset", message.Offset, "error", err, "message", string(message.Value))
+			return
+		}
+		if len(subaccount) < 1 {
+			subaccount = event.SubAccount
+		}
+		coin = []byte(event.Coin)
+	}
+
+	if len(subaccount) < 1 {
+		return
+	}
+	source.setCoin(subaccount, coin)
+}
+
+// setCoin 设置子账户的币种，coin为空表示删除。币种改变时通知各监听器中监控该子账户的会话
+func (source *switchEventSource) setCoin(subaccount string, coin []byte) {
+	path := source.watchDir + subaccount
+
+	source.lock.Lock()
+	defer source.lock.Unlock()
+
+	oldCoin, exists := source.coins[path]
+	eventType := zk.EventNodeDataChanged
+
+	if len(coin) < 1 {
+		if !exists {
+			return
+		}
+		delete(source.coins, path)
+		eventType = zk.EventNodeDeleted
+	} else {
+		if exists && bytes.Equal(oldCoin, coin) {
+			return
+		}
+		source.coins[path] = coin
+		if !exists {
+			eventType = zk.EventNodeCreated
+		}
+	}
+
+	logInfo(3, "Switch events: coin changed", "subaccount", subaccount, "old_coin", string(oldCoin), "coin", string(coin))
+
+	for _, watcher := range source.watchers {
+		for _, eventChan := range watcher.watcherChannels[path] {
+			eventChan <- zk.Event{Type: eventType, Path: path}
+			close(eventChan)
+		}
+		delete(watcher.watcherChannels, path)
+	}
+}
+
+// GetW 获取子账户的币种并设置监控
+func (watcher *KafkaSwitchWatcher) GetW(path string, sessionID uint32) (value []byte, event <-chan zk.Event, err error) {
+	source := watcher.source
+
+	source.lock.Lock()
+	value, exists := source.coins[path]
+	source.lock.Unlock()
+
+	if !exists {
+		if watcher.zookeeperManager == nil {
+			err = zk.ErrNoNode
+			return
+		}
+		// 子账户的切换事件可能尚未到达，从Zookeeper读取一次（不设置Zookeeper监控）
+		value, _, err = watcher.zookeeperManager.zookeeperConn.Get(path)
+		if err != nil {
+			return
+		}
+	}
+
+	source.lock.Lock()
+	defer source.lock.Unlock()
+
+	// 释放锁期间可能收到了该子账户的事件，以最新的值为准
+	if current, exists := source.coins[path]; exists {
+		value = current
+	} else if len(value) > 0 {
+		source.coins[path] = value
+	}
+
+	channels, exists := watcher.watcherChannels[path]
+	if !exists {
+		channels = make(NodeWatcherChannels)
+		watcher.watcherChannels[path] = channels
+	}
+
+	eventChan := make(chan zk.Event, 1)
+	channels[sessionID] = eventChan
+	event = eventChan
+	return
+}
+
+// ReleaseW 释放监控
+func (watcher *KafkaSwitchWatcher) ReleaseW(path string, sessionID uint32) {
+	watcher.source.lock.Lock()
+	defer watcher.source.lock.Unlock()
+
+	channels, exists := watcher.watcherChannels[path]
+	if !exists {
+		return
+	}
+
+	eventChan, exists := channels[sessionID]
+	if !exists {
+		return
+	}
+
+	close(eventChan)
+	delete(channels, sessionID)
+	if len(channels) == 0 {
+		delete(watcher.watcherChannels, path)
+	}
+}
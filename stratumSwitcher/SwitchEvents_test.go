@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaSwitchWatcher(t *testing.T) {
+	watcher := newKafkaSwitchWatcher("/switcher/btcbcc/", nil)
+	path := "/switcher/btcbcc/alice"
+
+	if _, _, err := watcher.GetW(path, 1); err != zk.ErrNoNode {
+		t.Fatalf("expected ErrNoNode for unknown sub-account, got %v", err)
+	}
+
+	watcher.source.applyMessage(kafka.Message{Key: []byte("alice"), Value: []byte(`{"sub_account":"alice","coin":"btc"}`)})
+	coin, event1, err := watcher.GetW(path, 1)
+	if err != nil || string(coin) != "btc" {
+		t.Fatalf("GetW returned %q, %v", coin, err)
+	}
+	_, event2, _ := watcher.GetW(path, 2)
+
+	// 币种未改变时不通知
+	watcher.source.applyMessage(kafka.Message{Key: []byte("alice"), Value: []byte(`{"coin":"btc"}`)})
+	select {
+	case <-event1:
+		t.Fatal("unexpected event when coin not changed")
+	default:
+	}
+
+	watcher.ReleaseW(path, 2)
+	if _, ok := <-event2; ok {
+		t.Error("released channel should be closed without event")
+	}
+
+	watcher.source.applyMessage(kafka.Message{Key: []byte("alice"), Value: []byte(`{"coin":"bcc"}`)})
+	e, ok := <-event1
+	if !ok || e.Type != zk.EventNodeDataChanged || e.Path != path {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if _, ok := <-event1; ok {
+		t.Error("event channel should be closed after event")
+	}
+
+	coin, event1, _ = watcher.GetW(path, 1)
+	if string(coin) != "bcc" {
+		t.Errorf("expected bcc, got %q", coin)
+	}
+
+	// 墓碑消息删除子账户
+	watcher.source.applyMessage(kafka.Message{Key: []byte("alice")})
+	if e := <-event1; e.Type != zk.EventNodeDeleted {
+		t.Errorf("expected EventNodeDeleted, got %+v", e)
+	}
+	if _, _, err := watcher.GetW(path, 1); err != zk.ErrNoNode {
+		t.Errorf("expected ErrNoNode after tombstone, got %v", err)
+	}
+}
+
+func TestKafkaSwitchWatcherShared(t *testing.T) {
+	brokers := []string{"127.0.0.1:9092"}
+	path := "/switcher/btcbcc/alice"
+
+	// 已由第一个监听器载入的Topic，其他监听器不再连接Kafka
+	source := newSwitchEventSource("/switcher/btcbcc/")
+	key := switchEventSourceKey(brokers, "switch_events", "/switcher/btcbcc/")
+	switchEventSourcesLock.Lock()
+	switchEventSources[key] = source
+	switchEventSourcesLock.Unlock()
+	defer func() {
+		switchEventSourcesLock.Lock()
+		delete(switchEventSources, key)
+		switchEventSourcesLock.Unlock()
+	}()
+
+	watcher1 := source.newWatcher(nil)
+	watcher2, err := NewKafkaSwitchWatcher(brokers, "switch_events", "/switcher/btcbcc/", nil)
+	if err != nil || watcher2.source != source {
+		t.Fatalf("NewKafkaSwitchWatcher should share the loaded topic, got %v", err)
+	}
+
+	source.applyMessage(kafka.Message{Key: []byte("alice"), Value: []byte(`{"coin":"btc"}`)})
+	// 不同监听器的会话ID可能相同
+	_, event1, _ := watcher1.GetW(path, 1)
+	coin, event2, _ := watcher2.GetW(path, 1)
+	if string(coin) != "btc" {
+		t.Errorf("expected btc, got %q", coin)
+	}
+
+	watcher1.ReleaseW(path, 1)
+	if _, ok := <-event1; ok {
+		t.Error("released channel should be closed without event")
+	}
+
+	source.applyMessage(kafka.Message{Key: []byte("alice"), Value: []byte(`{"coin":"bcc"}`)})
+	if e, ok := <-event2; !ok || e.Type != zk.EventNodeDataChanged {
+		t.Errorf("watcher of the other listener should be notified, got %+v", e)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 监控强制切换节点失败后重试的间隔
+var switchForceWatchRetryInterval = zookeeperConnAliveTimeout * time.Second
+
+// SwitchForceWatcher 监控强制切换节点（ZKSwitchForceNode）
+// 该节点存在时忽略防抖及最短停留时间，节点被创建时等待中的切换立即进行
+type SwitchForceWatcher struct {
+	lock sync.Mutex
+	// 节点是否存在
+	forced bool
+	// 节点存在时为已关闭的通道，否则在节点被创建时关闭
+	forcedChan chan struct{}
+
+	zookeeperConn ZookeeperConn
+	path          string
+}
+
+// NewSwitchForceWatcher 创建强制切换节点的监控器并开始监控
+func NewSwitchForceWatcher(zookeeperConn ZookeeperConn, path string) *SwitchForceWatcher {
+	watcher := new(SwitchForceWatcher)
+	watcher.forcedChan = make(chan struct{})
+	watcher.zookeeperConn = zookeeperConn
+	watcher.path = path
+
+	go watcher.watch()
+	return watcher
+}
+
+// IsForced 强制切换节点是否存在
+func (watcher *SwitchForceWatcher) IsForced() bool {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	return watcher.forced
+}
+
+// Forced 返回在强制切换节点存在时关闭的通道
+func (watcher *SwitchForceWatcher) Forced() <-chan struct{} {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	return watcher.forcedChan
+}
+
+// watch 监控节点的创建与删除
+func (watcher *SwitchForceWatcher) watch() {
+	for {
+		exists, _, event, err := watcher.zookeeperConn.ExistsW(watcher.path)
+		if err != nil {
+			logWarning("Watch Switch Force Node Failed", "path", watcher.path, "error", err, "retry_in", switchForceWatchRetryInterval)
+			time.Sleep(switchForceWatchRetryInterval)
+			continue
+		}
+		watcher.set(exists)
+		<-event
+	}
+}
+
+// set 设置节点是否存在
+func (watcher *SwitchForceWatcher) set(forced bool) {
+	watcher.lock.Lock()
+	defer watcher.lock.Unlock()
+
+	if forced == watcher.forced {
+		return
+	}
+	watcher.forced = forced
+	if forced {
+		close(watcher.forcedChan)
+	} else {
+		watcher.forcedChan = make(chan struct{})
+	}
+	logInfo(0, "Switch Force Node Changed", "path", watcher.path, "forced", forced)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitSwitchForced 等待强制切换节点的状态变为期望值
+func waitSwitchForced(t *testing.T, watcher *SwitchForceWatcher, expected bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for watcher.IsForced() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("IsForced() = %v, want %v", !expected, expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSwitchForceWatcher(t *testing.T) {
+	const path = "/stratumSwitcher/btcbcc_force"
+	conn := newFakeZookeeperConn(1)
+	watcher := NewSwitchForceWatcher(conn, path)
+	for conn.watchCount(path) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if watcher.IsForced() {
+		t.Error("should not be forced before the node is created")
+	}
+
+	// 节点被创建时通知等待中的切换
+	forced := watcher.Forced()
+	conn.setNode(path, "", 0)
+	select {
+	case <-forced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Forced() is not closed after the node is created")
+	}
+	if !watcher.IsForced() {
+		t.Error("should be forced after the node is created")
+	}
+
+	// 节点被删除后恢复等待
+	conn.deleteNode(path)
+	waitSwitchForced(t, watcher, false)
+	select {
+	case <-watcher.Forced():
+		t.Error("Forced() should not be closed after the node is deleted")
+	default:
+	}
+
+	conn.setNode(path, "", 0)
+	waitSwitchForced(t, watcher, true)
+}
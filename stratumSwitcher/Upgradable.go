@@ -1,91 +1,750 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
 )
 
-// 保存运行时状态文件的变量
-const runtimeFilePath = "./runtime.json"
+// 默认的不停机升级Unix Socket路径
+const defaultUpgradeSocketPath = "./upgrade.sock"
 
-// Upgradable 不停机升级StratumSwitcher进程
+// 等待新进程连接及响应的超时时间
+const upgradeHandshakeTimeoutSeconds = 30
+
+// 默认的等待新进程报告会话恢复结果的超时时间
+const defaultUpgradeResumeTimeoutSeconds = 120
+
+// 放弃升级时重新占用服务器ID的最大重试次数（每秒一次）
+// 被杀死的新进程持有的临时节点需要等待其zookeeper会话超时后才会被删除
+const upgradeRestoreServerIDRetries = zookeeperConnAliveTimeout * 3
+
+// 冻结会话后等待其读写goroutine退出的超时时间
+// 需要大于 readServerResponseTimeoutSeconds，以等待正在认证的会话
+const upgradeFreezeTimeoutSeconds = 15
+
+// 升级过程中暂停接受新连接时的休眠时间
+const upgradeAcceptPauseMilliseconds = 100
+
+// 单条升级消息的最大长度
+const upgradeMessageMaxSize = 64 * 1024
+
+// 单条升级消息附带的最大文件描述符数量
+const upgradeMessageMaxFds = 2
+
+// 升级消息的类型
+// 每个监听器先发送运行时数据，再发送其会话，即会话属于此前最近收到的运行时数据对应的监听器
+const (
+	// 运行时数据，附带监听socket
+	upgradeMsgRuntime = "runtime"
+	// 正在代理的会话，附带客户端连接和服务器连接
+	upgradeMsgSession = "session"
+	// 处于握手阶段的会话，附带客户端连接
+	upgradeMsgHandshakeSession = "handshake-session"
+	// 数据发送完毕
+	upgradeMsgEnd = "end"
+	// 新进程已收到全部数据
+	upgradeMsgReceived = "received"
+	// 旧进程已释放服务器ID
+	upgradeMsgReleased = "released"
+	// 新进程的会话恢复结果
+	upgradeMsgResult = "result"
+	// 旧进程确认升级，新进程开始读写连接
+	upgradeMsgCommit = "commit"
+	// 旧进程放弃升级，新进程应当退出
+	upgradeMsgAbort = "abort"
+)
+
+// UpgradeMessage 不停机升级时新旧进程之间通过Unix Socket传递的消息
+// 文件描述符通过 SCM_RIGHTS 附带在消息中
+type UpgradeMessage struct {
+	Type    string
+	Runtime *RuntimeData        `json:",omitempty"`
+	Session *StratumSessionData `json:",omitempty"`
+
+	// 新进程成功恢复的会话数及收到的会话总数
+	ResumedSessions int `json:",omitempty"`
+	TotalSessions   int `json:",omitempty"`
+}
+
+// Upgradable 不停机升级StratumSwitcher进程（包括其中的所有监听器）
 type Upgradable struct {
-	sessionManager *StratumSessionManager
+	sessionManagers []*StratumSessionManager
+}
+
+// frozenListener 升级时一个监听器被冻结的会话
+type frozenListener struct {
+	manager           *StratumSessionManager
+	sessions          []*StratumSession
+	handshakeSessions []*StratumSession
+	// 读写goroutine未能及时退出、无法移交的会话
+	abandonedSessions []*StratumSession
+	// 无法获取连接的文件描述符、未能发送给新进程的会话（已计入会话总数，视为恢复失败）
+	unsentSessions []*StratumSession
 }
 
 // NewUpgradable 创建Upgradable对象
-func NewUpgradable(sessionManager *StratumSessionManager) (upgradable *Upgradable) {
+func NewUpgradable(sessionManagers []*StratumSessionManager) (upgradable *Upgradable) {
 	upgradable = new(Upgradable)
-	upgradable.sessionManager = sessionManager
+	upgradable.sessionManagers = sessionManagers
 	return
 }
 
+// listenSignal 收到SIGUSR2信号时升级进程
+func (upgradable *Upgradable) listenSignal() {
+	go signalUSR2Listener(func() {
+		err := upgradable.upgradeStratumSwitcher()
+		if err != nil {
+			logError("Upgrade Failed", "error", err)
+		}
+	})
+
+	logInfo(0, "Stratum Switcher is Now Upgradable")
+}
+
 // 升级StratumSwitcher进程
+// 启动新进程，通过Unix Socket将所有监听器的监听socket和会话移交给它。
+// 新进程报告会话恢复成功后旧进程退出，否则旧进程收回会话并继续服务
 func (upgradable *Upgradable) upgradeStratumSwitcher() (err error) {
-	glog.Info("Upgrading...")
+	logInfo(0, "Upgrading")
+
+	// 升级相关的配置由所有监听器共用
+	socketPath := upgradable.sessionManagers[0].upgradeSocketPath
+
+	// 清理上次升级残留的socket文件
+	os.Remove(socketPath)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: socketPath, Net: "unixpacket"})
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	var args []string
+	for _, arg := range os.Args[1:] {
+		if !strings.HasPrefix(arg, "-runtime=") && !strings.HasPrefix(arg, "-upgrade-socket=") {
+			args = append(args, arg)
+		}
+	}
+	args = append(args, "-upgrade-socket="+socketPath)
+
+	cmd, err := startNewBin(os.Args[0], args)
+	if err != nil {
+		return
+	}
+
+	// 新进程退出时停止等待其连接
+	exited := make(chan bool)
+	go func() {
+		cmd.Wait()
+		close(exited)
+		listener.Close()
+	}()
+
+	// 等待新进程连接。在此之前旧进程一切照常，失败时无需恢复
+	listener.SetDeadline(time.Now().Add(upgradeHandshakeTimeoutSeconds * time.Second))
+	conn, err := listener.AcceptUnix()
+	if err != nil {
+		cmd.Process.Kill()
+		err = errors.New("waiting for new process failed: " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	frozen, err := upgradable.handOverSessions(conn)
+	if err == nil {
+		// 新进程不会恢复未移交的会话，退出前断开它们，以便记录断开原因及会话事件
+		for _, listener := range frozen {
+			stopFrozenSessions(listener.unsentSessions, "upgrade: session not handed over")
+			stopFrozenSessions(listener.abandonedSessions, "upgrade: session io not exited")
+		}
+		// 由主进程启动时，主进程改为等待新进程
+		notifyMasterUpgraded(cmd.Process.Pid)
+		logInfo(0, "Upgrade Finished, Exit")
+		glog.Flush()
+		os.Exit(0)
+		return
+	}
+
+	// 等待新进程退出后再收回会话，避免两个进程同时读写连接
+	select {
+	case <-exited:
+	case <-time.After(upgradeHandshakeTimeoutSeconds * time.Second):
+		logWarning("New Process Not Exited, Kill It")
+		cmd.Process.Kill()
+	}
+
+	for _, listener := range frozen {
+		listener.manager.rollbackUpgrade(listener.sessions, listener.handshakeSessions, listener.abandonedSessions)
+	}
+	err = errors.New("rolled back: " + err.Error())
+	return
+}
+
+// handOverSessions 冻结所有会话并移交给已连接的新进程
+// 返回 nil 时新进程已确认接管，旧进程应当退出；否则已通知新进程退出，调用者应在其退出后收回 frozen 中的会话
+func (upgradable *Upgradable) handOverSessions(conn *net.UnixConn) (frozen []frozenListener, err error) {
+	// 冻结会话，此后旧进程不再读写这些连接
+	frozen, totalSessions := upgradable.freezeSessions()
+
+	conn.SetDeadline(time.Now().Add(upgradeHandshakeTimeoutSeconds * time.Second))
+	err = upgradable.sendRuntimeData(conn, frozen)
+	if err == nil {
+		err = upgradable.waitResumeResult(conn, totalSessions)
+	}
+	if err == nil {
+		err = writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgCommit})
+	}
+	if err == nil {
+		return
+	}
+
+	// 新进程未能接管会话，通知其退出
+	logError("Upgrade Failed, Rolling Back", "error", err)
+	conn.SetDeadline(time.Now().Add(upgradeHandshakeTimeoutSeconds * time.Second))
+	writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgAbort})
+	return
+}
+
+// freezeSessions 同时冻结所有监听器的会话，返回各监听器被冻结的会话及可移交的会话总数
+func (upgradable *Upgradable) freezeSessions() (frozen []frozenListener, totalSessions int) {
+	frozen = make([]frozenListener, len(upgradable.sessionManagers))
+
+	var waitGroup sync.WaitGroup
+	for i, manager := range upgradable.sessionManagers {
+		waitGroup.Add(1)
+		go func(listener *frozenListener, manager *StratumSessionManager) {
+			defer waitGroup.Done()
+			listener.manager = manager
+			listener.sessions, listener.handshakeSessions, listener.abandonedSessions = manager.freezeSessions()
+		}(&frozen[i], manager)
+	}
+	waitGroup.Wait()
+
+	for _, listener := range frozen {
+		listener.manager.logInfo(0, "Sessions Frozen", "proxying", len(listener.sessions),
+			"handshaking", len(listener.handshakeSessions))
+		totalSessions += len(listener.sessions) + len(listener.handshakeSessions)
+	}
+	return
+}
+
+// waitResumeResult 释放服务器ID，等待新进程报告会话恢复结果并检查恢复成功率
+func (upgradable *Upgradable) waitResumeResult(conn *net.UnixConn, totalSessions int) (err error) {
+	manager := upgradable.sessionManagers[0]
+
+	// 释放Zookeeper中的服务器ID，以便新进程获得相同的ID
+	for _, listenerManager := range upgradable.sessionManagers {
+		err = listenerManager.releaseServerID()
+		if err != nil {
+			return errors.New(listenerManager.logPrefix() + "release server id failed: " + err.Error())
+		}
+	}
+
+	err = writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgReleased})
+	if err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(manager.upgradeResumeTimeout))
+	buf := make([]byte, upgradeMessageMaxSize)
+	msg, _, err := readUpgradeMessage(conn, buf)
+	if err != nil {
+		return errors.New("waiting for resume result failed: " + err.Error())
+	}
+	if msg.Type != upgradeMsgResult {
+		return errors.New("unexpected message from new process: " + msg.Type)
+	}
+
+	logInfo(0, "New Process Resumed Sessions", "resumed", msg.ResumedSessions, "total", msg.TotalSessions, "sent", totalSessions)
+
+	// 以旧进程发送的会话数为准，新进程未收到的会话也算作恢复失败
+	if totalSessions > 0 {
+		ratio := float64(msg.ResumedSessions) / float64(totalSessions)
+		if ratio < manager.upgradeMinResumeRatio {
+			return fmt.Errorf("resume ratio %.4f is lower than %.4f", ratio, manager.upgradeMinResumeRatio)
+		}
+	}
+	return
+}
+
+// releaseServerID 删除zookeeper中的服务器ID及会话ID块节点，但不关闭zookeeper连接
+func (manager *StratumSessionManager) releaseServerID() (err error) {
+	for _, nodePath := range manager.getServerIDNodes() {
+		deleteErr := manager.zookeeperManager.zookeeperConn.Delete(nodePath, -1)
+		if deleteErr != nil {
+			err = errors.New(nodePath + ": " + deleteErr.Error())
+		}
+	}
+	return
+}
+
+// restoreServerID 重新在zookeeper中占用服务器ID及会话ID块（放弃升级时调用）
+func (manager *StratumSessionManager) restoreServerID() {
+	for _, nodePath := range manager.getServerIDNodes() {
+		manager.restoreServerIDNode(nodePath)
+	}
+}
+
+// restoreServerIDNode 重新创建一个服务器ID或会话ID块节点
+func (manager *StratumSessionManager) restoreServerIDNode(nodePath string) {
+	zkConn := manager.zookeeperManager.zookeeperConn
+	for i := 0; ; i++ {
+		_, err := zkConn.Create(nodePath, manager.serverIDNodeData, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+		if err == nil {
+			manager.logInfo(0, "Server ID Restored", "path", nodePath)
+			return
+		}
+
+		if err == zk.ErrNodeExists {
+			// 节点可能未被成功删除，仍属于当前进程
+			_, stat, getErr := zkConn.Get(nodePath)
+			if getErr == nil && stat.EphemeralOwner == zkConn.SessionID() {
+				return
+			}
+		}
+
+		if i >= upgradeRestoreServerIDRetries {
+			manager.logError("Restore Server ID Failed", "path", nodePath, "error", err)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// rollbackUpgrade 放弃升级，收回已冻结的会话并恢复接受新连接
+func (manager *StratumSessionManager) rollbackUpgrade(sessions []*StratumSession, handshakeSessions []*StratumSession, abandonedSessions []*StratumSession) {
+	manager.restoreServerID()
+
+	var starters []func()
+	for _, session := range sessions {
+		start, err := manager.thawSession(session, true)
+		if err != nil {
+			manager.logError("Take Back Session Failed", "error", err)
+			continue
+		}
+		starters = append(starters, start)
+	}
+	for _, session := range handshakeSessions {
+		start, err := manager.thawSession(session, false)
+		if err != nil {
+			manager.logError("Take Back Session Failed", "error", err)
+			continue
+		}
+		starters = append(starters, start)
+	}
+	manager.logInfo(0, "Sessions Taken Back", "resumed", len(starters), "total", len(sessions)+len(handshakeSessions))
+
+	for _, start := range starters {
+		start()
+	}
+
+	// 读写goroutine未能及时退出的会话状态不确定，直接断开
+	stopFrozenSessions(abandonedSessions, "upgrade aborted")
+
+	manager.lock.Lock()
+	manager.upgrading = false
+	manager.lock.Unlock()
+
+	// 恢复接受新连接
+	if tcpListener, ok := manager.tcpListener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Time{})
+	}
+}
+
+// stopFrozenSessions 断开已冻结、但不会被恢复的会话
+func stopFrozenSessions(sessions []*StratumSession, reason string) {
+	for _, session := range sessions {
+		session.setStat(StatRunning)
+		session.setStopReason(reason)
+		session.Stop()
+	}
+}
+
+// thawSession 使用已冻结会话的连接及数据重建会话，与新进程恢复会话的方式相同
+func (manager *StratumSessionManager) thawSession(session *StratumSession, proxying bool) (start func(), err error) {
+	sessionData := session.getSessionData()
+
+	// 释放旧会话对象的币种监控，其监控goroutine将随之退出
+	manager.switchWatcher.ReleaseW(session.zkWatchPath, session.sessionID)
+
+	session.clientConn.SetReadDeadline(time.Time{})
+
+	if !proxying {
+		// 握手阶段的会话可能已连接了服务器，恢复后会重新连接
+		if session.serverConn != nil {
+			session.serverConn.Close()
+		}
+		return manager.resumeSession(session.clientConn, nil, sessionData)
+	}
+
+	session.serverConn.SetReadDeadline(time.Time{})
+	return manager.resumeSession(session.clientConn, session.serverConn, sessionData)
+}
+
+// freezeSessions 暂停接受新连接并冻结所有会话，返回可移交给新进程的会话
+// 以及读写goroutine未能及时退出、无法移交的会话
+func (manager *StratumSessionManager) freezeSessions() (sessions []*StratumSession, handshakeSessions []*StratumSession, abandonedSessions []*StratumSession) {
+	manager.lock.Lock()
+	manager.upgrading = true
+	var allSessions []*StratumSession
+	for _, session := range manager.sessions {
+		allSessions = append(allSessions, session)
+	}
+	for _, session := range manager.handshakeSessions {
+		allSessions = append(allSessions, session)
+	}
+	manager.lock.Unlock()
+
+	// 暂停接受新连接
+	if tcpListener, ok := manager.tcpListener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Now())
+	}
+
+	// 正在重连服务器的会话无法被冻结，它们将在旧进程退出时断开
+	var frozenSessions []*StratumSession
+	for _, session := range allSessions {
+		if session.freeze() {
+			frozenSessions = append(frozenSessions, session)
+		}
+	}
+
+	deadline := time.Now().Add(upgradeFreezeTimeoutSeconds * time.Second)
+	for _, session := range frozenSessions {
+		if !session.waitIOExit(deadline.Sub(time.Now())) {
+			session.logWarning("Session IO not exited, give up")
+			abandonedSessions = append(abandonedSessions, session)
+			continue
+		}
+
+		// 会话可能在冻结前完成了握手，因此要在goroutine退出后重新分类
+		if manager.isProxySession(session) {
+			sessions = append(sessions, session)
+		} else {
+			handshakeSessions = append(handshakeSessions, session)
+		}
+	}
+	return
+}
+
+// writeUpgradeMessage 发送一条升级消息
+func writeUpgradeMessage(conn *net.UnixConn, msg *UpgradeMessage, fds ...uintptr) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > upgradeMessageMaxSize {
+		return errors.New("upgrade message too large: " + msg.Type)
+	}
+	return writeMsgWithFds(conn, data, fds...)
+}
+
+// readUpgradeMessage 读取一条升级消息
+func readUpgradeMessage(conn *net.UnixConn, buf []byte) (msg *UpgradeMessage, fds []uintptr, err error) {
+	data, fds, err := readMsgWithFds(conn, buf, upgradeMessageMaxFds)
+	if err != nil {
+		return
+	}
+
+	msg = new(UpgradeMessage)
+	err = json.Unmarshal(data, msg)
+	return
+}
+
+// sendRuntimeData 将所有监听器的监听socket及会话发送给新进程，并等待其确认
+// 未能发送的会话记录在各监听器的 unsentSessions 中
+func (upgradable *Upgradable) sendRuntimeData(conn *net.UnixConn, frozen []frozenListener) (err error) {
+	for i := range frozen {
+		listener := &frozen[i]
+		listener.unsentSessions, err = listener.manager.sendRuntimeData(conn, listener.sessions, listener.handshakeSessions)
+		if err != nil {
+			return errors.New(listener.manager.logPrefix() + err.Error())
+		}
+		if len(listener.unsentSessions) > 0 {
+			listener.manager.logWarning("Sessions Not Handed Over", "count", len(listener.unsentSessions))
+		}
+	}
+
+	err = writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgEnd})
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, upgradeMessageMaxSize)
+	msg, _, err := readUpgradeMessage(conn, buf)
+	if err != nil {
+		return
+	}
+	if msg.Type != upgradeMsgReceived {
+		return errors.New("unexpected message from new process: " + msg.Type)
+	}
+	return
+}
+
+// sendRuntimeData 发送一个监听器的运行时数据及其会话，返回无法获取文件描述符、未发送的会话
+// 这些会话仍处于冻结状态，放弃升级时与其他会话一同恢复，确认升级时由调用者断开
+func (manager *StratumSessionManager) sendRuntimeData(conn *net.UnixConn, sessions []*StratumSession, handshakeSessions []*StratumSession) (unsent []*StratumSession, err error) {
+	listenerFD, err := getListenerFd(manager.tcpListener)
+	if err != nil {
+		return
+	}
 
 	var runtimeData RuntimeData
+	runtimeData.Version = runtimeDataVersion
 	runtimeData.Action = "upgrade"
-	runtimeData.ServerID = upgradable.sessionManager.serverID
+	runtimeData.ServerID = manager.serverID
+	runtimeData.ChainType = manager.chainType.ToString()
+	runtimeData.Listener = manager.name
+	runtimeData.SessionIDBlocks = manager.sessionIDManager.Blocks()[1:]
+	err = writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgRuntime, Runtime: &runtimeData}, listenerFD)
+	if err != nil {
+		err = errors.New("send listener failed: " + err.Error())
+		return
+	}
 
-	upgradable.sessionManager.lock.Lock()
-	err = func() error {
-		for _, session := range upgradable.sessionManager.sessions {
-			var sessionData StratumSessionData
+	for _, session := range sessions {
+		clientFD, fdErr := getConnFd(session.clientConn)
+		if fdErr != nil {
+			session.logWarning("Hand Over Session Failed", "error", fdErr)
+			unsent = append(unsent, session)
+			continue
+		}
 
-			sessionData.SessionID = session.sessionID
-			sessionData.MiningCoin = session.miningCoin
-			sessionData.StratumSubscribeRequest = session.stratumSubscribeRequest
-			sessionData.StratumAuthorizeRequest = session.stratumAuthorizeRequest
-			sessionData.VersionMask = session.versionMask
+		sessionData := session.getSessionData()
+		fds := []uintptr{clientFD}
+		if canHandOverConn(session.serverConn) {
+			serverFD, fdErr := getConnFd(session.serverConn)
+			if fdErr != nil {
+				session.logWarning("Hand Over Session Failed", "error", fdErr)
+				unsent = append(unsent, session)
+				continue
+			}
+			fds = append(fds, serverFD)
+		} else {
+			// TLS连接的加密状态无法移交，只移交矿机连接，由新进程重新连接服务器
+			// 不支持该字段的旧版本进程会因文件描述符数量不符而放弃恢复这些会话
+			sessionData.ReconnectServer = true
+		}
 
-			sessionData.ClientConnFD, err = getConnFd(session.clientConn)
-			if err != nil {
-				return errors.New("getConnFd Failed: " + err.Error())
+		err = writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgSession, Session: &sessionData}, fds...)
+		if err != nil {
+			err = errors.New("send session failed: " + err.Error())
+			return
+		}
+	}
+
+	for _, session := range handshakeSessions {
+		clientFD, fdErr := getConnFd(session.clientConn)
+		if fdErr != nil {
+			session.logWarning("Hand Over Session Failed", "error", fdErr)
+			unsent = append(unsent, session)
+			continue
+		}
+
+		sessionData := session.getSessionData()
+		err = writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgHandshakeSession, Session: &sessionData}, clientFD)
+		if err != nil {
+			err = errors.New("send handshake session failed: " + err.Error())
+			return
+		}
+	}
+	return
+}
+
+// receiveRuntimeData 连接旧进程的Unix Socket，接收各监听器的监听socket及会话
+// 返回的 runtimeDatas 与 listeners 一一对应，旧进程没有移交的监听器对应空的运行时数据。
+// 返回前会等待旧进程释放服务器ID，以便获得与其相同的ID。
+// 此后仍需通过 upgradeConn 向旧进程报告会话恢复结果。
+// 运行时数据与当前进程不兼容时不会确认接收，旧进程将放弃升级
+func receiveRuntimeData(socketPath string, listeners []ConfigData) (runtimeDatas []RuntimeData, upgradeConn *net.UnixConn, err error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: socketPath, Net: "unixpacket"})
+	if err != nil {
+		return
+	}
+	defer func() {
+		if upgradeConn == nil {
+			conn.Close()
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(upgradeHandshakeTimeoutSeconds * time.Second))
+	buf := make([]byte, upgradeMessageMaxSize)
+
+	runtimeDatas = make([]RuntimeData, len(listeners))
+	// 正在接收的监听器的运行时数据，会话属于最近收到的运行时数据对应的监听器
+	var runtimeData *RuntimeData
+
+	for {
+		msg, fds, readErr := readUpgradeMessage(conn, buf)
+		if readErr != nil {
+			err = errors.New("read upgrade message failed: " + readErr.Error())
+			return
+		}
+
+		if msg.Type != upgradeMsgRuntime && msg.Type != upgradeMsgEnd && runtimeData == nil {
+			// 运行时数据必须最先发送
+			err = errors.New("runtime message not received")
+			return
+		}
+
+		switch msg.Type {
+		case upgradeMsgRuntime:
+			if msg.Runtime == nil || len(fds) != 1 {
+				err = errors.New("invalid runtime message")
+				return
+			}
+			index := findListenerConfig(listeners, msg.Runtime.Listener)
+			if index < 0 {
+				err = errors.New("incompatible runtime data: listener " + msg.Runtime.Listener + " not found in config")
+				return
 			}
+			runtimeData = &runtimeDatas[index]
+			if runtimeData.Action != "" {
+				err = errors.New("duplicate runtime message of listener " + msg.Runtime.Listener)
+				return
+			}
+			runtimeData.Version = msg.Runtime.Version
+			runtimeData.Action = msg.Runtime.Action
+			runtimeData.ServerID = msg.Runtime.ServerID
+			runtimeData.ChainType = msg.Runtime.ChainType
+			runtimeData.Listener = msg.Runtime.Listener
+			runtimeData.SessionIDBlocks = msg.Runtime.SessionIDBlocks
+			runtimeData.ListenerFD = fds[0]
 
-			sessionData.ServerConnFD, err = getConnFd(session.serverConn)
+			err = runtimeData.checkVersion(listeners[index].ChainType)
 			if err != nil {
-				return errors.New("getConnFd Failed: " + err.Error())
+				err = errors.New("incompatible runtime data: " + err.Error())
+				return
 			}
 
-			err = setNoCloseOnExec(sessionData.ClientConnFD)
-			if err != nil {
-				return errors.New("setNoCloseOnExec Failed: " + err.Error())
+		case upgradeMsgSession:
+			expectedFds := 2
+			if msg.Session != nil && msg.Session.ReconnectServer {
+				expectedFds = 1
+			}
+			if msg.Session == nil || len(fds) != expectedFds {
+				logError("Invalid Session Message", "fds", len(fds))
+				continue
+			}
+			msg.Session.ClientConnFD = fds[0]
+			if !msg.Session.ReconnectServer {
+				msg.Session.ServerConnFD = fds[1]
+			}
+			msg.Session.migrate(runtimeData.Version)
+			runtimeData.SessionDatas = append(runtimeData.SessionDatas, *msg.Session)
+
+		case upgradeMsgHandshakeSession:
+			if msg.Session == nil || len(fds) != 1 {
+				logError("Invalid Handshake Session Message", "fds", len(fds))
+				continue
+			}
+			msg.Session.ClientConnFD = fds[0]
+			msg.Session.migrate(runtimeData.Version)
+			runtimeData.HandshakeSessionDatas = append(runtimeData.HandshakeSessionDatas, *msg.Session)
+
+		case upgradeMsgEnd:
+			if runtimeData == nil {
+				err = errors.New("runtime message not received")
+				return
+			}
+
+			for i := range runtimeDatas {
+				if runtimeDatas[i].Action == "" {
+					continue
+				}
+				runtimeDatas[i].Version = runtimeDataVersion
+				logInfo(0, "Sessions Received from Old Process", "listener", listeners[i].Name,
+					"proxying", len(runtimeDatas[i].SessionDatas), "handshaking", len(runtimeDatas[i].HandshakeSessionDatas))
 			}
 
-			err = setNoCloseOnExec(sessionData.ServerConnFD)
+			err = writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgReceived})
 			if err != nil {
-				return errors.New("setNoCloseOnExec Failed: " + err.Error())
+				return
 			}
 
-			runtimeData.SessionDatas = append(runtimeData.SessionDatas, sessionData)
+			// 等待旧进程释放服务器ID
+			msg, _, readErr = readUpgradeMessage(conn, buf)
+			if readErr == io.EOF {
+				// 不支持回滚的旧版本进程会直接退出
+				logInfo(0, "Old Process Exited")
+				return
+			}
+			if readErr != nil {
+				err = errors.New("waiting for old process failed: " + readErr.Error())
+				return
+			}
+			if msg.Type != upgradeMsgReleased {
+				err = errors.New("upgrade aborted by old process: " + msg.Type)
+				return
+			}
+			upgradeConn = conn
+			return
+
+		default:
+			logWarning("Unknown Upgrade Message", "type", msg.Type)
 		}
+	}
+}
 
-		return nil
-	}()
-	upgradable.sessionManager.lock.Unlock()
-	if err != nil {
-		return
+// findListenerConfig 查找旧进程的监听器在配置中的序号，找不到时返回-1
+// 旧进程没有配置 Listeners 时（监听器名称为空）对应第一个监听器
+func findListenerConfig(listeners []ConfigData, name string) int {
+	for i := range listeners {
+		if listeners[i].Name == name {
+			return i
+		}
 	}
+	if name == "" && len(listeners) > 0 {
+		return 0
+	}
+	return -1
+}
 
-	err = runtimeData.SaveToFile(runtimeFilePath)
+// confirmUpgrade 向旧进程报告会话恢复结果并等待其确认，返回新进程是否应当继续运行
+// 旧进程放弃升级时返回 false；旧进程在确认前退出时，会话只能由新进程继续服务
+func (upgradable *Upgradable) confirmUpgrade(conn *net.UnixConn, resumedSessions int, totalSessions int) bool {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(upgradeHandshakeTimeoutSeconds * time.Second))
+	err := writeUpgradeMessage(conn, &UpgradeMessage{Type: upgradeMsgResult, ResumedSessions: resumedSessions, TotalSessions: totalSessions})
 	if err != nil {
-		return
+		// 旧进程可能已发出放弃升级的消息，仍然尝试读取
+		logWarning("Send Resume Result Failed", "error", err)
 	}
 
-	upgradable.sessionManager.zookeeperManager.zookeeperConn.Close()
+	buf := make([]byte, upgradeMessageMaxSize)
+	msg, _, err := readUpgradeMessage(conn, buf)
+	if err == io.EOF {
+		logWarning("Old Process Exited without Confirming, Continue Running")
+		return true
+	}
+	if err == nil && msg.Type == upgradeMsgCommit {
+		logInfo(0, "Upgrade Confirmed by Old Process")
+		return true
+	}
 
-	var args []string
-	for _, arg := range os.Args[1:] {
-		if len(arg) < 9 || arg[0:9] != "-runtime=" {
-			args = append(args, arg)
-		}
+	if err != nil {
+		logError("Waiting for Old Process Confirming Failed", "error", err)
+	} else {
+		logError("Upgrade Aborted by Old Process", "type", msg.Type)
 	}
-	args = append(args, "-runtime="+runtimeFilePath)
+	return false
+}
 
-	err = execNewBin(os.Args[0], args)
-	return
+// exitAbortedUpgrade 旧进程放弃升级后退出新进程
+func (upgradable *Upgradable) exitAbortedUpgrade() {
+	// 立即释放服务器ID，以便旧进程重新占用
+	for _, manager := range upgradable.sessionManagers {
+		manager.zookeeperManager.zookeeperConn.Close()
+	}
+	glog.Flush()
+	os.Exit(1)
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// 升级测试中服务器ID及会话ID块的节点
+var upgradeTestServerIDNodes = []string{"/switcher/servers/1", "/switcher/servers/5"}
+
+// upgradeTest 在同一进程内模拟新旧进程之间的升级流程
+type upgradeTest struct {
+	t          *testing.T
+	manager    *StratumSessionManager
+	zkConn     *fakeZookeeperConn
+	upgradable *Upgradable
+	socketPath string
+	listener   *net.UnixListener
+	// 测试结束时关闭的连接
+	conns []net.Conn
+}
+
+func newUpgradeTest(t *testing.T) *upgradeTest {
+	test := &upgradeTest{t: t}
+	manager, watcher := newUpgradeTestManager(t)
+	setTestSubaccountCoin(watcher, "alice", "btc")
+	test.manager = manager
+	test.upgradable = NewUpgradable([]*StratumSessionManager{manager})
+
+	var err error
+	manager.sessionIDManager, err = NewSessionIDManager(1, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.serverID = 1
+	manager.upgradeMinResumeRatio = 0.9
+	manager.upgradeResumeTimeout = 5 * time.Second
+	manager.tcpListener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { manager.tcpListener.Close() })
+
+	test.zkConn = newFakeZookeeperConn(100)
+	manager.zookeeperManager = newFakeZookeeperManager(test.zkConn)
+	manager.serverIDNodeData = []byte("{}")
+	for _, nodePath := range upgradeTestServerIDNodes {
+		test.zkConn.Create(nodePath, manager.serverIDNodeData, zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+		manager.addServerIDNode(nodePath)
+	}
+	test.zkConn.ops = nil
+
+	test.socketPath = filepath.Join(t.TempDir(), "upgrade.sock")
+	test.listener, err = net.ListenUnix("unixpacket", &net.UnixAddr{Name: test.socketPath, Net: "unixpacket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		test.listener.Close()
+		for _, conn := range test.conns {
+			conn.Close()
+		}
+	})
+	return test
+}
+
+// tcpConnPair 创建一对相互连接的TCP连接
+func (test *upgradeTest) tcpConnPair() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		test.t.Fatal(err)
+	}
+	peer, err := listener.Accept()
+	if err != nil {
+		test.t.Fatal(err)
+	}
+	test.conns = append(test.conns, conn, peer)
+	return conn, peer
+}
+
+// addProxySession 添加一个正在代理的会话，返回矿机端及服务器端的对端连接
+// clientConn 为 nil 时使用TCP连接，否则使用给定的连接（如无法获取文件描述符的连接）
+func (test *upgradeTest) addProxySession(clientConn net.Conn) (clientPeer net.Conn, serverPeer net.Conn, sessionID uint32) {
+	if clientConn == nil {
+		clientConn, clientPeer = test.tcpConnPair()
+	}
+	serverConn, serverPeer := test.tcpConnPair()
+
+	sessionID, err := test.manager.sessionIDManager.AllocSessionID()
+	if err != nil {
+		test.t.Fatal(err)
+	}
+	session := NewStratumSession(test.manager, clientConn, sessionID)
+	handshakeTestSession(test.t, session,
+		`{"id":1,"method":"mining.subscribe","params":["cgminer/4.10"]}`,
+		`{"id":2,"method":"mining.authorize","params":["alice.rig1","x"]}`)
+	if err := session.getMiningCoin(); err != nil {
+		test.t.Fatal(err)
+	}
+	session.serverConn = serverConn
+	session.runningStat = StatRunning
+	test.manager.sessions[sessionID] = session
+	return
+}
+
+// newProcessResult 模拟的新进程的升级结果
+type newProcessResult struct {
+	err error
+	// 收到 released 消息时服务器ID节点是否仍存在
+	nodesExistOnReleased bool
+	sessions             int
+	confirmed            bool
+}
+
+// runNewProcess 在后台模拟新进程：接收运行时数据，等待 delay 后报告恢复了 resumed 个会话
+func (test *upgradeTest) runNewProcess(resumed int, delay time.Duration) <-chan newProcessResult {
+	resultChan := make(chan newProcessResult, 1)
+	go func() {
+		var result newProcessResult
+		defer func() { resultChan <- result }()
+
+		listeners := []ConfigData{{ChainType: ChainTypeBitcoin.ToString()}}
+		runtimeDatas, upgradeConn, err := receiveRuntimeData(test.socketPath, listeners)
+		if err != nil {
+			result.err = err
+			return
+		}
+		for _, nodePath := range upgradeTestServerIDNodes {
+			if test.zkConn.hasNode(nodePath) {
+				result.nodesExistOnReleased = true
+			}
+		}
+		// 不使用收到的连接，只关闭它们
+		syscall.Close(int(runtimeDatas[0].ListenerFD))
+		for _, sessionData := range runtimeDatas[0].SessionDatas {
+			syscall.Close(int(sessionData.ClientConnFD))
+			syscall.Close(int(sessionData.ServerConnFD))
+		}
+		result.sessions = len(runtimeDatas[0].SessionDatas)
+
+		time.Sleep(delay)
+		result.confirmed = test.upgradable.confirmUpgrade(upgradeConn, resumed, result.sessions)
+	}()
+	return resultChan
+}
+
+// handOver 接受新进程的连接并移交会话
+func (test *upgradeTest) handOver() ([]frozenListener, error) {
+	test.listener.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := test.listener.AcceptUnix()
+	if err != nil {
+		test.t.Fatal(err)
+	}
+	test.conns = append(test.conns, conn)
+	return test.upgradable.handOverSessions(conn)
+}
+
+// rollback 放弃升级，收回被冻结的会话并启动它们
+func (test *upgradeTest) rollback(frozen []frozenListener) {
+	for _, listener := range frozen {
+		listener.manager.rollbackUpgrade(listener.sessions, listener.handshakeSessions, listener.abandonedSessions)
+	}
+}
+
+// expectServerIDOps 检查Zookeeper中服务器ID节点的操作顺序
+func (test *upgradeTest) expectServerIDOps(expected ...string) {
+	ops := test.zkConn.getOps()
+	if strings.Join(ops, "; ") != strings.Join(expected, "; ") {
+		test.t.Errorf("zookeeper ops = %v, want %v", ops, expected)
+	}
+}
+
+// expectProxying 检查会话已恢复并在代理数据
+func expectProxying(t *testing.T, manager *StratumSessionManager, sessionID uint32, clientPeer net.Conn, serverPeer net.Conn) {
+	manager.lock.Lock()
+	session := manager.sessions[sessionID]
+	manager.lock.Unlock()
+	if session == nil || session.getStat() != StatRunning {
+		t.Errorf("session %08x not running", sessionID)
+		return
+	}
+
+	line := `{"id":null,"method":"mining.set_difficulty","params":[8]}` + "\n"
+	serverPeer.Write([]byte(line))
+	clientPeer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(line))
+	if _, err := clientPeer.Read(buf); err != nil || string(buf) != line {
+		t.Errorf("session %08x: client read %q, %v", sessionID, buf, err)
+	}
+}
+
+func TestUpgradeCommitted(t *testing.T) {
+	test := newUpgradeTest(t)
+	test.addProxySession(nil)
+	test.addProxySession(nil)
+
+	resultChan := test.runNewProcess(2, 0)
+	frozen, err := test.handOver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := <-resultChan
+	if result.err != nil || result.sessions != 2 || !result.confirmed {
+		t.Errorf("new process: %+v", result)
+	}
+	if result.nodesExistOnReleased {
+		t.Error("server id should be released before the new process is notified")
+	}
+	if len(frozen[0].sessions) != 2 || len(frozen[0].unsentSessions) != 0 {
+		t.Errorf("frozen sessions: %d, unsent: %d", len(frozen[0].sessions), len(frozen[0].unsentSessions))
+	}
+	// 服务器ID由新进程重新占用
+	test.expectServerIDOps("delete "+upgradeTestServerIDNodes[0], "delete "+upgradeTestServerIDNodes[1])
+}
+
+func TestUpgradeRollbackOnLowResumeRatio(t *testing.T) {
+	test := newUpgradeTest(t)
+	clientPeer1, serverPeer1, sessionID1 := test.addProxySession(nil)
+	clientPeer2, serverPeer2, sessionID2 := test.addProxySession(nil)
+	// 无法获取文件描述符的连接，会话不会被发送，但计入会话总数
+	pipeConn, pipePeer := net.Pipe()
+	test.conns = append(test.conns, pipeConn, pipePeer)
+	_, serverPeer3, sessionID3 := test.addProxySession(pipeConn)
+
+	// 新进程恢复了收到的全部会话，但只占旧进程会话总数的 2/3
+	resultChan := test.runNewProcess(2, 0)
+	frozen, err := test.handOver()
+	if err == nil || !strings.Contains(err.Error(), "resume ratio") {
+		t.Fatalf("handOverSessions should fail with low resume ratio, got %v", err)
+	}
+	result := <-resultChan
+	if result.err != nil || result.sessions != 2 || result.confirmed {
+		t.Errorf("new process should be told to exit: %+v", result)
+	}
+	if len(frozen[0].unsentSessions) != 1 || frozen[0].unsentSessions[0].sessionID != sessionID3 {
+		t.Errorf("unsent sessions: %v", frozen[0].unsentSessions)
+	}
+
+	test.rollback(frozen)
+	if test.manager.isUpgrading() {
+		t.Error("manager should not be upgrading after rollback")
+	}
+	// 服务器ID先释放，再重新占用
+	test.expectServerIDOps(
+		"delete "+upgradeTestServerIDNodes[0], "delete "+upgradeTestServerIDNodes[1],
+		"create "+upgradeTestServerIDNodes[0], "create "+upgradeTestServerIDNodes[1])
+	for _, nodePath := range upgradeTestServerIDNodes {
+		if _, stat, err := test.zkConn.Get(nodePath); err != nil || stat.EphemeralOwner != test.zkConn.SessionID() {
+			t.Errorf("server id node %s not restored: %v", nodePath, err)
+		}
+	}
+
+	expectProxying(t, test.manager, sessionID1, clientPeer1, serverPeer1)
+	expectProxying(t, test.manager, sessionID2, clientPeer2, serverPeer2)
+	expectProxying(t, test.manager, sessionID3, pipePeer, serverPeer3)
+}
+
+func TestUpgradeResumeResultTimeout(t *testing.T) {
+	test := newUpgradeTest(t)
+	clientPeer, serverPeer, sessionID := test.addProxySession(nil)
+	test.manager.upgradeResumeTimeout = 100 * time.Millisecond
+
+	// 新进程在旧进程放弃等待后才报告结果
+	resultChan := test.runNewProcess(1, 500*time.Millisecond)
+	frozen, err := test.handOver()
+	if err == nil || !strings.Contains(err.Error(), "waiting for resume result failed") {
+		t.Fatalf("handOverSessions should time out, got %v", err)
+	}
+	if result := <-resultChan; result.err != nil || result.confirmed {
+		t.Errorf("new process should be told to exit: %+v", result)
+	}
+
+	test.rollback(frozen)
+	expectProxying(t, test.manager, sessionID, clientPeer, serverPeer)
+}
+
+func TestUpgradeReleaseServerIDFailed(t *testing.T) {
+	test := newUpgradeTest(t)
+	clientPeer, serverPeer, sessionID := test.addProxySession(nil)
+	test.zkConn.failNext("delete "+upgradeTestServerIDNodes[1], zk.ErrConnectionClosed)
+
+	resultChan := test.runNewProcess(1, 0)
+	frozen, err := test.handOver()
+	if err == nil || !strings.Contains(err.Error(), "release server id failed") {
+		t.Fatalf("handOverSessions should fail, got %v", err)
+	}
+	// 新进程在收到 released 之前就被通知退出
+	if result := <-resultChan; result.err == nil || !strings.Contains(result.err.Error(), upgradeMsgAbort) {
+		t.Errorf("new process should receive abort, got %+v", result)
+	}
+
+	test.rollback(frozen)
+	// 未能删除的节点仍属于当前进程，重新创建失败时不再重试
+	test.expectServerIDOps(
+		"delete "+upgradeTestServerIDNodes[0], "delete "+upgradeTestServerIDNodes[1],
+		"create "+upgradeTestServerIDNodes[0], "create "+upgradeTestServerIDNodes[1])
+	for _, nodePath := range upgradeTestServerIDNodes {
+		if !test.zkConn.hasNode(nodePath) {
+			t.Errorf("server id node %s not restored", nodePath)
+		}
+	}
+	expectProxying(t, test.manager, sessionID, clientPeer, serverPeer)
+}
+
+func TestConfirmUpgrade(t *testing.T) {
+	upgradable := NewUpgradable(nil)
+	for _, test := range []struct {
+		reply     string
+		confirmed bool
+	}{
+		{upgradeMsgCommit, true},
+		{upgradeMsgAbort, false},
+		// 旧进程未确认就退出
+		{"", true},
+	} {
+		oldConn, newConn := newUnixConnPair(t)
+		done := make(chan struct{})
+		go func(reply string) {
+			defer close(done)
+			msg, _, err := readUpgradeMessage(oldConn, make([]byte, upgradeMessageMaxSize))
+			if err != nil || msg.Type != upgradeMsgResult || msg.ResumedSessions != 3 || msg.TotalSessions != 4 {
+				t.Errorf("unexpected result message: %+v, %v", msg, err)
+			}
+			if reply != "" {
+				writeUpgradeMessage(oldConn, &UpgradeMessage{Type: reply})
+			}
+			oldConn.Close()
+		}(test.reply)
+		if confirmed := upgradable.confirmUpgrade(newConn, 3, 4); confirmed != test.confirmed {
+			t.Errorf("reply %q: confirmUpgrade = %v, want %v", test.reply, confirmed, test.confirmed)
+		}
+		<-done
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// newUpgradeTestManager 创建不连接Zookeeper的会话管理器，子账户的币种由返回的监控器提供
+func newUpgradeTestManager(t *testing.T) (*StratumSessionManager, *KafkaSwitchWatcher) {
+	parser, err := NewWorkerNameParser(nil, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := newKafkaSwitchWatcher("/switcher/", nil)
+
+	manager := new(StratumSessionManager)
+	manager.sessions = make(StratumSessionMap)
+	manager.handshakeSessions = make(StratumSessionMap)
+	manager.chainType = ChainTypeBitcoin
+	manager.workerNameParser = parser
+	manager.switchWatcher = watcher
+	manager.zookeeperSwitcherWatchDir = "/switcher/"
+	manager.stratumServerInfoMap = StratumServerInfoMap{"btc": StratumServerInfo{}, "bcc": StratumServerInfo{}}
+	return manager, watcher
+}
+
+// setTestSubaccountCoin 设置子账户的币种
+func setTestSubaccountCoin(watcher *KafkaSwitchWatcher, subaccount string, coin string) {
+	watcher.source.applyMessage(kafka.Message{Key: []byte(subaccount), Value: []byte(`{"coin":"` + coin + `"}`)})
+}
+
+// handshakeTestSession 让会话处理矿机的握手请求，返回握手状态
+func handshakeTestSession(t *testing.T, session *StratumSession, requests ...string) AuthorizeStat {
+	session.protocolType = session.getDefaultStratumProtocol()
+	stat := StatConnected
+	for _, line := range requests {
+		request, err := NewJSONRPCRequest([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, stratumErr := session.stratumHandleRequest(request, &stat); stratumErr != nil {
+			t.Fatalf("%s: %v", line, stratumErr)
+		}
+	}
+	return stat
+}
+
+// transferSessionData 模拟通过升级消息发送会话数据
+func transferSessionData(t *testing.T, sessionData StratumSessionData) StratumSessionData {
+	data, err := json.Marshal(&UpgradeMessage{Type: upgradeMsgSession, Session: &sessionData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg UpgradeMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.Session.migrate(runtimeDataVersion)
+	return *msg.Session
+}
+
+func TestFreezeAndResumeSession(t *testing.T) {
+	manager, watcher := newUpgradeTestManager(t)
+	setTestSubaccountCoin(watcher, "alice", "bcc")
+
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+	serverConn, serverPeer := net.Pipe()
+	defer serverPeer.Close()
+
+	session := NewStratumSession(manager, clientConn, 0x01000002)
+	stat := handshakeTestSession(t, session,
+		`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"1fffe000"}]}`,
+		`{"id":2,"method":"mining.subscribe","params":["NiceHash/1.0.0"]}`,
+		`{"id":3,"method":"mining.suggest_difficulty","params":[65536]}`,
+		`{"id":4,"method":"mining.authorize","params":["alice.rig1","x"]}`)
+	if stat != StatAuthorized {
+		t.Fatalf("handshake stat = %d", stat)
+	}
+	if err := session.getMiningCoin(); err != nil {
+		t.Fatal(err)
+	}
+	// 正在挖备用币种
+	session.failoverFrom = "bcc"
+	session.miningCoin = "btc"
+	session.serverConn = serverConn
+	session.runningStat = StatRunning
+	manager.sessions[session.sessionID] = session
+
+	if !session.freeze() {
+		t.Fatal("running session should be frozen")
+	}
+	if session.getStat() != StatUpgrading {
+		t.Errorf("frozen session stat = %d", session.getStat())
+	}
+	select {
+	case <-session.upgradeNotify:
+	default:
+		t.Error("upgradeNotify should be closed")
+	}
+	if session.freeze() {
+		t.Error("frozen session should not be frozen again")
+	}
+	if !session.waitIOExit(time.Second) {
+		t.Error("session without IO goroutines should exit immediately")
+	}
+
+	sessionData := transferSessionData(t, session.getSessionData())
+
+	resumed := NewStratumSession(manager, clientConn, sessionData.SessionID)
+	if err := resumed.prepareResume(sessionData, serverConn); err != nil {
+		t.Fatal(err)
+	}
+	for name, pair := range map[string][2]interface{}{
+		"fullWorkerName":   {resumed.fullWorkerName, "alice.rig1"},
+		"subaccountName":   {resumed.subaccountName, "alice"},
+		"miningCoin":       {resumed.miningCoin, "btc"},
+		"failoverFrom":     {resumed.failoverFrom, "bcc"},
+		"versionMask":      {resumed.versionMask, uint32(0x1fffe000)},
+		"difficultyHint":   {resumed.difficultyHint, uint64(65536)},
+		"protocolType":     {resumed.protocolType, ProtocolBitcoinStratum},
+		"isNiceHashClient": {resumed.isNiceHashClient, true},
+		"serverConn":       {resumed.serverConn, serverConn},
+	} {
+		if pair[0] != pair[1] {
+			t.Errorf("%s = %v, want %v", name, pair[0], pair[1])
+		}
+	}
+	if resumed.getStat() != StatRunning {
+		t.Errorf("resumed session stat = %d", resumed.getStat())
+	}
+	if err := resumed.prepareResume(sessionData, serverConn); err != ErrSessionIsRunning {
+		t.Errorf("resuming a running session should fail, got %v", err)
+	}
+
+	// 子账户在升级期间改变了币种，不再继续挖备用币种
+	setTestSubaccountCoin(watcher, "alice", "btc")
+	resumed = NewStratumSession(manager, clientConn, sessionData.SessionID)
+	if err := resumed.prepareResume(sessionData, serverConn); err == nil {
+		t.Error("resume should fail when the mining coin changed")
+	}
+}
+
+func TestFreezeAndResumeHandshakeSession(t *testing.T) {
+	manager, _ := newUpgradeTestManager(t)
+
+	clientConn, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+
+	session := NewStratumSession(manager, clientConn, 0x01000003)
+	handshakeTestSession(t, session, `{"id":1,"method":"mining.subscribe","params":["cgminer/4.10"]}`)
+	session.runningStat = StatRunning
+	manager.handshakeSessions[session.sessionID] = session
+
+	// 矿机发来的认证请求，只读入了缓冲区
+	go clientPeer.Write([]byte(`{"id":2,"method":"mining.authorize","params":["alice.rig1","x"]}` + "\n"))
+	if _, err := session.clientReader.Peek(10); err != nil {
+		t.Fatal(err)
+	}
+	// 读取认证请求的goroutine读到一半时被冻结
+	session.pendingClientData = []byte(`{"id":3,"method":`)
+
+	if !session.freeze() {
+		t.Fatal("handshaking session should be frozen")
+	}
+	sessionData := transferSessionData(t, session.getSessionData())
+	if sessionData.StratumAuthorizeRequest != nil {
+		t.Fatal("authorize request should not be parsed yet")
+	}
+
+	resumed := NewStratumSession(manager, clientConn, sessionData.SessionID)
+	stat, err := resumed.prepareResumeHandshake(sessionData)
+	if err != nil || stat != StatSubScribed {
+		t.Fatalf("prepareResumeHandshake returned %d, %v", stat, err)
+	}
+
+	// 未处理的数据在新会话中按原顺序读出
+	reader := bufio.NewReader(resumed.clientReader)
+	pending := len(sessionData.PendingClientData)
+	data := make([]byte, pending)
+	if _, err := reader.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(sessionData.PendingClientData) {
+		t.Errorf("pending data = %q, want %q", data, sessionData.PendingClientData)
+	}
+	if string(data[:len(session.pendingClientData)]) != `{"id":3,"method":` {
+		t.Errorf("data read by the frozen goroutine should come first, got %q", data)
+	}
+}
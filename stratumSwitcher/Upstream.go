@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// 连接Stratum服务器的超时时间（包括TLS握手）
+const upstreamDialTimeoutSeconds = 15
+
+// UpstreamDialer 根据 StratumServerInfo.URL 连接Stratum服务器
+// URL 支持 host:port 或 tcp://host:port（TCP连接）、tls://host:port（TLS连接）
+// 以及 unix:///path/to/socket（Unix Socket连接）
+type UpstreamDialer struct {
+	// 配置中的URL，用于日志
+	URL string
+
+	network string
+	address string
+	// 为nil表示不使用TLS
+	tlsConfig *tls.Config
+}
+
+// UpstreamDialerMap 各币种的服务器连接器
+type UpstreamDialerMap map[string]*UpstreamDialer
+
+// NewUpstreamDialer 解析服务器URL并创建连接器
+func NewUpstreamDialer(serverInfo StratumServerInfo) (dialer *UpstreamDialer, err error) {
+	dialer = &UpstreamDialer{URL: serverInfo.URL, network: "tcp"}
+
+	url := serverInfo.URL
+	scheme := "tcp"
+	if pos := strings.Index(url, "://"); pos >= 0 {
+		scheme = strings.ToLower(url[:pos])
+		url = url[pos+3:]
+	}
+	if url == "" {
+		return nil, errors.New("empty stratum server address: " + serverInfo.URL)
+	}
+
+	switch scheme {
+	case "tcp":
+		dialer.address = url
+
+	case "tls":
+		dialer.address = url
+		dialer.tlsConfig, err = newUpstreamTLSConfig(serverInfo, url)
+		if err != nil {
+			return nil, err
+		}
+
+	case "unix":
+		dialer.network = "unix"
+		dialer.address = url
+
+	default:
+		return nil, errors.New("unsupported stratum server scheme: " + serverInfo.URL)
+	}
+	return
+}
+
+// NewUpstreamDialers 为所有币种创建服务器连接器
+func NewUpstreamDialers(serverInfoMap StratumServerInfoMap) (dialers UpstreamDialerMap, err error) {
+	dialers = make(UpstreamDialerMap)
+	for coin, serverInfo := range serverInfoMap {
+		dialers[coin], err = NewUpstreamDialer(serverInfo)
+		if err != nil {
+			return nil, errors.New("stratum server of " + coin + ": " + err.Error())
+		}
+	}
+	return
+}
+
+// newUpstreamTLSConfig 根据服务器信息中的证书选项创建TLS配置
+func newUpstreamTLSConfig(serverInfo StratumServerInfo, address string) (config *tls.Config, err error) {
+	config = new(tls.Config)
+
+	config.ServerName = serverInfo.TLSServerName
+	if config.ServerName == "" {
+		config.ServerName, _, err = net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config.InsecureSkipVerify = serverInfo.TLSInsecureSkipVerify
+
+	if serverInfo.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(serverInfo.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + serverInfo.TLSCAFile)
+		}
+	}
+
+	if serverInfo.TLSCertFile != "" || serverInfo.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(serverInfo.TLSCertFile, serverInfo.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// Dial 连接服务器，TLS连接在返回前完成握手
+func (dialer *UpstreamDialer) Dial(timeout time.Duration) (net.Conn, error) {
+	netDialer := &net.Dialer{Timeout: timeout}
+	if dialer.tlsConfig != nil {
+		return tls.DialWithDialer(netDialer, dialer.network, dialer.address, dialer.tlsConfig)
+	}
+	return netDialer.Dial(dialer.network, dialer.address)
+}
+
+// canHandOverConn 连接能否通过文件描述符移交给新进程
+// TLS连接的加密状态保存在进程内存中，无法移交
+func canHandOverConn(conn net.Conn) bool {
+	switch unwrapConn(conn).(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// 预先建立的连接默认的最长空闲时间
+// 连接被sserver关闭时会立即发现并补充，该时间只用于定期更换长期闲置的连接
+const defaultUpstreamPreconnectMaxIdleSeconds = 120
+
+// 建立连接失败后，等待该时间再重试
+const upstreamPreconnectRetrySeconds = 5
+
+// 预先建立连接的超时时间
+const upstreamPreconnectDialTimeoutSeconds = 5
+
+// 用于立即中断阻塞的读操作的读超时时间（一个早已过去的时间）
+var upstreamPreconnectInterruptDeadline = time.Unix(1, 0)
+
+// idleUpstreamConn 预先建立、尚未使用的服务器连接
+// sserver在收到订阅请求前不会发送任何数据，因此后台goroutine一直阻塞在读操作上：
+// 读操作返回说明连接已被关闭（或收到了意外的数据），连接不再可用。
+// 取用时设置一个已过去的读超时来中断读操作，只有因此超时才说明连接可用，不依赖对端的响应速度
+type idleUpstreamConn struct {
+	conn      net.Conn
+	createdAt time.Time
+	// 后台读操作返回后关闭
+	readDone chan struct{}
+	// 后台读操作读到的字节数及错误
+	readBytes int
+	readErr   error
+}
+
+// newIdleUpstreamConn 开始在后台监控连接，onClosed 在连接被对端关闭或收到意外数据时调用（取用时不调用）
+func newIdleUpstreamConn(conn net.Conn, onClosed func(idle *idleUpstreamConn)) *idleUpstreamConn {
+	idle := &idleUpstreamConn{
+		conn:      conn,
+		createdAt: time.Now(),
+		readDone:  make(chan struct{}),
+	}
+	go func() {
+		buf := make([]byte, 1)
+		idle.readBytes, idle.readErr = conn.Read(buf)
+		close(idle.readDone)
+		if !idle.interrupted() {
+			onClosed(idle)
+		}
+	}()
+	return idle
+}
+
+// interrupted 后台读操作是否因取用时设置的读超时而返回（且未读到数据）
+func (idle *idleUpstreamConn) interrupted() bool {
+	netErr, ok := idle.readErr.(net.Error)
+	return idle.readBytes == 0 && ok && netErr.Timeout()
+}
+
+// take 中断后台读操作，返回连接是否可用
+func (idle *idleUpstreamConn) take() bool {
+	idle.conn.SetReadDeadline(upstreamPreconnectInterruptDeadline)
+	<-idle.readDone
+	idle.conn.SetReadDeadline(time.Time{})
+	return idle.interrupted()
+}
+
+// UpstreamPreconnector 为各币种预先建立到Stratum服务器的连接
+// 切换币种或重连服务器时直接取用已建立的连接（TLS连接已完成握手），省去建立连接的时间。
+// 订阅请求中包含矿机的会话ID，sserver不支持订阅后重新绑定会话ID，因此订阅及认证仍在取用后进行
+type UpstreamPreconnector struct {
+	lock  sync.Mutex
+	conns map[string][]*idleUpstreamConn
+	// 各币种下次允许重试建立连接的时间（上次建立连接失败时设置）
+	retryTime map[string]time.Time
+
+	// 每个币种保持的连接数
+	count int
+	// 连接的最长空闲时间，超过后关闭并重新建立
+	maxIdle time.Duration
+	// 各币种的服务器连接器
+	dialers UpstreamDialerMap
+	// 连接被取用或关闭后通知补充
+	refillNotify chan bool
+}
+
+// NewUpstreamPreconnector 开始为各币种预先建立连接
+func NewUpstreamPreconnector(dialers UpstreamDialerMap, count int, maxIdle time.Duration) *UpstreamPreconnector {
+	preconnector := new(UpstreamPreconnector)
+	preconnector.conns = make(map[string][]*idleUpstreamConn)
+	preconnector.retryTime = make(map[string]time.Time)
+	preconnector.count = count
+	preconnector.maxIdle = maxIdle
+	preconnector.dialers = dialers
+	preconnector.refillNotify = make(chan bool, 1)
+
+	go preconnector.run()
+	glog.Info("Upstream preconnect: ", count, " connections per coin, max idle time: ", maxIdle)
+	return preconnector
+}
+
+// Get 取出一个到指定币种服务器的可用连接，没有可用连接时返回nil
+func (preconnector *UpstreamPreconnector) Get(coin string) net.Conn {
+	defer preconnector.notifyRefill()
+
+	for {
+		preconnector.lock.Lock()
+		conns := preconnector.conns[coin]
+		if len(conns) == 0 {
+			preconnector.lock.Unlock()
+			return nil
+		}
+		// 优先取用最新建立的连接
+		idle := conns[len(conns)-1]
+		preconnector.conns[coin] = conns[:len(conns)-1]
+		preconnector.lock.Unlock()
+
+		if idle.take() && time.Since(idle.createdAt) < preconnector.maxIdle {
+			return idle.conn
+		}
+		idle.conn.Close()
+	}
+}
+
+// notifyRefill 通知补充连接（不阻塞）
+func (preconnector *UpstreamPreconnector) notifyRefill() {
+	select {
+	case preconnector.refillNotify <- true:
+	default:
+	}
+}
+
+// onClosed 连接被对端关闭，将其移除并补充连接
+func (preconnector *UpstreamPreconnector) onClosed(coin string, idle *idleUpstreamConn) {
+	preconnector.lock.Lock()
+	conns := preconnector.conns[coin]
+	for i, c := range conns {
+		if c == idle {
+			preconnector.conns[coin] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	preconnector.lock.Unlock()
+
+	idle.conn.Close()
+	glog.V(3).Info("Upstream preconnect: connection closed by server: ", coin, "; ", idle.readErr)
+	preconnector.notifyRefill()
+}
+
+// run 在连接被取用、被关闭、到期或需要重试时关闭过期的连接并补充连接
+func (preconnector *UpstreamPreconnector) run() {
+	for {
+		wait := preconnector.maintain()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-preconnector.refillNotify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// maintain 为所有币种关闭过期的连接并补充连接，返回距离下次需要检查的时间
+func (preconnector *UpstreamPreconnector) maintain() time.Duration {
+	wait := preconnector.maxIdle
+	for coin, dialer := range preconnector.dialers {
+		preconnector.removeExpired(coin)
+		preconnector.refill(coin, dialer)
+
+		preconnector.lock.Lock()
+		if conns := preconnector.conns[coin]; len(conns) > 0 {
+			// 连接按建立时间排序，第一个连接最先过期
+			if expire := time.Until(conns[0].createdAt.Add(preconnector.maxIdle)); expire < wait {
+				wait = expire
+			}
+		}
+		if retry := time.Until(preconnector.retryTime[coin]); retry > 0 && retry < wait {
+			wait = retry
+		}
+		preconnector.lock.Unlock()
+	}
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// removeExpired 关闭指定币种中空闲时间过长的连接
+func (preconnector *UpstreamPreconnector) removeExpired(coin string) {
+	preconnector.lock.Lock()
+	conns := preconnector.conns[coin]
+	expired := 0
+	for expired < len(conns) && time.Since(conns[expired].createdAt) >= preconnector.maxIdle {
+		expired++
+	}
+	preconnector.conns[coin] = conns[expired:]
+	preconnector.lock.Unlock()
+
+	for _, idle := range conns[:expired] {
+		idle.take()
+		idle.conn.Close()
+	}
+}
+
+// refill 为指定币种补充连接，建立连接失败时在 upstreamPreconnectRetrySeconds 后再重试
+func (preconnector *UpstreamPreconnector) refill(coin string, dialer *UpstreamDialer) {
+	preconnector.lock.Lock()
+	missing := preconnector.count - len(preconnector.conns[coin])
+	retryTime := preconnector.retryTime[coin]
+	preconnector.lock.Unlock()
+
+	if missing <= 0 || time.Now().Before(retryTime) {
+		return
+	}
+
+	for i := 0; i < missing; i++ {
+		conn, err := dialer.Dial(upstreamPreconnectDialTimeoutSeconds * time.Second)
+		if err != nil {
+			glog.Warning("Upstream preconnect: connect stratum server failed: ", coin, "; ", dialer.URL, "; ", err)
+			preconnector.lock.Lock()
+			preconnector.retryTime[coin] = time.Now().Add(upstreamPreconnectRetrySeconds * time.Second)
+			preconnector.lock.Unlock()
+			return
+		}
+
+		idle := newIdleUpstreamConn(conn, func(idle *idleUpstreamConn) {
+			preconnector.onClosed(coin, idle)
+		})
+		preconnector.lock.Lock()
+		select {
+		case <-idle.readDone:
+			// 刚建立就被关闭，onClosed 已处理
+		default:
+			preconnector.conns[coin] = append(preconnector.conns[coin], idle)
+		}
+		preconnector.lock.Unlock()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPreconnector(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	serverInfoMap := StratumServerInfoMap{"btc": StratumServerInfo{URL: listener.Addr().String()}}
+	dialers, err := NewUpstreamDialers(serverInfoMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preconnector := NewUpstreamPreconnector(dialers, 2, time.Minute)
+
+	// 等待建立连接
+	serverConns := []net.Conn{<-accepted, <-accepted}
+	time.Sleep(100 * time.Millisecond)
+
+	if conn := preconnector.Get("bcc"); conn != nil {
+		t.Errorf("should not get connection of an unknown coin")
+	}
+
+	// 服务器关闭的连接会被立即移除并补充，不需要等到取用时
+	for _, conn := range serverConns {
+		conn.Close()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case conn := <-accepted:
+			serverConns[i] = conn
+		case <-time.After(5 * time.Second):
+			t.Fatal("closed connections were not replaced")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// 服务器迟迟不发送数据不影响取用
+	conn := preconnector.Get("btc")
+	if conn == nil {
+		t.Fatal("should get a connection after refill")
+	}
+	defer conn.Close()
+
+	// 取用后的连接可以正常收发数据，后台读操作没有读走数据
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	var serverConn net.Conn
+	for _, c := range serverConns {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 5)
+		if n, _ := c.Read(buf); n > 0 {
+			serverConn = c
+			break
+		}
+	}
+	if serverConn == nil {
+		t.Fatal("taken connection is not connected to the server")
+	}
+	serverConn.Write([]byte("pong\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 5)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "pong\n" {
+		t.Errorf("read %q, %v from taken connection", buf[:n], err)
+	}
+}
+
+func TestIdleUpstreamConnUnexpectedData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	closed := make(chan bool, 1)
+	idle := newIdleUpstreamConn(client, func(*idleUpstreamConn) {
+		closed <- true
+	})
+
+	// sserver不应在订阅前发送数据，收到数据的连接不可用
+	go server.Write([]byte("x"))
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("unexpected data was not detected")
+	}
+	if idle.take() {
+		t.Error("connection with unexpected data should not be usable")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewUpstreamDialer(t *testing.T) {
+	tests := []struct {
+		url        string
+		network    string
+		address    string
+		tls        bool
+		serverName string
+	}{
+		{"127.0.0.1:3333", "tcp", "127.0.0.1:3333", false, ""},
+		{"tcp://[::1]:3333", "tcp", "[::1]:3333", false, ""},
+		{"tls://sserver.example.com:3333", "tcp", "sserver.example.com:3333", true, "sserver.example.com"},
+		{"unix:///var/run/sserver.sock", "unix", "/var/run/sserver.sock", false, ""},
+	}
+	for _, test := range tests {
+		dialer, err := NewUpstreamDialer(StratumServerInfo{URL: test.url})
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if dialer.network != test.network || dialer.address != test.address || (dialer.tlsConfig != nil) != test.tls {
+			t.Errorf("%s: unexpected dialer %s %s %v", test.url, dialer.network, dialer.address, dialer.tlsConfig != nil)
+		}
+		if test.tls && dialer.tlsConfig.ServerName != test.serverName {
+			t.Errorf("%s: unexpected server name %s", test.url, dialer.tlsConfig.ServerName)
+		}
+	}
+
+	for _, url := range []string{"udp://127.0.0.1:3333", "tcp://", "tls://127.0.0.1"} {
+		if _, err := NewUpstreamDialer(StratumServerInfo{URL: url}); err == nil {
+			t.Errorf("%s should be rejected", url)
+		}
+	}
+}
+
+func TestUpstreamDialerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sserver.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix socket not supported: ", err)
+	}
+	defer listener.Close()
+
+	dialer, err := NewUpstreamDialer(StratumServerInfo{URL: "unix://" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !canHandOverConn(conn) {
+		t.Errorf("unix conn should be able to hand over")
+	}
+}
+
+func TestUpstreamDialerTLS(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+
+	dialer, err := NewUpstreamDialer(StratumServerInfo{URL: "tls://" + server.Listener.Addr().String(), TLSInsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("should be a TLS conn")
+	}
+	if canHandOverConn(conn) {
+		t.Errorf("TLS conn should not be able to hand over")
+	}
+}
@@ -6,12 +6,13 @@ import (
 	"encoding/hex"
 	"io"
 	"net"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-// IP2Long IP转整数
+// IP2Long IP转整数（仅支持IPv4）
 // 来自 <https://www.socketloop.com/tutorials/golang-convert-ip-address-string-to-long-unsigned-32-bit-integer>
 func IP2Long(ip string) uint32 {
 	var long uint32
@@ -32,6 +33,64 @@ func Long2IP(ipLong uint32) string {
 	return b0 + "." + b1 + "." + b2 + "." + b3
 }
 
+// parseClientIP 从 "ip:port" 或 "[ipv6]:port" 形式的地址中解析出IP
+// IPv4映射的IPv6地址（::ffff:a.b.c.d）会被转换为IPv4地址，解析失败返回nil
+func parseClientIP(ipPort string) net.IP {
+	host, _, err := net.SplitHostPort(ipPort)
+	if err != nil {
+		host = ipPort
+	}
+	// 去除IPv6地址中可能存在的zone（如 fe80::1%eth0）
+	if pos := strings.LastIndex(host, "%"); pos >= 0 {
+		host = host[:pos]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// clientIPParam 生成发送给sserver的矿机IP参数
+// IPv4地址总是以整数形式发送，以兼容旧版本的sserver；
+// IPv6地址仅在sserver支持时以字符串形式发送，否则发送0
+func clientIPParam(ip net.IP, supportIPv6 bool) interface{} {
+	if ip == nil {
+		return uint32(0)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return IP2Long(ip4.String())
+	}
+	if supportIPv6 {
+		return ip.String()
+	}
+	return uint32(0)
+}
+
+// isSameTCPAddr 判断监听地址是否与配置中的地址相同
+// 未指定的IP（如0.0.0.0与::）视为相同
+func isSameTCPAddr(addr net.Addr, configAddr string) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	confTCPAddr, err := net.ResolveTCPAddr("tcp", configAddr)
+	if err != nil {
+		return false
+	}
+	if tcpAddr.Port != confTCPAddr.Port {
+		return false
+	}
+	if len(confTCPAddr.IP) == 0 || confTCPAddr.IP.IsUnspecified() {
+		return len(tcpAddr.IP) == 0 || tcpAddr.IP.IsUnspecified()
+	}
+	return tcpAddr.IP.Equal(confTCPAddr.IP)
+}
+
 // Uint32ToHex unit32 转 hex
 func Uint32ToHex(num uint32) string {
 	bytesBuffer := bytes.NewBuffer([]byte{})
@@ -114,6 +173,26 @@ func IOCopyBuffer(dst io.Writer, src io.Reader, buf []byte) (bufferLen int, err
 	return
 }
 
+// activityReader 在每次读到数据时记录当前时间的Reader
+type activityReader struct {
+	reader     io.Reader
+	lastActive *int64
+}
+
+// newActivityReader 创建记录读取时间的Reader，时间以UnixNano格式原子地写入 lastActive
+func newActivityReader(reader io.Reader, lastActive *int64) *activityReader {
+	return &activityReader{reader, lastActive}
+}
+
+// Read 读取数据并记录时间
+func (r *activityReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(r.lastActive, time.Now().UnixNano())
+	}
+	return
+}
+
 // StripEthAddrFromFullName 从矿机名中去除不必要的以太坊钱包地址
 func StripEthAddrFromFullName(fullNameStr string) string {
 	pos := strings.Index(fullNameStr, ".")
@@ -126,9 +205,3 @@ func StripEthAddrFromFullName(fullNameStr string) string {
 
 	return fullNameStr
 }
-
-// FilterWorkerName 过滤矿工名
-func FilterWorkerName(workerName string) string {
-	pattren := regexp.MustCompile("[^a-zA-Z0-9._:|^/-]")
-	return pattren.ReplaceAllString(workerName, "")
-}
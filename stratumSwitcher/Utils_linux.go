@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"io"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"syscall"
@@ -34,55 +36,61 @@ func setCloseOnExec(fd uintptr) (err error) {
 	return
 }
 
-func setNoCloseOnExec(fd uintptr) (err error) {
-	_, err = fcntl(int(fd), syscall.F_SETFD, ^syscall.FD_CLOEXEC)
-	return
-}
-
-func execNewBin(binPath string, args []string) (err error) {
+func startNewBin(binPath string, args []string) (cmd *exec.Cmd, err error) {
 	realPath, err := filepath.Abs(binPath)
 	if err != nil {
 		realPath = binPath
 	}
 
-	argv := append([]string{binPath}, args...)
-	envv := os.Environ()
+	cmd = exec.Command(realPath, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// 由主进程启动时，新进程继承通知管道，升级后仍能通知主进程
+	if notify := masterNotifyFile(); notify != nil {
+		cmd.ExtraFiles = []*os.File{notify}
+	}
 
-	glog.Info("Exec: ", argv)
-	// flush all logs before load the new binary
+	glog.Info("Start: ", append([]string{binPath}, args...))
+	// flush all logs before start the new binary
 	glog.Flush()
 
-	return syscall.Exec(realPath, argv, envv)
+	err = cmd.Start()
+	return
 }
 
-func getConnFd(conn net.Conn) (fd uintptr, err error) {
-	tc, ok := conn.(*net.TCPConn)
+// getRawFd 获取连接或监听对象的文件描述符（不复制文件描述符，也不改变其阻塞模式）
+// 返回的文件描述符仅在对象关闭前有效
+func getRawFd(obj interface{}) (fd uintptr, err error) {
+	sc, ok := obj.(syscall.Conn)
 	if !ok {
-		return 0, errors.New("getConnFd: conn is not a TCPConn")
+		return 0, errors.New("getRawFd: object is not a syscall.Conn")
 	}
 
-	fc, err := tc.File()
+	rc, err := sc.SyscallConn()
 	if err != nil {
 		return
 	}
 
-	fd = fc.Fd()
+	err = rc.Control(func(rawFd uintptr) {
+		fd = rawFd
+	})
 	return
 }
 
-func getListenerFd(listener net.Listener) (fd uintptr, err error) {
-	tl, ok := listener.(*net.TCPListener)
-	if !ok {
-		return 0, errors.New("getListenerFd: listener is not a TCPListener")
+func getConnFd(conn net.Conn) (fd uintptr, err error) {
+	if !canHandOverConn(conn) {
+		return 0, errors.New("getConnFd: conn is not a TCPConn or UnixConn")
 	}
+	// 抓包时连接被包装过
+	return getRawFd(unwrapConn(conn))
+}
 
-	fl, err := tl.File()
-	if err != nil {
-		return
+func getListenerFd(listener net.Listener) (fd uintptr, err error) {
+	if _, ok := listener.(*net.TCPListener); !ok {
+		return 0, errors.New("getListenerFd: listener is not a TCPListener")
 	}
-
-	fd = fl.Fd()
-	return
+	return getRawFd(listener)
 }
 
 func newConnFromFd(fd uintptr) (conn net.Conn, err error) {
@@ -92,8 +100,10 @@ func newConnFromFd(fd uintptr) (conn net.Conn, err error) {
 		return
 	}
 
+	// net.FileConn 会复制文件描述符，原文件描述符需要关闭
 	f := os.NewFile(fd, "tcp conn")
 	conn, err = net.FileConn(f)
+	f.Close()
 	return
 }
 
@@ -106,14 +116,81 @@ func newListenerFromFd(fd uintptr) (listener net.Listener, err error) {
 
 	f := os.NewFile(fd, "tcp listener")
 	listener, err = net.FileListener(f)
+	f.Close()
 	return
 }
 
 func signalUSR2Listener(callback func()) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGUSR2)
 	for {
 		<-c
 		callback()
 	}
 }
+
+// writeMsgWithFds 通过Unix Socket发送一条消息，并附带文件描述符
+func writeMsgWithFds(conn *net.UnixConn, data []byte, fds ...uintptr) (err error) {
+	var oob []byte
+	if len(fds) > 0 {
+		intFds := make([]int, len(fds))
+		for i, fd := range fds {
+			intFds[i] = int(fd)
+		}
+		oob = syscall.UnixRights(intFds...)
+	}
+
+	n, oobn, err := conn.WriteMsgUnix(data, oob, nil)
+	if err != nil {
+		return
+	}
+	if n != len(data) || oobn != len(oob) {
+		err = ErrWriteFailed
+	}
+	return
+}
+
+// readMsgWithFds 从Unix Socket读取一条消息及其附带的文件描述符
+// 对端关闭连接时返回 io.EOF
+func readMsgWithFds(conn *net.UnixConn, buf []byte, maxFds int) (data []byte, fds []uintptr, err error) {
+	oob := make([]byte, syscall.CmsgSpace(maxFds*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return
+	}
+	if n == 0 && oobn == 0 {
+		err = io.EOF
+		return
+	}
+
+	if oobn > 0 {
+		var msgs []syscall.SocketControlMessage
+		msgs, err = syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return
+		}
+		for i := range msgs {
+			var intFds []int
+			intFds, err = syscall.ParseUnixRights(&msgs[i])
+			if err != nil {
+				return
+			}
+			for _, fd := range intFds {
+				fds = append(fds, uintptr(fd))
+			}
+		}
+	}
+
+	// 消息被截断，附带的文件描述符也已无意义，关闭它们以防泄露
+	if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+		for _, fd := range fds {
+			syscall.Close(int(fd))
+		}
+		fds = nil
+		err = errors.New("readMsgWithFds: message truncated")
+		return
+	}
+
+	data = buf[:n]
+	return
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newUnixConnPair 创建一对相互连接的 unixpacket 连接（与升级时使用的类型相同）
+func newUnixConnPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+// newTestPipe 创建管道，测试结束时关闭
+func newTestPipe(t *testing.T) (r *os.File, w *os.File) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// expectPipeEOF 检查管道的所有写端（包括传递出去的副本）都已关闭
+func expectPipeEOF(t *testing.T, r *os.File) {
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF after all write ends closed, got %v (fd leaked?)", err)
+	}
+}
+
+func TestMsgWithFdsRoundTrip(t *testing.T) {
+	sender, receiver := newUnixConnPair(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	r1, w1 := newTestPipe(t)
+	defer r1.Close()
+	r2, w2 := newTestPipe(t)
+	defer r2.Close()
+
+	err := writeMsgWithFds(sender, []byte("hello"), w1.Fd(), w2.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不带文件描述符的消息
+	err = writeMsgWithFds(sender, []byte("bye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w1.Close()
+	w2.Close()
+
+	buf := make([]byte, 64)
+	data, fds, err := readMsgWithFds(receiver, buf, 2)
+	if err != nil || string(data) != "hello" || len(fds) != 2 {
+		t.Fatalf("readMsgWithFds returned %q, %v, %v", data, fds, err)
+	}
+	// 收到的文件描述符按顺序对应发送的管道写端
+	for i, r := range []*os.File{r1, r2} {
+		w := os.NewFile(fds[i], "received")
+		w.Write([]byte{'a' + byte(i)})
+		w.Close()
+
+		got := make([]byte, 1)
+		r.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := r.Read(got); err != nil || got[0] != 'a'+byte(i) {
+			t.Errorf("fd %d: read %q, %v", i, got, err)
+		}
+		expectPipeEOF(t, r)
+	}
+
+	data, fds, err = readMsgWithFds(receiver, buf, 2)
+	if err != nil || string(data) != "bye" || len(fds) != 0 {
+		t.Errorf("readMsgWithFds returned %q, %v, %v", data, fds, err)
+	}
+
+	// 对端关闭
+	sender.Close()
+	if _, _, err = readMsgWithFds(receiver, buf, 2); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestMsgWithFdsTruncated(t *testing.T) {
+	sender, receiver := newUnixConnPair(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	// 数据被截断（MSG_TRUNC）
+	r1, w1 := newTestPipe(t)
+	defer r1.Close()
+	err := writeMsgWithFds(sender, bytes.Repeat([]byte("x"), 100), w1.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w1.Close()
+
+	data, fds, err := readMsgWithFds(receiver, make([]byte, 10), 2)
+	if err == nil || data != nil || fds != nil {
+		t.Errorf("expected truncated error, got %q, %v, %v", data, fds, err)
+	}
+	// 收到的文件描述符已被关闭
+	expectPipeEOF(t, r1)
+
+	// 文件描述符过多（MSG_CTRUNC）
+	pipes := make([]*os.File, 3)
+	writers := make([]*os.File, 3)
+	fdsToSend := make([]uintptr, 3)
+	for i := range pipes {
+		r, w := newTestPipe(t)
+		defer r.Close()
+		pipes[i], writers[i], fdsToSend[i] = r, w, w.Fd()
+	}
+	err = writeMsgWithFds(sender, []byte("three"), fdsToSend...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+
+	data, fds, err = readMsgWithFds(receiver, make([]byte, 64), 2)
+	if err == nil || fds != nil {
+		t.Errorf("expected truncated error, got %q, %v, %v", data, fds, err)
+	}
+	for _, r := range pipes {
+		expectPipeEOF(t, r)
+	}
+
+	// 截断后连接仍可继续使用
+	err = writeMsgWithFds(sender, []byte("ok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err = readMsgWithFds(receiver, make([]byte, 64), 2)
+	if err != nil || string(data) != "ok" {
+		t.Errorf("readMsgWithFds returned %q, %v", data, err)
+	}
+}
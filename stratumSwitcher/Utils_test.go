@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseClientIP(t *testing.T) {
+	cases := []struct {
+		ipPort string
+		ip     string
+	}{
+		{"1.2.3.4:5678", "1.2.3.4"},
+		{"[2001:db8::1]:3333", "2001:db8::1"},
+		{"[::ffff:1.2.3.4]:3333", "1.2.3.4"},
+		{"[fe80::1%eth0]:3333", "fe80::1"},
+		{"2001:db8::2", "2001:db8::2"},
+	}
+
+	for _, c := range cases {
+		ip := parseClientIP(c.ipPort)
+		if ip == nil || ip.String() != c.ip {
+			t.Errorf("parseClientIP(%s) returned %v, expected %s", c.ipPort, ip, c.ip)
+		}
+	}
+
+	if ip := parseClientIP("not an address"); ip != nil {
+		t.Errorf("parseClientIP should return nil for an invalid address, but returned %v", ip)
+	}
+}
+
+func TestClientIPParam(t *testing.T) {
+	ipv4 := parseClientIP("1.2.3.4:5678")
+	if param, ok := clientIPParam(ipv4, true).(uint32); !ok || param != 0x01020304 {
+		t.Errorf("IPv4 should be sent as uint32, but got %v", clientIPParam(ipv4, true))
+	}
+
+	ipv6 := parseClientIP("[2001:db8::1]:3333")
+	if param, ok := clientIPParam(ipv6, true).(string); !ok || param != "2001:db8::1" {
+		t.Errorf("IPv6 should be sent as string when supported, but got %v", clientIPParam(ipv6, true))
+	}
+	if param, ok := clientIPParam(ipv6, false).(uint32); !ok || param != 0 {
+		t.Errorf("IPv6 should be sent as 0 when not supported, but got %v", clientIPParam(ipv6, false))
+	}
+	if param, ok := clientIPParam(nil, true).(uint32); !ok || param != 0 {
+		t.Errorf("unknown IP should be sent as 0, but got %v", clientIPParam(nil, true))
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net"
+	"os/exec"
 
 	"github.com/golang/glog"
 )
@@ -25,13 +26,21 @@ func setCloseOnExec(fd uintptr) (err error) {
 	return
 }
 
-func setNoCloseOnExec(fd uintptr) (err error) {
-	glog.Fatal("Function setNoCloseOnExec has not implement in Windows.")
+func runMaster(binPath string, args []string) (exitCode int) {
+	glog.Fatal("Function runMaster has not implement in Windows.")
 	return
 }
 
-func execNewBin(binPath string, args []string) (err error) {
-	glog.Fatal("Function execNewBin has not implement in Windows.")
+func notifyMasterUpgraded(pid int) {
+}
+
+func startNewBin(binPath string, args []string) (cmd *exec.Cmd, err error) {
+	glog.Fatal("Function startNewBin has not implement in Windows.")
+	return
+}
+
+func getRawFd(obj interface{}) (fd uintptr, err error) {
+	glog.Fatal("Function getRawFd has not implement in Windows.")
 	return
 }
 
@@ -59,3 +68,13 @@ func signalUSR2Listener(callback func()) {
 	glog.Info("Function signalUSR2Listener has not implement in Windows.")
 	return
 }
+
+func writeMsgWithFds(conn *net.UnixConn, data []byte, fds ...uintptr) (err error) {
+	glog.Fatal("Function writeMsgWithFds has not implement in Windows.")
+	return
+}
+
+func readMsgWithFds(conn *net.UnixConn, buf []byte, maxFds int) (data []byte, fds []uintptr, err error) {
+	glog.Fatal("Function readMsgWithFds has not implement in Windows.")
+	return
+}
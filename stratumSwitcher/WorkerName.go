@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// 默认允许出现在矿工名中的字符（正则表达式字符组的内容）
+const defaultWorkerNameCharset = "a-zA-Z0-9._:|^/-"
+
+// WorkerNameRule 矿工名改写规则
+type WorkerNameRule struct {
+	// 正则表达式
+	Match string
+	// 替换为的内容，可用 $1 或 ${name} 引用分组
+	Replace string
+}
+
+// compiledWorkerNameRule 编译后的矿工名改写规则
+type compiledWorkerNameRule struct {
+	WorkerNameRule
+	regexp *regexp.Regexp
+}
+
+// WorkerNameParser 矿工名解析器，将矿机发送的各种格式的矿工名转换为“子账户名.矿机名”
+type WorkerNameParser struct {
+	// 按顺序执行的改写规则
+	rules []compiledWorkerNameRule
+	// 过滤不允许的字符
+	filter *regexp.Regexp
+	// 除“.”外可分隔子账户名与矿机名的字符
+	separators string
+	// 矿工名的最大长度，超出部分从矿机名中截断，为0表示不限制
+	maxLength int
+}
+
+// WorkerNameParseStep 矿工名解析过程中的一步，用于调试
+type WorkerNameParseStep struct {
+	Step   string
+	Result string
+}
+
+// WorkerNameParseResult 矿工名解析结果
+type WorkerNameParseResult struct {
+	// 子账户名
+	SubAccount string
+	// 矿机名（包含前导“.”，没有矿机名时为空）
+	MinerNameWithDot string
+	// 解析过程（仅在需要时记录）
+	Steps []WorkerNameParseStep `json:",omitempty"`
+}
+
+// NewWorkerNameParser 创建矿工名解析器
+// charset 为空时使用默认字符集，separators 中的字符总是允许出现在矿工名中
+func NewWorkerNameParser(rules []WorkerNameRule, charset string, separators string, maxLength int) (parser *WorkerNameParser, err error) {
+	parser = new(WorkerNameParser)
+
+	for i, rule := range rules {
+		re, compileErr := regexp.Compile(rule.Match)
+		if compileErr != nil {
+			err = errors.New("WorkerNameRules[" + fmt.Sprint(i) + "]: " + compileErr.Error())
+			return
+		}
+		parser.rules = append(parser.rules, compiledWorkerNameRule{rule, re})
+	}
+
+	if len(charset) == 0 {
+		charset = defaultWorkerNameCharset
+	}
+	// 分隔符放在前面，因为字符集可能以“-”结尾
+	parser.filter, err = regexp.Compile("[^" + escapeCharClass(separators) + charset + "]")
+	if err != nil {
+		err = errors.New("WorkerNameCharset: " + err.Error())
+		return
+	}
+
+	parser.separators = separators
+	parser.maxLength = maxLength
+	return
+}
+
+// Parse 解析矿工名
+// worker 为以太坊矿机在 worker 字段中单独发送的矿机名，stripEthAddr 表示去除矿工名开头的以太坊钱包地址，
+// trace 表示在结果中记录解析过程
+func (parser *WorkerNameParser) Parse(fullWorkerName string, worker string, stripEthAddr bool, trace bool) (result WorkerNameParseResult) {
+	name := fullWorkerName
+	addStep := func(step string) {
+		if trace {
+			result.Steps = append(result.Steps, WorkerNameParseStep{step, name})
+		}
+	}
+	addStep("input")
+
+	if worker != "" {
+		name += "." + worker
+		addStep("append worker")
+	}
+
+	for i, rule := range parser.rules {
+		if rule.regexp.MatchString(name) {
+			name = rule.regexp.ReplaceAllString(name, rule.Replace)
+			addStep(fmt.Sprintf("rule %d: %s -> %s", i, rule.Match, rule.Replace))
+		}
+	}
+
+	name = parser.filter.ReplaceAllString(name, "")
+	addStep("filter charset")
+
+	if stripEthAddr {
+		name = StripEthAddrFromFullName(name)
+		addStep("strip eth address")
+	}
+
+	// 截取第一个分隔符之前的做为子账户名，之后的做矿机名
+	pos := strings.IndexAny(name, "."+parser.separators)
+	if pos >= 0 {
+		result.SubAccount = name[:pos]
+		result.MinerNameWithDot = "." + name[pos+1:]
+	} else {
+		result.SubAccount = name
+	}
+
+	if parser.maxLength > 0 && len(result.SubAccount)+len(result.MinerNameWithDot) > parser.maxLength {
+		minerNameLength := parser.maxLength - len(result.SubAccount)
+		if minerNameLength > 1 {
+			result.MinerNameWithDot = result.MinerNameWithDot[:minerNameLength]
+		} else {
+			result.MinerNameWithDot = ""
+		}
+	}
+
+	name = result.SubAccount + result.MinerNameWithDot
+	addStep("split")
+	return
+}
+
+// escapeCharClass 转义字符串，使其可以放入正则表达式的字符组中
+func escapeCharClass(chars string) string {
+	var escaped strings.Builder
+	for _, c := range chars {
+		if c < unicode.MaxASCII && (unicode.IsPunct(c) || unicode.IsSymbol(c)) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWorkerNameParserDefault(t *testing.T) {
+	parser, err := NewWorkerNameParser(nil, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		worker       string
+		stripEthAddr bool
+		subAccount   string
+		minerName    string
+	}{
+		{"test.aaa", "", false, "test", ".aaa"},
+		{"te st.a@aa", "", false, "test", ".aaa"},
+		{"test", "", false, "test", ""},
+		{"test+aaa", "", false, "testaaa", ""},
+		{"0x00d8c82Eb65124Ea3452CaC59B64aCC230AA3482.test.aaa", "", true, "test", ".aaa"},
+		{"0x00d8c82Eb65124Ea3452CaC59B64aCC230AA3482", "test.aaa", true, "test", ".aaa"},
+		{"test", "aaa", true, "test", ".aaa"},
+	}
+
+	for _, c := range cases {
+		result := parser.Parse(c.name, c.worker, c.stripEthAddr, false)
+		if result.SubAccount != c.subAccount || result.MinerNameWithDot != c.minerName {
+			t.Errorf("Parse(%s, %s) returned %s%s, expected %s%s", c.name, c.worker,
+				result.SubAccount, result.MinerNameWithDot, c.subAccount, c.minerName)
+		}
+	}
+}
+
+func TestWorkerNameParserRules(t *testing.T) {
+	rules := []WorkerNameRule{
+		// 邮箱格式：worker@subaccount.com
+		{Match: `^([^@.]+)@([^@.]+)\.com$`, Replace: "$2.$1"},
+	}
+	parser, err := NewWorkerNameParser(rules, "", "+_", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		subAccount string
+		minerName  string
+	}{
+		{"rig1@test.com", "test", ".rig1"},
+		{"test+rig1", "test", ".rig1"},
+		{"test_rig1.a", "test", ".rig1.a"},
+		{"test.rig1_a", "test", ".rig1_a"},
+		{"test.0123456789", "test", ".0123456"},
+	}
+
+	for _, c := range cases {
+		result := parser.Parse(c.name, "", false, true)
+		if result.SubAccount != c.subAccount || result.MinerNameWithDot != c.minerName {
+			t.Errorf("Parse(%s) returned %s%s, expected %s%s, steps: %v", c.name,
+				result.SubAccount, result.MinerNameWithDot, c.subAccount, c.minerName, result.Steps)
+		}
+	}
+
+	if _, err := NewWorkerNameParser([]WorkerNameRule{{Match: "("}}, "", "", 0); err == nil {
+		t.Errorf("invalid rule should be rejected")
+	}
+}
@@ -61,6 +61,21 @@ func (watcher *NodeWatcher) Run() {
 // NodeWatcherMap Zookeeper监控器Map
 type NodeWatcherMap map[string]*NodeWatcher
 
+// ZookeeperConn Zookeeper连接，由 *zk.Conn 实现
+type ZookeeperConn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	SessionID() int64
+	State() zk.State
+	Close()
+}
+
 // ZookeeperManager Zookeeper管理器
 type ZookeeperManager struct {
 	// 修改 watcherMap 时加的锁
@@ -68,7 +83,7 @@ type ZookeeperManager struct {
 	// 监控器Map
 	watcherMap NodeWatcherMap
 	// Zookeeper连接
-	zookeeperConn *zk.Conn
+	zookeeperConn ZookeeperConn
 }
 
 // NewZookeeperManager 新建Zookeeper管理器
@@ -77,11 +92,11 @@ func NewZookeeperManager(brokers []string) (manager *ZookeeperManager, err error
 	manager.watcherMap = make(NodeWatcherMap)
 
 	// 建立到Zookeeper集群的连接
-	var event <-chan zk.Event
-	manager.zookeeperConn, event, err = zk.Connect(brokers, time.Duration(zookeeperConnAliveTimeout)*time.Second)
+	zkConn, event, err := zk.Connect(brokers, time.Duration(zookeeperConnAliveTimeout)*time.Second)
 	if err != nil {
 		return
 	}
+	manager.zookeeperConn = zkConn
 
 	zkConnected := make(chan bool, 1)
 
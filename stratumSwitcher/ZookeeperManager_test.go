@@ -0,0 +1,289 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// fakeZookeeperNode 内存中的Zookeeper节点
+type fakeZookeeperNode struct {
+	data           []byte
+	version        int32
+	ephemeralOwner int64
+}
+
+// fakeZookeeperConn 内存中的Zookeeper连接，用于测试
+// 父节点不要求存在；GetW、ExistsW 设置的监控在节点被创建、修改或删除时触发
+type fakeZookeeperConn struct {
+	lock      sync.Mutex
+	sessionID int64
+	state     zk.State
+	nodes     map[string]*fakeZookeeperNode
+	watches   map[string][]chan zk.Event
+	// 按顺序记录的写操作，如 "create /a"、"delete /a"
+	ops []string
+	// 指定操作返回的错误，键与 ops 中的记录相同
+	failures map[string]error
+}
+
+func newFakeZookeeperConn(sessionID int64) *fakeZookeeperConn {
+	return &fakeZookeeperConn{
+		sessionID: sessionID,
+		state:     zk.StateHasSession,
+		nodes:     make(map[string]*fakeZookeeperNode),
+		watches:   make(map[string][]chan zk.Event),
+		failures:  make(map[string]error),
+	}
+}
+
+// newFakeZookeeperManager 创建使用内存Zookeeper连接的Zookeeper管理器
+func newFakeZookeeperManager(conn *fakeZookeeperConn) *ZookeeperManager {
+	return &ZookeeperManager{watcherMap: make(NodeWatcherMap), zookeeperConn: conn}
+}
+
+// failNext 让下一次指定的操作返回错误
+func (conn *fakeZookeeperConn) failNext(op string, err error) {
+	conn.lock.Lock()
+	conn.failures[op] = err
+	conn.lock.Unlock()
+}
+
+// record 记录写操作，返回为其设置的错误
+func (conn *fakeZookeeperConn) record(op string) error {
+	conn.ops = append(conn.ops, op)
+	err := conn.failures[op]
+	delete(conn.failures, op)
+	return err
+}
+
+// getOps 返回已记录的写操作
+func (conn *fakeZookeeperConn) getOps() []string {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return append([]string(nil), conn.ops...)
+}
+
+// fire 触发节点上的监控
+func (conn *fakeZookeeperConn) fire(nodePath string, eventType zk.EventType) {
+	for _, watch := range conn.watches[nodePath] {
+		watch <- zk.Event{Type: eventType, State: conn.state, Path: nodePath}
+		close(watch)
+	}
+	delete(conn.watches, nodePath)
+}
+
+// setNode 直接写入节点（模拟其他进程的写入），ephemeralOwner 为0表示持久节点
+func (conn *fakeZookeeperConn) setNode(nodePath string, data string, ephemeralOwner int64) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	node, exists := conn.nodes[nodePath]
+	if !exists {
+		conn.nodes[nodePath] = &fakeZookeeperNode{data: []byte(data), ephemeralOwner: ephemeralOwner}
+		conn.fire(nodePath, zk.EventNodeCreated)
+		return
+	}
+	node.data = []byte(data)
+	node.version++
+	conn.fire(nodePath, zk.EventNodeDataChanged)
+}
+
+// deleteNode 直接删除节点（模拟其他进程的删除）
+func (conn *fakeZookeeperConn) deleteNode(nodePath string) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	delete(conn.nodes, nodePath)
+	conn.fire(nodePath, zk.EventNodeDeleted)
+}
+
+// hasNode 节点是否存在
+func (conn *fakeZookeeperConn) hasNode(nodePath string) bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	_, exists := conn.nodes[nodePath]
+	return exists
+}
+
+// watchCount 节点上尚未触发的监控数
+func (conn *fakeZookeeperConn) watchCount(nodePath string) int {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return len(conn.watches[nodePath])
+}
+
+func (conn *fakeZookeeperConn) stat(node *fakeZookeeperNode) *zk.Stat {
+	return &zk.Stat{Version: node.version, EphemeralOwner: node.ephemeralOwner, DataLength: int32(len(node.data))}
+}
+
+func (conn *fakeZookeeperConn) Get(nodePath string) ([]byte, *zk.Stat, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	node, exists := conn.nodes[nodePath]
+	if !exists {
+		return nil, nil, zk.ErrNoNode
+	}
+	return append([]byte(nil), node.data...), conn.stat(node), nil
+}
+
+func (conn *fakeZookeeperConn) GetW(nodePath string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	node, exists := conn.nodes[nodePath]
+	if !exists {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	watch := make(chan zk.Event, 1)
+	conn.watches[nodePath] = append(conn.watches[nodePath], watch)
+	return append([]byte(nil), node.data...), conn.stat(node), watch, nil
+}
+
+func (conn *fakeZookeeperConn) Set(nodePath string, data []byte, version int32) (*zk.Stat, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if err := conn.record("set " + nodePath); err != nil {
+		return nil, err
+	}
+	node, exists := conn.nodes[nodePath]
+	if !exists {
+		return nil, zk.ErrNoNode
+	}
+	if version >= 0 && version != node.version {
+		return nil, zk.ErrBadVersion
+	}
+	node.data = append([]byte(nil), data...)
+	node.version++
+	conn.fire(nodePath, zk.EventNodeDataChanged)
+	return conn.stat(node), nil
+}
+
+func (conn *fakeZookeeperConn) Create(nodePath string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if err := conn.record("create " + nodePath); err != nil {
+		return "", err
+	}
+	if _, exists := conn.nodes[nodePath]; exists {
+		return "", zk.ErrNodeExists
+	}
+	node := &fakeZookeeperNode{data: append([]byte(nil), data...)}
+	if flags&zk.FlagEphemeral != 0 {
+		node.ephemeralOwner = conn.sessionID
+	}
+	conn.nodes[nodePath] = node
+	conn.fire(nodePath, zk.EventNodeCreated)
+	return nodePath, nil
+}
+
+func (conn *fakeZookeeperConn) Delete(nodePath string, version int32) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if err := conn.record("delete " + nodePath); err != nil {
+		return err
+	}
+	if _, exists := conn.nodes[nodePath]; !exists {
+		return zk.ErrNoNode
+	}
+	delete(conn.nodes, nodePath)
+	conn.fire(nodePath, zk.EventNodeDeleted)
+	return nil
+}
+
+func (conn *fakeZookeeperConn) Exists(nodePath string) (bool, *zk.Stat, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	node, exists := conn.nodes[nodePath]
+	if !exists {
+		return false, nil, nil
+	}
+	return true, conn.stat(node), nil
+}
+
+func (conn *fakeZookeeperConn) ExistsW(nodePath string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	watch := make(chan zk.Event, 1)
+	conn.watches[nodePath] = append(conn.watches[nodePath], watch)
+	node, exists := conn.nodes[nodePath]
+	if !exists {
+		return false, nil, watch, nil
+	}
+	return true, conn.stat(node), watch, nil
+}
+
+func (conn *fakeZookeeperConn) Children(nodePath string) ([]string, *zk.Stat, error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	var children []string
+	for p := range conn.nodes {
+		if path.Dir(p) == nodePath && p != nodePath {
+			children = append(children, path.Base(p))
+		}
+	}
+	sort.Strings(children)
+	return children, &zk.Stat{NumChildren: int32(len(children))}, nil
+}
+
+func (conn *fakeZookeeperConn) SessionID() int64 {
+	return conn.sessionID
+}
+
+func (conn *fakeZookeeperConn) State() zk.State {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.state
+}
+
+func (conn *fakeZookeeperConn) Close() {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.state = zk.StateDisconnected
+	// 临时节点随会话删除
+	for p, node := range conn.nodes {
+		if node.ephemeralOwner == conn.sessionID {
+			delete(conn.nodes, p)
+			conn.fire(p, zk.EventNodeDeleted)
+		}
+	}
+}
+
+func TestFakeZookeeperConn(t *testing.T) {
+	conn := newFakeZookeeperConn(7)
+	manager := newFakeZookeeperManager(conn)
+
+	if err := manager.createZookeeperPath("/a/b/c/"); err != nil {
+		t.Fatal(err)
+	}
+	if children, _, _ := conn.Children("/a/b"); strings.Join(children, ",") != "c" {
+		t.Errorf("Children(/a/b) = %v", children)
+	}
+
+	if _, err := conn.Create("/a/e", []byte("1"), zk.FlagEphemeral, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, watch, err := conn.GetW("/a/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if event := <-watch; event.Type != zk.EventNodeDeleted {
+		t.Errorf("ephemeral node should be deleted on close, got %v", event)
+	}
+	if !conn.hasNode("/a/b/c") {
+		t.Error("persistent node should survive close")
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 工具的版本，出现在模拟矿机的user agent中
+const toolVersion = "1.0"
+
+// 模拟矿机使用的协议
+const (
+	// 比特币Stratum协议（DCR使用几乎相同的协议）
+	protocolStratum = iota
+	// 以太坊普通Stratum协议
+	protocolEthStratum
+	// NiceHash建议的以太坊Stratum协议（EthereumStratum/1.0.0）
+	protocolEthNiceHash
+	// EthProxy软件实现的以太坊Stratum协议（没有订阅阶段）
+	protocolEthProxy
+)
+
+// stratumSwitcher的链类型，与 stratumSwitcher 的 ChainType.ToString() 相同
+const (
+	chainBitcoin       = "bitcoin"
+	chainDecredNormal  = "decred-normal"
+	chainDecredGoMiner = "decred-gominer"
+	chainEthereum      = "ethereum"
+)
+
+// 矿机请求的ID。share提交请求的ID从 shareIDBase 开始递增
+const (
+	idConfigure = 1
+	idSubscribe = 2
+	idAuthorize = 3
+	idGetWork   = 4
+	shareIDBase = 100
+)
+
+// 矿机通过 mining.configure 请求的版本位掩码
+const minerVersionMask = 0x3fffe000
+
+// 桩服务器允许的版本位掩码，stratumSwitcher应将两者的交集发给矿机
+const stubVersionMask = 0x1fffe000
+
+// Dialect 模拟矿机所使用的协议方言
+type Dialect struct {
+	// 方言名称，用于 -miners 参数及报告
+	Name string
+	// 需要连接的stratumSwitcher的链类型
+	ChainType string
+	// 协议
+	Protocol int
+	// 是否通过 mining.configure 请求 version rolling
+	VersionRolling bool
+	// 是否为BTCAgent（认证后通过ex-message注册矿机及提交share，切换币种时会被stratumSwitcher断开）
+	BTCAgent bool
+}
+
+// dialects 支持的所有方言
+var dialects = []*Dialect{
+	{Name: "bitcoin", ChainType: chainBitcoin, Protocol: protocolStratum},
+	{Name: "bitcoin-versionrolling", ChainType: chainBitcoin, Protocol: protocolStratum, VersionRolling: true},
+	{Name: "btcagent", ChainType: chainBitcoin, Protocol: protocolStratum, BTCAgent: true},
+	{Name: "decred-normal", ChainType: chainDecredNormal, Protocol: protocolStratum},
+	{Name: "decred-gominer", ChainType: chainDecredGoMiner, Protocol: protocolStratum},
+	{Name: "eth-stratum", ChainType: chainEthereum, Protocol: protocolEthStratum},
+	{Name: "eth-nicehash", ChainType: chainEthereum, Protocol: protocolEthNiceHash},
+	{Name: "ethproxy", ChainType: chainEthereum, Protocol: protocolEthProxy},
+}
+
+// findDialect 按名称查找方言
+func findDialect(name string) *Dialect {
+	for _, dialect := range dialects {
+		if dialect.Name == name {
+			return dialect
+		}
+	}
+	return nil
+}
+
+// dialectNames 所有方言的名称
+func dialectNames() string {
+	names := make([]string, 0, len(dialects))
+	for _, dialect := range dialects {
+		names = append(names, dialect.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// userAgent 矿机发送的user agent
+func (dialect *Dialect) userAgent() string {
+	if dialect.BTCAgent {
+		// stratumSwitcher据此前缀识别BTCAgent
+		return "btccom-agent/loadTest-" + toolVersion
+	}
+	return "loadTest/" + toolVersion
+}
+
+// sessionIDString 会话ID在该链的协议中的形式，与stratumSwitcher中的 sessionIDString 相同
+func (dialect *Dialect) sessionIDString(sessionID uint32) string {
+	le := make([]byte, 4)
+	binary.LittleEndian.PutUint32(le, sessionID)
+
+	switch dialect.ChainType {
+	case chainDecredNormal:
+		// reversed 12 bytes
+		return "0000000000000000" + hex.EncodeToString(le)
+	case chainDecredGoMiner:
+		// reversed 4 bytes
+		return hex.EncodeToString(le)
+	case chainEthereum:
+		// 24 bit session id
+		return fmt.Sprintf("%08x", sessionID)[2:]
+	default:
+		return fmt.Sprintf("%08x", sessionID)
+	}
+}
+
+// checkSessionIDString 检查stratumSwitcher发给矿机的会话ID的格式
+func (dialect *Dialect) checkSessionIDString(s string) bool {
+	length := 8
+	switch dialect.ChainType {
+	case chainDecredNormal:
+		length = 24
+		if !strings.HasPrefix(s, "0000000000000000") {
+			return false
+		}
+	case chainEthereum:
+		length = 6
+	}
+	if len(s) != length {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// RPCMessage 解析双方发送的JSON RPC消息（请求、通知或响应）
+type RPCMessage struct {
+	ID      json.RawMessage `json:"id"`
+	JSONRPC string          `json:"jsonrpc,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  []interface{}   `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+// parseRPCMessage 解析一行JSON RPC消息
+func parseRPCMessage(line []byte) (message *RPCMessage, err error) {
+	message = new(RPCMessage)
+	err = json.Unmarshal(line, message)
+	return
+}
+
+// intID 返回数字形式的ID，ID不是数字时返回-1
+func (message *RPCMessage) intID() int {
+	id, err := strconv.Atoi(string(message.ID))
+	if err != nil {
+		return -1
+	}
+	return id
+}
+
+// paramString 返回第i个字符串参数
+func (message *RPCMessage) paramString(i int) (param string, ok bool) {
+	if i >= len(message.Params) {
+		return
+	}
+	param, ok = message.Params[i].(string)
+	return
+}
+
+// resultBool 响应结果是否为true
+func (message *RPCMessage) resultBool() bool {
+	var result bool
+	return json.Unmarshal(message.Result, &result) == nil && result
+}
+
+// marshalLine 将消息编码为一行JSON
+func marshalLine(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return append(data, '\n')
+}
+
+// 任务ID的形式为 币种-序号，矿机据此得知自己正在挖的币种
+func makeJobID(coin string, seq int64) string {
+	return fmt.Sprintf("%s-%d", coin, seq)
+}
+
+// jobCoin 任务ID所属的币种
+func jobCoin(jobID string) string {
+	pos := strings.LastIndexByte(jobID, '-')
+	if pos < 0 {
+		return ""
+	}
+	return jobID[:pos]
+}
+
+// EthProxy的任务中没有任务ID，将任务ID编码在header hash中
+func encodeEthProxyHeader(jobID string) string {
+	return "0x" + hex.EncodeToString([]byte(jobID))
+}
+
+// decodeEthProxyHeader 从header hash中解出任务ID
+func decodeEthProxyHeader(header string) string {
+	data, err := hex.DecodeString(strings.TrimPrefix(header, "0x"))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// 矿机发送的消息
+
+// subscribeRequest 订阅请求，EthProxy没有订阅阶段，返回nil
+func (dialect *Dialect) subscribeRequest() []byte {
+	params := []interface{}{dialect.userAgent()}
+	switch dialect.Protocol {
+	case protocolEthProxy:
+		return nil
+	case protocolEthNiceHash:
+		params = append(params, "EthereumStratum/1.0.0")
+	}
+	return marshalLine(map[string]interface{}{"id": idSubscribe, "method": "mining.subscribe", "params": params})
+}
+
+// configureRequest 请求 version rolling
+func (dialect *Dialect) configureRequest() []byte {
+	return marshalLine(map[string]interface{}{
+		"id":     idConfigure,
+		"method": "mining.configure",
+		"params": []interface{}{
+			[]string{"version-rolling"},
+			map[string]interface{}{"version-rolling.mask": fmt.Sprintf("%08x", minerVersionMask), "version-rolling.min-bit-count": 2}},
+	})
+}
+
+// authorizeRequest 认证请求
+func (dialect *Dialect) authorizeRequest(worker string) []byte {
+	if dialect.Protocol == protocolEthProxy {
+		return marshalLine(map[string]interface{}{"id": idAuthorize, "jsonrpc": "2.0", "method": "eth_submitLogin", "params": []string{worker, "x"}})
+	}
+	return marshalLine(map[string]interface{}{"id": idAuthorize, "method": "mining.authorize", "params": []string{worker, "x"}})
+}
+
+// getWorkRequest EthProxy认证后获取任务的请求
+func (dialect *Dialect) getWorkRequest() []byte {
+	return marshalLine(map[string]interface{}{"id": idGetWork, "jsonrpc": "2.0", "method": "eth_getWork", "params": []string{}})
+}
+
+// submitRequest share提交请求
+func (dialect *Dialect) submitRequest(id int, worker string, jobID string, nonce uint32) []byte {
+	var params []interface{}
+	switch dialect.Protocol {
+	case protocolStratum:
+		params = []interface{}{worker, jobID, "00000000", "5b0e1a2c", fmt.Sprintf("%08x", nonce)}
+		if dialect.VersionRolling {
+			params = append(params, fmt.Sprintf("%08x", nonce&stubVersionMask))
+		}
+	case protocolEthStratum:
+		params = []interface{}{worker, jobID, fmt.Sprintf("0x%016x", nonce), encodeEthProxyHeader(jobID), fmt.Sprintf("0x%064x", nonce)}
+	case protocolEthNiceHash:
+		params = []interface{}{worker, jobID, fmt.Sprintf("%012x", nonce)}
+	case protocolEthProxy:
+		params = []interface{}{fmt.Sprintf("0x%016x", nonce), encodeEthProxyHeader(jobID), fmt.Sprintf("0x%064x", nonce)}
+		return marshalLine(map[string]interface{}{"id": id, "jsonrpc": "2.0", "method": "eth_submitWork", "params": params})
+	}
+	return marshalLine(map[string]interface{}{"id": id, "method": "mining.submit", "params": params})
+}
+
+// 桩服务器发送的消息
+
+// subscribeResponse 订阅响应，sessionID 为该链协议中会话ID的形式
+func (dialect *Dialect) subscribeResponse(id json.RawMessage, sessionID string) []byte {
+	var result interface{}
+	switch dialect.Protocol {
+	case protocolStratum:
+		result = []interface{}{
+			[]interface{}{[]string{"mining.set_difficulty", sessionID}, []string{"mining.notify", sessionID}},
+			sessionID, 8}
+	case protocolEthNiceHash:
+		result = []interface{}{[]string{"mining.notify", sessionID, "EthereumStratum/1.0.0"}, sessionID}
+	default:
+		result = true
+	}
+	return marshalLine(map[string]interface{}{"id": id, "result": result, "error": nil})
+}
+
+// configureResponse version rolling 的配置响应及允许的版本位掩码
+func (dialect *Dialect) configureResponse(id json.RawMessage) []byte {
+	mask := fmt.Sprintf("%08x", stubVersionMask)
+	response := marshalLine(map[string]interface{}{
+		"id":     id,
+		"result": map[string]interface{}{"version-rolling": true, "version-rolling.mask": mask},
+		"error":  nil})
+	return append(response, marshalLine(map[string]interface{}{"id": nil, "method": "mining.set_version_mask", "params": []string{mask}})...)
+}
+
+// resultResponse 结果为 result 的响应
+func (dialect *Dialect) resultResponse(id json.RawMessage, result interface{}) []byte {
+	if dialect.Protocol == protocolEthProxy {
+		return marshalLine(map[string]interface{}{"id": id, "jsonrpc": "2.0", "result": result})
+	}
+	return marshalLine(map[string]interface{}{"id": id, "result": result, "error": nil})
+}
+
+// jobMessages 下发新任务的消息，firstJob 为true时同时下发难度
+func (dialect *Dialect) jobMessages(jobID string, firstJob bool) []byte {
+	var data []byte
+	switch dialect.Protocol {
+	case protocolStratum:
+		if firstJob {
+			data = marshalLine(map[string]interface{}{"id": nil, "method": "mining.set_difficulty", "params": []interface{}{8}})
+		}
+		data = append(data, marshalLine(map[string]interface{}{"id": nil, "method": "mining.notify", "params": []interface{}{
+			jobID, strings.Repeat("0", 64), "01000000010000", "ffffffff", []string{}, "20000000", "1d00ffff", "5b0e1a2c", true}})...)
+	case protocolEthStratum:
+		data = marshalLine(map[string]interface{}{"id": nil, "method": "mining.notify", "params": []interface{}{
+			jobID, fmt.Sprintf("0x%064x", 1), encodeEthProxyHeader(jobID), true}})
+	case protocolEthNiceHash:
+		if firstJob {
+			data = marshalLine(map[string]interface{}{"id": nil, "method": "mining.set_difficulty", "params": []interface{}{0.5}})
+		}
+		data = append(data, marshalLine(map[string]interface{}{"id": nil, "method": "mining.notify", "params": []interface{}{
+			jobID, fmt.Sprintf("%064x", 1), strings.TrimPrefix(encodeEthProxyHeader(jobID), "0x"), true}})...)
+	case protocolEthProxy:
+		data = dialect.resultResponse(json.RawMessage("0"), dialect.ethProxyWork(jobID))
+	}
+	return data
+}
+
+// ethProxyWork EthProxy的任务（header hash、seed hash、target）
+func (dialect *Dialect) ethProxyWork(jobID string) []string {
+	return []string{encodeEthProxyHeader(jobID), fmt.Sprintf("0x%064x", 1), "0x" + strings.Repeat("0", 8) + strings.Repeat("f", 56)}
+}
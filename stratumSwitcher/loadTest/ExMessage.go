@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// BTCAgent的ex-message，格式为 | magic_number(1) | cmd(1) | len(2, 小端，包括头部) | payload |
+// stratumSwitcher不解析ex-message，只原样转发
+const (
+	exMessageMagicNumber = 0x7F
+	exMessageHeaderLen   = 4
+
+	// | session_id(2) | client_agent | \0 | worker_name | \0 |
+	cmdRegisterWorker = 0x01
+	// | job_id(1) | session_id(2) | extra_nonce2(4) | nonce(4) |
+	cmdSubmitShare = 0x02
+	// | session_id(2) |
+	cmdUnregisterWorker = 0x04
+	// | diff_2_exp(1) | count(2) | session_id(2) ... |
+	cmdMiningSetDiff = 0x05
+)
+
+// ErrInvalidExMessage ex-message的长度不合法
+var ErrInvalidExMessage = errors.New("invalid ex-message length")
+
+// makeExMessage 构造一条ex-message
+func makeExMessage(cmd byte, payload []byte) []byte {
+	message := make([]byte, exMessageHeaderLen, exMessageHeaderLen+len(payload))
+	message[0] = exMessageMagicNumber
+	message[1] = cmd
+	binary.LittleEndian.PutUint16(message[2:], uint16(exMessageHeaderLen+len(payload)))
+	return append(message, payload...)
+}
+
+// registerWorkerMessage BTCAgent注册一台矿机
+func registerWorkerMessage(agentSessionID uint16, clientAgent string, workerName string) []byte {
+	payload := make([]byte, 2, 2+len(clientAgent)+len(workerName)+2)
+	binary.LittleEndian.PutUint16(payload, agentSessionID)
+	payload = append(payload, clientAgent...)
+	payload = append(payload, 0)
+	payload = append(payload, workerName...)
+	payload = append(payload, 0)
+	return makeExMessage(cmdRegisterWorker, payload)
+}
+
+// submitShareMessage BTCAgent为一台矿机提交share
+func submitShareMessage(jobID uint8, agentSessionID uint16, extraNonce2 uint32, nonce uint32) []byte {
+	payload := make([]byte, 11)
+	payload[0] = jobID
+	binary.LittleEndian.PutUint16(payload[1:], agentSessionID)
+	binary.LittleEndian.PutUint32(payload[3:], extraNonce2)
+	binary.LittleEndian.PutUint32(payload[7:], nonce)
+	return makeExMessage(cmdSubmitShare, payload)
+}
+
+// miningSetDiffMessage 为BTCAgent的矿机设置难度
+func miningSetDiffMessage(diff2Exp uint8, agentSessionIDs []uint16) []byte {
+	payload := make([]byte, 3+2*len(agentSessionIDs))
+	payload[0] = diff2Exp
+	binary.LittleEndian.PutUint16(payload[1:], uint16(len(agentSessionIDs)))
+	for i, id := range agentSessionIDs {
+		binary.LittleEndian.PutUint16(payload[3+2*i:], id)
+	}
+	return makeExMessage(cmdMiningSetDiff, payload)
+}
+
+// readFrame 读取一条消息：以换行结尾的JSON，或以magic number开头的ex-message
+func readFrame(reader *bufio.Reader) (frame []byte, isExMessage bool, err error) {
+	magic, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if magic[0] != exMessageMagicNumber {
+		frame, err = reader.ReadBytes('\n')
+		return
+	}
+
+	isExMessage = true
+	header, err := reader.Peek(exMessageHeaderLen)
+	if err != nil {
+		return
+	}
+	length := int(binary.LittleEndian.Uint16(header[2:]))
+	if length < exMessageHeaderLen {
+		err = ErrInvalidExMessage
+		return
+	}
+	frame = make([]byte, length)
+	_, err = io.ReadFull(reader, frame)
+	return
+}
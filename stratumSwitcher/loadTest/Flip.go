@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/segmentio/kafka-go"
+)
+
+// 改变币种的方式，与stratumSwitcher的 SwitchSource 对应
+const (
+	flipZookeeper = "zookeeper"
+	flipKafka     = "kafka"
+	flipNone      = "none"
+)
+
+// 连接Zookeeper及写入Kafka的超时时间
+const flipTimeout = 10 * time.Second
+
+// CoinFlipper 改变子账户币种的方式
+type CoinFlipper interface {
+	// Flip 将所有子账户的币种改为 coin
+	Flip(subaccounts []string, coin string) error
+	Close()
+}
+
+// newCoinFlipper 创建改变币种的方式，method 为 none 时返回nil
+func newCoinFlipper(method string, zkBrokers string, zkDirs string, kafkaBrokers string, kafkaTopics string) (flipper CoinFlipper, err error) {
+	switch method {
+	case flipZookeeper:
+		return newZookeeperFlipper(splitList(zkBrokers), splitList(zkDirs))
+	case flipKafka:
+		return newKafkaFlipper(splitList(kafkaBrokers), splitList(kafkaTopics))
+	case flipNone:
+		return nil, nil
+	default:
+		return nil, errors.New("unknown flip method " + method + ", should be zookeeper, kafka or none")
+	}
+}
+
+// splitList 拆分以逗号分隔的列表
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// ZookeeperFlipper 写入stratumSwitcher监控的Zookeeper节点（ZKSwitcherWatchDir/子账户名）
+type ZookeeperFlipper struct {
+	conn *zk.Conn
+	// 各stratumSwitcher的 ZKSwitcherWatchDir（以斜杠结尾）
+	dirs []string
+}
+
+// newZookeeperFlipper 连接Zookeeper并创建不存在的目录
+func newZookeeperFlipper(brokers []string, dirs []string) (flipper *ZookeeperFlipper, err error) {
+	if len(brokers) < 1 || len(dirs) < 1 {
+		err = errors.New("-zk and -zk-dirs are required to flip coins with zookeeper")
+		return
+	}
+
+	conn, _, err := zk.Connect(brokers, flipTimeout, zk.WithLogInfo(false))
+	if err != nil {
+		return
+	}
+	flipper = &ZookeeperFlipper{conn: conn}
+
+	for _, dir := range dirs {
+		if !strings.HasSuffix(dir, "/") {
+			dir += "/"
+		}
+		err = flipper.createDir(dir)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		flipper.dirs = append(flipper.dirs, dir)
+	}
+	return
+}
+
+// createDir 逐级创建目录
+func (flipper *ZookeeperFlipper) createDir(dir string) error {
+	path := ""
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		path += "/" + part
+		_, err := flipper.conn.Create(path, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return errors.New("create " + path + " failed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Flip 写入所有子账户的节点
+func (flipper *ZookeeperFlipper) Flip(subaccounts []string, coin string) error {
+	for _, dir := range flipper.dirs {
+		for _, subaccount := range subaccounts {
+			path := dir + subaccount
+			_, err := flipper.conn.Set(path, []byte(coin), -1)
+			if err == zk.ErrNoNode {
+				_, err = flipper.conn.Create(path, []byte(coin), 0, zk.WorldACL(zk.PermAll))
+			}
+			if err != nil {
+				return errors.New("write " + path + " failed: " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Close 关闭Zookeeper连接
+func (flipper *ZookeeperFlipper) Close() {
+	flipper.conn.Close()
+}
+
+// SwitchEvent 币种切换事件，与stratumSwitcher的 SwitchEvent 相同
+type SwitchEvent struct {
+	SubAccount string `json:"sub_account"`
+	Coin       string `json:"coin"`
+	Timestamp  int64  `json:"timestamp"` // 秒
+}
+
+// KafkaFlipper 写入stratumSwitcher消费的币种切换事件（SwitchSource 为 kafka 时）
+type KafkaFlipper struct {
+	writers []*kafka.Writer
+}
+
+// newKafkaFlipper 创建各Topic的Kafka Writer
+func newKafkaFlipper(brokers []string, topics []string) (flipper *KafkaFlipper, err error) {
+	if len(brokers) < 1 || len(topics) < 1 {
+		err = errors.New("-kafka and -kafka-topics are required to flip coins with kafka")
+		return
+	}
+
+	flipper = new(KafkaFlipper)
+	for _, topic := range topics {
+		flipper.writers = append(flipper.writers, kafka.NewWriter(kafka.WriterConfig{
+			Brokers: brokers,
+			Topic:   topic,
+			// 与userChainAPIServer相同，同一子账户的事件写入同一分区
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: flipTimeout,
+		}))
+	}
+	return
+}
+
+// Flip 为所有子账户写入切换事件
+func (flipper *KafkaFlipper) Flip(subaccounts []string, coin string) error {
+	messages := make([]kafka.Message, 0, len(subaccounts))
+	for _, subaccount := range subaccounts {
+		value, _ := json.Marshal(SwitchEvent{subaccount, coin, time.Now().Unix()})
+		messages = append(messages, kafka.Message{Key: []byte(subaccount), Value: value})
+	}
+
+	for _, writer := range flipper.writers {
+		ctx, cancel := context.WithTimeout(context.Background(), flipTimeout)
+		err := writer.WriteMessages(ctx, messages...)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close 关闭Kafka Writer
+func (flipper *KafkaFlipper) Close() {
+	for _, writer := range flipper.writers {
+		writer.Close()
+	}
+}
@@ -0,0 +1,320 @@
+// loadTest 模拟大量矿机对stratumSwitcher进行压力测试及协议兼容性检查
+//
+// 工具同时扮演矿机和sserver：为 -coins 中的每个币种启动一个桩服务器（stratumSwitcher的
+// StratumServerMap 应指向这些地址），并按 -miners 中的方言及数量模拟矿机连接stratumSwitcher。
+// 测试期间每隔 -flip-interval 通过Zookeeper或Kafka改变所有子账户的币种，
+// 结束时按方言报告握手耗时、切换耗时、丢失的字节数及违反协议的行为。
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadTest 一次测试的共享状态
+type LoadTest struct {
+	// 矿机名 -> 矿机，创建后只读
+	miners map[string]*Miner
+	// 各方言的统计数据，按 -miners 中的顺序
+	stats []*DialectStats
+
+	shareInterval  time.Duration
+	notifyInterval time.Duration
+	// BTCAgent每个连接注册的矿机数
+	agentWorkers int
+
+	// 停止提交share（测试结束前等待数据传完）
+	stopShares chan struct{}
+	// 测试结束，关闭所有连接
+	stop      chan struct{}
+	waitGroup sync.WaitGroup
+
+	flipLock sync.Mutex
+	// 币种改变的轮次、目标币种及改变的时间
+	flipRound int
+	flipCoin  string
+	flipTime  time.Time
+}
+
+// lookupMiner 按矿工名查找矿机，stratumSwitcher可能改写子账户名，因此只比较点之后的部分
+func (test *LoadTest) lookupMiner(worker string) *Miner {
+	pos := strings.IndexByte(worker, '.')
+	if pos < 0 {
+		return nil
+	}
+	return test.miners[worker[pos+1:]]
+}
+
+// setFlip 开始新一轮币种改变
+func (test *LoadTest) setFlip(coin string) int {
+	test.flipLock.Lock()
+	defer test.flipLock.Unlock()
+
+	test.flipRound++
+	test.flipCoin = coin
+	test.flipTime = time.Now()
+	return test.flipRound
+}
+
+// currentFlip 当前的币种改变轮次、目标币种及改变的时间
+func (test *LoadTest) currentFlip() (round int, coin string, at time.Time) {
+	test.flipLock.Lock()
+	defer test.flipLock.Unlock()
+
+	return test.flipRound, test.flipCoin, test.flipTime
+}
+
+// parsePairs 解析 key=value,key=value 形式的参数，返回按顺序排列的key
+func parsePairs(list string) (keys []string, values map[string]string, err error) {
+	values = make(map[string]string)
+	for _, item := range splitList(list) {
+		pos := strings.IndexByte(item, '=')
+		if pos < 1 {
+			err = fmt.Errorf("%q should be key=value", item)
+			return
+		}
+		key, value := item[:pos], item[pos+1:]
+		if _, ok := values[key]; ok {
+			err = fmt.Errorf("duplicate key %q", key)
+			return
+		}
+		keys = append(keys, key)
+		values[key] = value
+	}
+	return
+}
+
+// parseSwitcherAddrs 解析stratumSwitcher的地址：单个地址用于所有链，或 链类型=地址 的列表
+func parseSwitcherAddrs(list string) (addrs map[string]string, err error) {
+	if !strings.Contains(list, "=") {
+		addrs = map[string]string{"": strings.TrimSpace(list)}
+		return
+	}
+	_, addrs, err = parsePairs(list)
+	return
+}
+
+// switcherAddr 方言需要连接的stratumSwitcher地址
+func switcherAddr(addrs map[string]string, dialect *Dialect) string {
+	if addr, ok := addrs[dialect.ChainType]; ok {
+		return addr
+	}
+	return addrs[""]
+}
+
+func main() {
+	switcherFlag := flag.String("switcher", "127.0.0.1:3333", "Address of stratumSwitcher, or chain=address pairs separated by commas (chains: bitcoin, decred-normal, decred-gominer, ethereum)")
+	coinsFlag := flag.String("coins", "btc=127.0.0.1:13333,bcc=127.0.0.1:13334", "Coins and listen addresses of the stub stratum servers (coin=address,...), StratumServerMap of stratumSwitcher should point to them. Coins are flipped in this order")
+	minersFlag := flag.String("miners", "", "Number of simulated miners of each dialect (dialect=count,...), dialects: "+dialectNames())
+	conformance := flag.Bool("conformance", false, "Run 2 miners of every dialect whose chain has a stratumSwitcher address, unless -miners is given")
+	subaccountCount := flag.Int("subaccounts", 10, "Number of sub-accounts used by the miners")
+	subaccountPrefix := flag.String("subaccount-prefix", "loadtest", "Prefix of sub-account names")
+	durationSeconds := flag.Int("duration", 60, "Duration of the test in seconds")
+	ramp := flag.Int("ramp", 200, "New miner connections per second")
+	shareIntervalMs := flag.Int("share-interval-ms", 1000, "Share submit interval of each miner in milliseconds")
+	notifyIntervalSeconds := flag.Int("notify-interval", 10, "Job notify interval of the stub stratum servers in seconds")
+	agentWorkers := flag.Int("agent-workers", 4, "Number of workers registered by each BTCAgent connection")
+	flipMethod := flag.String("flip", flipZookeeper, "How to flip coins of the sub-accounts: zookeeper, kafka (SwitchSource of stratumSwitcher) or none")
+	flipIntervalSeconds := flag.Int("flip-interval", 20, "Coin flip interval in seconds, 0 to flip only at start")
+	drainSeconds := flag.Int("drain", 5, "Seconds to wait for in-flight data after miners stop submitting")
+	zkBrokers := flag.String("zk", "127.0.0.1:2181", "Zookeeper brokers, separated by commas")
+	zkDirs := flag.String("zk-dirs", "/stratumSwitcher/btcbcc/", "ZKSwitcherWatchDir of each stratumSwitcher, separated by commas")
+	kafkaBrokers := flag.String("kafka", "127.0.0.1:9092", "Kafka brokers, separated by commas")
+	kafkaTopics := flag.String("kafka-topics", "", "SwitchEventTopic of each stratumSwitcher, separated by commas")
+	flag.Parse()
+
+	switcherAddrs, err := parseSwitcherAddrs(*switcherFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -switcher:", err)
+		os.Exit(2)
+	}
+	coins, coinAddrs, err := parsePairs(*coinsFlag)
+	if err != nil || len(coins) < 1 {
+		fmt.Fprintln(os.Stderr, "invalid -coins:", err)
+		os.Exit(2)
+	}
+	minersSpec := *minersFlag
+	if len(minersSpec) < 1 && *conformance {
+		for _, dialect := range dialects {
+			if len(switcherAddr(switcherAddrs, dialect)) > 0 {
+				minersSpec += dialect.Name + "=2,"
+			}
+		}
+		minersSpec = strings.TrimSuffix(minersSpec, ",")
+	}
+	dialectOrder, minerCounts, err := parsePairs(minersSpec)
+	if err != nil || len(dialectOrder) < 1 {
+		fmt.Fprintln(os.Stderr, "invalid -miners:", err)
+		os.Exit(2)
+	}
+	if *subaccountCount < 1 || *ramp < 1 || *shareIntervalMs < 1 || *notifyIntervalSeconds < 1 || *agentWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "-subaccounts, -ramp, -share-interval-ms, -notify-interval and -agent-workers should be positive")
+		os.Exit(2)
+	}
+
+	test := &LoadTest{
+		miners:         make(map[string]*Miner),
+		shareInterval:  time.Duration(*shareIntervalMs) * time.Millisecond,
+		notifyInterval: time.Duration(*notifyIntervalSeconds) * time.Second,
+		agentWorkers:   *agentWorkers,
+		stopShares:     make(chan struct{}),
+		stop:           make(chan struct{}),
+	}
+
+	subaccounts := make([]string, *subaccountCount)
+	for i := range subaccounts {
+		subaccounts[i] = *subaccountPrefix + strconv.Itoa(i)
+	}
+
+	// 创建矿机，矿机名在所有方言中唯一
+	var miners []*Miner
+	for _, name := range dialectOrder {
+		dialect := findDialect(name)
+		count, err := strconv.Atoi(minerCounts[name])
+		if dialect == nil || err != nil || count < 1 {
+			fmt.Fprintf(os.Stderr, "invalid -miners: %s=%s, dialects: %s\n", name, minerCounts[name], dialectNames())
+			os.Exit(2)
+		}
+		addr := switcherAddr(switcherAddrs, dialect)
+		if len(addr) < 1 {
+			fmt.Fprintf(os.Stderr, "no stratumSwitcher address for chain %s (dialect %s)\n", dialect.ChainType, dialect.Name)
+			os.Exit(2)
+		}
+
+		stats := newDialectStats(dialect, count, addr)
+		test.stats = append(test.stats, stats)
+		for i := 0; i < count; i++ {
+			miner := &Miner{
+				test:         test,
+				dialect:      dialect,
+				stats:        stats,
+				switcherAddr: addr,
+				name:         "m" + strconv.Itoa(len(miners)),
+			}
+			miner.worker = subaccounts[len(miners)%len(subaccounts)] + "." + miner.name
+			test.miners[miner.name] = miner
+			miners = append(miners, miner)
+		}
+	}
+
+	// 启动桩服务器
+	var stubs []*StubServer
+	for _, coin := range coins {
+		stub, err := NewStubServer(test, coin, coinAddrs[coin])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "start stub stratum server failed:", err)
+			os.Exit(2)
+		}
+		stubs = append(stubs, stub)
+	}
+
+	// 连接stratumSwitcher前先设置子账户的初始币种
+	flipper, err := newCoinFlipper(*flipMethod, *zkBrokers, *zkDirs, *kafkaBrokers, *kafkaTopics)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "init coin flipper failed:", err)
+		os.Exit(2)
+	}
+	if flipper != nil {
+		test.setFlip(coins[0])
+		err = flipper.Flip(subaccounts, coins[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "set initial coin failed:", err)
+			os.Exit(2)
+		}
+	}
+
+	fmt.Printf("Starting %d miners (%s) with %d sub-accounts, coins %v, flip by %s every %ds, duration %ds\n",
+		len(miners), minersSpec, len(subaccounts), coins, *flipMethod, *flipIntervalSeconds, *durationSeconds)
+
+	// 按 -ramp 的速度建立连接
+	rampDone := make(chan struct{})
+	go func() {
+		defer close(rampDone)
+		interval := time.Second / time.Duration(*ramp)
+		for _, miner := range miners {
+			select {
+			case <-test.stopShares:
+				return
+			default:
+			}
+			test.waitGroup.Add(1)
+			go miner.Run()
+			time.Sleep(interval)
+		}
+	}()
+
+	// 定期改变币种
+	if flipper != nil && *flipIntervalSeconds > 0 && len(coins) > 1 {
+		go func() {
+			ticker := time.NewTicker(time.Duration(*flipIntervalSeconds) * time.Second)
+			defer ticker.Stop()
+			for i := 1; ; i++ {
+				select {
+				case <-test.stopShares:
+					return
+				case <-ticker.C:
+				}
+				coin := coins[i%len(coins)]
+				round := test.setFlip(coin)
+				err := flipper.Flip(subaccounts, coin)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "flip #%d to %s failed: %v\n", round, coin, err)
+					continue
+				}
+				fmt.Printf("%s flip #%d: %d sub-accounts -> %s\n", time.Now().Format("15:04:05"), round, len(subaccounts), coin)
+			}
+		}()
+	}
+
+	time.Sleep(time.Duration(*durationSeconds) * time.Second)
+	close(test.stopShares)
+	<-rampDone
+	time.Sleep(time.Duration(*drainSeconds) * time.Second)
+
+	// 统计未切换到目标币种的矿机
+	if flipper != nil {
+		_, target, _ := test.currentFlip()
+		for _, miner := range miners {
+			if miner.getCoin() != target {
+				miner.stats.lock.Lock()
+				miner.stats.switchMissed++
+				miner.stats.lock.Unlock()
+			}
+		}
+	}
+
+	close(test.stop)
+	if flipper != nil {
+		flipper.Close()
+	}
+	for _, stub := range stubs {
+		stub.Close()
+	}
+	test.waitGroup.Wait()
+
+	// 输出报告
+	passed := true
+	for _, stats := range test.stats {
+		stats.print()
+		if stats.passed() {
+			fmt.Println("  result:     PASS")
+		} else {
+			fmt.Println("  result:     FAIL")
+			passed = false
+		}
+	}
+	for _, stub := range stubs {
+		if n := atomic.LoadInt64(&stub.unknownWorkers); n > 0 {
+			fmt.Printf("stub %s: %d authorize requests from unknown workers\n", stub.coin, n)
+		}
+	}
+	if !passed {
+		os.Exit(1)
+	}
+}
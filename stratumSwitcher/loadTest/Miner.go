@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// 握手（从发起连接到认证成功）的超时时间，stratumSwitcher等待sserver响应的超时时间为10秒
+const handshakeTimeout = 15 * time.Second
+
+// 写入数据的超时时间
+const writeTimeout = 10 * time.Second
+
+// 连接断开后重连的间隔
+const minerReconnectDelay = 1 * time.Second
+
+// BTCAgent因切换币种被断开后重连的间隔（计入切换耗时）
+const agentReconnectDelay = 100 * time.Millisecond
+
+// Miner 模拟的矿机
+type Miner struct {
+	test    *LoadTest
+	dialect *Dialect
+	stats   *DialectStats
+	// 连接的stratumSwitcher地址
+	switcherAddr string
+	// 矿工名中点之后的部分，在所有矿机中唯一，桩服务器据此找到矿机
+	name string
+	// 完整的矿工名（子账户名.矿机名）
+	worker string
+
+	lock sync.Mutex
+	// stratumSwitcher在订阅响应中给出的会话ID，矿机无法得知时为空
+	sessionID string
+	// 正在挖的币种，即最后一次收到的任务所属的币种
+	coin string
+	// 最后一次收到的任务ID
+	jobID string
+	// 已完成切换的币种改变轮次
+	flipRound int
+	// share提交请求的序号
+	shareSeq int
+}
+
+// Run 连接stratumSwitcher并持续提交share，断开后重连，直到测试结束
+func (miner *Miner) Run() {
+	defer miner.test.waitGroup.Done()
+
+	for {
+		delay := minerReconnectDelay
+		if miner.runSession() && miner.dialect.BTCAgent {
+			delay = agentReconnectDelay
+		}
+
+		select {
+		case <-miner.test.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runSession 建立一次连接，返回握手是否成功
+func (miner *Miner) runSession() (handshaked bool) {
+	test := miner.test
+	stats := miner.stats
+
+	add(&stats.connects, 1)
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", miner.switcherAddr, handshakeTimeout)
+	if err != nil {
+		add(&stats.handshakeFailures, 1)
+		stats.violation("handshake failed", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// 测试结束时关闭连接
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-test.stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	err = miner.handshake(conn, reader)
+	if err != nil {
+		select {
+		case <-test.stop:
+		default:
+			add(&stats.handshakeFailures, 1)
+			stats.violation("handshake failed", err.Error())
+		}
+		return
+	}
+	handshaked = true
+	stats.recordHandshake(time.Since(start))
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- miner.readLoop(reader)
+	}()
+
+	err = miner.afterHandshake(conn)
+	if err == nil {
+		err = miner.submitLoop(conn, readErr)
+	}
+
+	select {
+	case <-test.stop:
+	default:
+		add(&stats.disconnects, 1)
+		// BTCAgent在切换币种时会被断开，其他矿机应保持连接
+		if !miner.dialect.BTCAgent {
+			stats.violation("disconnected by stratumSwitcher", fmt.Sprint(miner.worker, ": ", err))
+		}
+	}
+	return
+}
+
+// submitLoop 定期提交share，直到连接断开或测试结束，返回读取结束的原因
+func (miner *Miner) submitLoop(conn net.Conn, readErr <-chan error) error {
+	test := miner.test
+
+	// 随机的初始延迟，使各矿机的提交时间均匀分布
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(test.shareInterval))))
+	defer timer.Stop()
+
+	for {
+		select {
+		case err := <-readErr:
+			return err
+		case <-timer.C:
+			timer.Reset(test.shareInterval)
+			select {
+			case <-test.stopShares:
+				continue
+			default:
+			}
+			// 写入失败时连接已断开，等待读取结束
+			miner.submit(conn)
+		}
+	}
+}
+
+// write 写入握手后的数据并计数
+func (miner *Miner) write(conn net.Conn, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	n, err := conn.Write(data)
+	add(&miner.stats.upSent, n)
+	return err
+}
+
+// readMessage 读取握手阶段stratumSwitcher发来的一条JSON消息
+func (miner *Miner) readMessage(reader *bufio.Reader) (message *RPCMessage, err error) {
+	line, isExMessage, err := readFrame(reader)
+	if err != nil {
+		return
+	}
+	if isExMessage {
+		err = fmt.Errorf("unexpected ex-message during handshake: %x", line)
+		return
+	}
+	message, err = parseRPCMessage(line)
+	if err != nil {
+		err = fmt.Errorf("malformed JSON %q: %v", line, err)
+	}
+	return
+}
+
+// readResponse 读取握手阶段ID为 id 的响应
+func (miner *Miner) readResponse(reader *bufio.Reader, id int, name string) (message *RPCMessage, err error) {
+	message, err = miner.readMessage(reader)
+	if err != nil {
+		return
+	}
+	if len(message.Method) > 0 || message.intID() != id {
+		err = fmt.Errorf("expected %s response with id %d, got %s", name, id, marshalLine(message))
+	}
+	return
+}
+
+// handshake 与stratumSwitcher握手（订阅及认证），并检查stratumSwitcher的响应是否符合协议
+func (miner *Miner) handshake(conn net.Conn, reader *bufio.Reader) (err error) {
+	dialect := miner.dialect
+	stats := miner.stats
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if dialect.VersionRolling {
+		_, err = conn.Write(dialect.configureRequest())
+		if err != nil {
+			return
+		}
+		var response *RPCMessage
+		response, err = miner.readResponse(reader, idConfigure, "mining.configure")
+		if err != nil {
+			return
+		}
+		var result map[string]interface{}
+		json.Unmarshal(response.Result, &result)
+		if result["version-rolling"] != true || result["version-rolling.mask"] != fmt.Sprintf("%08x", minerVersionMask) {
+			stats.violation("mining.configure: unexpected result", string(response.Result))
+		}
+	}
+
+	if request := dialect.subscribeRequest(); request != nil {
+		_, err = conn.Write(request)
+		if err != nil {
+			return
+		}
+		var response *RPCMessage
+		response, err = miner.readResponse(reader, idSubscribe, "mining.subscribe")
+		if err != nil {
+			return
+		}
+		err = miner.checkSubscribeResponse(response)
+		if err != nil {
+			stats.violation("mining.subscribe: unexpected result", err.Error())
+			return
+		}
+	}
+
+	_, err = conn.Write(dialect.authorizeRequest(miner.worker))
+	if err != nil {
+		return
+	}
+	response, err := miner.readResponse(reader, idAuthorize, "authorize")
+	if err != nil {
+		return
+	}
+	if dialect.Protocol == protocolEthProxy && response.JSONRPC != "2.0" {
+		stats.violation("eth_submitLogin: response is not JSON-RPC 2.0", string(marshalLine(response)))
+	}
+	if !response.resultBool() {
+		err = fmt.Errorf("authorize rejected: %s", marshalLine(response))
+		return
+	}
+
+	// stratumSwitcher在认证响应之后发送两者版本位掩码的交集
+	if dialect.VersionRolling {
+		var notify *RPCMessage
+		notify, err = miner.readMessage(reader)
+		if err != nil {
+			return
+		}
+		if notify.Method != "mining.set_version_mask" {
+			stats.violation("mining.set_version_mask: not sent after authorize", string(marshalLine(notify)))
+			err = errors.New("mining.set_version_mask not sent after authorize")
+			return
+		}
+		miner.checkVersionMask(notify)
+	}
+	return
+}
+
+// checkSubscribeResponse 检查stratumSwitcher的订阅响应，并记录会话ID
+func (miner *Miner) checkSubscribeResponse(response *RPCMessage) error {
+	dialect := miner.dialect
+
+	switch dialect.Protocol {
+	case protocolStratum:
+		// [[["mining.set_difficulty", id], ["mining.notify", id]], extranonce1, extranonce2_size]
+		var result []interface{}
+		json.Unmarshal(response.Result, &result)
+		if len(result) < 3 {
+			return fmt.Errorf("result should have 3 elements: %s", response.Result)
+		}
+		extraNonce1, _ := result[1].(string)
+		if !dialect.checkSessionIDString(extraNonce1) {
+			return fmt.Errorf("bad extranonce1 for %s: %s", dialect.ChainType, response.Result)
+		}
+		miner.setSessionID(extraNonce1)
+
+	case protocolEthStratum:
+		if !response.resultBool() {
+			return fmt.Errorf("result should be true: %s", response.Result)
+		}
+
+	case protocolEthNiceHash:
+		// [["mining.notify", id, "EthereumStratum/1.0.0"], extranonce]
+		var result []interface{}
+		json.Unmarshal(response.Result, &result)
+		if len(result) < 2 {
+			return fmt.Errorf("result should have 2 elements: %s", response.Result)
+		}
+		notify, _ := result[0].([]interface{})
+		extraNonce, _ := result[1].(string)
+		if len(notify) < 3 || notify[0] != "mining.notify" || notify[2] != "EthereumStratum/1.0.0" {
+			return fmt.Errorf("bad subscription: %s", response.Result)
+		}
+		sessionID, _ := notify[1].(string)
+		if !dialect.checkSessionIDString(sessionID) || extraNonce != sessionID {
+			return fmt.Errorf("bad session ID or extranonce: %s", response.Result)
+		}
+		miner.setSessionID(sessionID)
+	}
+	return nil
+}
+
+// checkVersionMask 检查stratumSwitcher发送的版本位掩码
+func (miner *Miner) checkVersionMask(notify *RPCMessage) {
+	mask, _ := notify.paramString(0)
+	expected := fmt.Sprintf("%08x", minerVersionMask&stubVersionMask)
+	if mask != expected {
+		miner.stats.violation("mining.set_version_mask: wrong mask", fmt.Sprint(mask, ", expected ", expected))
+	}
+}
+
+// afterHandshake 握手后需要发送的数据：BTCAgent注册矿机，EthProxy获取任务
+func (miner *Miner) afterHandshake(conn net.Conn) error {
+	switch {
+	case miner.dialect.BTCAgent:
+		var data []byte
+		for i := 0; i < miner.test.agentWorkers; i++ {
+			data = append(data, registerWorkerMessage(uint16(i), "loadTest/"+toolVersion, fmt.Sprintf("%s-w%d", miner.worker, i))...)
+		}
+		return miner.write(conn, data)
+	case miner.dialect.Protocol == protocolEthProxy:
+		return miner.write(conn, miner.dialect.getWorkRequest())
+	}
+	return nil
+}
+
+// submit 提交一个share，尚未收到任务时不提交
+func (miner *Miner) submit(conn net.Conn) error {
+	miner.lock.Lock()
+	jobID := miner.jobID
+	miner.shareSeq++
+	seq := miner.shareSeq
+	miner.lock.Unlock()
+
+	if len(jobID) < 1 {
+		return nil
+	}
+
+	var data []byte
+	if miner.dialect.BTCAgent {
+		data = submitShareMessage(uint8(seq), uint16(seq%miner.test.agentWorkers), uint32(seq), rand.Uint32())
+	} else {
+		data = miner.dialect.submitRequest(shareIDBase+seq, miner.worker, jobID, rand.Uint32())
+	}
+	add(&miner.stats.sharesSent, 1)
+	return miner.write(conn, data)
+}
+
+// readLoop 读取握手后stratumSwitcher转发的数据，直到连接断开
+func (miner *Miner) readLoop(reader *bufio.Reader) error {
+	stats := miner.stats
+
+	for {
+		frame, isExMessage, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		if isExMessage {
+			add(&stats.downReceived, len(frame))
+			continue
+		}
+
+		message, err := parseRPCMessage(frame)
+		if err != nil {
+			stats.violation("malformed JSON from stratumSwitcher", string(frame))
+			continue
+		}
+
+		if len(message.Method) > 0 {
+			switch message.Method {
+			case "mining.set_version_mask":
+				// stratumSwitcher重连服务器后重新发送
+				miner.checkVersionMask(message)
+				continue
+			case "mining.notify":
+				if jobID, ok := message.paramString(0); ok {
+					miner.onJob(jobID)
+				}
+			}
+			add(&stats.downReceived, len(frame))
+			continue
+		}
+
+		switch id := message.intID(); {
+		case id == idAuthorize:
+			// stratumSwitcher重连服务器后重新发送的认证响应
+			if !message.resultBool() {
+				stats.violation("authorize rejected after reconnect", string(frame))
+			}
+			continue
+		case id >= shareIDBase:
+			add(&stats.sharesAnswered, 1)
+		case id == idGetWork || id == 0:
+			// EthProxy的任务
+			var work []string
+			if json.Unmarshal(message.Result, &work) == nil && len(work) > 0 {
+				miner.onJob(decodeEthProxyHeader(work[0]))
+			}
+		default:
+			stats.violation("unexpected response", string(frame))
+		}
+		add(&stats.downReceived, len(frame))
+	}
+}
+
+// onJob 收到新任务，任务所属的币种改变且为当前的目标币种时记录切换耗时
+func (miner *Miner) onJob(jobID string) {
+	coin := jobCoin(jobID)
+	round, target, flipTime := miner.test.currentFlip()
+
+	miner.lock.Lock()
+	miner.jobID = jobID
+	var switched bool
+	if coin != miner.coin {
+		switched = len(miner.coin) > 0
+		miner.coin = coin
+		if coin == target && miner.flipRound < round {
+			miner.flipRound = round
+		} else {
+			switched = false
+		}
+	}
+	miner.lock.Unlock()
+
+	if switched {
+		miner.stats.recordSwitch(time.Since(flipTime))
+	}
+}
+
+// setSessionID 记录stratumSwitcher给出的会话ID
+func (miner *Miner) setSessionID(sessionID string) {
+	miner.lock.Lock()
+	miner.sessionID = sessionID
+	miner.lock.Unlock()
+}
+
+// getSessionID 获取stratumSwitcher给出的会话ID
+func (miner *Miner) getSessionID() string {
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+	return miner.sessionID
+}
+
+// getCoin 获取正在挖的币种
+func (miner *Miner) getCoin() string {
+	miner.lock.Lock()
+	defer miner.lock.Unlock()
+	return miner.coin
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialectStats 一种方言的模拟矿机的统计数据
+type DialectStats struct {
+	// 以下计数器以原子操作访问，须放在结构体开头以保证64位对齐
+
+	// 发起的连接数
+	connects int64
+	// 握手失败的次数
+	handshakeFailures int64
+	// 握手后连接被断开的次数
+	disconnects int64
+	// 提交的share数及收到响应的share数（BTCAgent的share没有响应）
+	sharesSent     int64
+	sharesAnswered int64
+	// 握手后矿机发出的字节数，及桩服务器收到的字节数
+	upSent     int64
+	upReceived int64
+	// 握手后桩服务器发出的字节数，及矿机收到的字节数
+	downSent     int64
+	downReceived int64
+
+	dialect *Dialect
+	// 模拟的矿机数
+	miners int
+	// 连接的stratumSwitcher地址
+	switcherAddr string
+
+	lock sync.Mutex
+	// 握手耗时（从发起连接到认证成功）
+	handshakeLatencies []time.Duration
+	// 切换耗时（从改变币种到收到新币种的任务）
+	switchLatencies []time.Duration
+	// 结束时未在目标币种上的矿机数
+	switchMissed int
+	// 违反协议的次数及第一次的详情
+	violations        map[string]int
+	violationExamples map[string]string
+}
+
+// newDialectStats 创建统计数据
+func newDialectStats(dialect *Dialect, miners int, switcherAddr string) *DialectStats {
+	return &DialectStats{
+		dialect:           dialect,
+		miners:            miners,
+		switcherAddr:      switcherAddr,
+		violations:        make(map[string]int),
+		violationExamples: make(map[string]string),
+	}
+}
+
+// add 原子地增加计数器
+func add(counter *int64, delta int) {
+	atomic.AddInt64(counter, int64(delta))
+}
+
+// recordHandshake 记录一次成功的握手
+func (stats *DialectStats) recordHandshake(latency time.Duration) {
+	stats.lock.Lock()
+	stats.handshakeLatencies = append(stats.handshakeLatencies, latency)
+	stats.lock.Unlock()
+}
+
+// recordSwitch 记录一次完成的切换
+func (stats *DialectStats) recordSwitch(latency time.Duration) {
+	stats.lock.Lock()
+	stats.switchLatencies = append(stats.switchLatencies, latency)
+	stats.lock.Unlock()
+}
+
+// violation 记录一次违反协议的行为，kind 为类别，detail 为详情
+func (stats *DialectStats) violation(kind string, detail string) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	stats.violations[kind]++
+	if _, ok := stats.violationExamples[kind]; !ok {
+		stats.violationExamples[kind] = detail
+	}
+}
+
+// passed 是否通过：没有违反协议、握手失败或未完成的切换
+func (stats *DialectStats) passed() bool {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	return len(stats.violations) == 0 && stats.switchMissed == 0 &&
+		atomic.LoadInt64(&stats.handshakeFailures) == 0
+}
+
+// latencySummary 耗时的分布
+func latencySummary(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "-"
+	}
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p float64) time.Duration {
+		return sorted[int(float64(len(sorted)-1)*p)]
+	}
+	round := func(d time.Duration) time.Duration {
+		return d.Round(100 * time.Microsecond)
+	}
+	return fmt.Sprintf("min %v, p50 %v, p90 %v, p99 %v, max %v",
+		round(sorted[0]), round(percentile(0.5)), round(percentile(0.9)), round(percentile(0.99)), round(sorted[len(sorted)-1]))
+}
+
+// print 输出统计报告
+func (stats *DialectStats) print() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	upSent, upReceived := atomic.LoadInt64(&stats.upSent), atomic.LoadInt64(&stats.upReceived)
+	downSent, downReceived := atomic.LoadInt64(&stats.downSent), atomic.LoadInt64(&stats.downReceived)
+
+	fmt.Printf("== %s: %d miners, stratumSwitcher %s\n", stats.dialect.Name, stats.miners, stats.switcherAddr)
+	fmt.Printf("  handshake:  %d ok, %d failed, %d connects; %s\n", len(stats.handshakeLatencies),
+		atomic.LoadInt64(&stats.handshakeFailures), atomic.LoadInt64(&stats.connects), latencySummary(stats.handshakeLatencies))
+	fmt.Printf("  switch:     %d done, %d not on target coin; %s\n", len(stats.switchLatencies), stats.switchMissed,
+		latencySummary(stats.switchLatencies))
+	if stats.dialect.BTCAgent {
+		// BTCAgent协议中的share提交没有响应
+		fmt.Printf("  shares:     %d sent, not answered in BTCAgent protocol\n", atomic.LoadInt64(&stats.sharesSent))
+	} else {
+		fmt.Printf("  shares:     %d sent, %d answered\n", atomic.LoadInt64(&stats.sharesSent), atomic.LoadInt64(&stats.sharesAnswered))
+	}
+	fmt.Printf("  upstream:   %d bytes sent by miners, %d received by stub servers, %d lost\n", upSent, upReceived, upSent-upReceived)
+	fmt.Printf("  downstream: %d bytes sent by stub servers, %d received by miners, %d lost\n", downSent, downReceived, downSent-downReceived)
+	fmt.Printf("  disconnects after handshake: %d\n", atomic.LoadInt64(&stats.disconnects))
+
+	kinds := make([]string, 0, len(stats.violations))
+	for kind := range stats.violations {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  violation:  %s x%d, e.g. %s\n", kind, stats.violations[kind], stats.violationExamples[kind])
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StubServer 扮演一个币种的sserver的桩服务器
+// 它按矿机的方言响应stratumSwitcher的订阅及认证请求，之后定期下发任务（任务ID中带有币种），
+// 并响应share提交。stratumSwitcher的 StratumServerMap 应指向各币种的桩服务器
+type StubServer struct {
+	// 任务序号（原子操作，须放在结构体开头以保证64位对齐）
+	jobSeq int64
+	// 认证时矿工名不属于任何模拟矿机的次数（原子操作）
+	unknownWorkers int64
+
+	test     *LoadTest
+	coin     string
+	listener net.Listener
+
+	lock  sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// NewStubServer 在 addr 上监听并开始接受stratumSwitcher的连接
+func NewStubServer(test *LoadTest, coin string, addr string) (stub *StubServer, err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	stub = &StubServer{test: test, coin: coin, listener: listener, conns: make(map[net.Conn]bool)}
+	go stub.accept()
+	return
+}
+
+// accept 接受连接，直到监听被关闭
+func (stub *StubServer) accept() {
+	for {
+		conn, err := stub.listener.Accept()
+		if err != nil {
+			return
+		}
+		stub.lock.Lock()
+		stub.conns[conn] = true
+		stub.lock.Unlock()
+		go stub.serve(conn)
+	}
+}
+
+// Close 关闭监听及所有连接
+func (stub *StubServer) Close() {
+	stub.listener.Close()
+
+	stub.lock.Lock()
+	defer stub.lock.Unlock()
+	for conn := range stub.conns {
+		conn.Close()
+	}
+}
+
+// nextJobID 生成新的任务ID
+func (stub *StubServer) nextJobID() string {
+	return makeJobID(stub.coin, atomic.AddInt64(&stub.jobSeq, 1))
+}
+
+// stubConn 桩服务器与stratumSwitcher之间的一个连接
+type stubConn struct {
+	net.Conn
+	stats *DialectStats
+	// 任务下发与share响应在不同的goroutine中写入
+	lock sync.Mutex
+}
+
+// write 写入握手后的数据并计数
+func (conn *stubConn) write(data []byte) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	n, err := conn.Write(data)
+	add(&conn.stats.downSent, n)
+	return err
+}
+
+// serve 处理stratumSwitcher的一个连接
+func (stub *StubServer) serve(netConn net.Conn) {
+	defer func() {
+		netConn.Close()
+		stub.lock.Lock()
+		delete(stub.conns, netConn)
+		stub.lock.Unlock()
+	}()
+
+	reader := bufio.NewReader(netConn)
+	netConn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	// stratumSwitcher连续发送 mining.configure、mining.subscribe 及认证请求后才等待响应
+	var configure, subscribe, authorize *RPCMessage
+	var miner *Miner
+	for miner == nil {
+		line, isExMessage, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		if isExMessage {
+			continue
+		}
+		message, err := parseRPCMessage(line)
+		if err != nil {
+			continue
+		}
+
+		switch message.Method {
+		case "mining.configure":
+			configure = message
+		case "mining.subscribe":
+			subscribe = message
+		case "mining.authorize", "eth_submitLogin":
+			authorize = message
+			worker, _ := message.paramString(0)
+			miner = stub.test.lookupMiner(worker)
+			if miner == nil {
+				add(&stub.unknownWorkers, 1)
+				netConn.Write(marshalLine(map[string]interface{}{"id": message.ID, "result": false, "error": []interface{}{24, "unknown worker", nil}}))
+			}
+		}
+	}
+	netConn.SetReadDeadline(time.Time{})
+
+	dialect := miner.dialect
+	conn := &stubConn{Conn: netConn, stats: miner.stats}
+	sessionID := stub.checkHandshake(miner, configure, subscribe)
+
+	var response []byte
+	if configure != nil {
+		response = append(response, dialect.configureResponse(configure.ID)...)
+	}
+	if subscribe != nil {
+		response = append(response, dialect.subscribeResponse(subscribe.ID, sessionID)...)
+	}
+	response = append(response, dialect.resultResponse(authorize.ID, true)...)
+	netConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := netConn.Write(response)
+	if err != nil {
+		return
+	}
+
+	// 认证之后的数据会被stratumSwitcher原样转发给矿机，计入字节数
+	jobID := stub.nextJobID()
+	if conn.write(dialect.jobMessages(jobID, true)) != nil {
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go stub.notifyLoop(conn, dialect, done)
+
+	for {
+		frame, isExMessage, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		add(&miner.stats.upReceived, len(frame))
+
+		if isExMessage {
+			// 为BTCAgent注册的矿机设置难度
+			if frame[1] == cmdRegisterWorker && len(frame) >= exMessageHeaderLen+2 {
+				agentSessionID := binary.LittleEndian.Uint16(frame[exMessageHeaderLen:])
+				conn.write(miningSetDiffMessage(13, []uint16{agentSessionID}))
+			}
+			continue
+		}
+
+		message, err := parseRPCMessage(frame)
+		if err != nil {
+			miner.stats.violation("upstream: malformed JSON", string(frame))
+			continue
+		}
+		switch message.Method {
+		case "mining.submit", "eth_submitWork", "eth_submitHashrate":
+			conn.write(dialect.resultResponse(message.ID, true))
+		case "eth_getWork":
+			conn.write(dialect.resultResponse(message.ID, dialect.ethProxyWork(stub.nextJobID())))
+		default:
+			miner.stats.violation("upstream: unexpected request", string(frame))
+		}
+	}
+}
+
+// notifyLoop 定期下发新任务
+func (stub *StubServer) notifyLoop(conn *stubConn, dialect *Dialect, done <-chan struct{}) {
+	ticker := time.NewTicker(stub.test.notifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if conn.write(dialect.jobMessages(stub.nextJobID(), false)) != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkHandshake 检查stratumSwitcher转发的订阅请求，返回订阅响应中的会话ID
+func (stub *StubServer) checkHandshake(miner *Miner, configure *RPCMessage, subscribe *RPCMessage) (sessionID string) {
+	dialect := miner.dialect
+	stats := miner.stats
+
+	if dialect.VersionRolling {
+		mask := ""
+		if configure != nil && len(configure.Params) >= 2 {
+			options, _ := configure.Params[1].(map[string]interface{})
+			mask, _ = options["version-rolling.mask"].(string)
+		}
+		if mask != fmt.Sprintf("%08x", minerVersionMask) {
+			stats.violation("upstream: mining.configure not forwarded", string(marshalLine(configure)))
+		}
+	}
+
+	if subscribe == nil {
+		stats.violation("upstream: no mining.subscribe", miner.worker)
+		return
+	}
+
+	userAgent, _ := subscribe.paramString(0)
+	expectedUserAgent := dialect.userAgent()
+	if dialect.Protocol == protocolEthProxy {
+		// EthProxy没有订阅阶段，由stratumSwitcher生成订阅请求
+		expectedUserAgent = "ETHProxy"
+	}
+	if userAgent != expectedUserAgent {
+		stats.violation("upstream: user agent not forwarded", string(marshalLine(subscribe)))
+	}
+
+	if dialect.Protocol == protocolStratum {
+		// 参数为 user agent、会话ID（大端）、矿机IP
+		sessionIDHex, _ := subscribe.paramString(1)
+		id, err := strconv.ParseUint(sessionIDHex, 16, 32)
+		if len(sessionIDHex) != 8 || err != nil || len(subscribe.Params) < 3 {
+			stats.violation("upstream: bad mining.subscribe params", string(marshalLine(subscribe)))
+			return
+		}
+		sessionID = dialect.sessionIDString(uint32(id))
+	} else {
+		// 参数为 user agent、协议、会话ID、矿机IP
+		sessionID, _ = subscribe.paramString(2)
+		if !dialect.checkSessionIDString(sessionID) || len(subscribe.Params) < 4 {
+			stats.violation("upstream: bad mining.subscribe params", string(marshalLine(subscribe)))
+			return
+		}
+	}
+
+	if minerSessionID := miner.getSessionID(); len(minerSessionID) > 0 && minerSessionID != sessionID {
+		stats.violation("upstream: session ID differs from the one given to the miner",
+			fmt.Sprint(miner.worker, ": ", sessionID, " != ", minerSessionID))
+	}
+	return
+}
@@ -0,0 +1,296 @@
+// replayCapture 将stratumSwitcher的抓包文件重放给本地的stratumSwitcher，用于复现握手阶段的问题
+//
+// 工具同时扮演矿机及sserver：以矿机身份连接 -switcher，按抓包文件中的顺序发送矿机的数据；
+// 在 -upstream 上监听，扮演sserver接受stratumSwitcher的连接并发送sserver的数据。
+// stratumSwitcher发出的数据会与抓包文件中的逐行比较，不一致的行会被输出。
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// 抓包文件中的数据方向，与 stratumSwitcher/Capture.go 相同
+const (
+	captureDirClientIn      = "client_in"
+	captureDirClientOut     = "client_out"
+	captureDirServerIn      = "server_in"
+	captureDirServerOut     = "server_out"
+	captureDirServerConnect = "server_connect"
+)
+
+// CaptureHeader 抓包文件的第一行
+type CaptureHeader struct {
+	SessionID string
+	ClientIP  string
+	ChainType string
+	Listener  string `json:",omitempty"`
+	ServerID  uint32
+	StartTime string
+}
+
+// CaptureRecord 抓包文件中的一条记录
+type CaptureRecord struct {
+	Time int64
+	Dir  string
+	Data []byte
+}
+
+// sessionIDRewriter 替换数据中的会话ID
+// 重放时stratumSwitcher分配的会话ID与抓包时不同，而stratumSwitcher会检查sserver返回的会话ID，
+// 因此要从stratumSwitcher发出的数据中得知新的会话ID，并替换之后发送的数据中的旧会话ID
+type sessionIDRewriter struct {
+	// 旧会话ID的各种形式（大端、小端、以太坊的6位）
+	variants []string
+	// 旧会话ID -> 新会话ID
+	mapping map[string]string
+}
+
+// newSessionIDRewriter 创建会话ID替换器，sessionID 为抓包文件中8位十六进制的会话ID
+func newSessionIDRewriter(sessionID string) *sessionIDRewriter {
+	rewriter := &sessionIDRewriter{mapping: make(map[string]string)}
+	id, err := hex.DecodeString(sessionID)
+	if err != nil || len(id) != 4 {
+		return rewriter
+	}
+	le := []byte{id[3], id[2], id[1], id[0]}
+	rewriter.variants = []string{sessionID, hex.EncodeToString(le), sessionID[2:]}
+	return rewriter
+}
+
+// learn 比较抓包文件中的数据与实际数据，得知新的会话ID
+func (rewriter *sessionIDRewriter) learn(expected []byte, actual []byte) {
+	for _, v := range rewriter.variants {
+		if _, ok := rewriter.mapping[v]; ok {
+			continue
+		}
+		pos := bytes.Index(expected, []byte(v))
+		if pos < 0 || pos+len(v) > len(actual) {
+			continue
+		}
+		w := string(actual[pos : pos+len(v)])
+		if _, err := hex.DecodeString(w); err == nil && w != v {
+			rewriter.mapping[v] = w
+			fmt.Printf("session ID rewritten: %s -> %s\n", v, w)
+		}
+	}
+}
+
+// apply 将数据中的旧会话ID替换为新会话ID
+func (rewriter *sessionIDRewriter) apply(data []byte) []byte {
+	for _, v := range rewriter.variants {
+		if w, ok := rewriter.mapping[v]; ok {
+			data = bytes.Replace(data, []byte(v), []byte(w), -1)
+		}
+	}
+	return data
+}
+
+// peer 重放时的一个连接（到stratumSwitcher的矿机连接，或stratumSwitcher到桩服务器的连接）
+type peer struct {
+	name   string
+	conn   net.Conn
+	reader *bufio.Reader
+	// 抓包文件中尚未比较的数据
+	expected []byte
+	// 会话ID替换器
+	rewriter *sessionIDRewriter
+}
+
+// expect 读取stratumSwitcher发出的数据，逐行与抓包文件中的数据比较，返回不一致的行数
+func (p *peer) expect(data []byte, timeout time.Duration) (mismatches int, err error) {
+	p.expected = append(p.expected, data...)
+
+	for {
+		pos := bytes.IndexByte(p.expected, '\n')
+		if pos < 0 {
+			return
+		}
+		expectedLine := p.expected[:pos+1]
+		p.expected = p.expected[pos+1:]
+
+		p.conn.SetReadDeadline(time.Now().Add(timeout))
+		actualLine, readErr := p.reader.ReadBytes('\n')
+		if readErr != nil {
+			err = fmt.Errorf("%s: read failed, expected %q: %v", p.name, expectedLine, readErr)
+			return
+		}
+
+		expectedLine = p.rewriter.apply(expectedLine)
+		if !bytes.Equal(expectedLine, actualLine) {
+			p.rewriter.learn(expectedLine, actualLine)
+			expectedLine = p.rewriter.apply(expectedLine)
+		}
+
+		if bytes.Equal(expectedLine, actualLine) {
+			fmt.Printf("%s <= %s", p.name, actualLine)
+			continue
+		}
+		mismatches++
+		fmt.Printf("%s <= %s", p.name, actualLine)
+		fmt.Printf("%s !! expected: %s", p.name, expectedLine)
+	}
+}
+
+func main() {
+	capturePath := flag.String("capture", "", "Path of capture file")
+	switcherAddr := flag.String("switcher", "127.0.0.1:3333", "Listen address of the local stratumSwitcher")
+	upstreamAddr := flag.String("upstream", "127.0.0.1:13333", "Listen address of the stub stratum server, the local stratumSwitcher should connect to it")
+	timeoutSeconds := flag.Int("timeout", 10, "Timeout of waiting for data from stratumSwitcher")
+	dump := flag.Bool("dump", false, "Print the capture file and exit")
+	flag.Parse()
+
+	header, records, err := loadCapture(*capturePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "load capture failed:", err)
+		os.Exit(2)
+	}
+	fmt.Printf("Session %s, IP %s, chain %s, server ID %d, started at %s, %d records\n",
+		header.SessionID, header.ClientIP, header.ChainType, header.ServerID, header.StartTime, len(records))
+
+	if *dump {
+		dumpCapture(records)
+		return
+	}
+
+	mismatches, err := replay(records, newSessionIDRewriter(header.SessionID), *switcherAddr, *upstreamAddr, time.Duration(*timeoutSeconds)*time.Second)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Replay finished, %d mismatched lines\n", mismatches)
+	if mismatches > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadCapture 读取抓包文件
+func loadCapture(path string) (header CaptureHeader, records []CaptureRecord, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		err = fmt.Errorf("empty capture file")
+		return
+	}
+	err = json.Unmarshal(scanner.Bytes(), &header)
+	if err != nil {
+		return
+	}
+
+	for scanner.Scan() {
+		var record CaptureRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return
+		}
+		records = append(records, record)
+	}
+	err = scanner.Err()
+	return
+}
+
+// dumpCapture 以可读的格式输出抓包文件
+func dumpCapture(records []CaptureRecord) {
+	if len(records) == 0 {
+		return
+	}
+	start := records[0].Time
+	for _, record := range records {
+		offset := time.Duration(record.Time - start)
+		fmt.Printf("%12.6f %-14s %q\n", offset.Seconds(), record.Dir, record.Data)
+	}
+}
+
+// replay 重放抓包文件，返回stratumSwitcher发出的数据中不一致的行数
+func replay(records []CaptureRecord, rewriter *sessionIDRewriter, switcherAddr string, upstreamAddr string, timeout time.Duration) (mismatches int, err error) {
+	listener, err := net.Listen("tcp", upstreamAddr)
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	clientConn, err := net.DialTimeout("tcp", switcherAddr, timeout)
+	if err != nil {
+		return
+	}
+	defer clientConn.Close()
+	client := &peer{name: "miner", conn: clientConn, reader: bufio.NewReader(clientConn), rewriter: rewriter}
+
+	var server *peer
+	defer func() {
+		if server != nil {
+			server.conn.Close()
+		}
+	}()
+
+	for _, record := range records {
+		var n int
+		switch record.Dir {
+		case captureDirClientIn:
+			data := rewriter.apply(record.Data)
+			fmt.Printf("miner => %s", data)
+			_, err = clientConn.Write(data)
+
+		case captureDirClientOut:
+			n, err = client.expect(record.Data, timeout)
+			mismatches += n
+
+		case captureDirServerConnect:
+			if server != nil {
+				server.conn.Close()
+			}
+			server, err = acceptServerConn(listener, rewriter, timeout)
+			if err == nil {
+				fmt.Printf("server: stratumSwitcher connected (%s)\n", record.Data)
+			}
+
+		case captureDirServerIn:
+			if server == nil {
+				err = fmt.Errorf("server data before server connected")
+				break
+			}
+			data := rewriter.apply(record.Data)
+			fmt.Printf("server => %s", data)
+			_, err = server.conn.Write(data)
+
+		case captureDirServerOut:
+			if server == nil {
+				err = fmt.Errorf("server data before server connected")
+				break
+			}
+			n, err = server.expect(record.Data, timeout)
+			mismatches += n
+		}
+
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// acceptServerConn 以桩服务器的身份等待stratumSwitcher连接
+func acceptServerConn(listener net.Listener, rewriter *sessionIDRewriter, timeout time.Duration) (*peer, error) {
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Now().Add(timeout))
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("wait for stratumSwitcher to connect failed: %v", err)
+	}
+	return &peer{name: "server", conn: conn, reader: bufio.NewReader(conn), rewriter: rewriter}, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/btccom/btcpool-go-modules/health"
+	initusercoin "github.com/btccom/btcpool-go-modules/userChainAPIServer/initUserCoin"
+	switcherapiserver "github.com/btccom/btcpool-go-modules/userChainAPIServer/switcherAPIServer"
+)
+
+// registerHealthHTTPAPI 注册存活检查 /healthz 及就绪检查 /readyz，无需Basic认证
+// 两个子模块共用 initUserCoin 的 ListenAddr 监听
+func registerHealthHTTPAPI() {
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		health.WriteStatus(w, health.Status{Status: health.StatusOK})
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		health.WriteStatus(w, checkReadiness())
+	})
+}
+
+// checkReadiness 检查两个子模块的Zookeeper会话
+func checkReadiness() health.Status {
+	return health.NewStatus(map[string]error{
+		"switcherAPIServer/zookeeper": switcherapiserver.CheckZookeeper(),
+		"initUserCoin/zookeeper":      initusercoin.CheckZookeeper(),
+	})
+}
@@ -12,6 +12,7 @@ func main() {
 	configFilePath := flag.String("config", "./config.json", "Path of config file")
 	flag.Parse()
 
+	registerHealthHTTPAPI()
 	go switcherapiserver.Main(*configFilePath)
 	initusercoin.Main(*configFilePath)
 }
@@ -202,6 +202,9 @@ func setMiningCoin(puname string, coin string) (apiErr *APIError) {
 		return
 	}
 
+	// 写入Kafka在后台进行，zookeeper中的记录已创建，重试会被跳过
+	publishSwitchEvent(puname, coin)
+
 	apiErr = nil
 	return
 }
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	switchevent "github.com/btccom/btcpool-go-modules/userChainAPIServer/switchEvent"
 	"github.com/golang/glog"
 	"github.com/samuel/go-zookeeper/zk"
 )
@@ -51,6 +52,11 @@ type ConfigData struct {
 	EnableAPIServer bool
 	// API Server 的监听IP:端口
 	ListenAddr string
+
+	// Kafka集群的IP:端口列表
+	KafkaBrokers []string
+	// 币种切换事件的Kafka Topic，创建子账户的币种记录时同时写入该Topic，为空则不写入
+	SwitchEventTopic string
 }
 
 // zookeeperConn Zookeeper连接对象
@@ -129,6 +135,10 @@ func Main(configFilePath string) {
 		}
 	}
 
+	if len(configData.SwitchEventTopic) > 0 {
+		switchEventPublisher = switchevent.GetPublisher(configData.KafkaBrokers, configData.SwitchEventTopic)
+	}
+
 	// 开始执行币种初始化任务
 	for coin, url := range configData.UserListAPI {
 		waitGroup.Add(1)
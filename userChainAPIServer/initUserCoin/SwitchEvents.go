@@ -0,0 +1,16 @@
+package initusercoin
+
+import (
+	switchevent "github.com/btccom/btcpool-go-modules/userChainAPIServer/switchEvent"
+)
+
+// switchEventPublisher 币种切换事件的发布器（未配置 SwitchEventTopic 时为nil）
+var switchEventPublisher *switchevent.Publisher
+
+// publishSwitchEvent 将新子账户的币种写入Kafka，未配置 SwitchEventTopic 时不做任何事
+// Zookeeper中的记录已创建，发布在后台进行，失败时会一直重试
+func publishSwitchEvent(puname string, coin string) {
+	if switchEventPublisher != nil {
+		switchEventPublisher.Publish(puname, coin)
+	}
+}
@@ -1,6 +1,7 @@
 package initusercoin
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/golang/glog"
@@ -47,3 +48,14 @@ func createZookeeperPath(path string) error {
 
 	return nil
 }
+
+// CheckZookeeper 检查Zookeeper会话是否可用，用于就绪检查
+func CheckZookeeper() error {
+	if zookeeperConn == nil {
+		return errors.New("zookeeper not connected yet")
+	}
+	if state := zookeeperConn.State(); state != zk.StateHasSession {
+		return errors.New("zookeeper state: " + state.String())
+	}
+	return nil
+}
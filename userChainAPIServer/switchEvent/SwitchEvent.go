@@ -0,0 +1,174 @@
+package switchevent
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/segmentio/kafka-go"
+)
+
+// 写入币种切换事件的超时时间
+const writeTimeout = 10 * time.Second
+
+// 每批写入的最大消息数
+const writeBatchSize = 1000
+
+// 写入失败后重试的最短及最长等待时间
+const (
+	retryMinDelay = time.Second
+	retryMaxDelay = time.Minute
+)
+
+// SwitchEvent 币种切换事件，SwitchSource 为 kafka 的 stratumSwitcher 消费该事件来切换币种
+// 消息的Key为子账户名，Topic应开启日志压缩（cleanup.policy=compact）
+type SwitchEvent struct {
+	SubAccount string `json:"sub_account"`
+	Coin       string `json:"coin"`
+	Timestamp  int64  `json:"timestamp"` // 秒
+}
+
+// messageWriter 写入Kafka消息，由 *kafka.Writer 实现
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Publisher 币种切换事件的发布器
+// Zookeeper中的记录是权威的，事件只是其通知：发布在后台进行，写入失败时一直重试，
+// 同一子账户尚未写入的旧事件会被新事件取代，因此不会覆盖更新的币种
+type Publisher struct {
+	writer messageWriter
+
+	lock sync.Mutex
+	// 等待写入的事件，子账户名 -> 消息
+	pending map[string]kafka.Message
+	// 有新事件时通知
+	notify chan struct{}
+}
+
+var (
+	publishersLock sync.Mutex
+	publishers     = make(map[string]*Publisher)
+)
+
+// GetPublisher 返回写入指定Topic的发布器，同一进程中的各模块共用，以保证同一子账户的事件按顺序写入
+func GetPublisher(brokers []string, topic string) *Publisher {
+	publishersLock.Lock()
+	defer publishersLock.Unlock()
+
+	publisher := publishers[topic]
+	if publisher == nil {
+		publisher = newPublisher(kafka.NewWriter(kafka.WriterConfig{
+			Brokers: brokers,
+			Topic:   topic,
+			// 同一子账户的事件总是写入同一分区，以保证事件的顺序及日志压缩的结果正确
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+			WriteTimeout: writeTimeout,
+		}))
+		publishers[topic] = publisher
+	}
+	return publisher
+}
+
+// newPublisher 创建发布器并开始在后台写入
+func newPublisher(writer messageWriter) *Publisher {
+	publisher := &Publisher{
+		writer:  writer,
+		pending: make(map[string]kafka.Message),
+		notify:  make(chan struct{}, 1),
+	}
+	go publisher.run()
+	return publisher
+}
+
+// Publish 发布子账户的币种（不等待写入完成）
+func (publisher *Publisher) Publish(subAccount string, coin string) {
+	value, _ := json.Marshal(SwitchEvent{subAccount, coin, time.Now().Unix()})
+
+	publisher.lock.Lock()
+	publisher.pending[subAccount] = kafka.Message{Key: []byte(subAccount), Value: value}
+	publisher.lock.Unlock()
+
+	select {
+	case publisher.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending 等待写入的事件数
+func (publisher *Publisher) Pending() int {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	return len(publisher.pending)
+}
+
+// run 写入等待中的事件，失败时等待一段时间后重试
+func (publisher *Publisher) run() {
+	delay := retryMinDelay
+	for range publisher.notify {
+		for {
+			err := publisher.flush()
+			if err == nil {
+				delay = retryMinDelay
+				break
+			}
+
+			glog.Error("Publish switch events failed, pending: ", publisher.Pending(), ", retry after ", delay, ": ", err)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > retryMaxDelay {
+				delay = retryMaxDelay
+			}
+		}
+	}
+}
+
+// flush 分批写入所有等待中的事件
+func (publisher *Publisher) flush() error {
+	for {
+		batch := publisher.takeBatch()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		err := publisher.writer.WriteMessages(ctx, batch...)
+		cancel()
+		if err != nil {
+			publisher.restore(batch)
+			return err
+		}
+	}
+}
+
+// takeBatch 取出一批等待写入的事件
+func (publisher *Publisher) takeBatch() []kafka.Message {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+
+	batch := make([]kafka.Message, 0, writeBatchSize)
+	for subAccount, message := range publisher.pending {
+		if len(batch) >= writeBatchSize {
+			break
+		}
+		batch = append(batch, message)
+		delete(publisher.pending, subAccount)
+	}
+	return batch
+}
+
+// restore 放回写入失败的事件，已有更新事件的子账户除外
+func (publisher *Publisher) restore(batch []kafka.Message) {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+
+	for _, message := range batch {
+		subAccount := string(message.Key)
+		if _, replaced := publisher.pending[subAccount]; !replaced {
+			publisher.pending[subAccount] = message
+		}
+	}
+}
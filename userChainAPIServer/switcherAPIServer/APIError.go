@@ -42,4 +42,10 @@ var (
 
 	// APIErrUserCoinsEmpty 用户币种数组为空
 	APIErrUserCoinsEmpty = NewAPIError(108, "usercoins is empty")
+
+	// APIErrScheduleInvalid 定时切换计划不合法
+	APIErrScheduleInvalid = NewAPIError(109, "schedule invalid")
+
+	// APIErrScheduleNotFound 定时切换计划不存在
+	APIErrScheduleNotFound = NewAPIError(110, "schedule not found")
 )
@@ -89,6 +89,12 @@ func runAPIServer() {
 	http.HandleFunc("/subpool/update-coinbase", basicAuth(updateCoinbaseHandle))
 	http.HandleFunc("/subpool-update-coinbase", basicAuth(updateCoinbaseHandle))
 
+	http.HandleFunc("/session/subaccount", basicAuth(subAccountSessionsHandle))
+
+	http.HandleFunc("/schedule/get", basicAuth(getScheduleHandle))
+	http.HandleFunc("/schedule/set", basicAuth(setScheduleHandle))
+	http.HandleFunc("/schedule/delete", basicAuth(deleteScheduleHandle))
+
 	// The listener will be done in initUserCoin/HTTPAPI.go
 	/*err := http.ListenAndServe(configData.ListenAddr, nil)
 
@@ -493,6 +499,8 @@ func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIEr
 				apiErr = APIErrWriteRecordFailed
 				return
 			}
+
+			publishSwitchEvent(puname, coin)
 		} else {
 			if userUpdateTime <= 0 {
 				userUpdateTime = nowTime
@@ -504,11 +512,14 @@ func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIEr
 				time.Sleep(time.Duration(sleepTime) * time.Second)
 
 				// 写入新值
-				_, err = zookeeperConn.Set(zkPath, []byte(coin), -1)
+				_, err := zookeeperConn.Set(zkPath, []byte(coin), -1)
 
 				if err != nil {
 					glog.Error("zk.Set(", zkPath, ",", coin, ") Failed: ", err)
+					return
 				}
+
+				publishSwitchEvent(puname, coin)
 			}()
 		}
 
@@ -521,6 +532,8 @@ func changeMiningCoin(puname string, coin string) (oldCoin string, apiErr *APIEr
 			apiErr = APIErrWriteRecordFailed
 			return
 		}
+
+		publishSwitchEvent(puname, coin)
 	}
 
 	apiErr = nil
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	switchevent "github.com/btccom/btcpool-go-modules/userChainAPIServer/switchEvent"
 	"github.com/golang/glog"
 	"github.com/samuel/go-zookeeper/zk"
 )
@@ -44,6 +45,20 @@ type ConfigData struct {
 	ZKSubPoolUpdateBaseDir string
 	// 子池更新时jobmaker的应答超时时间，如果在该时间内jobmaker没有应答，则API返回错误
 	ZKSubPoolUpdateAckTimeout int
+	// stratumSwitcher发布会话目录的zookeeper路径，以斜杠结尾，为空则不提供会话查询API
+	ZKSessionDirectoryDir string
+
+	// Kafka集群的IP:端口列表
+	KafkaBrokers []string
+	// 币种切换事件的Kafka Topic，切换币种时除写入zookeeper外还将写入该Topic，为空则不写入
+	SwitchEventTopic string
+	// 启动时将zookeeper中所有子账户的币种写入 SwitchEventTopic 作为快照
+	SwitchEventSnapshotOnStart bool
+
+	// 子账户定时切换计划的zookeeper路径，以斜杠结尾，为空则不启用定时切换
+	ZKScheduleDir string
+	// 定时切换计划的检查间隔
+	ScheduleIntervalSeconds int
 }
 
 // zookeeperConn Zookeeper连接对象
@@ -80,6 +95,15 @@ func Main(configFilePath string) {
 	if len(configData.ZKSubPoolUpdateBaseDir) > 0 && configData.ZKSubPoolUpdateBaseDir[len(configData.ZKSubPoolUpdateBaseDir)-1] != '/' {
 		configData.ZKSubPoolUpdateBaseDir += "/"
 	}
+	if len(configData.ZKSessionDirectoryDir) > 0 && configData.ZKSessionDirectoryDir[len(configData.ZKSessionDirectoryDir)-1] != '/' {
+		configData.ZKSessionDirectoryDir += "/"
+	}
+	if len(configData.ZKScheduleDir) > 0 && configData.ZKScheduleDir[len(configData.ZKScheduleDir)-1] != '/' {
+		configData.ZKScheduleDir += "/"
+	}
+	if configData.ScheduleIntervalSeconds <= 0 {
+		configData.ScheduleIntervalSeconds = defaultScheduleIntervalSeconds
+	}
 
 	// 建立到Zookeeper集群的连接
 	conn, _, err := zk.Connect(configData.ZKBroker, time.Duration(zookeeperConnTimeout)*time.Second)
@@ -99,6 +123,13 @@ func Main(configFilePath string) {
 		return
 	}
 
+	if len(configData.SwitchEventTopic) > 0 {
+		switchEventPublisher = switchevent.GetPublisher(configData.KafkaBrokers, configData.SwitchEventTopic)
+		if configData.SwitchEventSnapshotOnStart {
+			go publishSwitchSnapshot()
+		}
+	}
+
 	if configData.EnableAPIServer {
 		waitGroup.Add(1)
 		go runAPIServer()
@@ -109,5 +140,17 @@ func Main(configFilePath string) {
 		go RunCronJob()
 	}
 
+	if len(configData.ZKScheduleDir) > 0 {
+		err = createZookeeperPath(configData.ZKScheduleDir)
+
+		if err != nil {
+			glog.Fatal("Create Zookeeper Path Failed: ", err)
+			return
+		}
+
+		waitGroup.Add(1)
+		go RunScheduler()
+	}
+
 	waitGroup.Wait()
 }
@@ -0,0 +1,412 @@
+package switcherapiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// 默认的定时切换检查间隔
+const defaultScheduleIntervalSeconds = 30
+
+// 定时切换失败后重试的最长间隔，重试间隔从检查间隔开始每次加倍
+const scheduleRetryMaxSeconds = 3600
+
+// ScheduleRule 定时切换规则：在指定星期的 Start 到 End 之间挖 Coin
+// End 早于 Start 表示跨越午夜（时段属于开始的那一天），两者相同表示全天
+type ScheduleRule struct {
+	Coin string `json:"coin"`
+	// 星期（0为星期日，6为星期六），为空表示每天
+	Weekdays []int `json:"weekdays,omitempty"`
+	// 开始及结束时间，格式为 HH:MM
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// 解析后的开始及结束时间（从零点开始的分钟数）
+	startMinute int
+	endMinute   int
+}
+
+// SwitchSchedule 子账户的定时切换计划，保存在 ZKScheduleDir/子账户名 节点中
+// 按顺序匹配规则，第一个包含当前时间的规则决定币种，都不匹配时使用 DefaultCoin（为空则不切换）
+type SwitchSchedule struct {
+	// 时区，如 Asia/Shanghai，为空表示UTC
+	Timezone    string         `json:"timezone"`
+	DefaultCoin string         `json:"default_coin,omitempty"`
+	Rules       []ScheduleRule `json:"rules"`
+
+	// 计划最后一次应用的币种及时间，只在计划决定的币种改变时切换，
+	// 因此时段内的手动切换会保持到下一个时段开始。设置计划时清空，使新计划立即生效
+	AppliedCoin string `json:"applied_coin,omitempty"`
+	AppliedAt   int64  `json:"applied_at,omitempty"`
+
+	// 切换失败的币种、连续失败次数、最后一次失败的时间及原因，切换成功或设置计划时清空
+	FailedCoin  string `json:"failed_coin,omitempty"`
+	FailedCount int    `json:"failed_count,omitempty"`
+	FailedAt    int64  `json:"failed_at,omitempty"`
+	FailedError string `json:"failed_error,omitempty"`
+
+	location *time.Location
+}
+
+// ScheduleResponse 查询定时切换计划的响应
+type ScheduleResponse struct {
+	APIResponse
+	PUName   string          `json:"puname"`
+	Schedule *SwitchSchedule `json:"schedule"`
+	// 计划决定的当前币种，为空表示当前不切换
+	CurrentCoin string `json:"current_coin"`
+}
+
+// 已加载的时区
+var scheduleLocations = make(map[string]*time.Location)
+var scheduleLocationsLock sync.Mutex
+
+// loadScheduleLocation 加载时区（带缓存）
+func loadScheduleLocation(name string) (*time.Location, error) {
+	scheduleLocationsLock.Lock()
+	defer scheduleLocationsLock.Unlock()
+
+	if location, ok := scheduleLocations[name]; ok {
+		return location, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	scheduleLocations[name] = location
+	return location, nil
+}
+
+// parseClock 解析 HH:MM 格式的时间，返回从零点开始的分钟数
+func parseClock(clock string) (minute int, err error) {
+	var hour int
+	n, err := fmt.Sscanf(clock, "%d:%d", &hour, &minute)
+	if err != nil || n != 2 || len(clock) != 5 || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, errors.New("invalid time " + clock + ", should be HH:MM")
+	}
+	return hour*60 + minute, nil
+}
+
+// parseSwitchSchedule 解析并检查定时切换计划
+func parseSwitchSchedule(data []byte) (schedule *SwitchSchedule, err error) {
+	schedule = new(SwitchSchedule)
+	err = json.Unmarshal(data, schedule)
+	if err != nil {
+		return
+	}
+
+	schedule.location, err = loadScheduleLocation(schedule.Timezone)
+	if err != nil {
+		return
+	}
+
+	if len(schedule.DefaultCoin) > 0 && !isAvailableCoin(schedule.DefaultCoin) {
+		err = errors.New("coin " + schedule.DefaultCoin + " is inexistent")
+		return
+	}
+
+	for i := range schedule.Rules {
+		rule := &schedule.Rules[i]
+		if !isAvailableCoin(rule.Coin) {
+			err = errors.New("coin " + rule.Coin + " is inexistent")
+			return
+		}
+		for _, weekday := range rule.Weekdays {
+			if weekday < 0 || weekday > 6 {
+				err = fmt.Errorf("invalid weekday %d, should be 0-6", weekday)
+				return
+			}
+		}
+		rule.startMinute, err = parseClock(rule.Start)
+		if err != nil {
+			return
+		}
+		rule.endMinute, err = parseClock(rule.End)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// isAvailableCoin 币种是否在 AvailableCoins 中
+func isAvailableCoin(coin string) bool {
+	for _, availableCoin := range configData.AvailableCoins {
+		if availableCoin == coin {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWeekday 规则是否适用于该星期
+func (rule *ScheduleRule) hasWeekday(weekday int) bool {
+	if len(rule.Weekdays) == 0 {
+		return true
+	}
+	for _, day := range rule.Weekdays {
+		if day == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// contains 规则的时段是否包含该时间（星期及从零点开始的分钟数）
+func (rule *ScheduleRule) contains(weekday int, minute int) bool {
+	if rule.startMinute == rule.endMinute {
+		return rule.hasWeekday(weekday)
+	}
+	if rule.startMinute < rule.endMinute {
+		return rule.hasWeekday(weekday) && minute >= rule.startMinute && minute < rule.endMinute
+	}
+	// 跨越午夜：当天开始的时段，或前一天开始、尚未结束的时段
+	return (rule.hasWeekday(weekday) && minute >= rule.startMinute) ||
+		(rule.hasWeekday((weekday+6)%7) && minute < rule.endMinute)
+}
+
+// CoinAt 计划在该时间决定的币种，为空表示不切换
+func (schedule *SwitchSchedule) CoinAt(now time.Time) string {
+	local := now.In(schedule.location)
+	weekday := int(local.Weekday())
+	minute := local.Hour()*60 + local.Minute()
+
+	for i := range schedule.Rules {
+		if schedule.Rules[i].contains(weekday, minute) {
+			return schedule.Rules[i].Coin
+		}
+	}
+	return schedule.DefaultCoin
+}
+
+// retryDue 切换到该币种失败后，是否已到重试时间（interval 为检查间隔）
+func (schedule *SwitchSchedule) retryDue(coin string, now time.Time, interval time.Duration) bool {
+	if coin != schedule.FailedCoin || schedule.FailedCount < 1 {
+		return true
+	}
+
+	delay := interval
+	for i := 1; i < schedule.FailedCount && delay < scheduleRetryMaxSeconds*time.Second; i++ {
+		delay *= 2
+	}
+	if delay > scheduleRetryMaxSeconds*time.Second {
+		delay = scheduleRetryMaxSeconds * time.Second
+	}
+	return !now.Before(time.Unix(schedule.FailedAt, 0).Add(delay))
+}
+
+// recordFailure 记录切换失败，同一币种连续失败时累计次数
+func (schedule *SwitchSchedule) recordFailure(coin string, errMsg string, now time.Time) {
+	if coin != schedule.FailedCoin {
+		schedule.FailedCoin = coin
+		schedule.FailedCount = 0
+	}
+	schedule.FailedCount++
+	schedule.FailedAt = now.Unix()
+	schedule.FailedError = errMsg
+}
+
+// clearFailure 清除切换失败的记录
+func (schedule *SwitchSchedule) clearFailure() {
+	schedule.FailedCoin = ""
+	schedule.FailedCount = 0
+	schedule.FailedAt = 0
+	schedule.FailedError = ""
+}
+
+// RunScheduler 定期检查所有子账户的定时切换计划，并通过与手动切换相同的途径切换币种
+func RunScheduler() {
+	defer waitGroup.Done()
+
+	for {
+		dir := configData.ZKScheduleDir[:len(configData.ZKScheduleDir)-1]
+		punames, _, err := zookeeperConn.Children(dir)
+		if err != nil {
+			glog.Error("zk.Children(", dir, ") Failed: ", err)
+		}
+		for _, puname := range punames {
+			applySchedule(puname)
+		}
+
+		time.Sleep(time.Duration(configData.ScheduleIntervalSeconds) * time.Second)
+	}
+}
+
+// applySchedule 检查子账户的定时切换计划，计划决定的币种改变时进行切换
+// 切换失败时将失败记录在计划中，并按指数退避重试
+func applySchedule(puname string) {
+	path := configData.ZKScheduleDir + puname
+	data, stat, err := zookeeperConn.Get(path)
+	if err != nil {
+		// 计划可能刚好被删除
+		glog.Warning("zk.Get(", path, ") Failed: ", err)
+		return
+	}
+
+	schedule, err := parseSwitchSchedule(data)
+	if err != nil {
+		glog.Warning("Invalid schedule of ", puname, ": ", err)
+		return
+	}
+
+	now := time.Now()
+	coin := schedule.CoinAt(now)
+	if coin == schedule.AppliedCoin {
+		return
+	}
+	if !schedule.retryDue(coin, now, time.Duration(configData.ScheduleIntervalSeconds)*time.Second) {
+		return
+	}
+
+	var apiErr *APIError
+	if len(coin) > 0 {
+		var oldCoin string
+		oldCoin, apiErr = changeMiningCoin(puname, coin)
+		if apiErr != nil {
+			schedule.recordFailure(coin, apiErr.ErrMsg, now)
+			glog.Warning("[schedule-switch] ", apiErr.ErrMsg, " (failed ", schedule.FailedCount, " times): ", puname, ": ", oldCoin, " -> ", coin)
+		} else {
+			glog.Info("[schedule-switch] ", puname, ": ", oldCoin, " -> ", coin)
+		}
+	}
+
+	if apiErr == nil {
+		// 记录已应用的币种
+		schedule.AppliedCoin = coin
+		schedule.AppliedAt = now.Unix()
+		schedule.clearFailure()
+	}
+
+	// 计划在此期间被修改时放弃写入，下次检查时按新计划处理
+	data, _ = json.Marshal(schedule)
+	_, err = zookeeperConn.Set(path, data, stat.Version)
+	if err != nil && err != zk.ErrBadVersion {
+		glog.Error("zk.Set(", path, ") Failed: ", err)
+	}
+}
+
+// schedulePUName 读取并检查请求中的子账户名
+func schedulePUName(w http.ResponseWriter, req *http.Request) (puname string, ok bool) {
+	if len(configData.ZKScheduleDir) == 0 {
+		writeError(w, 403, "API disabled")
+		return
+	}
+
+	puname = req.FormValue("puname")
+	if len(puname) < 1 {
+		writeError(w, APIErrPunameIsEmpty.ErrNo, APIErrPunameIsEmpty.ErrMsg)
+		return
+	}
+	if strings.Contains(puname, "/") {
+		writeError(w, APIErrPunameInvalid.ErrNo, APIErrPunameInvalid.ErrMsg)
+		return
+	}
+	if configData.StratumServerCaseInsensitive {
+		puname = strings.ToLower(puname)
+	}
+
+	ok = true
+	return
+}
+
+// getScheduleHandle 查询子账户的定时切换计划
+func getScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	puname, ok := schedulePUName(w, req)
+	if !ok {
+		return
+	}
+
+	path := configData.ZKScheduleDir + puname
+	data, _, err := zookeeperConn.Get(path)
+	if err == zk.ErrNoNode {
+		writeError(w, APIErrScheduleNotFound.ErrNo, APIErrScheduleNotFound.ErrMsg)
+		return
+	}
+	if err != nil {
+		glog.Error("zk.Get(", path, ") Failed: ", err)
+		writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+		return
+	}
+
+	schedule, err := parseSwitchSchedule(data)
+	if err != nil {
+		writeError(w, APIErrScheduleInvalid.ErrNo, APIErrScheduleInvalid.ErrMsg+": "+err.Error())
+		return
+	}
+
+	response := ScheduleResponse{APIResponse{0, "", true}, puname, schedule, schedule.CoinAt(time.Now())}
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
+
+// setScheduleHandle 设置子账户的定时切换计划，计划以JSON格式放在请求Body中，设置后立即生效
+func setScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	puname, ok := schedulePUName(w, req)
+	if !ok {
+		return
+	}
+
+	requestJSON, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		glog.Warning(err, ": ", req.RequestURI)
+		writeError(w, 500, err.Error())
+		return
+	}
+
+	schedule, err := parseSwitchSchedule(requestJSON)
+	if err != nil {
+		writeError(w, APIErrScheduleInvalid.ErrNo, APIErrScheduleInvalid.ErrMsg+": "+err.Error())
+		return
+	}
+	schedule.AppliedCoin = ""
+	schedule.AppliedAt = 0
+	schedule.clearFailure()
+	data, _ := json.Marshal(schedule)
+
+	path := configData.ZKScheduleDir + puname
+	_, err = zookeeperConn.Set(path, data, -1)
+	if err == zk.ErrNoNode {
+		_, err = zookeeperConn.Create(path, data, 0, zk.WorldACL(zk.PermAll))
+	}
+	if err != nil {
+		glog.Error("zk.Set(", path, ") Failed: ", err)
+		writeError(w, APIErrWriteRecordFailed.ErrNo, APIErrWriteRecordFailed.ErrMsg)
+		return
+	}
+
+	glog.Info("[schedule-set] ", puname, ": ", string(data))
+	applySchedule(puname)
+	writeSuccess(w)
+}
+
+// deleteScheduleHandle 删除子账户的定时切换计划，子账户保持当前的币种
+func deleteScheduleHandle(w http.ResponseWriter, req *http.Request) {
+	puname, ok := schedulePUName(w, req)
+	if !ok {
+		return
+	}
+
+	path := configData.ZKScheduleDir + puname
+	err := zookeeperConn.Delete(path, -1)
+	if err == zk.ErrNoNode {
+		writeError(w, APIErrScheduleNotFound.ErrNo, APIErrScheduleNotFound.ErrMsg)
+		return
+	}
+	if err != nil {
+		glog.Error("zk.Delete(", path, ") Failed: ", err)
+		writeError(w, APIErrWriteRecordFailed.ErrNo, APIErrWriteRecordFailed.ErrMsg)
+		return
+	}
+
+	glog.Info("[schedule-delete] ", puname)
+	writeSuccess(w)
+}
@@ -0,0 +1,204 @@
+package switcherapiserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	for _, test := range []struct {
+		clock  string
+		minute int
+		ok     bool
+	}{
+		{"00:00", 0, true},
+		{"08:30", 510, true},
+		{"23:59", 1439, true},
+		{"24:00", 0, false},
+		{"12:60", 0, false},
+		{"8:30", 0, false},
+		{"08:3", 0, false},
+		{"-1:30", 0, false},
+		{"0830", 0, false},
+		{"", 0, false},
+	} {
+		minute, err := parseClock(test.clock)
+		if (err == nil) != test.ok || minute != test.minute {
+			t.Errorf("parseClock(%q) = %d, %v", test.clock, minute, err)
+		}
+	}
+}
+
+// newTestSchedule 解析测试用的定时切换计划
+func newTestSchedule(t *testing.T, data string) *SwitchSchedule {
+	configData = &ConfigData{AvailableCoins: []string{"btc", "bcc", "bsv"}}
+	schedule, err := parseSwitchSchedule([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schedule
+}
+
+func TestScheduleRuleContains(t *testing.T) {
+	const (
+		sunday   = 0
+		monday   = 1
+		friday   = 5
+		saturday = 6
+	)
+	schedule := newTestSchedule(t, `{"rules": [
+		{"coin": "bcc", "weekdays": [1, 2, 3, 4, 5], "start": "08:00", "end": "18:00"},
+		{"coin": "bcc", "weekdays": [5], "start": "22:00", "end": "06:00"},
+		{"coin": "bcc", "weekdays": [0], "start": "12:00", "end": "12:00"}
+	]}`)
+	daytime, overnight, allDay := &schedule.Rules[0], &schedule.Rules[1], &schedule.Rules[2]
+
+	for _, test := range []struct {
+		name     string
+		rule     *ScheduleRule
+		weekday  int
+		clock    string
+		contains bool
+	}{
+		{"daytime start", daytime, monday, "08:00", true},
+		{"daytime before start", daytime, monday, "07:59", false},
+		{"daytime end is exclusive", daytime, monday, "18:00", false},
+		{"daytime other weekday", daytime, saturday, "12:00", false},
+		{"overnight evening", overnight, friday, "23:00", true},
+		{"overnight before start", overnight, friday, "21:59", false},
+		// 跨越午夜的时段属于开始的那一天，星期六凌晨属于星期五的时段
+		{"overnight after midnight", overnight, saturday, "05:59", true},
+		{"overnight end is exclusive", overnight, saturday, "06:00", false},
+		{"overnight morning of start day", overnight, friday, "05:00", false},
+		{"overnight evening of next day", overnight, saturday, "23:00", false},
+		// 开始与结束相同表示全天
+		{"all day", allDay, sunday, "00:00", true},
+		{"all day end", allDay, sunday, "23:59", true},
+		{"all day other weekday", allDay, monday, "12:00", false},
+	} {
+		minute, _ := parseClock(test.clock)
+		if contains := test.rule.contains(test.weekday, minute); contains != test.contains {
+			t.Errorf("%s: contains(%d, %s) = %v", test.name, test.weekday, test.clock, contains)
+		}
+	}
+
+	// 星期天的前一天是星期六
+	wrap := ScheduleRule{Weekdays: []int{saturday}, startMinute: 22 * 60, endMinute: 2 * 60}
+	if !wrap.contains(sunday, 60) || wrap.contains(monday, 60) {
+		t.Error("overnight rule starting on saturday should cover sunday morning only")
+	}
+
+	everyDay := ScheduleRule{}
+	for weekday := 0; weekday < 7; weekday++ {
+		if !everyDay.hasWeekday(weekday) {
+			t.Errorf("rule without weekdays should apply to weekday %d", weekday)
+		}
+	}
+}
+
+func TestSwitchScheduleCoinAt(t *testing.T) {
+	// 美国东部时间 2026-03-08 02:00 开始夏令时（时钟拨快到03:00）
+	schedule := newTestSchedule(t, `{
+		"timezone": "America/New_York",
+		"default_coin": "btc",
+		"rules": [
+			{"coin": "bcc", "start": "01:30", "end": "02:30"},
+			{"coin": "bsv", "weekdays": [1, 2, 3, 4, 5], "start": "09:00", "end": "17:00"},
+			{"coin": "bcc", "weekdays": [1, 2, 3, 4, 5], "start": "12:00", "end": "13:00"}
+		]
+	}`)
+
+	for _, test := range []struct {
+		name string
+		utc  string
+		coin string
+	}{
+		// 01:45 EST
+		{"before DST change", "2026-03-08T06:45:00Z", "bcc"},
+		// 03:15 EDT，02:00-03:00 不存在
+		{"after DST change", "2026-03-08T07:15:00Z", "btc"},
+		// 09:30 EST (UTC-5)
+		{"workday before DST", "2026-03-02T14:30:00Z", "bsv"},
+		{"workday before DST, 08:30 local", "2026-03-02T13:30:00Z", "btc"},
+		// 09:30 EDT (UTC-4)，规则按当地时间生效
+		{"workday after DST", "2026-03-09T13:30:00Z", "bsv"},
+		{"workday after DST, 17:30 local", "2026-03-09T21:30:00Z", "btc"},
+		// 重叠的规则按顺序匹配，先出现的规则优先
+		{"overlapping rules", "2026-03-09T16:30:00Z", "bsv"},
+		// 星期六
+		{"weekend", "2026-03-14T14:30:00Z", "btc"},
+	} {
+		now, err := time.Parse(time.RFC3339, test.utc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if coin := schedule.CoinAt(now); coin != test.coin {
+			t.Errorf("%s: CoinAt(%s) = %s, want %s", test.name, test.utc, coin, test.coin)
+		}
+	}
+
+	// 没有默认币种时，时段外不切换
+	noDefault := newTestSchedule(t, `{"rules": [{"coin": "bcc", "start": "08:00", "end": "18:00"}]}`)
+	if coin := noDefault.CoinAt(time.Date(2026, 3, 9, 20, 0, 0, 0, time.UTC)); coin != "" {
+		t.Errorf("expected no coin outside rules, got %s", coin)
+	}
+}
+
+func TestParseSwitchScheduleInvalid(t *testing.T) {
+	configData = &ConfigData{AvailableCoins: []string{"btc", "bcc"}}
+	for _, data := range []string{
+		`{"timezone": "Mars/Olympus", "rules": []}`,
+		`{"default_coin": "eth", "rules": []}`,
+		`{"rules": [{"coin": "eth", "start": "08:00", "end": "18:00"}]}`,
+		`{"rules": [{"coin": "bcc", "weekdays": [7], "start": "08:00", "end": "18:00"}]}`,
+		`{"rules": [{"coin": "bcc", "start": "8:00", "end": "18:00"}]}`,
+	} {
+		if _, err := parseSwitchSchedule([]byte(data)); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+}
+
+func TestScheduleRetryBackoff(t *testing.T) {
+	interval := 30 * time.Second
+	start := time.Unix(1800000000, 0)
+	schedule := &SwitchSchedule{}
+
+	if !schedule.retryDue("bcc", start, interval) {
+		t.Error("first attempt should be due")
+	}
+
+	// 连续失败时重试间隔加倍，最长为 scheduleRetryMaxSeconds
+	for i, delay := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		schedule.recordFailure("bcc", "write record failed", start)
+		if schedule.FailedCount != i+1 {
+			t.Fatalf("FailedCount = %d, want %d", schedule.FailedCount, i+1)
+		}
+		if schedule.retryDue("bcc", start.Add(delay-time.Second), interval) {
+			t.Errorf("failure %d: retry should wait %v", i+1, delay)
+		}
+		if !schedule.retryDue("bcc", start.Add(delay), interval) {
+			t.Errorf("failure %d: retry should be due after %v", i+1, delay)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		schedule.recordFailure("bcc", "write record failed", start)
+	}
+	if !schedule.retryDue("bcc", start.Add(scheduleRetryMaxSeconds*time.Second), interval) {
+		t.Error("retry interval should be capped")
+	}
+
+	// 计划决定的币种改变后立即切换，失败次数重新计算
+	if !schedule.retryDue("btc", start, interval) {
+		t.Error("switching to another coin should not wait")
+	}
+	schedule.recordFailure("btc", "write record failed", start)
+	if schedule.FailedCount != 1 || schedule.FailedCoin != "btc" {
+		t.Errorf("failure of another coin should restart counting: %+v", schedule)
+	}
+
+	schedule.clearFailure()
+	if !schedule.retryDue("btc", start, interval) || schedule.FailedError != "" {
+		t.Errorf("cleared schedule should be due: %+v", schedule)
+	}
+}
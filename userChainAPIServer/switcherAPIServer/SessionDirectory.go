@@ -0,0 +1,117 @@
+package switcherapiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// SessionDirectoryData stratumSwitcher发布的会话目录，与 stratumSwitcher/SessionDirectory.go 相同
+type SessionDirectoryData struct {
+	ServerID  uint32
+	HostName  string
+	UpdatedAt int64
+	// 监听器名称（stratumSwitcher只有一个监听器时为空）
+	Listener string `json:",omitempty"`
+	// 该服务器的会话总数
+	Sessions int
+	// 节点大小超出上限，连接数较少的子账户被省略
+	Truncated bool `json:",omitempty"`
+	// 子账户名 -> 币种 -> 连接数
+	SubAccounts map[string]map[string]int
+}
+
+// SubAccountServerSessions 子账户在一台stratumSwitcher上的连接
+type SubAccountServerSessions struct {
+	ServerID  uint32         `json:"server_id"`
+	HostName  string         `json:"host_name"`
+	UpdatedAt int64          `json:"updated_at"`
+	Listener  string         `json:"listener,omitempty"`
+	Coins     map[string]int `json:"coins"`
+}
+
+// SubAccountSessionsResponse 子账户会话查询的响应
+type SubAccountSessionsResponse struct {
+	APIResponse
+	PUName string `json:"puname"`
+	// 所有服务器上的连接数之和
+	Total int `json:"total"`
+	// 币种 -> 连接数
+	Coins   map[string]int             `json:"coins"`
+	Servers []SubAccountServerSessions `json:"servers"`
+	// 部分服务器的会话目录被截断，结果可能不完整
+	Incomplete bool `json:"incomplete"`
+}
+
+// subAccountSessionsHandle 查询子账户当前在哪些币种、哪些服务器上挖矿
+func subAccountSessionsHandle(w http.ResponseWriter, req *http.Request) {
+	if len(configData.ZKSessionDirectoryDir) == 0 {
+		writeError(w, 403, "API disabled")
+		return
+	}
+
+	puname := req.FormValue("puname")
+	if len(puname) < 1 {
+		writeError(w, APIErrPunameIsEmpty.ErrNo, APIErrPunameIsEmpty.ErrMsg)
+		return
+	}
+	if configData.StratumServerCaseInsensitive {
+		puname = strings.ToLower(puname)
+	}
+
+	dir := configData.ZKSessionDirectoryDir[:len(configData.ZKSessionDirectoryDir)-1]
+	children, _, err := zookeeperConn.Children(dir)
+	if err != nil {
+		glog.Error("zk.Children(", dir, ") Failed: ", err)
+		writeError(w, APIErrReadRecordFailed.ErrNo, APIErrReadRecordFailed.ErrMsg)
+		return
+	}
+
+	response := SubAccountSessionsResponse{
+		APIResponse: APIResponse{0, "", true},
+		PUName:      puname,
+		Coins:       make(map[string]int),
+		Servers:     []SubAccountServerSessions{},
+	}
+
+	for _, child := range children {
+		path := configData.ZKSessionDirectoryDir + child
+		dataJSON, _, err := zookeeperConn.Get(path)
+		if err != nil {
+			// 节点可能刚好随stratumSwitcher退出而消失
+			glog.Warning("zk.Get(", path, ") Failed: ", err)
+			continue
+		}
+
+		var data SessionDirectoryData
+		err = json.Unmarshal(dataJSON, &data)
+		if err != nil {
+			glog.Warning("Parse session directory ", path, " failed: ", err)
+			continue
+		}
+
+		coins, ok := data.SubAccounts[puname]
+		if !ok {
+			if data.Truncated {
+				response.Incomplete = true
+			}
+			continue
+		}
+
+		for coin, num := range coins {
+			response.Coins[coin] += num
+			response.Total += num
+		}
+		response.Servers = append(response.Servers, SubAccountServerSessions{data.ServerID, data.HostName, data.UpdatedAt, data.Listener, coins})
+	}
+
+	sort.Slice(response.Servers, func(i, j int) bool {
+		return response.Servers[i].ServerID < response.Servers[j].ServerID
+	})
+
+	responseJSON, _ := json.Marshal(response)
+	w.Write(responseJSON)
+}
@@ -0,0 +1,47 @@
+package switcherapiserver
+
+import (
+	switchevent "github.com/btccom/btcpool-go-modules/userChainAPIServer/switchEvent"
+	"github.com/golang/glog"
+)
+
+// switchEventPublisher 币种切换事件的发布器（未配置 SwitchEventTopic 时为nil）
+var switchEventPublisher *switchevent.Publisher
+
+// publishSwitchEvent 将子账户的币种写入Kafka，未配置 SwitchEventTopic 时不做任何事
+// Zookeeper中的记录已写入，发布在后台进行，失败时会一直重试
+func publishSwitchEvent(puname string, coin string) {
+	if switchEventPublisher != nil {
+		switchEventPublisher.Publish(puname, coin)
+	}
+}
+
+// publishSwitchSnapshot 将Zookeeper中所有子账户的币种写入Kafka作为快照
+// 用于首次启用币种切换事件，或补齐Kafka中缺失的子账户
+func publishSwitchSnapshot() {
+	watchDir := configData.ZKSwitcherWatchDir
+	users, _, err := zookeeperConn.Children(watchDir[:len(watchDir)-1])
+	if err != nil {
+		glog.Error("zk.Children(", watchDir, ") Failed: ", err)
+		return
+	}
+
+	glog.Info("Publishing switch snapshot, sub-accounts: ", len(users))
+
+	published := 0
+	for _, puname := range users {
+		coin, _, err := zookeeperConn.Get(watchDir + puname)
+		if err != nil {
+			glog.Warning("zk.Get(", watchDir+puname, ") Failed: ", err)
+			continue
+		}
+		if len(coin) < 1 {
+			continue
+		}
+
+		publishSwitchEvent(puname, string(coin))
+		published++
+	}
+
+	glog.Info("Switch snapshot queued, sub-accounts: ", published)
+}